@@ -0,0 +1,84 @@
+// Command embed-migrations generate Go file which registers migration files of directory in db package,
+// so migrations are available without files on disk(db.Config.MigrationsSource).
+// With -queries flag files are registered as named queries(db.Config.QueriesSource).
+//
+// Usage:
+//  //go:generate go run git.pnhub.ru/core/cmd/embed-migrations -dir ../../res/migrations/pg_dbname -name pg_dbname -pkg migrations -out pg_dbname.go
+//  //go:generate go run git.pnhub.ru/core/cmd/embed-migrations -queries -dir ../../res/queries/pg_dbname -name pg_dbname -pkg queries -out pg_dbname.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	dir := flag.String("dir", "", "directory with migration files")
+	name := flag.String("name", "", "migrations source name(default is directory name)")
+	pkg := flag.String("pkg", "migrations", "package of generated file")
+	out := flag.String("out", "", "output file(default stdout)")
+	queries := flag.Bool("queries", false, "register files as named queries instead of migrations")
+	flag.Parse()
+
+	register := "RegisterMigrations"
+	if *queries {
+		register = "RegisterQueries"
+	}
+	err := run(*dir, *name, *pkg, *out, register)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, name, pkg, out, register string) error {
+	if dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	if name == "" {
+		name = filepath.Base(filepath.Clean(dir))
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".sql") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "// Code generated by embed-migrations from %s. DO NOT EDIT.\n\n", filepath.ToSlash(dir))
+	fmt.Fprintf(buf, "package %s\n\n", pkg)
+	fmt.Fprintf(buf, "import \"git.pnhub.ru/core/libs/db\"\n\n")
+	fmt.Fprintf(buf, "func init() {\n\tdb.%s(%s, map[string][]byte{\n", register, strconv.Quote(name))
+	for _, n := range names {
+		content, err := ioutil.ReadFile(filepath.Join(dir, n))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "\t\t%s: []byte(%s),\n", strconv.Quote(n), strconv.Quote(string(content)))
+	}
+	fmt.Fprintf(buf, "\t})\n}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return ioutil.WriteFile(out, src, 0644)
+}
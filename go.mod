@@ -5,9 +5,14 @@ go 1.14
 require (
 	bou.ke/monkey v1.0.2
 	github.com/ClickHouse/clickhouse-go v1.4.0
+	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/go-chi/cors v1.1.1
 	github.com/golang-migrate/migrate/v4 v4.11.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/influxdata/influxdb v1.8.0
+	github.com/jackc/pgconn v1.5.0
+	github.com/jackc/pgproto3/v2 v2.0.1
+	github.com/jackc/pgtype v1.3.0
 	github.com/jackc/pgx/v4 v4.6.0
 	github.com/kr/text v0.2.0 // indirect
 	github.com/lib/pq v1.5.2
@@ -23,6 +28,7 @@ require (
 	golang.org/x/mod v0.3.0 // indirect
 	golang.org/x/net v0.0.0-20200513185701-a91f0712d120
 	golang.org/x/tools v0.0.0-20200522201501-cb1345f3a375 // indirect
+	google.golang.org/grpc v1.29.1
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/yaml.v2 v2.3.0
 	honnef.co/go/tools v0.0.1-2020.1.3 // indirect
@@ -42,23 +42,52 @@ func NewApplication(providers []ProviderFunction) *Application {
 	}
 }
 
+// Start build application and start its lifecycle. With --openapi-write or --openapi-check flag spec of routes
+// registered by invoker is written or checked instead of start, so no OnStart hook is run, and Ctx is cancelled.
 func (a *Application) Start(invoker interface{}) {
 	a.providers = append(a.providers, func() context.Context { return a.Ctx })
+	var openAPIDone bool
 	a.FxApplication = fx.New(
 		fx.Provide(a.providers...),
 		fx.Invoke(invoker),
+		fx.Invoke(func(p openAPIParams) error {
+			// flags are parsed by config provider, so they are checked after invoker
+			if !openAPICommand() {
+				return nil
+			}
+			if p.HTTPServer == nil {
+				return fmt.Errorf("no http server for openapi spec")
+			}
+			openAPIDone = true
+			return p.HTTPServer.runOpenAPICommand()
+		}),
 	)
+	err := a.FxApplication.Err()
+	if err != nil {
+		a.logger.Fatal(err)
+	}
+	if openAPIDone {
+		a.FxApplication = nil
+		a.Cancel()
+		return
+	}
 
 	go a.ListenSignals()
 
 	startCtx, cancel := context.WithTimeout(a.Ctx, fx.DefaultTimeout)
 	defer cancel()
-	err := a.FxApplication.Start(startCtx)
+	err = a.FxApplication.Start(startCtx)
 	if err != nil {
 		a.logger.Fatal(err)
 	}
 }
 
+type openAPIParams struct {
+	fx.In
+
+	HTTPServer *HTTPServer `optional:"true"`
+}
+
 func (a *Application) Stop() {
 	stopCtx, cancel := context.WithTimeout(a.Ctx, fx.DefaultTimeout)
 	defer cancel()
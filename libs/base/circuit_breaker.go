@@ -0,0 +1,111 @@
+package base
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type ErrCircuitOpen struct {
+	Name string
+}
+
+func (e ErrCircuitOpen) Error() string {
+	return fmt.Sprintf("circuit breaker %s is open", e.Name)
+}
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold is number of consecutive failures which open circuit
+	FailureThreshold int `json:"failure_threshold" yaml:"failure_threshold"`
+	// OpenTimeout is time in open state before trial requests are allowed
+	OpenTimeout time.Duration `json:"open_timeout" yaml:"open_timeout"`
+	// HalfOpenRequests is number of concurrent trial requests in half-open state
+	HalfOpenRequests int `json:"half_open_requests" yaml:"half_open_requests"`
+}
+
+// CircuitBreaker stop calls to failing resource for OpenTimeout after FailureThreshold consecutive failures.
+// After timeout it allows HalfOpenRequests trial calls, one success closes circuit, one failure opens it again.
+type CircuitBreaker struct {
+	name     string
+	cfg      CircuitBreakerConfig
+	mx       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	trials   int
+}
+
+func NewCircuitBreaker(name string, cfg CircuitBreakerConfig) *CircuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = time.Second * 30
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &CircuitBreaker{name: name, cfg: cfg}
+}
+
+// Allow return ErrCircuitOpen if call is not permitted. Every permitted call must be finished with Done.
+func (b *CircuitBreaker) Allow() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenTimeout {
+			return ErrCircuitOpen{Name: b.name}
+		}
+		b.state = CircuitHalfOpen
+		b.trials = 0
+		fallthrough
+	case CircuitHalfOpen:
+		if b.trials >= b.cfg.HalfOpenRequests {
+			return ErrCircuitOpen{Name: b.name}
+		}
+		b.trials++
+	}
+	return nil
+}
+
+// Done report result of permitted call
+func (b *CircuitBreaker) Done(success bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if success {
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.cfg.FailureThreshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *CircuitBreaker) State() CircuitState {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.state
+}
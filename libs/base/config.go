@@ -15,6 +15,7 @@ import (
 	"git.pnhub.ru/core/libs/influx"
 	"git.pnhub.ru/core/libs/kfk"
 	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/trace"
 )
 
 type Config struct {
@@ -22,12 +23,17 @@ type Config struct {
 
 	Zap *log.ZapConfig `json:"log" yaml:"log"`
 
-	HTTPServer *HTTPServerConfig `json:"http_server" yaml:"http_server"`
+	HTTPServer  *HTTPServerConfig `json:"http_server" yaml:"http_server"`
+	HTTPClients HTTPClientsConfig `json:"http_clients" yaml:"http_clients"`
+	GRPCServer  *GRPCServerConfig `json:"grpc_server" yaml:"grpc_server"`
 
-	DB     db.SelectorConfig     `json:"db_selector" yaml:"db_selector"`
-	Influx influx.SelectorConfig `json:"influx_selector" yaml:"influx_selector"`
+	DB       db.SelectorConfig     `json:"db_selector" yaml:"db_selector"`
+	DBShards db.ShardsConfig       `json:"db_shards" yaml:"db_shards"`
+	Influx   influx.SelectorConfig `json:"influx_selector" yaml:"influx_selector"`
 
 	Kafka *kfk.Config `json:"kafka" yaml:"kafka"`
+
+	Tracing *trace.Config `json:"tracing" yaml:"tracing"`
 }
 
 func NewConfig() (Config, error) {
@@ -43,6 +49,8 @@ func ReadCfgPathFlag() string {
 	p := viper.GetString("cfg")
 	if p == "" {
 		pflag.StringP("cfg", "c", "config.yml", "Path to config file")
+		pflag.String(OpenAPIWriteFlag, "", "Write OpenAPI spec to file and exit")
+		pflag.String(OpenAPICheckFlag, "", "Compare OpenAPI spec with file and exit, fail if spec is outdated")
 		pflag.Parse()
 		err := viper.BindPFlags(pflag.CommandLine)
 		if err != nil {
@@ -0,0 +1,185 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/uber-go/tally"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/metrics"
+	"git.pnhub.ru/core/libs/trace"
+)
+
+// grpcInterceptors contain standard interceptors of GRPCServer
+type grpcInterceptors struct {
+	logger log.Logger
+	scope  tally.Scope
+	cfg    *GRPCServerConfig
+}
+
+// wrappedStream replace context of server stream
+type wrappedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *wrappedStream) Context() context.Context {
+	return s.ctx
+}
+
+func withStreamContext(ss grpc.ServerStream, ctx context.Context) grpc.ServerStream {
+	if ctx == ss.Context() {
+		return ss
+	}
+	return &wrappedStream{ServerStream: ss, ctx: ctx}
+}
+
+func (i *grpcInterceptors) unaryTracing(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := i.startSpan(ctx, info.FullMethod)
+	defer span.End()
+	resp, err := handler(ctx, req)
+	setSpanStatus(span, err)
+	return resp, err
+}
+
+func (i *grpcInterceptors) streamTracing(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := i.startSpan(ss.Context(), info.FullMethod)
+	defer span.End()
+	err := handler(srv, withStreamContext(ss, ctx))
+	setSpanStatus(span, err)
+	return err
+}
+
+func (i *grpcInterceptors) startSpan(ctx context.Context, method string) (context.Context, *trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = trace.Extract(ctx, func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	})
+	return trace.Start(ctx, method,
+		trace.WithKind(trace.SpanKindServer),
+		trace.WithAttributes(map[string]interface{}{
+			"rpc.system": "grpc",
+			"rpc.method": method,
+		}))
+}
+
+func setSpanStatus(span *trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttribute("rpc.grpc.status_code", int(code))
+	if err != nil {
+		span.SetStatus(trace.StatusError, err.Error())
+	}
+}
+
+func (i *grpcInterceptors) unaryDeadline(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, cancel := i.deadline(ctx)
+	defer cancel()
+	return handler(ctx, req)
+}
+
+func (i *grpcInterceptors) streamDeadline(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, cancel := i.deadline(ss.Context())
+	defer cancel()
+	return handler(srv, withStreamContext(ss, ctx))
+}
+
+// deadline apply default timeout to call without deadline and limit client deadline with max timeout
+func (i *grpcInterceptors) deadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, ok := ctx.Deadline()
+	switch {
+	case !ok && i.cfg.DefaultTimeout > 0:
+		timeout := i.cfg.DefaultTimeout
+		if i.cfg.MaxTimeout > 0 && timeout > i.cfg.MaxTimeout {
+			timeout = i.cfg.MaxTimeout
+		}
+		return context.WithTimeout(ctx, timeout)
+	case i.cfg.MaxTimeout > 0 && (!ok || time.Until(d) > i.cfg.MaxTimeout):
+		return context.WithTimeout(ctx, i.cfg.MaxTimeout)
+	default:
+		return ctx, func() {}
+	}
+}
+
+func (i *grpcInterceptors) unaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	i.record(info.FullMethod, "unary", start, err)
+	return resp, err
+}
+
+func (i *grpcInterceptors) streamMetrics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	i.record(info.FullMethod, "stream", start, err)
+	return err
+}
+
+func (i *grpcInterceptors) record(method, kind string, start time.Time, err error) {
+	scope := i.scope.Tagged(map[string]string{"method": method, "type": kind, "code": status.Code(err).String()})
+	scope.Counter("requests").Inc(1)
+	scope.Histogram("latency", metrics.DefaultBuckets()).RecordDuration(time.Since(start))
+}
+
+func (i *grpcInterceptors) unaryLogging(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	// handlers take logger with trace and span ids by log.FromContext
+	resp, err := handler(log.ToContext(ctx, i.logger), req)
+	i.log(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+func (i *grpcInterceptors) streamLogging(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	i.log(ss.Context(), info.FullMethod, start, err)
+	return err
+}
+
+// log write finished call, server side errors are logged with error level
+func (i *grpcInterceptors) log(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	logger := log.WithContext(ctx, i.logger).With("method", method, "code", code.String(), "time", time.Since(start))
+	switch code {
+	case codes.OK:
+		logger.Debug("grpc call")
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unimplemented, codes.Unavailable, codes.DeadlineExceeded:
+		logger.With("err", err).Error("grpc call")
+	default:
+		logger.With("err", err).Info("grpc call")
+	}
+}
+
+func (i *grpcInterceptors) unaryRecovery(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = i.recovered(ctx, info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func (i *grpcInterceptors) streamRecovery(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = i.recovered(ss.Context(), info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// recovered log panic with stack and convert it to Internal status
+func (i *grpcInterceptors) recovered(ctx context.Context, method string, r interface{}) error {
+	log.WithContext(ctx, i.logger).With("method", method, "stack", string(debug.Stack())).Error(fmt.Errorf("panic in grpc handler: %v", r))
+	i.scope.Tagged(map[string]string{"method": method}).Counter("panics").Inc(1)
+	return status.Errorf(codes.Internal, "internal error")
+}
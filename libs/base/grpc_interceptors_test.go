@@ -0,0 +1,133 @@
+package base
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+func TestGRPCDeadline(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    GRPCServerConfig
+		client time.Duration
+		want   time.Duration
+	}{
+		{name: "no timeouts"},
+		{name: "client deadline is kept", cfg: GRPCServerConfig{DefaultTimeout: time.Second}, client: time.Minute, want: time.Minute},
+		{name: "default timeout", cfg: GRPCServerConfig{DefaultTimeout: time.Second}, want: time.Second},
+		{name: "default limited by max", cfg: GRPCServerConfig{DefaultTimeout: time.Minute, MaxTimeout: time.Second}, want: time.Second},
+		{name: "client deadline limited by max", cfg: GRPCServerConfig{MaxTimeout: time.Second}, client: time.Minute, want: time.Second},
+		{name: "client deadline within max", cfg: GRPCServerConfig{MaxTimeout: time.Minute}, client: time.Second, want: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := &grpcInterceptors{cfg: &tt.cfg}
+			ctx := context.Background()
+			if tt.client > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.client)
+				defer cancel()
+			}
+			ctx, cancel := i.deadline(ctx)
+			defer cancel()
+			d, ok := ctx.Deadline()
+			if tt.want == 0 {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.InDelta(t, float64(tt.want), float64(time.Until(d)), float64(time.Millisecond*100))
+		})
+	}
+}
+
+// probeServer is handler of test service, it is called with request of health check
+type probeServer func(ctx context.Context) error
+
+func registerProbe(s *grpc.Server, probe probeServer) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Probe",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Call",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(healthpb.HealthCheckRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Probe/Call"}
+				return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return &healthpb.HealthCheckResponse{}, probe(ctx)
+				})
+			},
+		}},
+	}, probe)
+}
+
+func TestGRPCServerInterceptors(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	probe := probeServer(func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			return status.Error(codes.FailedPrecondition, "no deadline")
+		}
+		panic("boom")
+	})
+	gs, err := NewGRPCServer(GRPCServerParams{
+		Ctx:    context.Background(),
+		Logger: &log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()},
+		Cfg:    &GRPCServerConfig{Host: "127.0.0.1", DefaultTimeout: time.Second},
+		Scope:  scope,
+		Services: []GRPCService{GRPCServiceFunc(func(s *grpc.Server) {
+			registerProbe(s, probe)
+		})},
+	})
+	require.NoError(t, err)
+	require.NoError(t, gs.Listen())
+	go func() {
+		_ = gs.Serve()
+	}()
+	defer gs.Stop(context.Background())
+
+	conn, err := grpc.Dial(gs.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.Invoke(context.Background(), "/test.Probe/Call", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+	assert.Equal(t, codes.Internal, status.Code(err), "panic is converted to Internal: %v", err)
+	assert.Equal(t, "internal error", status.Convert(err).Message(), "panic value is not sent to client")
+
+	// recovery is inside metrics, so panic is counted as Internal call
+	counters := scope.Snapshot().Counters()
+	var requests, panics int64
+	for _, c := range counters {
+		if c.Tags()["method"] != "/test.Probe/Call" {
+			continue
+		}
+		switch c.Name() {
+		case "grpc-server.requests":
+			assert.Equal(t, codes.Internal.String(), c.Tags()["code"])
+			requests += c.Value()
+		case "grpc-server.panics":
+			panics += c.Value()
+		}
+	}
+	assert.Equal(t, int64(1), requests)
+	assert.Equal(t, int64(1), panics)
+
+	health := healthpb.NewHealthClient(conn)
+	resp, err := health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "test.Probe"})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+}
@@ -0,0 +1,292 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/fx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+// GRPCServicesGroup is fx group of GRPCService values registered on GRPCServer
+const GRPCServicesGroup = "grpc_services"
+
+type GRPCServerConfig struct {
+	Host string `json:"host" yaml:"host"`
+	Port int    `json:"port" yaml:"port"`
+
+	TLS       *GRPCTLSConfig       `json:"tls" yaml:"tls"`
+	Keepalive *GRPCKeepaliveConfig `json:"keepalive" yaml:"keepalive"`
+
+	MaxRecvMsgSize       int    `json:"max_recv_msg_size" yaml:"max_recv_msg_size"`
+	MaxSendMsgSize       int    `json:"max_send_msg_size" yaml:"max_send_msg_size"`
+	MaxConcurrentStreams uint32 `json:"max_concurrent_streams" yaml:"max_concurrent_streams"`
+
+	// DefaultTimeout is applied to calls without client deadline, MaxTimeout limit client deadline
+	DefaultTimeout time.Duration `json:"default_timeout" yaml:"default_timeout"`
+	MaxTimeout     time.Duration `json:"max_timeout" yaml:"max_timeout"`
+
+	// ShutdownTimeout limit graceful stop, server is stopped forcibly after it(default DefaultShutdownTimeout)
+	ShutdownTimeout time.Duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	Reflection      bool          `json:"reflection" yaml:"reflection"`
+}
+
+// GRPCTLSConfig enable TLS, client certificates are verified with ClientCAFile(mTLS)
+type GRPCTLSConfig struct {
+	CertFile          string `json:"cert_file" yaml:"cert_file"`
+	KeyFile           string `json:"key_file" yaml:"key_file"`
+	ClientCAFile      string `json:"client_ca_file" yaml:"client_ca_file"`
+	RequireClientCert bool   `json:"require_client_cert" yaml:"require_client_cert"`
+}
+
+type GRPCKeepaliveConfig struct {
+	MaxConnectionIdle     time.Duration `json:"max_connection_idle" yaml:"max_connection_idle"`
+	MaxConnectionAge      time.Duration `json:"max_connection_age" yaml:"max_connection_age"`
+	MaxConnectionAgeGrace time.Duration `json:"max_connection_age_grace" yaml:"max_connection_age_grace"`
+	Time                  time.Duration `json:"time" yaml:"time"`
+	Timeout               time.Duration `json:"timeout" yaml:"timeout"`
+	MinTime               time.Duration `json:"min_time" yaml:"min_time"`
+	PermitWithoutStream   bool          `json:"permit_without_stream" yaml:"permit_without_stream"`
+}
+
+// GRPCService register its implementation on server(usually with generated RegisterXXXServer function)
+type GRPCService interface {
+	RegisterGRPC(s *grpc.Server)
+}
+
+// GRPCServiceFunc is function adapter for GRPCService
+type GRPCServiceFunc func(s *grpc.Server)
+
+func (f GRPCServiceFunc) RegisterGRPC(s *grpc.Server) {
+	f(s)
+}
+
+// ProvideGRPCService annotate constructor of GRPCService for GRPCServicesGroup.
+// Result is passed to NewApplication with other providers.
+func ProvideGRPCService(constructor interface{}) ProviderFunction {
+	return fx.Annotated{
+		Group:  GRPCServicesGroup,
+		Target: constructor,
+	}
+}
+
+type GRPCServerParams struct {
+	fx.In
+
+	Ctx      context.Context
+	Logger   log.Logger
+	Cfg      *GRPCServerConfig
+	Lc       fx.Lifecycle
+	Scope    tally.Scope   `optional:"true"`
+	Services []GRPCService `group:"grpc_services"`
+}
+
+type GRPCServer struct {
+	*grpc.Server
+
+	Ctx    context.Context
+	Logger log.Logger
+	Cfg    *GRPCServerConfig
+	Health *health.Server
+
+	listener net.Listener
+}
+
+// NewGRPCServer create server with logging, recovery, metrics, tracing and deadline interceptors,
+// register services from fx group, health service and reflection(if enabled).
+// Server listen on fx start and is stopped gracefully on fx stop.
+func NewGRPCServer(p GRPCServerParams) (*GRPCServer, error) {
+	if p.Cfg == nil {
+		return nil, ErrNilDependency(p.Cfg)
+	}
+	logger := log.ForkLogger(p.Logger)
+	scope := p.Scope
+	if scope == nil {
+		scope = tally.NoopScope
+	}
+	opts, err := grpcServerOptions(p.Cfg)
+	if err != nil {
+		return nil, err
+	}
+	i := &grpcInterceptors{
+		logger: logger,
+		scope:  scope.SubScope("grpc-server"),
+		cfg:    p.Cfg,
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(i.unaryTracing, i.unaryDeadline, i.unaryMetrics, i.unaryLogging, i.unaryRecovery),
+		grpc.ChainStreamInterceptor(i.streamTracing, i.streamDeadline, i.streamMetrics, i.streamLogging, i.streamRecovery),
+	)
+
+	gs := &GRPCServer{
+		Server: grpc.NewServer(opts...),
+		Ctx:    p.Ctx,
+		Logger: logger,
+		Cfg:    p.Cfg,
+		Health: health.NewServer(),
+	}
+	for _, s := range p.Services {
+		s.RegisterGRPC(gs.Server)
+	}
+	healthpb.RegisterHealthServer(gs.Server, gs.Health)
+	if p.Cfg.Reflection {
+		reflection.Register(gs.Server)
+	}
+
+	if p.Lc != nil {
+		p.Lc.Append(fx.Hook{
+			OnStart: func(ctx context.Context) error {
+				err := gs.Listen()
+				if err != nil {
+					return err
+				}
+				go func() {
+					err := gs.Serve()
+					if err != nil && err != grpc.ErrServerStopped {
+						logger.Fatal(err)
+					}
+				}()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				gs.Logger.Info("stopping gRPC server.")
+				gs.Stop(ctx)
+				gs.Logger.Info("stopped gRPC server.")
+				return nil
+			},
+		})
+	}
+	return gs, nil
+}
+
+// Listen open listener on configured address and mark registered services as serving
+func (g *GRPCServer) Listen() error {
+	l, err := net.Listen("tcp", net.JoinHostPort(g.Cfg.Host, strconv.Itoa(g.Cfg.Port)))
+	if err != nil {
+		return err
+	}
+	g.listener = l
+	for name := range g.Server.GetServiceInfo() {
+		g.Health.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+	}
+	g.Health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	return nil
+}
+
+// Addr return listener address, it is useful with zero port
+func (g *GRPCServer) Addr() net.Addr {
+	if g.listener == nil {
+		return nil
+	}
+	return g.listener.Addr()
+}
+
+func (g *GRPCServer) Serve() error {
+	if g.listener == nil {
+		return fmt.Errorf("grpc server is not listening")
+	}
+	return g.Server.Serve(g.listener)
+}
+
+// Stop mark services as not serving and stop server gracefully. Active calls are cancelled
+// after shutdown timeout or when ctx is done.
+func (g *GRPCServer) Stop(ctx context.Context) {
+	g.Health.Shutdown()
+	timeout := g.Cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	stopCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		g.Server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-stopCtx.Done():
+		g.Logger.Warn("gRPC graceful stop timeout, closing active calls")
+		g.Server.Stop()
+		<-done
+	}
+}
+
+func grpcServerOptions(cfg *GRPCServerConfig) ([]grpc.ServerOption, error) {
+	var opts []grpc.ServerOption
+	if cfg.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(cfg.MaxRecvMsgSize))
+	}
+	if cfg.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(cfg.MaxSendMsgSize))
+	}
+	if cfg.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(cfg.MaxConcurrentStreams))
+	}
+	if k := cfg.Keepalive; k != nil {
+		opts = append(opts,
+			grpc.KeepaliveParams(keepalive.ServerParameters{
+				MaxConnectionIdle:     k.MaxConnectionIdle,
+				MaxConnectionAge:      k.MaxConnectionAge,
+				MaxConnectionAgeGrace: k.MaxConnectionAgeGrace,
+				Time:                  k.Time,
+				Timeout:               k.Timeout,
+			}),
+			grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+				MinTime:             k.MinTime,
+				PermitWithoutStream: k.PermitWithoutStream,
+			}),
+		)
+	}
+	if cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	return opts, nil
+}
+
+// Build create server tls.Config with certificate and client CA pool
+func (c *GRPCTLSConfig) Build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,345 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+	"golang.org/x/net/http2"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/metrics"
+	"git.pnhub.ru/core/libs/util"
+)
+
+const DefaultHTTPClientKey = "default"
+
+// IdempotencyKeyHeader marks non idempotent request as safe for retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+type HTTPClientsConfig map[string]*HTTPClientConfig
+
+type HTTPClientConfig struct {
+	Timeout               time.Duration `json:"timeout" yaml:"timeout"`
+	DialTimeout           time.Duration `json:"dial_timeout" yaml:"dial_timeout"`
+	KeepAlive             time.Duration `json:"keep_alive" yaml:"keep_alive"`
+	TLSHandshakeTimeout   time.Duration `json:"tls_handshake_timeout" yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `json:"response_header_timeout" yaml:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+
+	MaxIdleConns        int  `json:"max_idle_conns" yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int  `json:"max_idle_conns_per_host" yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int  `json:"max_conns_per_host" yaml:"max_conns_per_host"`
+	DisableCompression  bool `json:"disable_compression" yaml:"disable_compression"`
+	HTTP2               bool `json:"http2" yaml:"http2"`
+
+	TLS            *HTTPClientTLSConfig  `json:"tls" yaml:"tls"`
+	Retry          *HTTPRetryConfig      `json:"retry" yaml:"retry"`
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker" yaml:"circuit_breaker"`
+}
+
+type HTTPClientTLSConfig struct {
+	CAFile             string `json:"ca_file" yaml:"ca_file"`
+	CertFile           string `json:"cert_file" yaml:"cert_file"`
+	KeyFile            string `json:"key_file" yaml:"key_file"`
+	ServerName         string `json:"server_name" yaml:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+}
+
+type HTTPRetryConfig struct {
+	MaxAttempts int          `json:"max_attempts" yaml:"max_attempts"`
+	Backoff     util.Backoff `json:"backoff" yaml:"backoff"`
+	// Statuses are response codes which are retried, default 502, 503, 504
+	Statuses []int `json:"statuses" yaml:"statuses"`
+}
+
+// HTTPClientFactory create named http clients from config. Each client has configured transport,
+// retries for idempotent requests, circuit breaker per host, propagation of request id, client span with
+// W3C trace context injection and metrics tagged by client name and response status.
+type HTTPClientFactory struct {
+	ctx     context.Context
+	logger  log.Logger
+	cfg     HTTPClientsConfig
+	scope   tally.Scope
+	mx      sync.Mutex
+	clients map[string]*http.Client
+}
+
+func NewHTTPClientFactory(ctx context.Context, logger log.Logger, cfg HTTPClientsConfig, scope tally.Scope) *HTTPClientFactory {
+	if cfg == nil {
+		cfg = make(HTTPClientsConfig)
+	}
+	if scope == nil {
+		scope = tally.NoopScope
+	}
+	return &HTTPClientFactory{
+		ctx:     ctx,
+		logger:  log.ForkLogger(logger),
+		cfg:     cfg,
+		scope:   scope.SubScope("http-client"),
+		clients: make(map[string]*http.Client),
+	}
+}
+
+// Client return client with defined name(or default). Clients are created once and shared.
+func (f *HTTPClientFactory) Client(keys ...string) (*http.Client, error) {
+	key := DefaultHTTPClientKey
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if c, ok := f.clients[key]; ok {
+		return c, nil
+	}
+	cfg, ok := f.cfg[key]
+	if !ok {
+		if key != DefaultHTTPClientKey {
+			return nil, fmt.Errorf("no http client with key %s", key)
+		}
+		cfg = &HTTPClientConfig{}
+	}
+	c, err := f.create(key, cfg)
+	if err != nil {
+		return nil, err
+	}
+	f.clients[key] = c
+	return c, nil
+}
+
+// CloseIdleConnections close idle connections of all created clients
+func (f *HTTPClientFactory) CloseIdleConnections() {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	for _, c := range f.clients {
+		c.CloseIdleConnections()
+	}
+}
+
+func (f *HTTPClientFactory) create(name string, cfg *HTTPClientConfig) (*http.Client, error) {
+	tr, err := NewHTTPTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var rt http.RoundTripper = tr
+	if cfg.CircuitBreaker != nil {
+		rt = &breakerTransport{next: rt, cfg: *cfg.CircuitBreaker, name: name, breakers: make(map[string]*CircuitBreaker)}
+	}
+	if cfg.Retry != nil && cfg.Retry.MaxAttempts > 1 {
+		rt = &retryTransport{next: rt, cfg: *cfg.Retry, scope: f.scope.Tagged(map[string]string{"client": name})}
+	}
+	rt = &metricsTransport{next: rt, name: name, scope: f.scope}
+	rt = &tracingTransport{next: rt, name: name}
+	rt = &propagationTransport{next: rt}
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: rt,
+	}, nil
+}
+
+// NewHTTPTransport create transport with timeouts, pool limits and TLS from config
+func NewHTTPTransport(cfg *HTTPClientConfig) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		DisableCompression:    cfg.DisableCompression,
+	}
+	if cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tlsCfg
+	}
+	if cfg.HTTP2 {
+		err := http2.ConfigureTransport(tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tr, nil
+}
+
+// Build create tls.Config with CA pool and client certificate
+func (c *HTTPClientTLSConfig) Build() (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify, // #nosec
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+type propagationTransport struct {
+	next http.RoundTripper
+}
+
+func (t *propagationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := PropagatedHeadersFromContext(req.Context())
+	if len(h) == 0 {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for name := range h {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, h.Get(name))
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+type metricsTransport struct {
+	next  http.RoundTripper
+	name  string
+	scope tally.Scope
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	scope := t.scope.Tagged(map[string]string{"client": t.name, "method": req.Method, "status": status})
+	scope.Counter("requests").Inc(1)
+	scope.Histogram("latency", metrics.DefaultBuckets()).RecordDuration(time.Since(start))
+	return resp, err
+}
+
+type retryTransport struct {
+	next  http.RoundTripper
+	cfg   HTTPRetryConfig
+	scope tally.Scope
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRetryable(req) {
+		return t.next.RoundTrip(req)
+	}
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < t.cfg.MaxAttempts; attempt++ {
+		attemptReq := req
+		if attempt > 0 {
+			t.scope.Counter("retries").Inc(1)
+			err = t.cfg.Backoff.Wait(req.Context(), attempt-1)
+			if err != nil {
+				return nil, err
+			}
+			// request of caller must not be modified, so body is set on clone
+			attemptReq = req.Clone(req.Context())
+			if req.GetBody != nil {
+				attemptReq.Body, err = req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		resp, err = t.next.RoundTrip(attemptReq)
+		if !t.shouldRetry(resp, err) || attempt == t.cfg.MaxAttempts-1 {
+			break
+		}
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	return resp, err
+}
+
+func (t *retryTransport) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		_, open := err.(ErrCircuitOpen)
+		return !open
+	}
+	statuses := t.cfg.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, s := range statuses {
+		if resp.StatusCode == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryable check that request is idempotent and its body can be sent again
+func isRetryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return req.Header.Get(IdempotencyKeyHeader) != ""
+	}
+}
+
+type breakerTransport struct {
+	next     http.RoundTripper
+	name     string
+	cfg      CircuitBreakerConfig
+	mx       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.breaker(req.URL.Host)
+	err := b.Allow()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	b.Done(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, err
+}
+
+func (t *breakerTransport) breaker(host string) *CircuitBreaker {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		b = NewCircuitBreaker(t.name+"/"+host, t.cfg)
+		t.breakers[host] = b
+	}
+	return b
+}
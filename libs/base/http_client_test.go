@@ -0,0 +1,134 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"git.pnhub.ru/core/libs/util"
+)
+
+func TestIsRetryable(t *testing.T) {
+	withKey := httptest.NewRequest(http.MethodPost, "/", nil)
+	withKey.Header.Set(IdempotencyKeyHeader, "k1")
+	// body of httptest request has no GetBody, so it can not be sent again
+	streamed := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("data"))
+	resendable, err := http.NewRequest(http.MethodPut, "/", strings.NewReader("data"))
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		req  *http.Request
+		want bool
+	}{
+		"get":                   {req: httptest.NewRequest(http.MethodGet, "/", nil), want: true},
+		"delete":                {req: httptest.NewRequest(http.MethodDelete, "/", nil), want: true},
+		"post":                  {req: httptest.NewRequest(http.MethodPost, "/", nil)},
+		"patch":                 {req: httptest.NewRequest(http.MethodPatch, "/", nil)},
+		"post with idempotency": {req: withKey, want: true},
+		"body without GetBody":  {req: streamed},
+		"body with GetBody":     {req: resendable, want: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetryable(tt.req))
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	resp := func(status int) *http.Response {
+		return &http.Response{StatusCode: status}
+	}
+	def := &retryTransport{}
+	assert.True(t, def.shouldRetry(resp(http.StatusBadGateway), nil))
+	assert.True(t, def.shouldRetry(resp(http.StatusServiceUnavailable), nil))
+	assert.True(t, def.shouldRetry(resp(http.StatusGatewayTimeout), nil))
+	assert.False(t, def.shouldRetry(resp(http.StatusInternalServerError), nil))
+	assert.False(t, def.shouldRetry(resp(http.StatusOK), nil))
+	assert.True(t, def.shouldRetry(nil, errors.New("connection refused")))
+	assert.False(t, def.shouldRetry(nil, ErrCircuitOpen{Name: "c"}), "open circuit is not retried")
+
+	custom := &retryTransport{cfg: HTTPRetryConfig{Statuses: []int{http.StatusTooManyRequests}}}
+	assert.True(t, custom.shouldRetry(resp(http.StatusTooManyRequests), nil))
+	assert.False(t, custom.shouldRetry(resp(http.StatusServiceUnavailable), nil), "configured statuses replace defaults")
+}
+
+// roundTripFunc is transport of test which answers by function
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRetryTransport(t *testing.T) {
+	var bodies []string
+	var requests []*http.Request
+	statuses := []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		data, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(data))
+		status := statuses[len(requests)-1]
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+	scope := tally.NewTestScope("", nil)
+	rt := &retryTransport{
+		next:  next,
+		cfg:   HTTPRetryConfig{MaxAttempts: 3, Backoff: util.Backoff{Min: time.Millisecond, Max: time.Millisecond}},
+		scope: scope,
+	}
+
+	req, err := http.NewRequest(http.MethodPut, "http://service/users/1", strings.NewReader(`{"name":"a"}`))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{`{"name":"a"}`, `{"name":"a"}`, `{"name":"a"}`}, bodies, "body is sent on every attempt")
+	assert.Same(t, req, requests[0])
+	assert.NotSame(t, req, requests[1], "retry is sent by clone of request")
+	assert.Equal(t, int64(2), scope.Snapshot().Counters()["retries+"].Value())
+
+	// last response is returned when attempts are over
+	requests, bodies = nil, nil
+	statuses = []int{http.StatusBadGateway, http.StatusGatewayTimeout, http.StatusServiceUnavailable}
+	resp, err = rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://service/users/1", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Len(t, requests, 3)
+
+	// not idempotent request is sent once
+	requests, bodies = nil, nil
+	statuses = []int{http.StatusServiceUnavailable}
+	resp, err = rt.RoundTrip(httptest.NewRequest(http.MethodPost, "http://service/users", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Len(t, requests, 1)
+}
+
+func TestRetryTransportCancel(t *testing.T) {
+	calls := 0
+	rt := &retryTransport{
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return nil, errors.New("connection refused")
+		}),
+		cfg:   HTTPRetryConfig{MaxAttempts: 5, Backoff: util.Backoff{Min: time.Hour, Max: time.Hour}},
+		scope: tally.NoopScope,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "http://service/", nil).WithContext(ctx)
+	_, err := rt.RoundTrip(req)
+	assert.Equal(t, context.DeadlineExceeded, err, "backoff is interrupted by request context")
+	assert.Equal(t, 1, calls)
+}
@@ -5,14 +5,17 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/go-chi/cors"
 	"go.uber.org/fx"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/webdav"
 
 	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/tenant"
 )
 
 const DefaultShutdownTimeout = time.Second * 15
@@ -35,9 +38,15 @@ type HTTPServerConfig struct {
 	IdleTimeout       time.Duration `json:"idle_timeout" yaml:"idle_timeout"`
 	ReadHeaderTimeout time.Duration `json:"read_header_timeout" yaml:"read_header_timeout"`
 
-	TLS    *TLSConfig    `json:"tls" yaml:"tls"`
-	WebDav *WebDavConfig `json:"web_dav" yaml:"web_dav"`
-	CORS   *CorsConfig   `json:"cors" yaml:"cors"`
+	TLS     *TLSConfig     `json:"tls" yaml:"tls"`
+	WebDav  *WebDavConfig  `json:"web_dav" yaml:"web_dav"`
+	Static  *StaticConfig  `json:"static" yaml:"static"`
+	CORS    *CorsConfig    `json:"cors" yaml:"cors"`
+	OpenAPI *OpenAPIConfig `json:"openapi" yaml:"openapi"`
+
+	Stream *StreamGatewayConfig `json:"stream" yaml:"stream"`
+	// Tenant enable resolution of request tenant by TenantMiddleware
+	Tenant *tenant.Config `json:"tenant" yaml:"tenant"`
 }
 
 type HTTP2Config struct {
@@ -60,6 +69,12 @@ type WebDavConfig struct {
 	Dir    string `json:"dir" yaml:"dir"`
 }
 
+// StaticConfig describe directory with static files(example: OpenAPI docs UI assets)
+type StaticConfig struct {
+	Prefix string `json:"prefix" yaml:"prefix"`
+	Dir    string `json:"dir" yaml:"dir"`
+}
+
 type CorsConfig struct {
 	AllowedOrigins   []string `json:"allowed_origins" yaml:"allowed_origins"`
 	AllowedMethods   []string `json:"allowed_methods" yaml:"allowed_methods"`
@@ -73,6 +88,12 @@ type HTTPServer struct {
 	Ctx    context.Context
 	Logger log.Logger
 	Cfg    *HTTPServerConfig
+	// Tenants resolve tenant of requests if HTTPServerConfig.Tenant is set
+	Tenants *tenant.Resolver
+
+	routesMx sync.Mutex
+	router   *chi.Mux
+	routes   []*Route
 }
 
 func NewHTTPServer(ctx context.Context, logger log.Logger, cfg *HTTPServerConfig, lc fx.Lifecycle) (*HTTPServer, error) {
@@ -108,6 +129,13 @@ func NewHTTPServer(ctx context.Context, logger log.Logger, cfg *HTTPServerConfig
 		Cfg:    cfg,
 		Server: httpServer,
 	}
+	if cfg.Tenant != nil {
+		var err error
+		hs.Tenants, err = tenant.NewResolver(cfg.Tenant)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if lc != nil {
 		lc.Append(fx.Hook{
@@ -144,6 +172,11 @@ func (h *HTTPServer) CreateWebDavHandler() (string, *webdav.Handler) {
 	return h.Cfg.WebDav.Prefix, wdHandler
 }
 
+// CreateStaticHandler create file server for static dir(prefix must end on '/', example /docs/)
+func (h *HTTPServer) CreateStaticHandler() (string, http.Handler) {
+	return h.Cfg.Static.Prefix, http.StripPrefix(h.Cfg.Static.Prefix, http.FileServer(http.Dir(h.Cfg.Static.Dir)))
+}
+
 func (h *HTTPServer) EnableCORS() {
 	if h.Cfg.CORS == nil {
 		h.Cfg.CORS = &DefaultCORS
@@ -159,7 +192,14 @@ func (h *HTTPServer) EnableCORS() {
 	}
 }
 
+// SetHandler set server handler wrapped with PropagationMiddleware, TracingMiddleware, TenantMiddleware
+// and CORS(if configured)
 func (h *HTTPServer) SetHandler(handler http.Handler) {
+	handler = LoggerMiddleware(h.Logger)(handler)
+	if h.Tenants != nil {
+		handler = TenantMiddleware(h.Tenants)(handler)
+	}
+	handler = PropagationMiddleware(TracingMiddleware(handler))
 	if h.Cfg.CORS != nil {
 		c := h.Cfg.CORS
 		h.Handler = cors.New(cors.Options{
@@ -174,6 +214,7 @@ func (h *HTTPServer) SetHandler(handler http.Handler) {
 }
 
 func (h *HTTPServer) Start() error {
+	h.mountRouter()
 	var err error
 	if h.Cfg != nil && h.Cfg.TLS != nil {
 		err = h.Server.ListenAndServeTLS(h.Cfg.TLS.CertFile, h.Cfg.TLS.KeyFile)
@@ -192,3 +233,18 @@ func (h *HTTPServer) Stop() error {
 	}
 	return nil
 }
+
+// mountRouter set router as server handler if typed routes were registered and no other handler was set.
+// OpenAPI document and static files are served by the same router.
+func (h *HTTPServer) mountRouter() {
+	if h.Handler != nil || h.router == nil {
+		return
+	}
+	router := h.Router()
+	router.Get(h.openAPIConfig().Path, h.ServeOpenAPI)
+	if h.Cfg.Static != nil {
+		prefix, handler := h.CreateStaticHandler()
+		router.Handle(prefix+"*", handler)
+	}
+	h.SetHandler(router)
+}
@@ -0,0 +1,30 @@
+package base
+
+import (
+	"git.pnhub.ru/core/libs/influx"
+)
+
+// NewInfluxClients create influx clients for selector. Clients with HTTPClient option use named client from factory.
+func NewInfluxClients(cfg influx.SelectorConfig, factory *HTTPClientFactory) (map[string]*influx.Client, error) {
+	clients := make(map[string]*influx.Client, len(cfg))
+	for key, c := range cfg {
+		if c.HTTPClient == "" || factory == nil {
+			cli, err := influx.NewInfluxDBClient(c)
+			if err != nil {
+				return nil, err
+			}
+			clients[key] = cli
+			continue
+		}
+		httpClient, err := factory.Client(c.HTTPClient)
+		if err != nil {
+			return nil, err
+		}
+		cli, err := influx.NewInfluxDBClientWithHTTPClient(c, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		clients[key] = cli
+	}
+	return clients, nil
+}
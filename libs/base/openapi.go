@@ -0,0 +1,497 @@
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+const OpenAPIVersion = "3.0.3"
+
+const DefaultOpenAPIPath = "/openapi.json"
+
+// Flags for CI usage: write spec to file or check committed spec and exit
+const (
+	OpenAPIWriteFlag = "openapi-write"
+	OpenAPICheckFlag = "openapi-check"
+)
+
+type OpenAPIConfig struct {
+	// Path where spec is served. Extension defines format(.json or .yaml)
+	Path        string   `json:"path" yaml:"path"`
+	Title       string   `json:"title" yaml:"title"`
+	Version     string   `json:"version" yaml:"version"`
+	Description string   `json:"description" yaml:"description"`
+	Servers     []string `json:"servers" yaml:"servers"`
+}
+
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi" yaml:"openapi"`
+	Info       OpenAPIInfo                             `json:"info" yaml:"info"`
+	Servers    []OpenAPIServer                         `json:"servers,omitempty" yaml:"servers,omitempty"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths" yaml:"paths"`
+	Components OpenAPIComponents                       `json:"components" yaml:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title" yaml:"title"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Version     string `json:"version" yaml:"version"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url" yaml:"url"`
+}
+
+type OpenAPIComponents struct {
+	Schemas map[string]*OpenAPISchema `json:"schemas,omitempty" yaml:"schemas,omitempty"`
+}
+
+type OpenAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty" yaml:"summary,omitempty"`
+	Description string                      `json:"description,omitempty" yaml:"description,omitempty"`
+	OperationID string                      `json:"operationId,omitempty" yaml:"operationId,omitempty"`
+	Tags        []string                    `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty" yaml:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses" yaml:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name        string         `json:"name" yaml:"name"`
+	In          string         `json:"in" yaml:"in"`
+	Description string         `json:"description,omitempty" yaml:"description,omitempty"`
+	Required    bool           `json:"required,omitempty" yaml:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema" yaml:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty" yaml:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content" yaml:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                       `json:"description" yaml:"description"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty" yaml:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema" yaml:"schema"`
+}
+
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty" yaml:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty" yaml:"type,omitempty"`
+	Format               string                    `json:"format,omitempty" yaml:"format,omitempty"`
+	Description          string                    `json:"description,omitempty" yaml:"description,omitempty"`
+	Example              interface{}               `json:"example,omitempty" yaml:"example,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty" yaml:"nullable,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty" yaml:"items,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty" yaml:"properties,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty" yaml:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty" yaml:"required,omitempty"`
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	pathParamRegex = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+)
+
+// OpenAPI build OpenAPI 3 document from routes registered by Handle
+func (h *HTTPServer) OpenAPI() *OpenAPIDocument {
+	cfg := h.openAPIConfig()
+	g := &openAPIGenerator{schemas: make(map[string]*OpenAPISchema)}
+	doc := &OpenAPIDocument{
+		OpenAPI: OpenAPIVersion,
+		Info: OpenAPIInfo{
+			Title:       cfg.Title,
+			Description: cfg.Description,
+			Version:     cfg.Version,
+		},
+		Paths: make(map[string]map[string]*OpenAPIOperation),
+	}
+	for _, s := range cfg.Servers {
+		doc.Servers = append(doc.Servers, OpenAPIServer{URL: s})
+	}
+	for _, route := range h.Routes() {
+		p := pathParamRegex.ReplaceAllString(route.Path, "{$1}")
+		if doc.Paths[p] == nil {
+			doc.Paths[p] = make(map[string]*OpenAPIOperation)
+		}
+		doc.Paths[p][strings.ToLower(route.Method)] = g.operation(route)
+	}
+	doc.Components.Schemas = g.schemas
+	return doc
+}
+
+// MarshalOpenAPI encode OpenAPI document in format defined by file extension(.yaml, .yml or .json)
+func (h *HTTPServer) MarshalOpenAPI(filePath string) ([]byte, error) {
+	doc := h.OpenAPI()
+	switch path.Ext(filePath) {
+	case ".yaml", ".yml":
+		return yaml.Marshal(doc)
+	default:
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+}
+
+// WriteOpenAPI write OpenAPI document to file
+func (h *HTTPServer) WriteOpenAPI(filePath string) error {
+	data, err := h.MarshalOpenAPI(filePath)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, data, 0644)
+}
+
+// CheckOpenAPI compare generated OpenAPI document with committed file and return error on drift
+func (h *HTTPServer) CheckOpenAPI(filePath string) error {
+	actual, err := h.MarshalOpenAPI(filePath)
+	if err != nil {
+		return err
+	}
+	committed, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(actual, committed) {
+		return nil
+	}
+	actualLines := strings.Split(string(actual), "\n")
+	committedLines := strings.Split(string(committed), "\n")
+	for i := 0; i < len(actualLines) || i < len(committedLines); i++ {
+		var a, c string
+		if i < len(actualLines) {
+			a = actualLines[i]
+		}
+		if i < len(committedLines) {
+			c = committedLines[i]
+		}
+		if a != c {
+			return fmt.Errorf("openapi spec %s is outdated, first difference at line %d:\n- %s\n+ %s\nregenerate it with --%s=%s",
+				filePath, i+1, c, a, OpenAPIWriteFlag, filePath)
+		}
+	}
+	return fmt.Errorf("openapi spec %s is outdated", filePath)
+}
+
+// ServeOpenAPI serve generated OpenAPI document
+func (h *HTTPServer) ServeOpenAPI(w http.ResponseWriter, r *http.Request) {
+	p := h.openAPIConfig().Path
+	data, err := h.MarshalOpenAPI(p)
+	if err != nil {
+		h.WriteError(w, err)
+		return
+	}
+	switch path.Ext(p) {
+	case ".yaml", ".yml":
+		w.Header().Set("Content-Type", "application/yaml")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		h.Logger.Error(err)
+	}
+}
+
+// openAPICommand check that --openapi-write or --openapi-check flag is set
+func openAPICommand() bool {
+	return viper.GetString(OpenAPIWriteFlag) != "" || viper.GetString(OpenAPICheckFlag) != ""
+}
+
+// runOpenAPICommand handle --openapi-write and --openapi-check flags. It is called by Application.Start
+// after invoker instead of start of lifecycle, so routes must be registered by Handle before start.
+func (h *HTTPServer) runOpenAPICommand() error {
+	if p := viper.GetString(OpenAPIWriteFlag); p != "" {
+		err := h.WriteOpenAPI(p)
+		if err != nil {
+			return err
+		}
+		h.Logger.Infof("openapi spec has been written to %s", p)
+		return nil
+	}
+	if p := viper.GetString(OpenAPICheckFlag); p != "" {
+		err := h.CheckOpenAPI(p)
+		if err != nil {
+			return err
+		}
+		h.Logger.Infof("openapi spec %s is up to date", p)
+	}
+	return nil
+}
+
+func (h *HTTPServer) openAPIConfig() *OpenAPIConfig {
+	cfg := OpenAPIConfig{}
+	if h.Cfg.OpenAPI != nil {
+		cfg = *h.Cfg.OpenAPI
+	}
+	if cfg.Path == "" {
+		cfg.Path = DefaultOpenAPIPath
+	}
+	if cfg.Title == "" {
+		cfg.Title = path.Base(os.Args[0])
+	}
+	if cfg.Version == "" {
+		cfg.Version = "0.0.0"
+	}
+	return &cfg
+}
+
+type openAPIGenerator struct {
+	schemas map[string]*OpenAPISchema
+}
+
+func (g *openAPIGenerator) operation(route *Route) *OpenAPIOperation {
+	op := &OpenAPIOperation{
+		Summary:     route.Summary,
+		Description: route.Description,
+		Tags:        route.Tags,
+		OperationID: operationID(route),
+		Responses:   make(map[string]*OpenAPIResponse),
+	}
+	if route.Request != nil {
+		t := derefType(reflect.TypeOf(route.Request))
+		if t.Kind() == reflect.Struct && t != timeType {
+			op.Parameters = g.parameters(t)
+			if hasBodyFields(t) && methodHasBody(route.Method) {
+				op.RequestBody = &OpenAPIRequestBody{
+					Required: true,
+					Content:  jsonContent(g.bodySchema(t)),
+				}
+			}
+		} else if methodHasBody(route.Method) {
+			op.RequestBody = &OpenAPIRequestBody{
+				Required: true,
+				Content:  jsonContent(g.schema(t)),
+			}
+		}
+	}
+	status := fmt.Sprintf("%d", route.Status)
+	resp := &OpenAPIResponse{Description: http.StatusText(route.Status)}
+	if route.Response != nil {
+		resp.Content = jsonContent(g.schema(reflect.TypeOf(route.Response)))
+	}
+	op.Responses[status] = resp
+	op.Responses["default"] = &OpenAPIResponse{
+		Description: "Error",
+		Content:     jsonContent(g.schema(reflect.TypeOf(HTTPError{}))),
+	}
+	return op
+}
+
+func (g *openAPIGenerator) parameters(t reflect.Type) []*OpenAPIParameter {
+	var params []*OpenAPIParameter
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			params = append(params, g.parameters(field.Type)...)
+			continue
+		}
+		in, name := paramLocation(field)
+		if in == "" {
+			continue
+		}
+		params = append(params, &OpenAPIParameter{
+			Name:        name,
+			In:          in,
+			Description: field.Tag.Get("description"),
+			Required:    in == "path" || field.Tag.Get("required") == "true",
+			Schema:      g.fieldSchema(field),
+		})
+	}
+	return params
+}
+
+// bodySchema build inline schema for request struct without param fields
+func (g *openAPIGenerator) bodySchema(t reflect.Type) *OpenAPISchema {
+	s := &OpenAPISchema{Type: "object", Properties: make(map[string]*OpenAPISchema)}
+	g.fillProperties(s, t, true)
+	return s
+}
+
+func (g *openAPIGenerator) schema(t reflect.Type) *OpenAPISchema {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+	var s *OpenAPISchema
+	switch {
+	case t == timeType:
+		s = &OpenAPISchema{Type: "string", Format: "date-time"}
+	case t == durationType:
+		s = &OpenAPISchema{Type: "integer", Format: "int64", Description: "duration in nanoseconds"}
+	case t == rawMessageType:
+		s = &OpenAPISchema{}
+	default:
+		s = g.kindSchema(t)
+	}
+	if nullable && s.Ref == "" {
+		s.Nullable = true
+	}
+	return s
+}
+
+func (g *openAPIGenerator) kindSchema(t reflect.Type) *OpenAPISchema {
+	switch t.Kind() {
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &OpenAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &OpenAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &OpenAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &OpenAPISchema{Type: "string", Format: "byte"}
+		}
+		return &OpenAPISchema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.structSchema(t)
+	default:
+		return &OpenAPISchema{}
+	}
+}
+
+// structSchema store named struct in components and return reference on it
+func (g *openAPIGenerator) structSchema(t reflect.Type) *OpenAPISchema {
+	if t.Name() == "" {
+		s := &OpenAPISchema{Type: "object", Properties: make(map[string]*OpenAPISchema)}
+		g.fillProperties(s, t, false)
+		return s
+	}
+	name := schemaName(t)
+	ref := &OpenAPISchema{Ref: "#/components/schemas/" + name}
+	if _, ok := g.schemas[name]; ok {
+		return ref
+	}
+	s := &OpenAPISchema{Type: "object", Properties: make(map[string]*OpenAPISchema)}
+	// register before filling to stop recursion on self-referenced types
+	g.schemas[name] = s
+	g.fillProperties(s, t, false)
+	return ref
+}
+
+func (g *openAPIGenerator) fillProperties(s *OpenAPISchema, t reflect.Type, skipParams bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		if skipParams {
+			if in, _ := paramLocation(field); in != "" {
+				continue
+			}
+		}
+		name, omitEmpty, skip := jsonFieldName(field)
+		if skip {
+			continue
+		}
+		if field.Anonymous && name == "" && derefType(field.Type).Kind() == reflect.Struct {
+			g.fillProperties(s, derefType(field.Type), skipParams)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		s.Properties[name] = g.fieldSchema(field)
+		if (!omitEmpty && field.Type.Kind() != reflect.Ptr) || field.Tag.Get("required") == "true" {
+			s.Required = append(s.Required, name)
+		}
+	}
+	sort.Strings(s.Required)
+}
+
+func (g *openAPIGenerator) fieldSchema(field reflect.StructField) *OpenAPISchema {
+	s := g.schema(field.Type)
+	description := field.Tag.Get("description")
+	example := field.Tag.Get("example")
+	enum := field.Tag.Get("enum")
+	if description == "" && example == "" && enum == "" {
+		return s
+	}
+	if s.Ref != "" {
+		// siblings of $ref are ignored in OpenAPI 3.0
+		return s
+	}
+	s.Description = description
+	if example != "" {
+		s.Example = example
+	}
+	if enum != "" {
+		s.Enum = strings.Split(enum, ",")
+	}
+	return s
+}
+
+func jsonFieldName(field reflect.StructField) (name string, omitEmpty bool, skip bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, true
+	}
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty, false
+}
+
+func schemaName(t reflect.Type) string {
+	pkg := path.Base(t.PkgPath())
+	if pkg == "" || pkg == "." {
+		return t.Name()
+	}
+	return pkg + "." + t.Name()
+}
+
+func operationID(route *Route) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(route.Method))
+	for _, part := range strings.FieldsFunc(pathParamRegex.ReplaceAllString(route.Path, "$1"), func(r rune) bool {
+		return r == '/' || r == '-' || r == '_' || r == '.'
+	}) {
+		b.WriteString(strings.ToUpper(part[:1]))
+		b.WriteString(part[1:])
+	}
+	return b.String()
+}
+
+func jsonContent(s *OpenAPISchema) map[string]*OpenAPIMediaType {
+	return map[string]*OpenAPIMediaType{"application/json": {Schema: s}}
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,127 @@
+package base
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func newTestOpenAPIServer() *HTTPServer {
+	h := newTestHTTPServer(&HTTPServerConfig{OpenAPI: &OpenAPIConfig{
+		Title:   "users",
+		Version: "1.0.0",
+		Servers: []string{"http://localhost:8080"},
+	}})
+	for _, route := range testRoutes() {
+		h.Handle(route)
+	}
+	return h
+}
+
+func TestOpenAPIGolden(t *testing.T) {
+	const golden = "testdata/openapi.golden.json"
+	actual, err := newTestOpenAPIServer().MarshalOpenAPI(golden)
+	require.NoError(t, err)
+	if *updateGolden {
+		require.NoError(t, ioutil.WriteFile(golden, actual, 0644))
+	}
+	expected, err := ioutil.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual), "run go test with -update to regenerate golden file")
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	doc := newTestOpenAPIServer().OpenAPI()
+
+	require.Contains(t, doc.Paths, "/users/{id}", "regexp of path param is removed")
+	assert.Len(t, doc.Paths["/users/{id}"], 3)
+
+	get := doc.Paths["/users/{id}"]["get"]
+	require.NotNil(t, get)
+	assert.Equal(t, "getUsersId", get.OperationID)
+	assert.Nil(t, get.RequestBody, "GET has no body")
+	var params []string
+	for _, p := range get.Parameters {
+		params = append(params, p.In+":"+p.Name)
+	}
+	assert.Equal(t, []string{"path:id", "query:verbose", "query:fields", "header:X-Tenant"}, params)
+	assert.True(t, get.Parameters[0].Required, "path param is required")
+	assert.Equal(t, "#/components/schemas/base.testUser", get.Responses["200"].Content["application/json"].Schema.Ref)
+
+	put := doc.Paths["/users/{id}"]["put"]
+	require.NotNil(t, put)
+	require.NotNil(t, put.RequestBody)
+	body := put.RequestBody.Content["application/json"].Schema
+	assert.NotContains(t, body.Properties, "ID", "param fields are not in body")
+	assert.Equal(t, []string{"name"}, body.Required)
+	assert.Contains(t, put.Responses, "202")
+	assert.Contains(t, put.Responses, "default")
+
+	user := doc.Components.Schemas["base.testUser"]
+	require.NotNil(t, user)
+	assert.Equal(t, []string{"id", "name"}, user.Required)
+	assert.Equal(t, "user name", user.Properties["name"].Description)
+	assert.True(t, user.Properties["email"].Nullable)
+	assert.Equal(t, "array", user.Properties["tags"].Type)
+}
+
+func TestCheckOpenAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openapi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	h := newTestOpenAPIServer()
+	for _, name := range []string{"openapi.json", "openapi.yaml"} {
+		t.Run(name, func(t *testing.T) {
+			p := filepath.Join(dir, name)
+			assert.Error(t, h.CheckOpenAPI(p), "missing file")
+
+			require.NoError(t, h.WriteOpenAPI(p))
+			assert.NoError(t, h.CheckOpenAPI(p))
+
+			drifted := newTestOpenAPIServer()
+			drifted.Handle(&Route{Method: "post", Path: "/users", Request: testUser{}, Response: testUser{}})
+			err := drifted.CheckOpenAPI(p)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "is outdated, first difference at line")
+		})
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "openapi.json"))
+	require.NoError(t, err)
+	var doc OpenAPIDocument
+	require.NoError(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, OpenAPIVersion, doc.OpenAPI)
+	assert.Equal(t, "users", doc.Info.Title)
+}
+
+func TestRunOpenAPICommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openapi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "spec.yaml")
+	defer viper.Set(OpenAPIWriteFlag, "")
+	defer viper.Set(OpenAPICheckFlag, "")
+
+	assert.False(t, openAPICommand())
+
+	viper.Set(OpenAPIWriteFlag, p)
+	assert.True(t, openAPICommand())
+	require.NoError(t, newTestOpenAPIServer().runOpenAPICommand())
+	assert.FileExists(t, p)
+
+	viper.Set(OpenAPIWriteFlag, "")
+	viper.Set(OpenAPICheckFlag, p)
+	assert.True(t, openAPICommand())
+	assert.NoError(t, newTestOpenAPIServer().runOpenAPICommand())
+	assert.Error(t, newTestHTTPServer(nil).runOpenAPICommand(), "server without routes drifts from spec")
+}
@@ -0,0 +1,58 @@
+package base
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// PropagatedHeaders are copied from incoming request to outgoing requests of HTTPClientFactory clients.
+// Trace context headers are not copied, clients inject context of own span.
+var PropagatedHeaders = []string{RequestIDHeader}
+
+type propagationKey struct{}
+
+// WithPropagatedHeaders store headers which must be passed to outgoing requests in context
+func WithPropagatedHeaders(ctx context.Context, header http.Header) context.Context {
+	h := make(http.Header)
+	for _, name := range PropagatedHeaders {
+		if v := header.Get(name); v != "" {
+			h.Set(name, v)
+		}
+	}
+	return context.WithValue(ctx, propagationKey{}, h)
+}
+
+// PropagatedHeadersFromContext return headers stored by WithPropagatedHeaders
+func PropagatedHeadersFromContext(ctx context.Context) http.Header {
+	h, _ := ctx.Value(propagationKey{}).(http.Header)
+	return h
+}
+
+// RequestIDFromContext return id of incoming request
+func RequestIDFromContext(ctx context.Context) string {
+	return PropagatedHeadersFromContext(ctx).Get(RequestIDHeader)
+}
+
+// PropagationMiddleware assign request id(if client did not send it) and store propagated headers in request context
+func PropagationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(RequestIDHeader) == "" {
+			r.Header.Set(RequestIDHeader, newRequestID())
+		}
+		w.Header().Set(RequestIDHeader, r.Header.Get(RequestIDHeader))
+		next.ServeHTTP(w, r.WithContext(WithPropagatedHeaders(r.Context(), r.Header)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
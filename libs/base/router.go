@@ -0,0 +1,315 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+// TypedHandlerFunc handle decoded request. req is pointer on new instance of Route.Request type
+// (or nil if Route.Request is nil), returned value is encoded as JSON response.
+type TypedHandlerFunc func(ctx context.Context, req interface{}) (interface{}, error)
+
+// Route describe HTTP endpoint with known request and response types.
+// Request and Response are samples of payload types(example: CreateUserRequest{}), they are used
+// for request decoding and OpenAPI document generation.
+// Request struct fields with tags `path:"name"`, `query:"name"` and `header:"name"` are filled from
+// path params, query string and headers, other fields are decoded from JSON body.
+type Route struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Tags        []string
+	Status      int
+	Request     interface{}
+	Response    interface{}
+	Handler     TypedHandlerFunc
+	// RawHandler is used instead of Handler for endpoints with custom encoding(files, streams).
+	RawHandler http.Handler
+}
+
+// HTTPError is error with HTTP status code. Typed handlers can return it to control response status.
+type HTTPError struct {
+	Status  int    `json:"-"`
+	Message string `json:"error"`
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+func NewHTTPError(status int, format string, args ...interface{}) *HTTPError {
+	return &HTTPError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// Router return router which is used as server handler if no other handler was set
+func (h *HTTPServer) Router() chi.Router {
+	h.routesMx.Lock()
+	defer h.routesMx.Unlock()
+	if h.router == nil {
+		h.router = chi.NewRouter()
+	}
+	return h.router
+}
+
+// Routes return all typed routes registered by Handle
+func (h *HTTPServer) Routes() []*Route {
+	h.routesMx.Lock()
+	defer h.routesMx.Unlock()
+	routes := make([]*Route, len(h.routes))
+	copy(routes, h.routes)
+	return routes
+}
+
+// Handle register typed route in server router
+func (h *HTTPServer) Handle(route *Route) {
+	if route.Method == "" {
+		route.Method = http.MethodGet
+	}
+	route.Method = strings.ToUpper(route.Method)
+	if route.Status == 0 {
+		route.Status = http.StatusOK
+	}
+	var handler = route.RawHandler
+	if handler == nil {
+		handler = h.typedHandler(route)
+	}
+	h.Router().Method(route.Method, route.Path, handler)
+
+	h.routesMx.Lock()
+	h.routes = append(h.routes, route)
+	h.routesMx.Unlock()
+}
+
+func (h *HTTPServer) typedHandler(route *Route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req interface{}
+		if route.Request != nil {
+			var err error
+			req, err = DecodeRequest(r, route.Request)
+			if err != nil {
+				h.writeError(r.Context(), w, NewHTTPError(http.StatusBadRequest, "%v", err))
+				return
+			}
+		}
+		resp, err := route.Handler(r.Context(), req)
+		if err != nil {
+			h.writeError(r.Context(), w, err)
+			return
+		}
+		h.writeJSON(r.Context(), w, route.Status, resp)
+	})
+}
+
+// WriteJSON encode v as JSON response with defined status
+func (h *HTTPServer) WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	h.writeJSON(context.Background(), w, status, v)
+}
+
+func (h *HTTPServer) writeJSON(ctx context.Context, w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.FromContext(ctx, h.Logger).Error(err)
+	}
+}
+
+// WriteError write error as JSON response. Status is taken from HTTPError(wrapped too) or 500 for other errors
+// and HTTPError without status.
+func (h *HTTPServer) WriteError(w http.ResponseWriter, err error) {
+	h.writeError(context.Background(), w, err)
+}
+
+// writeError is WriteError which logs with logger of request context
+func (h *HTTPServer) writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		log.FromContext(ctx, h.Logger).Error(err)
+		httpErr = NewHTTPError(http.StatusInternalServerError, "%v", err)
+	}
+	status := httpErr.Status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	h.writeJSON(ctx, w, status, httpErr)
+}
+
+// DecodeRequest create new instance of sample type and fill it from path params, query, headers and JSON body
+func DecodeRequest(r *http.Request, sample interface{}) (interface{}, error) {
+	t := reflect.TypeOf(sample)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	ptr := reflect.New(t)
+	if t.Kind() != reflect.Struct {
+		err := decodeBody(r, ptr.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return ptr.Interface(), nil
+	}
+	if hasBodyFields(t) && methodHasBody(r.Method) {
+		err := decodeBody(r, ptr.Interface())
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := decodeParams(r, ptr.Elem())
+	if err != nil {
+		return nil, err
+	}
+	return ptr.Interface(), nil
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	if r.Body == nil || r.ContentLength == 0 {
+		return nil
+	}
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("cannot decode body: %v", err)
+	}
+	return nil
+}
+
+func decodeParams(r *http.Request, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			err := decodeParams(r, v.Field(i))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		in, name := paramLocation(field)
+		if in == "" {
+			continue
+		}
+		var raw string
+		switch in {
+		case "path":
+			raw = chi.URLParam(r, name)
+		case "query":
+			raw = r.URL.Query().Get(name)
+		case "header":
+			raw = r.Header.Get(name)
+		}
+		if raw == "" {
+			continue
+		}
+		err := setParam(v.Field(i), raw)
+		if err != nil {
+			return fmt.Errorf("bad %s param %s: %v", in, name, err)
+		}
+	}
+	return nil
+}
+
+func setParam(v reflect.Value, raw string) error {
+	if v.Kind() == reflect.Ptr {
+		p := reflect.New(v.Type().Elem())
+		err := setParam(p.Elem(), raw)
+		if err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		parts := strings.Split(raw, ",")
+		s := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			err := setParam(s.Index(i), part)
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	default:
+		return fmt.Errorf("unsupported param type %s", v.Type())
+	}
+	return nil
+}
+
+// paramLocation return OpenAPI parameter location and name for struct field
+func paramLocation(field reflect.StructField) (string, string) {
+	for _, in := range []string{"path", "query", "header"} {
+		name, ok := field.Tag.Lookup(in)
+		if ok && name != "-" {
+			return in, name
+		}
+	}
+	return "", ""
+}
+
+func hasBodyFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if hasBodyFields(field.Type) {
+				return true
+			}
+			continue
+		}
+		in, _ := paramLocation(field)
+		if in == "" && field.Tag.Get("json") != "-" {
+			return true
+		}
+	}
+	return false
+}
+
+func methodHasBody(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,225 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+func newTestHTTPServer(cfg *HTTPServerConfig) *HTTPServer {
+	if cfg == nil {
+		cfg = &HTTPServerConfig{}
+	}
+	return &HTTPServer{
+		Server: &http.Server{},
+		Ctx:    context.Background(),
+		Logger: &log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()},
+		Cfg:    cfg,
+	}
+}
+
+type testUser struct {
+	ID    int64    `json:"id"`
+	Name  string   `json:"name" description:"user name" example:"alice"`
+	Email *string  `json:"email,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+type testGetUserRequest struct {
+	ID      int64    `path:"id"`
+	Verbose bool     `query:"verbose"`
+	Fields  []string `query:"fields"`
+	Tenant  string   `header:"X-Tenant"`
+}
+
+type testUpdateUserRequest struct {
+	ID   int64    `path:"id"`
+	Page *int     `query:"page"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+func testRoutes() []*Route {
+	return []*Route{
+		{
+			Path:     "/users/{id}",
+			Summary:  "Get user",
+			Request:  testGetUserRequest{},
+			Response: testUser{},
+			Handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				r := req.(*testGetUserRequest)
+				if r.ID == 404 {
+					return nil, NewHTTPError(http.StatusNotFound, "user %d is not found", r.ID)
+				}
+				return &testUser{ID: r.ID, Name: r.Tenant, Tags: r.Fields}, nil
+			},
+		},
+		{
+			Method:   "put",
+			Path:     "/users/{id:[0-9]+}",
+			Tags:     []string{"users"},
+			Status:   http.StatusAccepted,
+			Request:  &testUpdateUserRequest{},
+			Response: testUser{},
+			Handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				r := req.(*testUpdateUserRequest)
+				if r.Name == "" {
+					return nil, http.ErrNoCookie
+				}
+				return &testUser{ID: r.ID, Name: r.Name, Tags: r.Tags}, nil
+			},
+		},
+		{
+			Method: http.MethodDelete,
+			Path:   "/users/{id}",
+			Status: http.StatusNoContent,
+			Handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			},
+		},
+		{
+			Path: "/raw",
+			RawHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("raw"))
+			}),
+		},
+	}
+}
+
+func TestHandle(t *testing.T) {
+	h := newTestHTTPServer(nil)
+	for _, route := range testRoutes() {
+		h.Handle(route)
+	}
+	routes := h.Routes()
+	require.Len(t, routes, 4)
+	assert.Equal(t, http.MethodGet, routes[0].Method, "default method")
+	assert.Equal(t, http.StatusOK, routes[0].Status, "default status")
+	assert.Equal(t, http.MethodPut, routes[1].Method)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers map[string]string
+		status  int
+		resp    string
+	}{
+		{
+			name:    "get",
+			method:  http.MethodGet,
+			target:  "/users/7?fields=a,b",
+			headers: map[string]string{"X-Tenant": "acme"},
+			status:  http.StatusOK,
+			resp:    `{"id":7,"name":"acme","tags":["a","b"]}`,
+		},
+		{name: "bad path param", method: http.MethodGet, target: "/users/x", status: http.StatusBadRequest},
+		{name: "http error", method: http.MethodGet, target: "/users/404", status: http.StatusNotFound, resp: `{"error":"user 404 is not found"}`},
+		{
+			name:   "put with body",
+			method: http.MethodPut,
+			target: "/users/3",
+			body:   `{"name":"bob","tags":["x"]}`,
+			status: http.StatusAccepted,
+			resp:   `{"id":3,"name":"bob","tags":["x"]}`,
+		},
+		{name: "bad body", method: http.MethodPut, target: "/users/3", body: `{"name":`, status: http.StatusBadRequest},
+		{name: "other error", method: http.MethodPut, target: "/users/3", body: `{}`, status: http.StatusInternalServerError, resp: `{"error":"http: named cookie not present"}`},
+		{name: "path regexp", method: http.MethodPut, target: "/users/abc", body: `{}`, status: http.StatusMethodNotAllowed},
+		{name: "no content", method: http.MethodDelete, target: "/users/1", status: http.StatusNoContent},
+		{name: "raw", method: http.MethodGet, target: "/raw", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.Router().ServeHTTP(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.resp != "" {
+				assert.JSONEq(t, tt.resp, rec.Body.String())
+				assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+// withURLParams return request with chi path params like it is routed by chi
+func withURLParams(r *http.Request, params map[string]string) *http.Request {
+	rctx := chi.NewRouteContext()
+	for k, v := range params {
+		rctx.URLParams.Add(k, v)
+	}
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestDecodeRequest(t *testing.T) {
+	page := 2
+
+	req := withURLParams(httptest.NewRequest(http.MethodGet, "/users/5?verbose=true&fields=id,name", nil), map[string]string{"id": "5"})
+	req.Header.Set("X-Tenant", "acme")
+	v, err := DecodeRequest(req, testGetUserRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, &testGetUserRequest{ID: 5, Verbose: true, Fields: []string{"id", "name"}, Tenant: "acme"}, v)
+
+	req = withURLParams(httptest.NewRequest(http.MethodPatch, "/users/5?page=2", strings.NewReader(`{"name":"a","ID":9}`)), map[string]string{"id": "5"})
+	v, err = DecodeRequest(req, &testUpdateUserRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, &testUpdateUserRequest{ID: 5, Page: &page, Name: "a"}, v, "path param wins over body field")
+
+	// body of GET is not decoded
+	v, err = DecodeRequest(httptest.NewRequest(http.MethodGet, "/users", strings.NewReader(`{"name":"a"}`)), testUpdateUserRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, &testUpdateUserRequest{}, v)
+
+	// not struct sample is decoded from body
+	v, err = DecodeRequest(httptest.NewRequest(http.MethodPost, "/tags", strings.NewReader(`["a","b"]`)), []string{})
+	require.NoError(t, err)
+	assert.Equal(t, &[]string{"a", "b"}, v)
+
+	_, err = DecodeRequest(httptest.NewRequest(http.MethodGet, "/users?verbose=maybe", nil), testGetUserRequest{})
+	assert.EqualError(t, err, `bad query param verbose: strconv.ParseBool: parsing "maybe": invalid syntax`)
+
+	_, err = DecodeRequest(httptest.NewRequest(http.MethodGet, "/users?page=1.5", nil), testUpdateUserRequest{})
+	assert.Error(t, err)
+
+	_, err = DecodeRequest(httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{`)), testUpdateUserRequest{})
+	assert.Error(t, err)
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		resp   string
+	}{
+		{name: "http error", err: NewHTTPError(http.StatusConflict, "exists"), status: http.StatusConflict, resp: `{"error":"exists"}`},
+		{name: "wrapped http error", err: fmt.Errorf("create: %w", NewHTTPError(http.StatusConflict, "exists")), status: http.StatusConflict, resp: `{"error":"exists"}`},
+		{name: "http error without status", err: &HTTPError{Message: "oops"}, status: http.StatusInternalServerError, resp: `{"error":"oops"}`},
+		{name: "other error", err: errors.New("db is down"), status: http.StatusInternalServerError, resp: `{"error":"db is down"}`},
+	}
+	h := newTestHTTPServer(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.WriteError(rec, tt.err)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.JSONEq(t, tt.resp, rec.Body.String())
+		})
+	}
+}
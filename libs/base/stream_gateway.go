@@ -0,0 +1,341 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/rx"
+)
+
+const LastEventIDHeader = "Last-Event-ID"
+
+// LastEventIDParam is query param alternative of Last-Event-ID header(browsers WebSocket API cannot set headers)
+const LastEventIDParam = "last_event_id"
+
+var DefaultStreamGatewayConfig = StreamGatewayConfig{
+	BufferSize:        64,
+	ReplaySize:        256,
+	HeartbeatInterval: time.Second * 15,
+	WriteTimeout:      time.Second * 10,
+	SlowConsumer:      "disconnect",
+}
+
+type StreamGatewayConfig struct {
+	// BufferSize is size of per client events buffer
+	BufferSize int `json:"buffer_size" yaml:"buffer_size"`
+	// ReplaySize is number of last events stored for Last-Event-ID resume
+	ReplaySize        int           `json:"replay_size" yaml:"replay_size"`
+	HeartbeatInterval time.Duration `json:"heartbeat_interval" yaml:"heartbeat_interval"`
+	WriteTimeout      time.Duration `json:"write_timeout" yaml:"write_timeout"`
+	// SlowConsumer define what to do with client which buffer is full: block, drop or disconnect
+	SlowConsumer string `json:"slow_consumer" yaml:"slow_consumer"`
+}
+
+func (c *StreamGatewayConfig) policy() rx.SlowConsumerPolicy {
+	switch c.SlowConsumer {
+	case "block":
+		return rx.Block
+	case "drop":
+		return rx.DropNewest
+	default:
+		return rx.Disconnect
+	}
+}
+
+// StreamEvent is notifier event with sequence id
+type StreamEvent struct {
+	ID    uint64      `json:"id"`
+	Event string      `json:"event,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// NamedStreamEvent can be implemented by notifier events to define SSE event name
+type NamedStreamEvent interface {
+	StreamEventName() string
+}
+
+// StreamFilter decide if event must be sent to client. query is client connection query params.
+type StreamFilter func(query url.Values, data interface{}) bool
+
+// StreamGateway expose rx.Notifier events to SSE and WebSocket clients.
+// Every event gets sequence id and is stored in short replay buffer, so reconnected clients can resume
+// from Last-Event-ID. Every client has own rx.Observer with bounded buffer and configured slow consumer policy.
+// All clients are disconnected on HTTPServer shutdown.
+//
+// Note: HTTPServerConfig.WriteTimeout limits lifetime of SSE connections, keep it zero for servers with streams.
+type StreamGateway struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	logger   log.Logger
+	cfg      StreamGatewayConfig
+	filter   StreamFilter
+	source   *rx.Observer
+	fanout   *rx.Notifier
+	upgrader websocket.Upgrader
+	clients  sync.WaitGroup
+
+	mx     sync.Mutex
+	seq    uint64
+	replay []*StreamEvent
+}
+
+// NewStreamGateway create gateway for notifier. Config is taken from HTTPServerConfig.Stream. filter can be nil.
+func (h *HTTPServer) NewStreamGateway(notifier *rx.Notifier, filter StreamFilter) *StreamGateway {
+	cfg := DefaultStreamGatewayConfig
+	if h.Cfg.Stream != nil {
+		cfg = *h.Cfg.Stream
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultStreamGatewayConfig.BufferSize
+	}
+	ctx, cancel := context.WithCancel(h.Ctx)
+	g := &StreamGateway{
+		ctx:    ctx,
+		cancel: cancel,
+		logger: log.ForkLogger(h.Logger),
+		cfg:    cfg,
+		filter: filter,
+		fanout: rx.NewNotifier(ctx),
+		replay: make([]*StreamEvent, 0, cfg.ReplaySize),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	g.source = notifier.CreateObserver(g.dispatch, cfg.BufferSize)
+	h.Server.RegisterOnShutdown(g.Close)
+	return g
+}
+
+// Close disconnect all clients and stop listening of notifier
+func (g *StreamGateway) Close() {
+	g.source.Stop()
+	g.cancel()
+	g.clients.Wait()
+}
+
+func (g *StreamGateway) dispatch(ctx context.Context, i interface{}) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	g.seq++
+	ev := &StreamEvent{ID: g.seq, Data: i}
+	if named, ok := i.(NamedStreamEvent); ok {
+		ev.Event = named.StreamEventName()
+	}
+	if g.cfg.ReplaySize > 0 {
+		if len(g.replay) >= g.cfg.ReplaySize {
+			g.replay = g.replay[1:]
+		}
+		g.replay = append(g.replay, ev)
+	}
+	g.fanout.Notify(ev)
+}
+
+// SSEHandler serve events as text/event-stream
+func (g *StreamGateway) SSEHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		c := &streamClient{
+			write: func(ev *StreamEvent) error {
+				data, err := json.Marshal(ev.Data)
+				if err != nil {
+					return err
+				}
+				if ev.Event != "" {
+					_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Event, data)
+				} else {
+					_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.ID, data)
+				}
+				if err != nil {
+					return err
+				}
+				flusher.Flush()
+				return nil
+			},
+			ping: func() error {
+				_, err := fmt.Fprint(w, ": ping\n\n")
+				if err != nil {
+					return err
+				}
+				flusher.Flush()
+				return nil
+			},
+		}
+		g.serve(r.Context(), r, c)
+	})
+}
+
+// WebSocketHandler serve events as JSON encoded StreamEvent messages
+func (g *StreamGateway) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := g.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			g.logger.Warn(err)
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		// read loop is required for processing of control messages
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		c := &streamClient{
+			write: func(ev *StreamEvent) error {
+				err := conn.SetWriteDeadline(g.writeDeadline())
+				if err != nil {
+					return err
+				}
+				return conn.WriteJSON(ev)
+			},
+			ping: func() error {
+				return conn.WriteControl(websocket.PingMessage, nil, g.writeDeadline())
+			},
+		}
+		g.serve(ctx, r, c)
+
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+		c.mx.Lock()
+		_ = conn.WriteControl(websocket.CloseMessage, msg, g.writeDeadline())
+		c.mx.Unlock()
+		_ = conn.Close()
+	})
+}
+
+type streamClient struct {
+	mx     sync.Mutex
+	closed bool
+	write  func(ev *StreamEvent) error
+	ping   func() error
+}
+
+// serve replay missed events, subscribe client on live events and block until client or gateway is done
+func (g *StreamGateway) serve(ctx context.Context, r *http.Request, c *streamClient) {
+	g.clients.Add(1)
+	defer g.clients.Done()
+
+	query := r.URL.Query()
+	lastID, resume := lastEventID(r)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// writer must not be used after handler return
+	defer func() {
+		c.mx.Lock()
+		c.closed = true
+		c.mx.Unlock()
+	}()
+
+	send := func(ev *StreamEvent) bool {
+		if g.filter != nil && !g.filter(query, ev.Data) {
+			return true
+		}
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		if c.closed {
+			return false
+		}
+		err := c.write(ev)
+		if err != nil {
+			g.logger.Debugf("stream client write: %v", err)
+			cancel()
+			return false
+		}
+		return true
+	}
+
+	// client lock is held until replay is written, so live events can not overtake replayed ones
+	c.mx.Lock()
+	g.mx.Lock()
+	var missed []*StreamEvent
+	if resume {
+		for _, ev := range g.replay {
+			if ev.ID > lastID {
+				missed = append(missed, ev)
+			}
+		}
+	}
+	observer := g.fanout.CreateObserverWithPolicy(func(ctx context.Context, i interface{}) {
+		send(i.(*StreamEvent))
+	}, g.cfg.BufferSize, g.cfg.policy())
+	g.mx.Unlock()
+	c.mx.Unlock()
+	defer observer.Stop()
+
+	for _, ev := range missed {
+		if !send(ev) {
+			return
+		}
+	}
+
+	var heartbeat <-chan time.Time
+	if g.cfg.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(g.cfg.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.ctx.Done():
+			return
+		case <-observer.Done():
+			if observer.Dropped() > 0 {
+				g.logger.Warnf("slow stream client %s disconnected", r.RemoteAddr)
+			}
+			return
+		case <-heartbeat:
+			c.mx.Lock()
+			err := c.ping()
+			c.mx.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (g *StreamGateway) writeDeadline() time.Time {
+	if g.cfg.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(g.cfg.WriteTimeout)
+}
+
+func lastEventID(r *http.Request) (uint64, bool) {
+	raw := r.Header.Get(LastEventIDHeader)
+	if raw == "" {
+		raw = r.URL.Query().Get(LastEventIDParam)
+	}
+	if raw == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
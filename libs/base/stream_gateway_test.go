@@ -0,0 +1,300 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.pnhub.ru/core/libs/rx"
+)
+
+type testStreamEvent struct {
+	Type string `json:"type"`
+	N    int    `json:"n"`
+}
+
+func (e testStreamEvent) StreamEventName() string {
+	return e.Type
+}
+
+func typeFilter(query url.Values, data interface{}) bool {
+	t := query.Get("type")
+	return t == "" || data.(testStreamEvent).Type == t
+}
+
+func newTestGateway(t *testing.T, cfg StreamGatewayConfig) (*rx.Notifier, *StreamGateway) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := newTestHTTPServer(&HTTPServerConfig{Stream: &cfg})
+	h.Ctx = ctx
+	notifier := rx.NewNotifier(ctx)
+	g := h.NewStreamGateway(notifier, typeFilter)
+	t.Cleanup(func() {
+		g.Close()
+		cancel()
+	})
+	return notifier, g
+}
+
+// waitDispatched wait until gateway assigns ids to n events
+func waitDispatched(t *testing.T, g *StreamGateway, n uint64) {
+	require.Eventually(t, func() bool {
+		g.mx.Lock()
+		defer g.mx.Unlock()
+		return g.seq == n
+	}, time.Second, time.Millisecond)
+}
+
+// slowClient is stream client which write blocks until test receives event
+type slowClient struct {
+	events     chan *StreamEvent
+	writing    chan struct{}
+	subscribed chan struct{}
+	done       chan struct{}
+}
+
+// serveSlowClient serve client in background. Heartbeat is used for detection of subscription.
+func serveSlowClient(g *StreamGateway, target string) *slowClient {
+	s := &slowClient{
+		events:     make(chan *StreamEvent),
+		writing:    make(chan struct{}, 100),
+		subscribed: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	c := &streamClient{
+		write: func(ev *StreamEvent) error {
+			s.writing <- struct{}{}
+			s.events <- ev
+			return nil
+		},
+		ping: func() error {
+			select {
+			case s.subscribed <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	}
+	go func() {
+		defer close(s.done)
+		g.serve(context.Background(), httptest.NewRequest(http.MethodGet, target, nil), c)
+	}()
+	return s
+}
+
+func (s *slowClient) receive(t *testing.T, n int) []int {
+	t.Helper()
+	var out []int
+	for i := 0; i < n; i++ {
+		select {
+		case ev := <-s.events:
+			out = append(out, ev.Data.(testStreamEvent).N)
+		case <-time.After(time.Second):
+			t.Fatalf("event %d is not received", i+1)
+		}
+	}
+	return out
+}
+
+func (s *slowClient) assertNoEvents(t *testing.T) {
+	t.Helper()
+	select {
+	case ev := <-s.events:
+		t.Fatalf("unexpected event %d", ev.ID)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func notifyRange(notifier *rx.Notifier, from, to int) {
+	for i := from; i <= to; i++ {
+		notifier.Notify(testStreamEvent{Type: "a", N: i})
+	}
+}
+
+func TestStreamGatewayBlock(t *testing.T) {
+	notifier, g := newTestGateway(t, StreamGatewayConfig{BufferSize: 1, HeartbeatInterval: time.Millisecond, SlowConsumer: "block"})
+	c := serveSlowClient(g, "/")
+	<-c.subscribed
+
+	notified := make(chan struct{})
+	go func() {
+		notifyRange(notifier, 1, 5)
+		close(notified)
+	}()
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, c.receive(t, 5), "slow client gets every event in order")
+	<-notified
+}
+
+func TestStreamGatewayDropNewest(t *testing.T) {
+	notifier, g := newTestGateway(t, StreamGatewayConfig{BufferSize: 1, HeartbeatInterval: time.Millisecond, SlowConsumer: "drop"})
+	c := serveSlowClient(g, "/")
+	<-c.subscribed
+
+	notifyRange(notifier, 1, 1)
+	<-c.writing
+	// 2 waits in buffer, 3 and 4 are dropped
+	notifyRange(notifier, 2, 4)
+	waitDispatched(t, g, 4)
+	assert.Equal(t, []int{1, 2}, c.receive(t, 2))
+	c.assertNoEvents(t)
+
+	notifyRange(notifier, 5, 5)
+	assert.Equal(t, []int{5}, c.receive(t, 1), "client is still connected")
+}
+
+func TestStreamGatewayDisconnect(t *testing.T) {
+	notifier, g := newTestGateway(t, StreamGatewayConfig{BufferSize: 1, HeartbeatInterval: time.Millisecond, SlowConsumer: "disconnect"})
+	c := serveSlowClient(g, "/")
+	<-c.subscribed
+
+	notifyRange(notifier, 1, 1)
+	<-c.writing
+	notifyRange(notifier, 2, 3)
+	waitDispatched(t, g, 3)
+	assert.Equal(t, []int{1}, c.receive(t, 1))
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("slow client is not disconnected")
+	}
+	c.assertNoEvents(t)
+}
+
+func TestStreamGatewayReplay(t *testing.T) {
+	notifier, g := newTestGateway(t, StreamGatewayConfig{BufferSize: 8, ReplaySize: 3})
+	notifyRange(notifier, 1, 5)
+	waitDispatched(t, g, 5)
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		events []int
+	}{
+		{name: "header", target: "/", header: "3", events: []int{4, 5}},
+		{name: "query param", target: "/?last_event_id=4", events: []int{5}},
+		{name: "older than replay buffer", target: "/", header: "0", events: []int{3, 4, 5}},
+		{name: "bad id", target: "/?last_event_id=x"},
+		{name: "no id", target: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set(LastEventIDHeader, tt.header)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			var got []int
+			c := &streamClient{
+				write: func(ev *StreamEvent) error {
+					got = append(got, ev.Data.(testStreamEvent).N)
+					if len(got) == len(tt.events) {
+						cancel()
+					}
+					return nil
+				},
+				ping: func() error { return nil },
+			}
+			if len(tt.events) == 0 {
+				cancel()
+			}
+			g.serve(ctx, r, c)
+			assert.Equal(t, tt.events, got)
+		})
+	}
+}
+
+func TestStreamGatewaySSE(t *testing.T) {
+	notifier, g := newTestGateway(t, StreamGatewayConfig{BufferSize: 8, ReplaySize: 8, HeartbeatInterval: time.Hour})
+	srv := httptest.NewServer(g.SSEHandler())
+	defer srv.Close()
+
+	notifier.Notify(testStreamEvent{Type: "a", N: 1})
+	notifier.Notify(testStreamEvent{Type: "b", N: 2})
+	notifier.Notify(testStreamEvent{Type: "a", N: 3})
+	waitDispatched(t, g, 3)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"?type=a", nil)
+	require.NoError(t, err)
+	req.Header.Set(LastEventIDHeader, "0")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	notifier.Notify(testStreamEvent{Type: "b", N: 4})
+	notifier.Notify(testStreamEvent{Type: "a", N: 5})
+
+	r := bufio.NewReader(resp.Body)
+	var frames []string
+	for len(frames) < 3 {
+		frame, err := readSSEFrame(r)
+		require.NoError(t, err)
+		frames = append(frames, frame)
+	}
+	assert.Equal(t, []string{
+		"id: 1\nevent: a\ndata: {\"type\":\"a\",\"n\":1}",
+		"id: 3\nevent: a\ndata: {\"type\":\"a\",\"n\":3}",
+		"id: 5\nevent: a\ndata: {\"type\":\"a\",\"n\":5}",
+	}, frames, "replayed and live events of filter")
+
+	// gateway close ends response
+	g.Close()
+	_, err = readSSEFrame(r)
+	assert.Error(t, err)
+}
+
+func readSSEFrame(r *bufio.Reader) (string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestStreamGatewayWebSocket(t *testing.T) {
+	notifier, g := newTestGateway(t, StreamGatewayConfig{BufferSize: 8, ReplaySize: 8, HeartbeatInterval: time.Hour})
+	srv := httptest.NewServer(g.WebSocketHandler())
+	defer srv.Close()
+
+	notifier.Notify(testStreamEvent{Type: "a", N: 1})
+	notifier.Notify(testStreamEvent{Type: "b", N: 2})
+	waitDispatched(t, g, 2)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?type=b&last_event_id=0", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	notifier.Notify(testStreamEvent{Type: "b", N: 3})
+	for _, want := range []uint64{2, 3} {
+		var ev struct {
+			ID    uint64          `json:"id"`
+			Event string          `json:"event"`
+			Data  testStreamEvent `json:"data"`
+		}
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		require.NoError(t, conn.ReadJSON(&ev))
+		assert.Equal(t, want, ev.ID)
+		assert.Equal(t, "b", ev.Event)
+		assert.Equal(t, "b", ev.Data.Type)
+	}
+
+	g.Close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "close message is sent on shutdown: %v", err)
+}
@@ -0,0 +1,39 @@
+package base
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"git.pnhub.ru/core/libs/tenant"
+	"git.pnhub.ru/core/libs/trace"
+)
+
+// TenantMiddleware resolve tenant of request and store it in request context(tenant.FromContext).
+// Request without required tenant is rejected with 400, unknown tenant with 403 and bad token with 401.
+func TenantMiddleware(resolver *tenant.Resolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, err := resolver.Resolve(r)
+			if err != nil {
+				status := http.StatusUnauthorized
+				switch err {
+				case tenant.ErrNoTenant:
+					status = http.StatusBadRequest
+				case tenant.ErrUnknownTenant:
+					status = http.StatusForbidden
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				_ = json.NewEncoder(w).Encode(NewHTTPError(status, "%v", err))
+				return
+			}
+			if t == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := tenant.WithTenant(r.Context(), t)
+			trace.SpanFromContext(ctx).SetAttribute(tenant.Tag, t)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
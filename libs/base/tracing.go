@@ -0,0 +1,108 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/trace"
+)
+
+// LoggerMiddleware store logger in request context, handlers take it with trace and span ids by log.FromContext
+func LoggerMiddleware(logger log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(log.ToContext(r.Context(), logger)))
+		})
+	}
+}
+
+// TracingMiddleware continue trace from W3C traceparent header(or start new one) and create server span for request.
+// Span is named by chi route pattern if request is served by chi router.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := trace.ExtractHTTP(r.Context(), r.Header)
+		ctx, span := trace.Start(ctx, "HTTP "+r.Method,
+			trace.WithKind(trace.SpanKindServer),
+			trace.WithAttributes(map[string]interface{}{
+				"http.method":     r.Method,
+				"http.target":     r.URL.Path,
+				"http.host":       r.Host,
+				"http.user_agent": r.UserAgent(),
+			}))
+		defer span.End()
+
+		// chi reuses route context from request, so route pattern is available after serving
+		rctx := chi.NewRouteContext()
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			span.SetName(r.Method + " " + pattern)
+		}
+		span.SetAttribute("http.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(trace.StatusError, http.StatusText(rec.status))
+		}
+	})
+}
+
+// statusRecorder remember response status and keep Flusher and Hijacker of wrapped writer
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+type tracingTransport struct {
+	next http.RoundTripper
+	name string
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := trace.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithKind(trace.SpanKindClient),
+		trace.WithAttributes(map[string]interface{}{
+			"http.method": req.Method,
+			"http.url":    req.URL.String(),
+			"http.client": t.name,
+		}))
+	defer span.End()
+	req = req.Clone(ctx)
+	trace.InjectHTTP(ctx, req.Header)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(trace.StatusError, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
@@ -0,0 +1,675 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/segmentio/kafka-go"
+	"github.com/uber-go/tally"
+	"go.uber.org/fx"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/rx"
+	"git.pnhub.ru/core/libs/util"
+)
+
+type CDCConfig struct {
+	// Key is db key in Selector(default DefaultDBKey)
+	Key string `json:"key" yaml:"key"`
+	// Slot is logical replication slot, it is created with pgoutput plugin if it does not exist
+	Slot string `json:"slot" yaml:"slot"`
+	// Publication is publication of replicated tables, it is created for Tables(all tables if empty) if it does not exist
+	Publication string   `json:"publication" yaml:"publication"`
+	Tables      []string `json:"tables" yaml:"tables"`
+	// StatusInterval is period of standby status updates to server(default 10s)
+	StatusInterval time.Duration `json:"status_interval" yaml:"status_interval"`
+	// Reconnect is backoff between reconnects after connection loss or handler error
+	Reconnect util.Backoff `json:"reconnect" yaml:"reconnect"`
+}
+
+// LSN is postgres WAL position
+type LSN uint64
+
+// ParseLSN parse LSN in X/X format
+func ParseLSN(s string) (LSN, error) {
+	var hi, lo uint32
+	_, err := fmt.Sscanf(s, "%X/%X", &hi, &lo)
+	if err != nil {
+		return 0, fmt.Errorf("bad lsn %q: %v", s, err)
+	}
+	return LSN(uint64(hi)<<32 | uint64(lo)), nil
+}
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
+
+func (l LSN) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+type ChangeKind string
+
+const (
+	ChangeInsert   ChangeKind = "insert"
+	ChangeUpdate   ChangeKind = "update"
+	ChangeDelete   ChangeKind = "delete"
+	ChangeTruncate ChangeKind = "truncate"
+)
+
+// Change is change of one row(or truncate of table) decoded from pgoutput
+type Change struct {
+	Kind   ChangeKind `json:"kind"`
+	Schema string     `json:"schema"`
+	Table  string     `json:"table"`
+	// Columns are new values of insert and update. Unchanged toasted values are not sent by server and absent.
+	Columns map[string]interface{} `json:"columns,omitempty"`
+	// Old are key columns(or whole row with REPLICA IDENTITY FULL) of update and delete
+	Old        map[string]interface{} `json:"old,omitempty"`
+	XID        uint32                 `json:"xid"`
+	LSN        LSN                    `json:"lsn"`
+	CommitTime time.Time              `json:"commit_time"`
+}
+
+// CDCTransaction is committed transaction with its changes
+type CDCTransaction struct {
+	XID uint32
+	// LSN is end of commit record, it is confirmed to server after handler succeeds
+	LSN        LSN
+	CommitTime time.Time
+	Changes    []*Change
+}
+
+// CDCHandler process committed transaction. Transaction is delivered again after reconnect if handler fails.
+type CDCHandler func(ctx context.Context, tx *CDCTransaction) error
+
+// CDCNotifier return handler which push each *Change to notifier
+func CDCNotifier(n *rx.Notifier) CDCHandler {
+	return func(ctx context.Context, tx *CDCTransaction) error {
+		for _, change := range tx.Changes {
+			n.Notify(change)
+		}
+		return nil
+	}
+}
+
+// MessageWriter is kafka writer(*kafka.Writer or *kfk.Writer)
+type MessageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// CDCWriter return handler which write changes of transaction to kafka as json, message key is schema.table
+func CDCWriter(w MessageWriter) CDCHandler {
+	return func(ctx context.Context, tx *CDCTransaction) error {
+		msgs := make([]kafka.Message, 0, len(tx.Changes))
+		for _, change := range tx.Changes {
+			data, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, kafka.Message{
+				Key:   []byte(change.Schema + "." + change.Table),
+				Value: data,
+				Time:  change.CommitTime,
+			})
+		}
+		return w.WriteMessages(ctx, msgs...)
+	}
+}
+
+// CDC read changes of postgres with logical replication(pgoutput plugin) and pass committed transactions to handler.
+// Position is confirmed to slot only after handler succeeds, so restart resumes from last handled transaction.
+type CDC struct {
+	ctx      context.Context
+	logger   log.Logger
+	selector *Selector
+	cfg      CDCConfig
+	handler  CDCHandler
+	connInfo *pgtype.ConnInfo
+
+	confirmed uint64
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewCDC(ctx context.Context, logger log.Logger, selector *Selector, cfg *CDCConfig, handler CDCHandler, lc fx.Lifecycle) (*CDC, error) {
+	if selector == nil {
+		return nil, fmt.Errorf("no db selector for cdc")
+	}
+	if handler == nil {
+		return nil, fmt.Errorf("no handler for cdc")
+	}
+	if cfg == nil || cfg.Slot == "" || cfg.Publication == "" {
+		return nil, fmt.Errorf("no slot or publication for cdc")
+	}
+	c := *cfg
+	if c.Key == "" {
+		c.Key = DefaultDBKey
+	}
+	if c.StatusInterval <= 0 {
+		c.StatusInterval = time.Second * 10
+	}
+	for _, r := range c.Slot {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')) {
+			return nil, fmt.Errorf("bad replication slot name %s", c.Slot)
+		}
+	}
+	cdc := &CDC{
+		ctx:      ctx,
+		logger:   log.ForkLogger(logger),
+		selector: selector,
+		cfg:      c,
+		handler:  handler,
+		connInfo: pgtype.NewConnInfo(),
+		done:     make(chan struct{}),
+	}
+	if lc != nil {
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				cdc.Start()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				return cdc.Stop(ctx)
+			},
+		})
+	}
+	return cdc, nil
+}
+
+// Confirmed return last position confirmed to server
+func (c *CDC) Confirmed() LSN {
+	return LSN(atomic.LoadUint64(&c.confirmed))
+}
+
+// Start run replication loop in background
+func (c *CDC) Start() {
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.cancel = cancel
+	go c.run(ctx)
+}
+
+// Stop stop replication loop and close connection
+func (c *CDC) Stop(ctx context.Context) error {
+	if c.cancel == nil {
+		return nil
+	}
+	c.cancel()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *CDC) run(ctx context.Context) {
+	defer close(c.done)
+	attempt := 0
+	for ctx.Err() == nil {
+		err := c.replicate(ctx, func() { attempt = 0 })
+		if ctx.Err() != nil {
+			return
+		}
+		c.logger.Warnf("cdc %s: replication is interrupted: %v", c.cfg.Slot, err)
+		if c.cfg.Reconnect.Wait(ctx, attempt) != nil {
+			return
+		}
+		attempt++
+	}
+}
+
+// replicate open replication connection, prepare publication and slot and stream changes until error or ctx is done
+func (c *CDC) replicate(ctx context.Context, connected func()) error {
+	cfg, err := c.selector.GetCfg(c.cfg.Key)
+	if err != nil {
+		return err
+	}
+	connCfg, err := pgconn.ParseConfig(cfg.FormatDriver())
+	if err != nil {
+		return err
+	}
+	connCfg.RuntimeParams["replication"] = "database"
+	conn, err := pgconn.ConnectConfig(ctx, connCfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_ = conn.Close(closeCtx)
+	}()
+
+	err = c.prepare(ctx, conn)
+	if err != nil {
+		return err
+	}
+	err = c.startReplication(ctx, conn)
+	if err != nil {
+		return err
+	}
+	connected()
+	c.logger.Infof("cdc %s: replication is started", c.cfg.Slot)
+	return c.stream(ctx, conn)
+}
+
+// prepare create publication and slot if they do not exist
+func (c *CDC) prepare(ctx context.Context, conn *pgconn.PgConn) error {
+	res, err := conn.Exec(ctx, "SELECT 1 FROM pg_publication WHERE pubname = "+quoteLiteral(c.cfg.Publication)).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 || len(res[0].Rows) == 0 {
+		target := "ALL TABLES"
+		if len(c.cfg.Tables) > 0 {
+			tables := make([]string, len(c.cfg.Tables))
+			for i, table := range c.cfg.Tables {
+				tables[i] = pgx.Identifier(strings.Split(table, ".")).Sanitize()
+			}
+			target = "TABLE " + strings.Join(tables, ", ")
+		}
+		_, err = conn.Exec(ctx, fmt.Sprintf("CREATE PUBLICATION %s FOR %s",
+			pgx.Identifier{c.cfg.Publication}.Sanitize(), target)).ReadAll()
+		if err != nil {
+			return fmt.Errorf("create publication %s: %v", c.cfg.Publication, err)
+		}
+		c.logger.Infof("cdc: publication %s is created for %s", c.cfg.Publication, target)
+	}
+
+	_, err = conn.Exec(ctx, fmt.Sprintf("CREATE_REPLICATION_SLOT %s LOGICAL pgoutput NOEXPORT_SNAPSHOT", c.cfg.Slot)).ReadAll()
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "42710" {
+			return nil // slot exists
+		}
+		return fmt.Errorf("create replication slot %s: %v", c.cfg.Slot, err)
+	}
+	c.logger.Infof("cdc: replication slot %s is created", c.cfg.Slot)
+	return nil
+}
+
+// startReplication start streaming from confirmed position of slot
+func (c *CDC) startReplication(ctx context.Context, conn *pgconn.PgConn) error {
+	query := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL 0/0 (proto_version '1', publication_names %s)",
+		c.cfg.Slot, quoteLiteral(c.cfg.Publication))
+	err := conn.SendBytes(ctx, (&pgproto3.Query{String: query}).Encode(nil))
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+}
+
+// cdcRelation is table description sent by server before its first change
+type cdcRelation struct {
+	schema  string
+	table   string
+	columns []cdcColumn
+}
+
+type cdcColumn struct {
+	name string
+	oid  uint32
+}
+
+// cdcStream is state of replication stream
+type cdcStream struct {
+	relations map[uint32]*cdcRelation
+	tx        *CDCTransaction
+	serverEnd LSN
+}
+
+func (c *CDC) stream(ctx context.Context, conn *pgconn.PgConn) error {
+	s := &cdcStream{relations: make(map[uint32]*cdcRelation)}
+	nextStatus := time.Now()
+	for {
+		if !time.Now().Before(nextStatus) {
+			err := c.sendStatus(ctx, conn)
+			if err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(c.cfg.StatusInterval)
+		}
+		// receive is interrupted for status update, pgconn keeps connection on deadline
+		recvCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && pgconn.Timeout(err) {
+				continue
+			}
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			reply, err := c.handleCopyData(ctx, s, msg.Data)
+			if err != nil {
+				return err
+			}
+			if reply {
+				nextStatus = time.Now()
+			}
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyDone:
+			return fmt.Errorf("replication stream is closed by server")
+		}
+	}
+}
+
+// handleCopyData process keepalive or wal data message, return true if server requests status reply
+func (c *CDC) handleCopyData(ctx context.Context, s *cdcStream, data []byte) (bool, error) {
+	r := &walReader{buf: data}
+	switch r.byte() {
+	case 'k':
+		s.serverEnd = LSN(r.uint64())
+		r.uint64() // server time
+		reply := r.byte() == 1
+		if r.err != nil {
+			return false, r.err
+		}
+		if s.tx == nil && s.serverEnd > c.Confirmed() {
+			// all sent transactions are handled, rest of wal is not published
+			c.confirm(s.serverEnd)
+		}
+		c.metrics().Gauge("cdc_lag_bytes").Update(float64(s.serverEnd - c.Confirmed()))
+		return reply, nil
+	case 'w':
+		r.uint64() // start of data
+		if end := LSN(r.uint64()); end > s.serverEnd {
+			s.serverEnd = end
+		}
+		r.uint64() // server time
+		if r.err != nil {
+			return false, r.err
+		}
+		return false, c.handleMessage(ctx, s, &walReader{buf: r.buf})
+	}
+	return false, nil
+}
+
+// handleMessage decode pgoutput message, committed transaction is passed to handler
+func (c *CDC) handleMessage(ctx context.Context, s *cdcStream, r *walReader) error {
+	switch r.byte() {
+	case 'B':
+		lsn := LSN(r.uint64())
+		commitTime := pgTime(int64(r.uint64()))
+		s.tx = &CDCTransaction{XID: r.uint32(), LSN: lsn, CommitTime: commitTime}
+	case 'C':
+		r.byte()   // flags
+		r.uint64() // commit lsn
+		end := LSN(r.uint64())
+		if r.err != nil {
+			return r.err
+		}
+		tx := s.tx
+		s.tx = nil
+		if tx == nil {
+			return fmt.Errorf("commit without begin at %s", end)
+		}
+		tx.LSN = end
+		return c.commit(ctx, tx)
+	case 'R':
+		id := r.uint32()
+		rel := &cdcRelation{schema: r.string(), table: r.string()}
+		r.byte() // replica identity
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			r.byte() // flags
+			col := cdcColumn{name: r.string(), oid: r.uint32()}
+			r.uint32() // type modifier
+			rel.columns = append(rel.columns, col)
+		}
+		s.relations[id] = rel
+	case 'I':
+		rel, err := s.relation(r.uint32())
+		if err != nil {
+			return err
+		}
+		r.byte() // 'N'
+		s.add(rel, &Change{Kind: ChangeInsert, Columns: c.tuple(r, rel, false)})
+	case 'U':
+		rel, err := s.relation(r.uint32())
+		if err != nil {
+			return err
+		}
+		change := &Change{Kind: ChangeUpdate}
+		kind := r.byte()
+		if kind == 'K' || kind == 'O' {
+			change.Old = c.tuple(r, rel, kind == 'K')
+			r.byte() // 'N'
+		}
+		change.Columns = c.tuple(r, rel, false)
+		s.add(rel, change)
+	case 'D':
+		rel, err := s.relation(r.uint32())
+		if err != nil {
+			return err
+		}
+		kind := r.byte()
+		s.add(rel, &Change{Kind: ChangeDelete, Old: c.tuple(r, rel, kind == 'K')})
+	case 'T':
+		n := int(r.uint32())
+		r.byte() // options
+		for i := 0; i < n && r.err == nil; i++ {
+			rel, err := s.relation(r.uint32())
+			if err != nil {
+				return err
+			}
+			s.add(rel, &Change{Kind: ChangeTruncate})
+		}
+	}
+	return r.err
+}
+
+func (s *cdcStream) relation(id uint32) (*cdcRelation, error) {
+	rel, ok := s.relations[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown relation %d", id)
+	}
+	return rel, nil
+}
+
+func (s *cdcStream) add(rel *cdcRelation, change *Change) {
+	change.Schema = rel.schema
+	change.Table = rel.table
+	if s.tx != nil {
+		change.XID = s.tx.XID
+		change.CommitTime = s.tx.CommitTime
+		s.tx.Changes = append(s.tx.Changes, change)
+	}
+}
+
+// commit pass transaction to handler and confirm its position
+func (c *CDC) commit(ctx context.Context, tx *CDCTransaction) error {
+	if len(tx.Changes) > 0 {
+		for _, change := range tx.Changes {
+			change.LSN = tx.LSN
+		}
+		err := c.handler(ctx, tx)
+		if err != nil {
+			c.metrics().Counter("cdc_handler_errors").Inc(1)
+			return fmt.Errorf("handle transaction %d at %s: %v", tx.XID, tx.LSN, err)
+		}
+		c.metrics().Counter("cdc_changes").Inc(int64(len(tx.Changes)))
+		c.metrics().Counter("cdc_transactions").Inc(1)
+	}
+	c.confirm(tx.LSN)
+	return nil
+}
+
+func (c *CDC) confirm(lsn LSN) {
+	atomic.StoreUint64(&c.confirmed, uint64(lsn))
+}
+
+// tuple decode tuple data to values by column names, nulls of not key columns are skipped in key tuple
+func (c *CDC) tuple(r *walReader, rel *cdcRelation, key bool) map[string]interface{} {
+	n := int(r.uint16())
+	out := make(map[string]interface{}, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		var col cdcColumn
+		if i < len(rel.columns) {
+			col = rel.columns[i]
+		} else {
+			col.name = fmt.Sprintf("column%d", i+1)
+		}
+		switch r.byte() {
+		case 'n':
+			if !key {
+				out[col.name] = nil
+			}
+		case 't':
+			data := r.bytes(int(r.uint32()))
+			out[col.name] = c.decodeValue(col.oid, data)
+		}
+		// 'u' is unchanged toasted value which is not sent
+	}
+	return out
+}
+
+// decodeValue decode text value of type oid, value of unknown type is string
+func (c *CDC) decodeValue(oid uint32, data []byte) interface{} {
+	dt, ok := c.connInfo.DataTypeForOID(oid)
+	if !ok {
+		return string(data)
+	}
+	v := reflect.New(reflect.TypeOf(dt.Value).Elem()).Interface()
+	decoder, ok := v.(pgtype.TextDecoder)
+	if !ok {
+		return string(data)
+	}
+	if err := decoder.DecodeText(c.connInfo, data); err != nil {
+		return string(data)
+	}
+	return v.(pgtype.Value).Get()
+}
+
+// sendStatus send standby status update with confirmed position
+func (c *CDC) sendStatus(ctx context.Context, conn *pgconn.PgConn) error {
+	lsn := uint64(c.Confirmed())
+	buf := make([]byte, 34)
+	buf[0] = 'r'
+	binary.BigEndian.PutUint64(buf[1:], lsn)  // written
+	binary.BigEndian.PutUint64(buf[9:], lsn)  // flushed
+	binary.BigEndian.PutUint64(buf[17:], lsn) // applied
+	binary.BigEndian.PutUint64(buf[25:], uint64(time.Since(pgEpoch)/time.Microsecond))
+	return conn.SendBytes(ctx, (&pgproto3.CopyData{Data: buf}).Encode(nil))
+}
+
+func (c *CDC) metrics() tally.Scope {
+	scope := c.selector.metrics.Scope()
+	if scope == nil {
+		return tally.NoopScope
+	}
+	return scope.Tagged(map[string]string{"db": c.cfg.Key, "slot": c.cfg.Slot})
+}
+
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// pgTime convert microseconds since 2000-01-01 to time
+func pgTime(us int64) time.Time {
+	return pgEpoch.Add(time.Duration(us) * time.Microsecond)
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// walReader read big endian values of replication message, first error is kept and zero values are returned after it
+type walReader struct {
+	buf []byte
+	err error
+}
+
+func (r *walReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = fmt.Errorf("short replication message")
+		return nil
+	}
+	out := r.buf[:n]
+	r.buf = r.buf[n:]
+	return out
+}
+
+func (r *walReader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *walReader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *walReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *walReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *walReader) bytes(n int) []byte {
+	b := r.next(n)
+	if b == nil {
+		return nil
+	}
+	out := make([]byte, n)
+	copy(out, b)
+	return out
+}
+
+// string read null terminated string
+func (r *walReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	i := 0
+	for i < len(r.buf) && r.buf[i] != 0 {
+		i++
+	}
+	if i == len(r.buf) {
+		r.err = fmt.Errorf("short replication message")
+		return ""
+	}
+	s := string(r.buf[:i])
+	r.buf = r.buf[i+1:]
+	return s
+}
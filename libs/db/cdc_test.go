@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		in  string
+		lsn LSN
+		err bool
+	}{
+		{in: "0/0", lsn: 0},
+		{in: "0/16B3748", lsn: 0x16B3748},
+		{in: "1/0", lsn: 1 << 32},
+		{in: "FFFFFFFF/FFFFFFFF", lsn: LSN(^uint64(0))},
+		{in: "16/B374D848", lsn: 0x16B374D848},
+		{in: "", err: true},
+		{in: "16", err: true},
+		{in: "x/1", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			lsn, err := ParseLSN(tt.in)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.lsn, lsn)
+			assert.Equal(t, tt.in, lsn.String())
+		})
+	}
+}
+
+// walBuilder build big endian pgoutput messages
+type walBuilder []byte
+
+func (b walBuilder) byte(v byte) walBuilder {
+	return append(b, v)
+}
+
+func (b walBuilder) uint16(v uint16) walBuilder {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func (b walBuilder) uint32(v uint32) walBuilder {
+	out := make([]byte, 4)
+	binary.BigEndian.PutUint32(out, v)
+	return append(b, out...)
+}
+
+func (b walBuilder) uint64(v uint64) walBuilder {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, v)
+	return append(b, out...)
+}
+
+func (b walBuilder) string(v string) walBuilder {
+	return append(append(b, v...), 0)
+}
+
+// tuple add tuple data, nil value is null, "\x00" is unchanged toasted value
+func (b walBuilder) tuple(values ...interface{}) walBuilder {
+	b = b.uint16(uint16(len(values)))
+	for _, v := range values {
+		switch v {
+		case nil:
+			b = b.byte('n')
+		case "\x00":
+			b = b.byte('u')
+		default:
+			s := fmt.Sprint(v)
+			b = b.byte('t').uint32(uint32(len(s)))
+			b = append(b, s...)
+		}
+	}
+	return b
+}
+
+func testRelation(id uint32) walBuilder {
+	return walBuilder{}.byte('R').uint32(id).string("public").string("users").byte('d').uint16(3).
+		byte(1).string("id").uint32(pgtype.Int8OID).uint32(0).
+		byte(0).string("name").uint32(pgtype.TextOID).uint32(0).
+		byte(0).string("active").uint32(pgtype.BoolOID).uint32(0)
+}
+
+func newTestCDC(handler CDCHandler) *CDC {
+	return &CDC{
+		selector: &Selector{},
+		cfg:      CDCConfig{Key: DefaultDBKey, Slot: "test"},
+		handler:  handler,
+		connInfo: pgtype.NewConnInfo(),
+	}
+}
+
+func TestCDCHandleMessage(t *testing.T) {
+	commitTime := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	begin := walBuilder{}.byte('B').uint64(0x100).uint64(uint64(commitTime.Sub(pgEpoch) / time.Microsecond)).uint32(42)
+	commit := walBuilder{}.byte('C').byte(0).uint64(0x100).uint64(0x200).uint64(0)
+
+	tests := []struct {
+		name     string
+		messages []walBuilder
+		changes  []*Change
+		err      bool
+	}{
+		{
+			name: "insert",
+			messages: []walBuilder{
+				testRelation(1), begin,
+				walBuilder{}.byte('I').uint32(1).byte('N').tuple(1, "alice", "t"),
+				commit,
+			},
+			changes: []*Change{
+				{Kind: ChangeInsert, Columns: map[string]interface{}{"id": int64(1), "name": "alice", "active": true}},
+			},
+		},
+		{
+			name: "update with key and toasted value",
+			messages: []walBuilder{
+				testRelation(1), begin,
+				walBuilder{}.byte('U').uint32(1).byte('K').tuple(1, nil, nil).byte('N').tuple(2, "\x00", nil),
+				commit,
+			},
+			changes: []*Change{
+				{
+					Kind:    ChangeUpdate,
+					Old:     map[string]interface{}{"id": int64(1)},
+					Columns: map[string]interface{}{"id": int64(2), "active": nil},
+				},
+			},
+		},
+		{
+			name: "update without old tuple",
+			messages: []walBuilder{
+				testRelation(1), begin,
+				walBuilder{}.byte('U').uint32(1).byte('N').tuple(1, "bob", "f"),
+				commit,
+			},
+			changes: []*Change{
+				{Kind: ChangeUpdate, Columns: map[string]interface{}{"id": int64(1), "name": "bob", "active": false}},
+			},
+		},
+		{
+			name: "delete with full identity",
+			messages: []walBuilder{
+				testRelation(1), begin,
+				walBuilder{}.byte('D').uint32(1).byte('O').tuple(1, "alice", nil),
+				commit,
+			},
+			changes: []*Change{
+				{Kind: ChangeDelete, Old: map[string]interface{}{"id": int64(1), "name": "alice", "active": nil}},
+			},
+		},
+		{
+			name: "truncate",
+			messages: []walBuilder{
+				testRelation(1), begin,
+				walBuilder{}.byte('T').uint32(1).byte(0).uint32(1),
+				commit,
+			},
+			changes: []*Change{{Kind: ChangeTruncate}},
+		},
+		{
+			name: "unknown relation",
+			messages: []walBuilder{
+				begin,
+				walBuilder{}.byte('I').uint32(7).byte('N').tuple(1),
+			},
+			err: true,
+		},
+		{
+			name: "commit without begin",
+			messages: []walBuilder{
+				commit,
+			},
+			err: true,
+		},
+		{
+			name: "short message",
+			messages: []walBuilder{
+				walBuilder{}.byte('B').uint32(1),
+			},
+			err: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handled []*CDCTransaction
+			c := newTestCDC(func(ctx context.Context, tx *CDCTransaction) error {
+				handled = append(handled, tx)
+				return nil
+			})
+			s := &cdcStream{relations: make(map[uint32]*cdcRelation)}
+			var err error
+			for _, msg := range tt.messages {
+				err = c.handleMessage(context.Background(), s, &walReader{buf: msg})
+				if err != nil {
+					break
+				}
+			}
+			if tt.err {
+				assert.Error(t, err)
+				assert.Empty(t, handled)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, handled, 1)
+			tx := handled[0]
+			assert.Equal(t, uint32(42), tx.XID)
+			assert.Equal(t, LSN(0x200), tx.LSN)
+			assert.True(t, commitTime.Equal(tx.CommitTime))
+			assert.Equal(t, LSN(0x200), c.Confirmed())
+			require.Len(t, tx.Changes, len(tt.changes))
+			for i, want := range tt.changes {
+				got := tx.Changes[i]
+				assert.Equal(t, want.Kind, got.Kind)
+				assert.Equal(t, "public", got.Schema)
+				assert.Equal(t, "users", got.Table)
+				assert.Equal(t, want.Columns, got.Columns)
+				assert.Equal(t, want.Old, got.Old)
+				assert.Equal(t, uint32(42), got.XID)
+				assert.Equal(t, LSN(0x200), got.LSN)
+			}
+		})
+	}
+}
+
+func TestCDCHandlerError(t *testing.T) {
+	c := newTestCDC(func(ctx context.Context, tx *CDCTransaction) error {
+		return fmt.Errorf("fail")
+	})
+	c.confirm(0x50)
+	s := &cdcStream{relations: make(map[uint32]*cdcRelation)}
+	messages := []walBuilder{
+		testRelation(1),
+		walBuilder{}.byte('B').uint64(0x100).uint64(0).uint32(1),
+		walBuilder{}.byte('I').uint32(1).byte('N').tuple(1, "a", "t"),
+		walBuilder{}.byte('C').byte(0).uint64(0x100).uint64(0x200).uint64(0),
+	}
+	var err error
+	for _, msg := range messages {
+		err = c.handleMessage(context.Background(), s, &walReader{buf: msg})
+		if err != nil {
+			break
+		}
+	}
+	assert.Error(t, err)
+	assert.Equal(t, LSN(0x50), c.Confirmed(), "position of failed transaction must not be confirmed")
+}
+
+func TestCDCHandleKeepalive(t *testing.T) {
+	c := newTestCDC(func(ctx context.Context, tx *CDCTransaction) error { return nil })
+	s := &cdcStream{relations: make(map[uint32]*cdcRelation)}
+
+	reply, err := c.handleCopyData(context.Background(), s, walBuilder{}.byte('k').uint64(0x300).uint64(0).byte(1))
+	require.NoError(t, err)
+	assert.True(t, reply)
+	assert.Equal(t, LSN(0x300), c.Confirmed(), "idle stream position is confirmed")
+
+	s.tx = &CDCTransaction{XID: 1}
+	reply, err = c.handleCopyData(context.Background(), s, walBuilder{}.byte('k').uint64(0x400).uint64(0).byte(0))
+	require.NoError(t, err)
+	assert.False(t, reply)
+	assert.Equal(t, LSN(0x300), c.Confirmed(), "position inside open transaction is not confirmed")
+
+	_, err = c.handleCopyData(context.Background(), s, walBuilder{}.byte('k').uint32(1))
+	assert.Error(t, err)
+}
+
+func TestWalReader(t *testing.T) {
+	r := &walReader{buf: walBuilder{}.byte(1).uint16(2).uint32(3).uint64(4).string("abc").byte('x')}
+	assert.Equal(t, byte(1), r.byte())
+	assert.Equal(t, uint16(2), r.uint16())
+	assert.Equal(t, uint32(3), r.uint32())
+	assert.Equal(t, uint64(4), r.uint64())
+	assert.Equal(t, "abc", r.string())
+	assert.Equal(t, []byte("x"), r.bytes(1))
+	require.NoError(t, r.err)
+
+	assert.Equal(t, uint32(0), r.uint32())
+	assert.Error(t, r.err)
+	assert.Equal(t, byte(0), (&walReader{buf: []byte{}, err: r.err}).byte(), "zero value is returned after error")
+
+	r = &walReader{buf: []byte("abc")}
+	assert.Equal(t, "", r.string())
+	assert.Error(t, r.err, "string without terminator")
+
+	r = &walReader{buf: []byte("abc")}
+	assert.Nil(t, r.bytes(-1))
+	assert.Error(t, r.err)
+}
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/fx"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/metrics"
+	"git.pnhub.ru/core/libs/util"
+)
+
+// Overflow policies of ClickHouseBatcher
+const (
+	OverflowBlock = "block"
+	OverflowDrop  = "drop"
+)
+
+var ErrBatcherClosed = fmt.Errorf("clickhouse batcher is closed")
+
+type ClickHouseBatcherConfig struct {
+	// Key is db key in Selector(default DefaultDBKey)
+	Key           string        `json:"key" yaml:"key"`
+	BatchSize     int           `json:"batch_size" yaml:"batch_size"`
+	FlushInterval time.Duration `json:"flush_interval" yaml:"flush_interval"`
+	// BufferSize is max rows waiting for flush per table
+	BufferSize int `json:"buffer_size" yaml:"buffer_size"`
+	// Overflow is reaction on full buffer: block(default) waits for space, drop drops row and counts it
+	Overflow    string       `json:"overflow" yaml:"overflow"`
+	MaxAttempts int          `json:"max_attempts" yaml:"max_attempts"`
+	Backoff     util.Backoff `json:"backoff" yaml:"backoff"`
+}
+
+func (c *ClickHouseBatcherConfig) setDefaults() {
+	if c.Key == "" {
+		c.Key = DefaultDBKey
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 10000
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = c.BatchSize * 10
+	}
+	if c.Overflow == "" {
+		c.Overflow = OverflowBlock
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+}
+
+// ClickHouseBatcher buffer rows per table and insert them in batches with Begin/Prepare/Exec/Commit protocol.
+// Batch is flushed when it reaches BatchSize or on FlushInterval, failed batch is retried with backoff.
+// Buffered rows are flushed on fx stop.
+type ClickHouseBatcher struct {
+	ctx      context.Context
+	logger   log.Logger
+	selector *Selector
+	cfg      ClickHouseBatcherConfig
+
+	mx       sync.RWMutex
+	closed   bool
+	tables   map[string]*ClickHouseTable
+	inflight sync.WaitGroup
+	stop     chan struct{}
+	drain    chan struct{}
+	workers  sync.WaitGroup
+	// flushCtx is context of Close, it limits retries of final flush
+	flushCtx context.Context
+}
+
+func NewClickHouseBatcher(ctx context.Context, logger log.Logger, selector *Selector, cfg *ClickHouseBatcherConfig, lc fx.Lifecycle) (*ClickHouseBatcher, error) {
+	if selector == nil {
+		return nil, fmt.Errorf("no db selector for clickhouse batcher")
+	}
+	c := ClickHouseBatcherConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	c.setDefaults()
+	b := &ClickHouseBatcher{
+		ctx:      ctx,
+		logger:   log.ForkLogger(logger),
+		selector: selector,
+		cfg:      c,
+		tables:   make(map[string]*ClickHouseTable),
+		stop:     make(chan struct{}),
+		drain:    make(chan struct{}),
+	}
+	if lc != nil {
+		lc.Append(fx.Hook{
+			OnStop: func(ctx context.Context) error {
+				b.logger.Info("flushing clickhouse batches")
+				return b.Close(ctx)
+			},
+		})
+	}
+	return b, nil
+}
+
+// ClickHouseTable is buffer of rows for one table and columns set
+type ClickHouseTable struct {
+	batcher *ClickHouseBatcher
+	name    string
+	query   string
+	rows    chan []interface{}
+}
+
+// Table return buffer for table with columns. Buffer is created on first call for table and columns set
+// and its worker is started.
+func (b *ClickHouseBatcher) Table(name string, columns ...string) *ClickHouseTable {
+	key := name + "(" + strings.Join(columns, ",") + ")"
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if t, ok := b.tables[key]; ok {
+		return t
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	t := &ClickHouseTable{
+		batcher: b,
+		name:    name,
+		query:   fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", name, strings.Join(columns, ", "), placeholders),
+		rows:    make(chan []interface{}, b.cfg.BufferSize),
+	}
+	b.tables[key] = t
+	if !b.closed {
+		b.workers.Add(1)
+		go t.process()
+	}
+	return t
+}
+
+// Insert add row to buffer. With block overflow it waits for space until ctx is done,
+// with drop overflow row is dropped if buffer is full.
+func (t *ClickHouseTable) Insert(ctx context.Context, values ...interface{}) error {
+	b := t.batcher
+	b.mx.RLock()
+	if b.closed {
+		b.mx.RUnlock()
+		return ErrBatcherClosed
+	}
+	b.inflight.Add(1)
+	b.mx.RUnlock()
+	defer b.inflight.Done()
+
+	if b.cfg.Overflow == OverflowDrop {
+		select {
+		case t.rows <- values:
+		default:
+			t.metrics().Counter("dropped_rows").Inc(1)
+		}
+		return nil
+	}
+	select {
+	case t.rows <- values:
+		return nil
+	case <-b.stop:
+		return ErrBatcherClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stop accepting rows and flush buffered rows until ctx is done
+func (b *ClickHouseBatcher) Close(ctx context.Context) error {
+	b.mx.Lock()
+	if b.closed {
+		b.mx.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mx.Unlock()
+	close(b.stop)
+	b.inflight.Wait()
+	b.flushCtx = ctx
+	close(b.drain)
+
+	done := make(chan struct{})
+	go func() {
+		b.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("clickhouse batcher is not flushed: %v", ctx.Err())
+	}
+}
+
+func (t *ClickHouseTable) metrics() tally.Scope {
+	scope := t.batcher.selector.metrics.Scope()
+	if scope == nil {
+		return tally.NoopScope
+	}
+	return scope.Tagged(map[string]string{"db": t.batcher.cfg.Key, "table": t.name})
+}
+
+func (t *ClickHouseTable) process() {
+	b := t.batcher
+	defer b.workers.Done()
+	ticker := time.NewTicker(b.cfg.FlushInterval)
+	defer ticker.Stop()
+	batch := make([][]interface{}, 0, b.cfg.BatchSize)
+	for {
+		select {
+		case row := <-t.rows:
+			batch = append(batch, row)
+			if len(batch) >= b.cfg.BatchSize {
+				batch = t.flush(batch, false)
+			}
+		case <-ticker.C:
+			batch = t.flush(batch, false)
+		case <-b.drain:
+			for {
+				select {
+				case row := <-t.rows:
+					batch = append(batch, row)
+					if len(batch) >= b.cfg.BatchSize {
+						batch = t.flush(batch, true)
+					}
+				default:
+					t.flush(batch, true)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush insert batch with retries, batch is dropped after MaxAttempts failures
+func (t *ClickHouseTable) flush(batch [][]interface{}, final bool) [][]interface{} {
+	if len(batch) == 0 {
+		return batch
+	}
+	b := t.batcher
+	scope := t.metrics()
+	var err error
+	for attempt := 0; attempt < b.cfg.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			scope.Counter("retries").Inc(1)
+			if b.backoff(attempt-1, final) != nil {
+				break
+			}
+		}
+		start := time.Now()
+		err = t.insert(batch)
+		scope.Histogram("flush_latency", metrics.DefaultBuckets()).RecordDuration(time.Since(start))
+		if err == nil {
+			scope.Counter("batches").Inc(1)
+			scope.Counter("rows").Inc(int64(len(batch)))
+			return batch[:0]
+		}
+		b.logger.Warnf("clickhouse batch insert to %s failed(attempt %d/%d): %v", t.name, attempt+1, b.cfg.MaxAttempts, err)
+	}
+	scope.Counter("failed_batches").Inc(1)
+	scope.Counter("dropped_rows").Inc(int64(len(batch)))
+	b.logger.Error(fmt.Errorf("clickhouse batch of %d rows to %s is dropped: %v", len(batch), t.name, err))
+	return batch[:0]
+}
+
+// backoff wait before retry. Wait is interrupted by batcher context, on final flush by context of Close.
+func (b *ClickHouseBatcher) backoff(attempt int, final bool) error {
+	if final {
+		return b.cfg.Backoff.Wait(b.flushCtx, attempt)
+	}
+	return b.cfg.Backoff.Wait(b.ctx, attempt)
+}
+
+func (t *ClickHouseTable) insert(batch [][]interface{}) error {
+	db, err := t.batcher.selector.GetDB(t.batcher.cfg.Key)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(t.query)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, row := range batch {
+		_, err = stmt.Exec(row...)
+		if err != nil {
+			_ = stmt.Close()
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	err = stmt.Close()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
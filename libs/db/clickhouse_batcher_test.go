@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"git.pnhub.ru/core/libs/util"
+)
+
+// counter return sum of counters with name for all tags
+func counter(scope tally.TestScope, name string) int64 {
+	var sum int64
+	for _, c := range scope.Snapshot().Counters() {
+		if c.Name() == name {
+			sum += c.Value()
+		}
+	}
+	return sum
+}
+
+func newTestBatcher(t *testing.T, f *fakeDB, cfg *ClickHouseBatcherConfig) (*ClickHouseBatcher, tally.TestScope) {
+	d := f.selector()
+	scope := tally.NewTestScope("", nil)
+	d.metrics.SetScope(scope)
+	b, err := NewClickHouseBatcher(context.Background(), d.logger, d, cfg, nil)
+	require.NoError(t, err)
+	return b, scope
+}
+
+func TestClickHouseBatcherFlush(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return nil, nil
+	})
+	b, scope := newTestBatcher(t, f, &ClickHouseBatcherConfig{BatchSize: 2, FlushInterval: time.Hour})
+	events := b.Table("events", "id", "name")
+	assert.Same(t, events, b.Table("events", "id", "name"))
+
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, events.Insert(ctx, i, "created"))
+	}
+	require.Eventually(t, func() bool {
+		return len(f.statements("COMMIT")) == 1
+	}, time.Second, time.Millisecond, "full batch is flushed")
+	assert.Len(t, f.statements("INSERT INTO events (id, name) VALUES (?, ?)"), 2)
+
+	require.NoError(t, b.Close(ctx))
+	inserts := f.statements("INSERT")
+	require.Len(t, inserts, 3, "rest of rows is flushed on close")
+	assert.Equal(t, []interface{}{int64(3), "created"}, inserts[2].args)
+	assert.Equal(t, int64(2), counter(scope, "batches"))
+	assert.Equal(t, int64(3), counter(scope, "rows"))
+
+	assert.Equal(t, ErrBatcherClosed, events.Insert(ctx, 4, "created"))
+	assert.NoError(t, b.Close(ctx))
+}
+
+func TestClickHouseBatcherColumns(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return nil, nil
+	})
+	b, _ := newTestBatcher(t, f, &ClickHouseBatcherConfig{FlushInterval: time.Hour})
+	ctx := context.Background()
+	require.NoError(t, b.Table("events", "id").Insert(ctx, 1))
+	require.NoError(t, b.Table("events", "id", "name").Insert(ctx, 2, "created"))
+	require.NoError(t, b.Close(ctx))
+	assert.Len(t, f.statements("INSERT INTO events (id) VALUES (?)"), 1)
+	assert.Len(t, f.statements("INSERT INTO events (id, name) VALUES (?, ?)"), 1, "tables with other columns have own buffers")
+}
+
+func TestClickHouseBatcherRetry(t *testing.T) {
+	var fails int32 = 1
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if strings.HasPrefix(query, "INSERT") && atomic.AddInt32(&fails, -1) >= 0 {
+			return nil, errors.New("too many parts")
+		}
+		return nil, nil
+	})
+	b, scope := newTestBatcher(t, f, &ClickHouseBatcherConfig{
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		MaxAttempts:   2,
+		Backoff:       util.Backoff{Min: time.Millisecond, Max: time.Millisecond},
+	})
+	ctx := context.Background()
+	require.NoError(t, b.Table("events", "id").Insert(ctx, 1))
+	require.Eventually(t, func() bool {
+		return counter(scope, "batches") == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int64(1), counter(scope, "retries"))
+	assert.Len(t, f.statements("ROLLBACK"), 1)
+
+	// batch is dropped after attempts
+	atomic.StoreInt32(&fails, 2)
+	require.NoError(t, b.Table("events", "id").Insert(ctx, 2))
+	require.NoError(t, b.Close(ctx))
+	assert.Equal(t, int64(1), counter(scope, "failed_batches"))
+	assert.Equal(t, int64(1), counter(scope, "dropped_rows"))
+}
+
+func TestClickHouseBatcherDrop(t *testing.T) {
+	flushing := make(chan struct{})
+	release := make(chan struct{})
+	var first int32
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if strings.HasPrefix(query, "INSERT") && atomic.CompareAndSwapInt32(&first, 0, 1) {
+			close(flushing)
+			<-release
+		}
+		return nil, nil
+	})
+	b, scope := newTestBatcher(t, f, &ClickHouseBatcherConfig{BatchSize: 1, BufferSize: 1, FlushInterval: time.Hour, Overflow: OverflowDrop})
+	events := b.Table("events", "id")
+	ctx := context.Background()
+	require.NoError(t, events.Insert(ctx, 1))
+	<-flushing
+	require.NoError(t, events.Insert(ctx, 2))
+	require.NoError(t, events.Insert(ctx, 3), "row is dropped without error")
+	assert.Equal(t, int64(1), counter(scope, "dropped_rows"))
+
+	close(release)
+	require.NoError(t, b.Close(ctx))
+	assert.Len(t, f.statements("INSERT"), 2)
+}
+
+func TestClickHouseBatcherCloseTimeout(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if strings.HasPrefix(query, "INSERT") {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	})
+	b, scope := newTestBatcher(t, f, &ClickHouseBatcherConfig{
+		FlushInterval: time.Hour,
+		Backoff:       util.Backoff{Min: time.Hour, Max: time.Hour},
+	})
+	require.NoError(t, b.Table("events", "id").Insert(context.Background(), 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	_ = b.Close(ctx)
+	done := make(chan struct{})
+	go func() {
+		b.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("final flush is not interrupted by close context")
+	}
+	assert.Equal(t, int64(1), counter(scope, "dropped_rows"))
+	assert.Len(t, f.statements("INSERT"), 1)
+}
@@ -2,10 +2,30 @@
 package db
 
 import (
-	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Postgres ssl modes
+const (
+	SslModeDisable    = "disable"
+	SslModeRequire    = "require"
+	SslModeVerifyCA   = "verify-ca"
+	SslModeVerifyFull = "verify-full"
+)
+
+// ClickHouse load balancing modes(connection_open_strategy of clickhouse-go)
+const (
+	LoadBalancingRandom     = "random"
+	LoadBalancingInOrder    = "in_order"
+	LoadBalancingTimeRandom = "time_random"
+)
+
 type SelectorConfig map[string]*Config
 
 type Config struct {
@@ -15,16 +35,91 @@ type Config struct {
 	Ssl                  bool              `json:"ssl" yaml:"ssl"`
 	PreferSimpleProtocol bool              `json:"prefer_simple_protocol" yaml:"prefer_simple_protocol"`
 	AdditionalParams     map[string]string `json:"additional_params" yaml:"additional_params"`
+	// SslMode is postgres sslmode: disable, require, verify-ca or verify-full. Ssl flag means require if it is not set.
+	SslMode     string `json:"ssl_mode" yaml:"ssl_mode"`
+	SslRootCert string `json:"ssl_root_cert" yaml:"ssl_root_cert"`
+	SslCert     string `json:"ssl_cert" yaml:"ssl_cert"`
+	SslKey      string `json:"ssl_key" yaml:"ssl_key"`
+	// ApplicationName is reported to postgres(default is binary name)
+	ApplicationName  string        `json:"application_name" yaml:"application_name"`
+	StatementTimeout time.Duration `json:"statement_timeout" yaml:"statement_timeout"`
+	SearchPath       string        `json:"search_path" yaml:"search_path"`
+	// Tenants have own schemas(TenantSchemaPrefix + tenant) with the same migrations. search_path is set to schema
+	// of tenant from context(tenant.FromContext) on connection acquire(pgx-native) and in transactions(sql.DB):
+	// RunInTx transactions or own transaction of each query of Node.Querier. SearchPath is shared part of tenant search_path.
+	Tenants            []string `json:"tenants" yaml:"tenants"`
+	TenantSchemaPrefix string   `json:"tenant_schema_prefix" yaml:"tenant_schema_prefix"`
 
 	Database string `json:"database" yaml:"database"`
 	Username string `json:"username" yaml:"username"`
 	Password string `json:"password" yaml:"password"`
 
+	// Hosts are other ClickHouse hosts(host:port) of cluster, connection is opened to one of Host and Hosts
+	// selected by LoadBalancing: random(default), in_order or time_random
+	Hosts         []string `json:"hosts" yaml:"hosts"`
+	LoadBalancing string   `json:"load_balancing" yaml:"load_balancing"`
+	// Cluster is ClickHouse cluster name, migrations table is replicated on cluster and ${cluster} in migrations is replaced by it
+	Cluster string `json:"cluster" yaml:"cluster"`
+	// SslSkipVerify disable server certificate verification, TLSConfig is name of config registered
+	// with clickhouse.RegisterTLSConfig(ClickHouse only)
+	SslSkipVerify bool   `json:"ssl_skip_verify" yaml:"ssl_skip_verify"`
+	TLSConfig     string `json:"tls_config" yaml:"tls_config"`
+
 	MaxOpenConns    int           `json:"max_open_conns" yaml:"max_open_conns"`
 	MaxConnLifetime time.Duration `json:"max_conn_lifetime" yaml:"max_conn_lifetime"`
 
+	// LogLevel is pgx log level(trace, debug, info, warn, error, none), default error
+	LogLevel string `json:"log_level" yaml:"log_level"`
+	// SlowQueryThreshold enable warning with sql of queries which take longer(pgx drivers only)
+	SlowQueryThreshold time.Duration `json:"slow_query_threshold" yaml:"slow_query_threshold"`
+
 	DesiredVersion int    `json:"desired_version" yaml:"desired_version"`
 	SQLDir         string `json:"sql_dir" yaml:"sql_dir"`
+	// MigrationsSource is name of in-binary migrations(RegisterMigrations) and Go migrations(RegisterGoMigration).
+	// Files from SQLDir are used instead of embedded files if dir is set.
+	MigrationsSource string `json:"migrations_source" yaml:"migrations_source"`
+	// Environment name, down migrations are refused in production(prod) unless AllowDownMigrations is set
+	Environment         string `json:"environment" yaml:"environment"`
+	AllowDownMigrations bool   `json:"allow_down_migrations" yaml:"allow_down_migrations"`
+	// ChecksumMode is reaction on changed applied migration file: warn(default), fail or off
+	ChecksumMode string `json:"checksum_mode" yaml:"checksum_mode"`
+	// SchemaSnapshot is file with expected schema, live schema is compared with it after migrations.
+	// SchemaDriftMode is reaction on difference: warn(default) or fail.
+	SchemaSnapshot  string `json:"schema_snapshot" yaml:"schema_snapshot"`
+	SchemaDriftMode string `json:"schema_drift_mode" yaml:"schema_drift_mode"`
+
+	// QueriesDir is directory with *.sql files of named queries(`-- name: GetUser` headers), QueriesSource is name
+	// of in-binary queries(RegisterQueries) which are used if dir is not set. Queries are validated with PREPARE on start,
+	// types of parameters without context are set in header(`-- name: GetUser(bigint)`).
+	QueriesDir    string `json:"queries_dir" yaml:"queries_dir"`
+	QueriesSource string `json:"queries_source" yaml:"queries_source"`
+
+	// Replicas are read only hosts of the same database, other settings are taken from primary config
+	Replicas             []*ReplicaConfig `json:"replicas" yaml:"replicas"`
+	ReplicaCheckInterval time.Duration    `json:"replica_check_interval" yaml:"replica_check_interval"`
+	MaxReplicationLag    time.Duration    `json:"max_replication_lag" yaml:"max_replication_lag"`
+
+	// HealthCheckInterval is period of primary ping, pool is re-created after HealthFailureThreshold failed pings in a row
+	HealthCheckInterval    time.Duration `json:"health_check_interval" yaml:"health_check_interval"`
+	HealthFailureThreshold int           `json:"health_failure_threshold" yaml:"health_failure_threshold"`
+}
+
+type ReplicaConfig struct {
+	Host string `json:"host" yaml:"host"`
+	Port int    `json:"port" yaml:"port"`
+}
+
+// ReplicaConfig return copy of primary config with replica host and port, migrations are disabled for replica
+func (c *Config) ReplicaConfig(r *ReplicaConfig) *Config {
+	out := *c
+	out.Host = r.Host
+	if r.Port > 0 {
+		out.Port = r.Port
+	}
+	out.Replicas = nil
+	out.Hosts = nil
+	out.DesiredVersion = 0
+	return &out
 }
 
 func (c *Config) FormatDriver() string {
@@ -34,26 +129,98 @@ func (c *Config) FormatDriver() string {
 	return c.DSNFormat()
 }
 
+// DSNFormat return postgres keyword/value DSN for pq, pgx and pgx-native drivers. Values are quoted and escaped,
+// AdditionalParams are passed as is and override generated params.
 func (c *Config) DSNFormat() string {
-	var sslmod string
+	params := map[string]string{
+		"host":             c.Host,
+		"port":             strconv.Itoa(c.Port),
+		"dbname":           c.Database,
+		"user":             c.Username,
+		"password":         c.Password,
+		"sslmode":          c.sslMode(),
+		"sslrootcert":      c.SslRootCert,
+		"sslcert":          c.SslCert,
+		"sslkey":           c.SslKey,
+		"application_name": c.ApplicationName,
+		"search_path":      c.SearchPath,
+	}
+	if params["application_name"] == "" {
+		params["application_name"] = filepath.Base(os.Args[0])
+	}
+	if c.StatementTimeout > 0 {
+		params["statement_timeout"] = strconv.FormatInt(int64(c.StatementTimeout/time.Millisecond), 10)
+	}
+	for k, v := range c.AdditionalParams {
+		params[k] = v
+	}
+
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+quoteDSNValue(params[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// sslMode return SslMode or mode by Ssl flag for configs without it
+func (c *Config) sslMode() string {
+	if c.SslMode != "" {
+		return c.SslMode
+	}
 	if c.Ssl {
-		sslmod = "enable"
-	} else {
-		sslmod = "disable"
+		return SslModeRequire
 	}
-	params := fmt.Sprintf(`host=%s port=%d dbname=%s user=%s password='%s' sslmode=%s`,
-		c.Host,
-		c.Port,
-		c.Database,
-		c.Username,
-		c.Password,
-		sslmod)
-	return params
+	return SslModeDisable
 }
 
+// quoteDSNValue quote value of keyword/value DSN with escaped backslashes and quotes
+func quoteDSNValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// URLFormat return clickhouse-go DSN with credentials, tls, cluster hosts and additional params
 func (c *Config) URLFormat() string {
-	params := fmt.Sprintf(`tcp://%s:%d`,
-		c.Host,
-		c.Port)
-	return params
+	query := url.Values{}
+	for k, v := range c.AdditionalParams {
+		query.Set(k, v)
+	}
+	if c.Database != "" {
+		query.Set("database", c.Database)
+	}
+	if c.Username != "" {
+		query.Set("username", c.Username)
+	}
+	if c.Password != "" {
+		query.Set("password", c.Password)
+	}
+	if c.Ssl {
+		query.Set("secure", "true")
+	}
+	if c.SslSkipVerify {
+		query.Set("skip_verify", "true")
+	}
+	if c.TLSConfig != "" {
+		query.Set("tls_config", c.TLSConfig)
+	}
+	if len(c.Hosts) > 0 {
+		query.Set("alt_hosts", strings.Join(c.Hosts, ","))
+	}
+	if c.LoadBalancing != "" {
+		query.Set("connection_open_strategy", c.LoadBalancing)
+	}
+	dsn := url.URL{
+		Scheme:   "tcp",
+		Host:     c.Host + ":" + strconv.Itoa(c.Port),
+		RawQuery: query.Encode(),
+	}
+	return dsn.String()
 }
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDSNFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		dsn  string
+	}{
+		{
+			name: "plain",
+			cfg:  Config{Host: "localhost", Port: 5432, Database: "app", Username: "user", Password: "pass", ApplicationName: "test"},
+			dsn:  "application_name='test' dbname='app' host='localhost' password='pass' port='5432' sslmode='disable' user='user'",
+		},
+		{
+			name: "escaped password",
+			cfg:  Config{Host: "localhost", Port: 5432, Password: `p a'ss\word`, ApplicationName: "test"},
+			dsn:  `application_name='test' host='localhost' password='p a\'ss\\word' port='5432' sslmode='disable'`,
+		},
+		{
+			name: "ssl flag",
+			cfg:  Config{Host: "db", Port: 5432, Ssl: true, ApplicationName: "test"},
+			dsn:  "application_name='test' host='db' port='5432' sslmode='require'",
+		},
+		{
+			name: "ssl mode over flag",
+			cfg:  Config{Host: "db", Port: 5432, Ssl: true, SslMode: SslModeVerifyFull, SslRootCert: "/ca.pem", ApplicationName: "test"},
+			dsn:  "application_name='test' host='db' port='5432' sslmode='verify-full' sslrootcert='/ca.pem'",
+		},
+		{
+			name: "statement timeout and search path",
+			cfg:  Config{Host: "db", Port: 5432, StatementTimeout: time.Second * 2, SearchPath: "app, public", ApplicationName: "test"},
+			dsn:  "application_name='test' host='db' port='5432' search_path='app, public' sslmode='disable' statement_timeout='2000'",
+		},
+		{
+			name: "additional params override",
+			cfg:  Config{Host: "db", Port: 5432, ApplicationName: "test", AdditionalParams: map[string]string{"sslmode": "prefer", "connect_timeout": "5"}},
+			dsn:  "application_name='test' connect_timeout='5' host='db' port='5432' sslmode='prefer'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.dsn, tt.cfg.DSNFormat())
+		})
+	}
+}
+
+func TestConfigDSNFormatParse(t *testing.T) {
+	cfg := Config{Host: "localhost", Port: 5433, Database: "my db", Username: "us'er", Password: `p a'ss\word =`, ApplicationName: "test"}
+	parsed, err := pgconn.ParseConfig(cfg.DSNFormat())
+	require.NoError(t, err)
+	assert.Equal(t, "localhost", parsed.Host)
+	assert.Equal(t, uint16(5433), parsed.Port)
+	assert.Equal(t, "my db", parsed.Database)
+	assert.Equal(t, "us'er", parsed.User)
+	assert.Equal(t, `p a'ss\word =`, parsed.Password)
+	assert.Nil(t, parsed.TLSConfig)
+}
+
+func TestConfigURLFormat(t *testing.T) {
+	cfg := Config{Driver: "clickhouse", Host: "ch1", Port: 9000}
+	assert.Equal(t, "tcp://ch1:9000", cfg.FormatDriver())
+
+	cfg = Config{
+		Driver:           "clickhouse",
+		Host:             "ch1",
+		Port:             9000,
+		Database:         "events",
+		Username:         "writer",
+		Password:         "p&ss=1",
+		Ssl:              true,
+		SslSkipVerify:    true,
+		TLSConfig:        "internal",
+		Hosts:            []string{"ch2:9000", "ch3:9000"},
+		LoadBalancing:    "in_order",
+		AdditionalParams: map[string]string{"read_timeout": "10", "database": "overridden"},
+	}
+	dsn, err := url.Parse(cfg.FormatDriver())
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", dsn.Scheme)
+	assert.Equal(t, "ch1:9000", dsn.Host)
+	assert.Equal(t, url.Values{
+		"database":                 {"events"},
+		"username":                 {"writer"},
+		"password":                 {"p&ss=1"},
+		"secure":                   {"true"},
+		"skip_verify":              {"true"},
+		"tls_config":               {"internal"},
+		"alt_hosts":                {"ch2:9000,ch3:9000"},
+		"connection_open_strategy": {"in_order"},
+		"read_timeout":             {"10"},
+	}, dsn.Query(), "fields of config override additional params")
+}
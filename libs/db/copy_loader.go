@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/util"
+)
+
+type CopyLoaderConfig struct {
+	// Table is target table(schema.table is allowed), Columns are columns of rows in order
+	Table     string   `json:"table" yaml:"table"`
+	Columns   []string `json:"columns" yaml:"columns"`
+	ChunkSize int      `json:"chunk_size" yaml:"chunk_size"`
+	// Staging copy chunk to temporary table and merge it to Table with INSERT ... ON CONFLICT(ConflictColumns).
+	// UpdateColumns are updated on conflict(default all not conflict columns), conflicting rows are skipped if list is empty.
+	Staging         bool     `json:"staging" yaml:"staging"`
+	ConflictColumns []string `json:"conflict_columns" yaml:"conflict_columns"`
+	UpdateColumns   []string `json:"update_columns" yaml:"update_columns"`
+	// RejectFile is json lines file for rows which failed to load, load fails on bad row if it is not set
+	RejectFile string `json:"reject_file" yaml:"reject_file"`
+}
+
+// CopyProgress is called after each chunk, mark counter is count of loaded rows
+type CopyProgress func(mark *util.TimeMark, rejected int64)
+
+// CopyResult is result of CopyLoader load
+type CopyResult struct {
+	Rows     int64
+	Rejected int64
+	Duration time.Duration
+}
+
+// CopyLoader stream rows to postgres with COPY in chunks. Chunk with bad rows is split to find them,
+// bad rows are written to reject file and other rows of chunk are loaded.
+type CopyLoader struct {
+	logger   log.Logger
+	pgx      *PGXNative
+	cfg      CopyLoaderConfig
+	table    pgx.Identifier
+	Progress CopyProgress
+
+	mx       sync.Mutex
+	rejects  *os.File
+	rejected int64
+}
+
+func NewCopyLoader(logger log.Logger, p *PGXNative, cfg *CopyLoaderConfig) (*CopyLoader, error) {
+	if p == nil {
+		return nil, fmt.Errorf("copy loader requires pgx-native db")
+	}
+	if cfg == nil || cfg.Table == "" || len(cfg.Columns) == 0 {
+		return nil, fmt.Errorf("no table or columns for copy loader")
+	}
+	c := *cfg
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = 10000
+	}
+	if c.Staging && len(c.ConflictColumns) == 0 {
+		return nil, fmt.Errorf("staging copy to %s requires conflict columns", c.Table)
+	}
+	if c.Staging && c.UpdateColumns == nil {
+		conflict := make(map[string]bool, len(c.ConflictColumns))
+		for _, col := range c.ConflictColumns {
+			conflict[col] = true
+		}
+		for _, col := range c.Columns {
+			if !conflict[col] {
+				c.UpdateColumns = append(c.UpdateColumns, col)
+			}
+		}
+	}
+	return &CopyLoader{
+		logger: log.ForkLogger(logger),
+		pgx:    p,
+		cfg:    c,
+		table:  pgx.Identifier(strings.Split(c.Table, ".")),
+	}, nil
+}
+
+// LoadChan load rows from channel until it is closed or ctx is done
+func (l *CopyLoader) LoadChan(ctx context.Context, rows <-chan []interface{}) (*CopyResult, error) {
+	return l.load(ctx, func() ([]interface{}, bool, error) {
+		select {
+		case row, ok := <-rows:
+			return row, ok, nil
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	})
+}
+
+// Load load rows of iterator(pgx.CopyFromRows, pgx.CopyFromSlice or own source)
+func (l *CopyLoader) Load(ctx context.Context, src pgx.CopyFromSource) (*CopyResult, error) {
+	return l.load(ctx, func() ([]interface{}, bool, error) {
+		if !src.Next() {
+			return nil, false, src.Err()
+		}
+		values, err := src.Values()
+		return values, err == nil, err
+	})
+}
+
+func (l *CopyLoader) load(ctx context.Context, next func() ([]interface{}, bool, error)) (*CopyResult, error) {
+	mark := util.NewTimeMark()
+	l.mx.Lock()
+	l.rejected = 0
+	l.mx.Unlock()
+	defer l.closeRejects()
+	chunk := make([][]interface{}, 0, l.cfg.ChunkSize)
+	flush := func() error {
+		loaded, err := l.loadChunk(ctx, chunk)
+		mark.Done(loaded)
+		chunk = chunk[:0]
+		if err != nil {
+			return err
+		}
+		if l.Progress != nil {
+			l.Progress(mark, l.rejectedCount())
+		}
+		return nil
+	}
+
+	for {
+		row, ok, err := next()
+		if err != nil {
+			return l.result(mark), err
+		}
+		if !ok {
+			break
+		}
+		chunk = append(chunk, row)
+		if len(chunk) >= l.cfg.ChunkSize {
+			if err = flush(); err != nil {
+				return l.result(mark), err
+			}
+		}
+	}
+	if len(chunk) > 0 {
+		if err := flush(); err != nil {
+			return l.result(mark), err
+		}
+	}
+	res := l.result(mark)
+	l.logger.Infof("copied %d rows to %s(rejected %d): %s", res.Rows, l.cfg.Table, res.Rejected, mark)
+	return res, nil
+}
+
+func (l *CopyLoader) result(mark *util.TimeMark) *CopyResult {
+	return &CopyResult{Rows: mark.Counter(), Rejected: l.rejectedCount(), Duration: mark.Check()}
+}
+
+// loadChunk copy rows, chunk failed with data error is split in halves until bad rows are found and rejected
+func (l *CopyLoader) loadChunk(ctx context.Context, rows [][]interface{}) (int64, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	n, err := l.copyRows(ctx, rows)
+	if err == nil {
+		return n, nil
+	}
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if l.cfg.RejectFile == "" || !isDataError(err) {
+		return 0, fmt.Errorf("copy to %s: %v", l.cfg.Table, err)
+	}
+	if len(rows) == 1 {
+		return 0, l.reject(rows[0], err)
+	}
+	half := len(rows) / 2
+	left, err := l.loadChunk(ctx, rows[:half])
+	if err != nil {
+		return left, err
+	}
+	right, err := l.loadChunk(ctx, rows[half:])
+	return left + right, err
+}
+
+// isDataError check that error is data exception(class 22) or integrity constraint violation(class 23) of row,
+// other errors(connection loss, etc.) are not caused by rows and are not rejected
+func isDataError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
+
+// copyRows copy rows in transaction directly or through staging table
+func (l *CopyLoader) copyRows(ctx context.Context, rows [][]interface{}) (int64, error) {
+	tx, err := l.pgx.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	target := l.table
+	if l.cfg.Staging {
+		target = pgx.Identifier{"copy_stage_" + strings.ReplaceAll(l.cfg.Table, ".", "_")}
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+			target.Sanitize(), l.table.Sanitize()))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := tx.CopyFrom(ctx, target, l.cfg.Columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return 0, err
+	}
+	if l.cfg.Staging {
+		_, err = tx.Exec(ctx, l.mergeQuery(target))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit(ctx)
+}
+
+func (l *CopyLoader) mergeQuery(stage pgx.Identifier) string {
+	columns := quoteIdentifiers(l.cfg.Columns)
+	action := "DO NOTHING"
+	if len(l.cfg.UpdateColumns) > 0 {
+		set := make([]string, len(l.cfg.UpdateColumns))
+		for i, col := range l.cfg.UpdateColumns {
+			c := pgx.Identifier{col}.Sanitize()
+			set[i] = c + " = EXCLUDED." + c
+		}
+		action = "DO UPDATE SET " + strings.Join(set, ", ")
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (%s) %s",
+		l.table.Sanitize(), columns, columns, stage.Sanitize(), quoteIdentifiers(l.cfg.ConflictColumns), action)
+}
+
+func quoteIdentifiers(names []string) string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = pgx.Identifier{name}.Sanitize()
+	}
+	return strings.Join(out, ", ")
+}
+
+type rejectedRow struct {
+	Table string        `json:"table"`
+	Error string        `json:"error"`
+	Row   []interface{} `json:"row"`
+}
+
+// reject write bad row to reject file
+func (l *CopyLoader) reject(row []interface{}, cause error) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.rejects == nil {
+		f, err := os.OpenFile(l.cfg.RejectFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		l.rejects = f
+	}
+	data, err := json.Marshal(rejectedRow{Table: l.cfg.Table, Error: cause.Error(), Row: row})
+	if err != nil {
+		return err
+	}
+	_, err = l.rejects.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	l.rejected++
+	return nil
+}
+
+func (l *CopyLoader) rejectedCount() int64 {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.rejected
+}
+
+func (l *CopyLoader) closeRejects() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.rejects == nil {
+		return
+	}
+	err := l.rejects.Close()
+	if err != nil {
+		l.logger.Error(fmt.Errorf("close reject file: %v", err))
+	}
+	l.rejects = nil
+}
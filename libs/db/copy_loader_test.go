@@ -0,0 +1,116 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+func newTestCopyLoader(t *testing.T, cfg *CopyLoaderConfig) *CopyLoader {
+	l, err := NewCopyLoader(&log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()}, &PGXNative{}, cfg)
+	require.NoError(t, err)
+	return l
+}
+
+func TestCopyLoaderConfig(t *testing.T) {
+	_, err := NewCopyLoader(nil, nil, &CopyLoaderConfig{Table: "t", Columns: []string{"a"}})
+	assert.Error(t, err, "pgx-native is required")
+	_, err = NewCopyLoader(nil, &PGXNative{}, &CopyLoaderConfig{Table: "t"})
+	assert.Error(t, err, "columns are required")
+	_, err = NewCopyLoader(nil, &PGXNative{}, &CopyLoaderConfig{Table: "t", Columns: []string{"a"}, Staging: true})
+	assert.Error(t, err, "staging requires conflict columns")
+
+	l := newTestCopyLoader(t, &CopyLoaderConfig{Table: "public.events", Columns: []string{"id", "name", "ts"}})
+	assert.Equal(t, 10000, l.cfg.ChunkSize)
+	assert.Equal(t, pgx.Identifier{"public", "events"}, l.table)
+}
+
+func TestCopyLoaderMergeQuery(t *testing.T) {
+	stage := pgx.Identifier{"copy_stage_public_events"}
+
+	l := newTestCopyLoader(t, &CopyLoaderConfig{
+		Table:           "public.events",
+		Columns:         []string{"id", "name", "ts"},
+		Staging:         true,
+		ConflictColumns: []string{"id"},
+	})
+	assert.Equal(t, []string{"name", "ts"}, l.cfg.UpdateColumns, "not conflict columns are updated by default")
+	assert.Equal(t, `INSERT INTO "public"."events" ("id", "name", "ts") SELECT "id", "name", "ts" FROM "copy_stage_public_events" `+
+		`ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "ts" = EXCLUDED."ts"`, l.mergeQuery(stage))
+
+	l = newTestCopyLoader(t, &CopyLoaderConfig{
+		Table:           "events",
+		Columns:         []string{"id", "Name"},
+		Staging:         true,
+		ConflictColumns: []string{"id", "Name"},
+	})
+	assert.Equal(t, `INSERT INTO "events" ("id", "Name") SELECT "id", "Name" FROM "copy_stage_public_events" `+
+		`ON CONFLICT ("id", "Name") DO NOTHING`, l.mergeQuery(stage))
+
+	l = newTestCopyLoader(t, &CopyLoaderConfig{
+		Table:           "events",
+		Columns:         []string{"id", "name", "ts"},
+		Staging:         true,
+		ConflictColumns: []string{"id"},
+		UpdateColumns:   []string{},
+	})
+	assert.Contains(t, l.mergeQuery(stage), "DO NOTHING", "empty update list skips conflicting rows")
+}
+
+func TestIsDataError(t *testing.T) {
+	for code, want := range map[string]bool{
+		"22P02": true,  // invalid text representation
+		"22001": true,  // string data right truncation
+		"23505": true,  // unique violation
+		"23502": true,  // not null violation
+		"08006": false, // connection failure
+		"57014": false, // query canceled
+		"42P01": false, // undefined table
+	} {
+		assert.Equal(t, want, isDataError(&pgconn.PgError{Code: code}), code)
+	}
+	assert.True(t, isDataError(fmt.Errorf("copy: %w", &pgconn.PgError{Code: "22P02"})))
+	assert.False(t, isDataError(errors.New("unexpected EOF")))
+}
+
+func TestCopyLoaderReject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rejects := filepath.Join(dir, "rejects.jsonl")
+	l := newTestCopyLoader(t, &CopyLoaderConfig{Table: "events", Columns: []string{"id", "name"}, RejectFile: rejects})
+	require.NoError(t, l.reject([]interface{}{1, "a"}, &pgconn.PgError{Code: "23505", Message: "duplicate key"}))
+	require.NoError(t, l.reject([]interface{}{2, nil}, &pgconn.PgError{Code: "23502", Message: "null value"}))
+	assert.Equal(t, int64(2), l.rejectedCount())
+	l.closeRejects()
+	l.closeRejects()
+
+	f, err := os.Open(rejects)
+	require.NoError(t, err)
+	defer f.Close()
+	var rows []rejectedRow
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var row rejectedRow
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &row))
+		rows = append(rows, row)
+	}
+	require.Len(t, rows, 2)
+	assert.Equal(t, "events", rows[0].Table)
+	assert.Contains(t, rows[0].Error, "duplicate key")
+	assert.Equal(t, []interface{}{float64(2), nil}, rows[1].Row)
+}
@@ -0,0 +1,46 @@
+package db
+
+import "fmt"
+
+// ErrNotFound is returned by Selector for key without db config
+type ErrNotFound struct {
+	Key string
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("no db with key %s", e.Key)
+}
+
+// ErrWrongDriver is returned by Selector when db with key is opened with driver of other type
+type ErrWrongDriver struct {
+	Key    string
+	Driver string
+	Want   string
+}
+
+func (e ErrWrongDriver) Error() string {
+	return fmt.Sprintf("db with key %s has driver %q which does not provide %s", e.Key, e.Driver, e.Want)
+}
+
+// ErrNoQuery is returned by Selector for name which is not loaded from query files of db
+type ErrNoQuery struct {
+	Key  string
+	Name string
+}
+
+func (e ErrNoQuery) Error() string {
+	return fmt.Sprintf("no query %s for db with key %s", e.Name, e.Key)
+}
+
+// ErrNoShard is returned by Selector for unknown shard group or shard key which is out of ranges of group
+type ErrNoShard struct {
+	Group    string
+	ShardKey interface{}
+}
+
+func (e ErrNoShard) Error() string {
+	if e.ShardKey == nil {
+		return fmt.Sprintf("no shard group %s", e.Group)
+	}
+	return fmt.Sprintf("no shard of group %s for key %v", e.Group, e.ShardKey)
+}
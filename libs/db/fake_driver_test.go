@@ -0,0 +1,224 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+// fakeResult is answer of fakeDB on statement, rows are returned for queries
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+type fakeStatement struct {
+	query string
+	args  []interface{}
+}
+
+// fakeDB is database/sql driver which answers statements by handler and records them.
+// BEGIN, COMMIT and ROLLBACK of transactions are passed to handler as statements too.
+type fakeDB struct {
+	mx      sync.Mutex
+	handler func(query string, args []interface{}) (*fakeResult, error)
+	stmts   []fakeStatement
+}
+
+func newFakeDB(handler func(query string, args []interface{}) (*fakeResult, error)) *fakeDB {
+	return &fakeDB{handler: handler}
+}
+
+// selector return selector with default postgres db which is served by fake
+func (f *fakeDB) selector() *Selector {
+	return &Selector{
+		logger:   &log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()},
+		cfgMap:   SelectorConfig{DefaultDBKey: {Driver: "postgres"}},
+		sqlDBMap: map[string]*sql.DB{DefaultDBKey: sql.OpenDB(f)},
+		metrics:  new(QueryMetrics),
+	}
+}
+
+// statements return recorded statements which contain substring
+func (f *fakeDB) statements(substr string) []fakeStatement {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	var out []fakeStatement
+	for _, s := range f.stmts {
+		if strings.Contains(s.query, substr) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (f *fakeDB) run(query string, named []driver.NamedValue) (*fakeResult, error) {
+	args := make([]interface{}, len(named))
+	for i, v := range named {
+		args[i] = v.Value
+	}
+	f.mx.Lock()
+	f.stmts = append(f.stmts, fakeStatement{query: query, args: args})
+	f.mx.Unlock()
+	res, err := f.handler(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = &fakeResult{}
+	}
+	return res, nil
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db: f}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+// fakeHosts are fakes which are opened by "fake" driver by host of config
+var fakeHosts sync.Map
+
+var fakeHostPattern = regexp.MustCompile(`host='?([^' ]+)`)
+
+// fakeDriver open connections of fakeDB registered in fakeHosts, it is used for pools created by Selector
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	m := fakeHostPattern.FindStringSubmatch(dsn)
+	if m == nil {
+		return nil, fmt.Errorf("no host in dsn %s", dsn)
+	}
+	f, ok := fakeHosts.Load(m[1])
+	if !ok {
+		return nil, fmt.Errorf("no fake db for host %s", m[1])
+	}
+	return f.(*fakeDB).Connect(context.Background())
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	_, err := c.db.run("PING", nil)
+	return err
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	_, err := c.db.run("BEGIN", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeTx{db: c.db}, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{res: res}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(res.affected), nil
+}
+
+// fakeStmt pass prepared query to handler on each run
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return out
+}
+
+type fakeRows struct {
+	res *fakeResult
+	pos int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.res.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.res.rows) {
+		return io.EOF
+	}
+	copy(dest, r.res.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (t *fakeTx) Commit() error {
+	_, err := t.db.run("COMMIT", nil)
+	return err
+}
+
+func (t *fakeTx) Rollback() error {
+	_, err := t.db.run("ROLLBACK", nil)
+	return err
+}
@@ -0,0 +1,339 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+
+	"git.pnhub.ru/core/libs/tenant"
+)
+
+const (
+	DefaultHealthCheckInterval    = time.Second * 10
+	DefaultHealthFailureThreshold = 3
+	DefaultReplicaCheckInterval   = time.Second * 5
+)
+
+func (c *Config) healthCheckInterval() time.Duration {
+	if c.HealthCheckInterval > 0 {
+		return c.HealthCheckInterval
+	}
+	return DefaultHealthCheckInterval
+}
+
+func (c *Config) healthFailureThreshold() int {
+	if c.HealthFailureThreshold > 0 {
+		return c.HealthFailureThreshold
+	}
+	return DefaultHealthFailureThreshold
+}
+
+func (c *Config) replicaCheckInterval() time.Duration {
+	if c.ReplicaCheckInterval > 0 {
+		return c.ReplicaCheckInterval
+	}
+	return DefaultReplicaCheckInterval
+}
+
+// health is state of primary checks
+type health struct {
+	mx        sync.Mutex
+	failures  int
+	recreated int
+	lastErr   error
+	lastCheck time.Time
+	migration *MigrationStatus
+	leaders   map[string]bool
+
+	tenantMigrations map[string]*MigrationStatus
+}
+
+// Status is snapshot of db state
+type Status struct {
+	Key       string           `json:"key"`
+	Driver    string           `json:"driver"`
+	Host      string           `json:"host"`
+	Healthy   bool             `json:"healthy"`
+	LastError string           `json:"last_error,omitempty"`
+	LastCheck time.Time        `json:"last_check"`
+	Failures  int              `json:"failures"`
+	Recreated int              `json:"recreated"`
+	Pool      PoolStats        `json:"pool"`
+	Migration *MigrationStatus `json:"migration,omitempty"`
+	// TenantMigrations are migration states of tenant schemas by tenant
+	TenantMigrations map[string]*MigrationStatus `json:"tenant_migrations,omitempty"`
+	Replicas         []ReplicaStatus             `json:"replicas,omitempty"`
+	// Leadership is state of leader elections on db by name
+	Leadership map[string]bool `json:"leadership,omitempty"`
+}
+
+type ReplicaStatus struct {
+	Host      string    `json:"host"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	Pool      PoolStats `json:"pool"`
+}
+
+type PoolStats struct {
+	MaxOpen   int   `json:"max_open"`
+	Open      int   `json:"open"`
+	InUse     int   `json:"in_use"`
+	Idle      int   `json:"idle"`
+	WaitCount int64 `json:"wait_count"`
+}
+
+// Stats return pool stats of sql.DB or pgx pool
+func (n *Node) Stats() PoolStats {
+	if n.PGX != nil {
+		s := n.PGX.Stat()
+		return PoolStats{
+			MaxOpen:   int(s.MaxConns()),
+			Open:      int(s.TotalConns()),
+			InUse:     int(s.AcquiredConns()),
+			Idle:      int(s.IdleConns()),
+			WaitCount: s.EmptyAcquireCount(),
+		}
+	}
+	s := n.DB.Stats()
+	return PoolStats{
+		MaxOpen:   s.MaxOpenConnections,
+		Open:      s.OpenConnections,
+		InUse:     s.InUse,
+		Idle:      s.Idle,
+		WaitCount: s.WaitCount,
+	}
+}
+
+// Status return state of all db sorted by key
+func (d *Selector) Status() []Status {
+	d.mx.RLock()
+	keys := make([]string, 0, len(d.cfgMap))
+	for k := range d.cfgMap {
+		keys = append(keys, k)
+	}
+	d.mx.RUnlock()
+	sort.Strings(keys)
+
+	out := make([]Status, 0, len(keys))
+	for _, key := range keys {
+		node, err := d.primary(key)
+		if err != nil {
+			continue
+		}
+		st := Status{
+			Key:    key,
+			Driver: node.Cfg.Driver,
+			Host:   node.Cfg.Host,
+			Pool:   node.Stats(),
+		}
+		d.mx.RLock()
+		h := d.healthMap[key]
+		set := d.replicaMap[key]
+		d.mx.RUnlock()
+		if h != nil {
+			h.mx.Lock()
+			st.Healthy = h.failures == 0
+			st.LastCheck = h.lastCheck
+			st.Failures = h.failures
+			st.Recreated = h.recreated
+			st.Migration = h.migration
+			st.TenantMigrations = h.tenantMigrations
+			if len(h.leaders) > 0 {
+				st.Leadership = make(map[string]bool, len(h.leaders))
+				for name, leader := range h.leaders {
+					st.Leadership[name] = leader
+				}
+			}
+			if h.lastErr != nil {
+				st.LastError = h.lastErr.Error()
+			}
+			h.mx.Unlock()
+		}
+		if set != nil {
+			for _, r := range set.replicas {
+				st.Replicas = append(st.Replicas, r.status())
+			}
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// setLeadership record state of leader election for Status
+func (d *Selector) setLeadership(key, name string, leader bool) {
+	d.mx.RLock()
+	h := d.healthMap[key]
+	d.mx.RUnlock()
+	if h == nil {
+		return
+	}
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if h.leaders == nil {
+		h.leaders = make(map[string]bool)
+	}
+	h.leaders[name] = leader
+}
+
+func (r *replica) status() ReplicaStatus {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	st := ReplicaStatus{
+		Host:      r.cfg.Host,
+		Healthy:   r.healthy,
+		LastCheck: r.lastCheck,
+	}
+	if r.lastErr != nil {
+		st.LastError = r.lastErr.Error()
+	}
+	if r.node != nil {
+		st.Pool = r.node.Stats()
+	}
+	return st
+}
+
+// checkHealth ping primaries and replicas with configured intervals until ctx is done
+func (d *Selector) checkHealth(ctx context.Context) {
+	interval := DefaultReplicaCheckInterval
+	d.mx.RLock()
+	for _, cfg := range d.cfgMap {
+		if i := cfg.healthCheckInterval(); i < interval {
+			interval = i
+		}
+		if i := cfg.replicaCheckInterval(); len(cfg.Replicas) > 0 && i < interval {
+			interval = i
+		}
+	}
+	d.mx.RUnlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.mx.RLock()
+			healths := make(map[string]*health, len(d.healthMap))
+			for k, h := range d.healthMap {
+				healths[k] = h
+			}
+			sets := make(map[string]*replicaSet, len(d.replicaMap))
+			for k, s := range d.replicaMap {
+				sets[k] = s
+			}
+			d.mx.RUnlock()
+
+			for key, h := range healths {
+				h.mx.Lock()
+				last := h.lastCheck
+				h.mx.Unlock()
+				node, err := d.primary(key)
+				if err == nil && now.Sub(last) >= node.Cfg.healthCheckInterval()-interval/2 {
+					d.checkPrimary(ctx, key, node, h)
+				}
+			}
+			for key, set := range sets {
+				for _, r := range set.replicas {
+					r.mx.RLock()
+					last := r.lastCheck
+					r.mx.RUnlock()
+					if now.Sub(last) >= r.cfg.replicaCheckInterval()-interval/2 {
+						d.checkReplica(ctx, key, r)
+					}
+				}
+			}
+		}
+	}
+}
+
+// checkPrimary ping primary and re-create its pool after HealthFailureThreshold failures in a row.
+// Old pool is closed in background, so handles of pool must be taken from Selector for each use.
+func (d *Selector) checkPrimary(ctx context.Context, key string, node *Node, h *health) {
+	pingCtx, cancel := context.WithTimeout(ctx, node.Cfg.healthCheckInterval())
+	err := node.Ping(pingCtx)
+	cancel()
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.lastCheck = time.Now()
+	h.lastErr = err
+	if err == nil {
+		if h.failures > 0 {
+			d.logger.Infof("db %s is available", key)
+		}
+		h.failures = 0
+		return
+	}
+	h.failures++
+	d.logger.Warnf("db %s ping failed(%d/%d): %v", key, h.failures, node.Cfg.healthFailureThreshold(), err)
+	if h.failures < node.Cfg.healthFailureThreshold() || ctx.Err() != nil {
+		return
+	}
+
+	fresh, err := d.openNode(key, node.Cfg)
+	if err != nil {
+		h.lastErr = err
+		d.logger.Errorf("cannot re-create db %s pool: %v", key, err)
+		return
+	}
+	old := d.setNode(key, fresh)
+	h.failures = 0
+	h.recreated++
+	d.logger.Warnf("db %s pool is re-created", key)
+	if old != nil {
+		// pgx pool close waits for acquired connections
+		go old.Close()
+	}
+}
+
+// DefaultPoolStatsInterval is period of pool stats report
+const DefaultPoolStatsInterval = time.Second * 10
+
+// reportPoolStats write pool stats gauges of primaries and replicas until ctx is done, scope is set by SetScope
+func (d *Selector) reportPoolStats(ctx context.Context) {
+	ticker := time.NewTicker(DefaultPoolStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scope := d.metrics.Scope()
+			if scope == nil {
+				continue
+			}
+			for _, st := range d.Status() {
+				reportPool(scope.Tagged(map[string]string{"db": st.Key, "role": "primary", "host": st.Host}), st.Pool)
+				if st.Migration != nil {
+					tagged := scope.Tagged(map[string]string{"db": st.Key})
+					tagged.Gauge("migration_version").Update(float64(st.Migration.Version))
+					tagged.Gauge("migration_pending").Update(float64(len(st.Migration.Pending)))
+				}
+				for t, m := range st.TenantMigrations {
+					if m == nil {
+						continue
+					}
+					tagged := scope.Tagged(map[string]string{"db": st.Key, tenant.Tag: t})
+					tagged.Gauge("migration_version").Update(float64(m.Version))
+					tagged.Gauge("migration_pending").Update(float64(len(m.Pending)))
+				}
+				for _, r := range st.Replicas {
+					reportPool(scope.Tagged(map[string]string{"db": st.Key, "role": "replica", "host": r.Host}), r.Pool)
+				}
+			}
+		}
+	}
+}
+
+func reportPool(scope tally.Scope, s PoolStats) {
+	scope.Gauge("pool_max_open").Update(float64(s.MaxOpen))
+	scope.Gauge("pool_open").Update(float64(s.Open))
+	scope.Gauge("pool_in_use").Update(float64(s.InUse))
+	scope.Gauge("pool_idle").Update(float64(s.Idle))
+	scope.Gauge("pool_wait_count").Update(float64(s.WaitCount))
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPrimaryRecreate(t *testing.T) {
+	// pings of 3 checks and of first re-created pool fail
+	var failPings int32 = 4
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if query == "PING" && atomic.AddInt32(&failPings, -1) >= 0 {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	})
+	fakeHosts.Store("primary", f)
+	defer fakeHosts.Delete("primary")
+
+	d := f.selector()
+	d.cfgMap[DefaultDBKey] = &Config{Driver: "fake", Host: "primary", HealthFailureThreshold: 2}
+	d.pgxMap = make(map[string]*PGXNative)
+	d.healthMap = map[string]*health{DefaultDBKey: new(health)}
+	h := d.healthMap[DefaultDBKey]
+	check := func() {
+		node, err := d.primary(DefaultDBKey)
+		require.NoError(t, err)
+		d.checkPrimary(context.Background(), DefaultDBKey, node, h)
+	}
+	old := d.sqlDBMap[DefaultDBKey]
+
+	check()
+	st := d.Status()[0]
+	assert.False(t, st.Healthy)
+	assert.Equal(t, 1, st.Failures)
+	assert.Equal(t, "connection refused", st.LastError)
+
+	// threshold is reached, but ping of new pool fails too
+	check()
+	st = d.Status()[0]
+	assert.Equal(t, 2, st.Failures)
+	assert.Equal(t, 0, st.Recreated)
+	assert.Same(t, old, d.sqlDBMap[DefaultDBKey])
+
+	check()
+	st = d.Status()[0]
+	assert.True(t, st.Healthy, "failures are reset with new pool")
+	assert.Equal(t, 1, st.Recreated)
+	assert.NotSame(t, old, d.sqlDBMap[DefaultDBKey])
+	require.Eventually(t, func() bool {
+		return old.Ping() != nil
+	}, time.Second, time.Millisecond, "old pool is closed")
+
+	check()
+	st = d.Status()[0]
+	assert.True(t, st.Healthy)
+	assert.Empty(t, st.LastError)
+}
+
+func TestCheckPrimaryStopped(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return nil, errors.New("connection refused")
+	})
+	d := f.selector()
+	d.cfgMap[DefaultDBKey].HealthFailureThreshold = 1
+	h := new(health)
+	d.healthMap = map[string]*health{DefaultDBKey: h}
+	node, err := d.primary(DefaultDBKey)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.checkPrimary(ctx, DefaultDBKey, node, h)
+	assert.Equal(t, 1, h.failures)
+	assert.Equal(t, 0, h.recreated, "pool is not re-created on shutdown")
+}
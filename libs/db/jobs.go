@@ -0,0 +1,559 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"github.com/uber-go/tally"
+	"go.uber.org/fx"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/metrics"
+	"git.pnhub.ru/core/libs/util"
+)
+
+// JobsTable is table of job queue, it is created by migration of RegisterJobsMigration
+const JobsTable = "jobs"
+
+const jobsMigrationUp = `create table if not exists jobs
+(
+    id           bigserial   not null
+        constraint jobs_pk
+            primary key,
+    type         varchar     not null,
+    unique_key   varchar,
+    payload      jsonb       not null default '{}',
+    priority     integer     not null default 0,
+    state        varchar     not null default 'pending',
+    attempts     integer     not null default 0,
+    max_attempts integer     not null default 5,
+    run_at       timestamptz not null default now(),
+    heartbeat_at timestamptz,
+    locked_by    varchar,
+    last_error   text,
+    created_at   timestamptz not null default now(),
+    updated_at   timestamptz not null default now()
+);
+
+create unique index if not exists jobs_type_unique_key_uindex
+    on jobs (type, unique_key)
+    where unique_key is not null and state in ('pending', 'running');
+
+create index if not exists jobs_claim_index
+    on jobs (type, priority desc, run_at, id)
+    where state = 'pending';
+
+create index if not exists jobs_heartbeat_index
+    on jobs (heartbeat_at)
+    where state = 'running';
+`
+
+const jobsMigrationDown = `drop table if exists jobs;
+`
+
+// RegisterJobsMigration add job queue table migration with version to in-binary migrations source
+func RegisterJobsMigration(sourceName string, version uint) {
+	RegisterMigrations(sourceName, map[string][]byte{
+		fmt.Sprintf("%d_jobs.up.sql", version):   []byte(jobsMigrationUp),
+		fmt.Sprintf("%d_jobs.down.sql", version): []byte(jobsMigrationDown),
+	})
+}
+
+// Job states
+const (
+	JobPending  = "pending"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobDead     = "dead"
+	JobCanceled = "canceled"
+)
+
+var (
+	ErrJobExists   = fmt.Errorf("job with unique key is already queued")
+	ErrJobNotFound = fmt.Errorf("job is not found or has other state")
+)
+
+const jobColumns = "id, type, unique_key, payload, priority, state, attempts, max_attempts, run_at, heartbeat_at, locked_by, last_error, created_at, updated_at"
+
+type Job struct {
+	ID          int64      `db:"id" json:"id"`
+	Type        string     `db:"type" json:"type"`
+	UniqueKey   *string    `db:"unique_key" json:"unique_key,omitempty"`
+	Payload     []byte     `db:"payload" json:"payload"`
+	Priority    int        `db:"priority" json:"priority"`
+	State       string     `db:"state" json:"state"`
+	Attempts    int        `db:"attempts" json:"attempts"`
+	MaxAttempts int        `db:"max_attempts" json:"max_attempts"`
+	RunAt       time.Time  `db:"run_at" json:"run_at"`
+	HeartbeatAt *time.Time `db:"heartbeat_at" json:"heartbeat_at,omitempty"`
+	LockedBy    *string    `db:"locked_by" json:"locked_by,omitempty"`
+	LastError   *string    `db:"last_error" json:"last_error,omitempty"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// Decode unmarshal json payload of job to v
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// JobHandler process job, returned error(or panic) schedules retry or moves job to dead state after max attempts
+type JobHandler func(ctx context.Context, job *Job) error
+
+// EnqueueOptions of job, zero values mean run now with default priority and max attempts
+type EnqueueOptions struct {
+	RunAt    time.Time
+	Priority int
+	// UniqueKey forbid second pending or running job of the same type and key
+	UniqueKey   string
+	MaxAttempts int
+}
+
+// JobFilter select jobs for admin listing, empty fields are not filtered
+type JobFilter struct {
+	Type   string
+	State  string
+	Limit  int
+	Offset int
+}
+
+type JobQueueConfig struct {
+	// Key is db key in Selector(default DefaultDBKey)
+	Key          string        `json:"key" yaml:"key"`
+	PollInterval time.Duration `json:"poll_interval" yaml:"poll_interval"`
+	// HeartbeatInterval is period of running job heartbeat, job without heartbeat for StuckTimeout is recovered
+	HeartbeatInterval  time.Duration `json:"heartbeat_interval" yaml:"heartbeat_interval"`
+	StuckTimeout       time.Duration `json:"stuck_timeout" yaml:"stuck_timeout"`
+	DefaultMaxAttempts int           `json:"default_max_attempts" yaml:"default_max_attempts"`
+	// Backoff is delay before retry of failed job
+	Backoff util.Backoff `json:"backoff" yaml:"backoff"`
+}
+
+func (c *JobQueueConfig) setDefaults() {
+	if c.Key == "" {
+		c.Key = DefaultDBKey
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = time.Second
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = time.Second * 10
+	}
+	if c.StuckTimeout <= 0 {
+		c.StuckTimeout = c.HeartbeatInterval * 6
+	}
+	if c.DefaultMaxAttempts <= 0 {
+		c.DefaultMaxAttempts = 5
+	}
+}
+
+type jobWorkers struct {
+	count   int
+	handler JobHandler
+}
+
+// JobQueue is durable postgres job queue. Workers of each job type claim jobs with FOR UPDATE SKIP LOCKED,
+// so queue can be processed by several instances.
+type JobQueue struct {
+	ctx      context.Context
+	logger   log.Logger
+	selector *Selector
+	cfg      JobQueueConfig
+	worker   string
+	claims   uint64
+
+	mx       sync.Mutex
+	handlers map[string]*jobWorkers
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewJobQueue(ctx context.Context, logger log.Logger, selector *Selector, cfg *JobQueueConfig, lc fx.Lifecycle) (*JobQueue, error) {
+	if selector == nil {
+		return nil, fmt.Errorf("no db selector for job queue")
+	}
+	c := JobQueueConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	c.setDefaults()
+	host, _ := os.Hostname()
+	q := &JobQueue{
+		ctx:      ctx,
+		logger:   log.ForkLogger(logger),
+		selector: selector,
+		cfg:      c,
+		worker:   host + ":" + strconv.Itoa(os.Getpid()),
+		handlers: make(map[string]*jobWorkers),
+	}
+	if lc != nil {
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				q.Start()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				return q.Stop(ctx)
+			},
+		})
+	}
+	return q, nil
+}
+
+// Register set handler and count of workers for job type. It must be called before Start.
+func (q *JobQueue) Register(jobType string, workers int, handler JobHandler) {
+	if workers <= 0 {
+		workers = 1
+	}
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	q.handlers[jobType] = &jobWorkers{count: workers, handler: handler}
+}
+
+// Enqueue add job with json payload. Job is added in transaction of RunInTx if ctx has it.
+// Return ErrJobExists if job with the same unique key is pending or running.
+func (q *JobQueue) Enqueue(ctx context.Context, jobType string, payload interface{}, opts *EnqueueOptions) (int64, error) {
+	if opts == nil {
+		opts = &EnqueueOptions{}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	runAt := opts.RunAt
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = q.cfg.DefaultMaxAttempts
+	}
+	var uniqueKey *string
+	if opts.UniqueKey != "" {
+		uniqueKey = &opts.UniqueKey
+	}
+	querier, err := q.selector.Querier(ctx, q.cfg.Key)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = QueryOne(ctx, querier, &id, "INSERT INTO "+JobsTable+" (type, unique_key, payload, priority, max_attempts, run_at)"+
+		" VALUES ($1, $2, $3, $4, $5, $6)"+
+		" ON CONFLICT (type, unique_key) WHERE unique_key IS NOT NULL AND state IN ('pending', 'running') DO NOTHING"+
+		" RETURNING id",
+		jobType, uniqueKey, string(data), opts.Priority, maxAttempts, runAt)
+	if err == sql.ErrNoRows {
+		return 0, ErrJobExists
+	}
+	return id, err
+}
+
+// Start run workers of registered job types and recovery of stuck jobs
+func (q *JobQueue) Start() {
+	ctx, cancel := context.WithCancel(q.ctx)
+	q.cancel = cancel
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	for jobType, w := range q.handlers {
+		for i := 0; i < w.count; i++ {
+			q.wg.Add(1)
+			go q.work(ctx, jobType, w.handler)
+		}
+	}
+	q.wg.Add(1)
+	go q.recover(ctx)
+}
+
+// Stop cancel running jobs and wait for workers
+func (q *JobQueue) Stop(ctx context.Context) error {
+	if q.cancel == nil {
+		return nil
+	}
+	q.cancel()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *JobQueue) work(ctx context.Context, jobType string, handler JobHandler) {
+	defer q.wg.Done()
+	for ctx.Err() == nil {
+		job, err := q.claim(ctx, jobType)
+		if err == nil {
+			q.process(ctx, job, handler)
+			continue
+		}
+		if err != sql.ErrNoRows && ctx.Err() == nil {
+			q.logger.Warnf("claim job %s: %v", jobType, err)
+		}
+		if util.SleepContext(ctx, q.cfg.PollInterval) != nil {
+			return
+		}
+	}
+}
+
+// jobClaimed is condition of job which is still running by the same claim. Job can be returned to pending state
+// by recover and claimed again while its handler is running, so late updates of previous claim must not change it.
+const jobClaimed = " WHERE id = $1 AND state = 'running' AND locked_by = $2 AND attempts = $3"
+
+// claim take due pending job of type with highest priority, locked_by of job is unique token of claim
+func (q *JobQueue) claim(ctx context.Context, jobType string) (*Job, error) {
+	node, err := q.selector.Writer(ctx, q.cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	err = QueryOne(ctx, node.Querier(), job, "UPDATE "+JobsTable+
+		" SET state = 'running', attempts = attempts + 1, heartbeat_at = now(), locked_by = $2, updated_at = now()"+
+		" WHERE id = (SELECT id FROM "+JobsTable+" WHERE type = $1 AND state = 'pending' AND run_at <= now()"+
+		" ORDER BY priority DESC, run_at, id LIMIT 1 FOR UPDATE SKIP LOCKED)"+
+		" RETURNING "+jobColumns, jobType, q.worker+":"+strconv.FormatUint(atomic.AddUint64(&q.claims, 1), 10))
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (q *JobQueue) process(ctx context.Context, job *Job, handler JobHandler) {
+	scope := q.metrics().Tagged(map[string]string{"type": job.Type})
+	jobCtx, cancel := context.WithCancel(ctx)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		q.heartbeat(jobCtx, job, cancel)
+	}()
+
+	start := time.Now()
+	err := q.call(jobCtx, job, handler)
+	cancel()
+	<-heartbeatDone
+	scope.Histogram("job_duration", metrics.DefaultBuckets()).RecordDuration(time.Since(start))
+
+	// job state is saved even if queue is stopping
+	saveCtx, saveCancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer saveCancel()
+	if err == nil {
+		scope.Counter("jobs_done").Inc(1)
+		q.save(saveCtx, scope, job, "UPDATE "+JobsTable+" SET state = 'done', locked_by = NULL, last_error = NULL, updated_at = now()"+
+			jobClaimed)
+		return
+	}
+
+	if ctx.Err() != nil {
+		// queue is stopping, interrupted job is returned to pending state without spent attempt
+		scope.Counter("jobs_interrupted").Inc(1)
+		q.logger.Infof("job %d %s is interrupted by stop: %v", job.ID, job.Type, err)
+		q.save(saveCtx, scope, job, "UPDATE "+JobsTable+" SET state = 'pending', attempts = attempts - 1, locked_by = NULL, updated_at = now()"+
+			jobClaimed)
+		return
+	}
+
+	state := JobPending
+	if job.Attempts >= job.MaxAttempts {
+		state = JobDead
+		scope.Counter("jobs_dead").Inc(1)
+		q.logger.Error(fmt.Errorf("job %d %s is dead after %d attempts: %v", job.ID, job.Type, job.Attempts, err))
+	} else {
+		scope.Counter("jobs_failed").Inc(1)
+		q.logger.Warnf("job %d %s failed(attempt %d/%d): %v", job.ID, job.Type, job.Attempts, job.MaxAttempts, err)
+	}
+	runAt := time.Now().Add(q.cfg.Backoff.Delay(job.Attempts - 1))
+	q.save(saveCtx, scope, job, "UPDATE "+JobsTable+" SET state = $4, run_at = $5, last_error = $6, locked_by = NULL, updated_at = now()"+
+		jobClaimed, state, runAt, err.Error())
+}
+
+// save update state of job by its claim, update of job which is recovered and claimed again is skipped
+func (q *JobQueue) save(ctx context.Context, scope tally.Scope, job *Job, query string, args ...interface{}) {
+	n, err := q.execCount(ctx, query, append([]interface{}{job.ID, job.lockedBy(), job.Attempts}, args...)...)
+	if err != nil {
+		q.logger.Error(fmt.Errorf("save job %d: %v", job.ID, err))
+		return
+	}
+	if n == 0 {
+		scope.Counter("jobs_lost").Inc(1)
+		q.logger.Warnf("job %d %s is not saved: it is recovered after heartbeat timeout", job.ID, job.Type)
+	}
+}
+
+func (j *Job) lockedBy() string {
+	if j.LockedBy == nil {
+		return ""
+	}
+	return *j.LockedBy
+}
+
+// call run handler and convert panic to error
+func (q *JobQueue) call(ctx context.Context, job *Job, handler JobHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// heartbeat update heartbeat of claimed job, job is cancelled if it is recovered after heartbeat timeout
+func (q *JobQueue) heartbeat(ctx context.Context, job *Job, cancel context.CancelFunc) {
+	ticker := time.NewTicker(q.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := q.execCount(ctx, "UPDATE "+JobsTable+" SET heartbeat_at = now()"+jobClaimed, job.ID, job.lockedBy(), job.Attempts)
+		if err != nil {
+			if ctx.Err() == nil {
+				q.logger.Warnf("heartbeat of job %d: %v", job.ID, err)
+			}
+			continue
+		}
+		if n == 0 {
+			q.logger.Warnf("job %d %s is cancelled: it is recovered after heartbeat timeout", job.ID, job.Type)
+			cancel()
+			return
+		}
+	}
+}
+
+// recover return jobs without heartbeat for StuckTimeout to pending state or to dead state after max attempts
+func (q *JobQueue) recover(ctx context.Context) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := q.execCount(ctx, "UPDATE "+JobsTable+
+			" SET state = CASE WHEN attempts >= max_attempts THEN 'dead' ELSE 'pending' END,"+
+			" locked_by = NULL, last_error = 'heartbeat timeout', updated_at = now()"+
+			" WHERE state = 'running' AND heartbeat_at < $1", time.Now().Add(-q.cfg.StuckTimeout))
+		if err != nil {
+			if ctx.Err() == nil {
+				q.logger.Warnf("recover stuck jobs: %v", err)
+			}
+			continue
+		}
+		if n > 0 {
+			q.metrics().Counter("jobs_recovered").Inc(n)
+			q.logger.Warnf("recovered %d stuck jobs", n)
+		}
+	}
+}
+
+// Job return job by id
+func (q *JobQueue) Job(ctx context.Context, id int64) (*Job, error) {
+	querier, err := q.selector.ReadQuerier(ctx, q.cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	err = QueryOne(ctx, querier, job, "SELECT "+jobColumns+" FROM "+JobsTable+" WHERE id = $1", id)
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	}
+	return job, err
+}
+
+// ListJobs return jobs by filter ordered by id desc(default limit 100)
+func (q *JobQueue) ListJobs(ctx context.Context, filter JobFilter) ([]*Job, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	querier, err := q.selector.ReadQuerier(ctx, q.cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	err = NamedQueryAll(ctx, querier, &jobs, "SELECT "+jobColumns+" FROM "+JobsTable+
+		" WHERE (:type = '' OR type = :type) AND (:state = '' OR state = :state)"+
+		" ORDER BY id DESC LIMIT :limit OFFSET :offset", map[string]interface{}{
+		"type":   filter.Type,
+		"state":  filter.State,
+		"limit":  filter.Limit,
+		"offset": filter.Offset,
+	})
+	return jobs, err
+}
+
+// RetryJob move dead, canceled or pending job to pending state with reset attempts to run now.
+// Return ErrJobExists if other job with the same unique key is pending or running.
+func (q *JobQueue) RetryJob(ctx context.Context, id int64) error {
+	n, err := q.execCount(ctx, "UPDATE "+JobsTable+" SET state = 'pending', attempts = 0, run_at = now(), updated_at = now()"+
+		" WHERE id = $1 AND state IN ('dead', 'canceled', 'pending')", id)
+	if isUniqueViolation(err) {
+		return ErrJobExists
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// CancelJob cancel pending job, running job can not be canceled
+func (q *JobQueue) CancelJob(ctx context.Context, id int64) error {
+	n, err := q.execCount(ctx, "UPDATE "+JobsTable+" SET state = 'canceled', updated_at = now() WHERE id = $1 AND state = 'pending'", id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+const sqlStateUniqueViolation = "23505"
+
+// isUniqueViolation check that error is unique constraint violation of pgx or pq
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == sqlStateUniqueViolation
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == sqlStateUniqueViolation
+	}
+	return false
+}
+
+func (q *JobQueue) execCount(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	querier, err := q.selector.Querier(ctx, q.cfg.Key)
+	if err != nil {
+		return 0, err
+	}
+	return querier.Exec(ctx, query, args...)
+}
+
+func (q *JobQueue) metrics() tally.Scope {
+	scope := q.selector.metrics.Scope()
+	if scope == nil {
+		return tally.NoopScope
+	}
+	return scope.Tagged(map[string]string{"db": q.cfg.Key})
+}
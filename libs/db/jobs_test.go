@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/util"
+)
+
+func newTestJobQueue(t *testing.T, f *fakeDB, cfg JobQueueConfig) (*JobQueue, tally.TestScope) {
+	selector := f.selector()
+	scope := tally.NewTestScope("", nil)
+	selector.metrics.SetScope(scope)
+	q, err := NewJobQueue(context.Background(), &log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()}, selector, &cfg, nil)
+	require.NoError(t, err)
+	return q, scope
+}
+
+func testJob(attempts, maxAttempts int) *Job {
+	token := "host:1:1"
+	return &Job{ID: 7, Type: "mail", State: JobRunning, Attempts: attempts, MaxAttempts: maxAttempts, LockedBy: &token}
+}
+
+func TestJobQueueClaim(t *testing.T) {
+	var claims int32
+	now := time.Now()
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		res := &fakeResult{columns: strings.Split(jobColumns, ", ")}
+		if atomic.AddInt32(&claims, 1) == 1 {
+			res.rows = [][]driver.Value{{
+				int64(7), "mail", nil, []byte(`{"to":"a"}`), int64(10), JobRunning, int64(1), int64(5),
+				now, now, args[1], nil, now, now,
+			}}
+		}
+		return res, nil
+	})
+	q, _ := newTestJobQueue(t, f, JobQueueConfig{})
+
+	job, err := q.claim(context.Background(), "mail")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), job.ID)
+	assert.Equal(t, 1, job.Attempts)
+	assert.Equal(t, 10, job.Priority)
+	assert.Nil(t, job.UniqueKey)
+	var payload struct{ To string }
+	require.NoError(t, job.Decode(&payload))
+	assert.Equal(t, "a", payload.To)
+
+	_, err = q.claim(context.Background(), "mail")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	stmts := f.statements("FOR UPDATE SKIP LOCKED")
+	require.Len(t, stmts, 2)
+	assert.Equal(t, []interface{}{"mail", q.worker + ":1"}, stmts[0].args)
+	assert.Equal(t, q.worker+":2", stmts[1].args[1], "every claim has own token")
+	assert.Equal(t, q.worker+":1", job.lockedBy())
+}
+
+func TestJobQueueProcess(t *testing.T) {
+	backoff := util.Backoff{Min: time.Minute, Max: time.Hour, Factor: 2}
+	tests := []struct {
+		name     string
+		job      *Job
+		handler  JobHandler
+		affected int64
+		state    string
+		lastErr  string
+		delay    time.Duration
+		counters map[string]int64
+	}{
+		{
+			name:     "done",
+			job:      testJob(1, 3),
+			handler:  func(ctx context.Context, job *Job) error { return nil },
+			affected: 1,
+			state:    JobDone,
+			counters: map[string]int64{"jobs_done": 1},
+		},
+		{
+			name:     "retry",
+			job:      testJob(2, 3),
+			handler:  func(ctx context.Context, job *Job) error { return errors.New("smtp is down") },
+			affected: 1,
+			state:    JobPending,
+			lastErr:  "smtp is down",
+			delay:    time.Minute * 2,
+			counters: map[string]int64{"jobs_failed": 1},
+		},
+		{
+			name:     "dead after max attempts",
+			job:      testJob(3, 3),
+			handler:  func(ctx context.Context, job *Job) error { return errors.New("smtp is down") },
+			affected: 1,
+			state:    JobDead,
+			lastErr:  "smtp is down",
+			delay:    time.Minute * 4,
+			counters: map[string]int64{"jobs_dead": 1, "jobs_failed": 0},
+		},
+		{
+			name:     "panic",
+			job:      testJob(1, 3),
+			handler:  func(ctx context.Context, job *Job) error { panic("nil map") },
+			affected: 1,
+			state:    JobPending,
+			lastErr:  "panic: nil map",
+			delay:    time.Minute,
+			counters: map[string]int64{"jobs_failed": 1},
+		},
+		{
+			name:     "lost claim",
+			job:      testJob(1, 3),
+			handler:  func(ctx context.Context, job *Job) error { return nil },
+			affected: 0,
+			state:    JobDone,
+			counters: map[string]int64{"jobs_done": 1, "jobs_lost": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+				return &fakeResult{affected: tt.affected}, nil
+			})
+			q, scope := newTestJobQueue(t, f, JobQueueConfig{HeartbeatInterval: time.Hour, Backoff: backoff})
+			start := time.Now()
+			q.process(context.Background(), tt.job, tt.handler)
+
+			stmts := f.statements("UPDATE " + JobsTable)
+			require.Len(t, stmts, 1)
+			assert.Contains(t, stmts[0].query, jobClaimed)
+			args := stmts[0].args
+			assert.Equal(t, []interface{}{int64(7), "host:1:1", int64(tt.job.Attempts)}, args[:3], "job is saved by its claim")
+			if tt.state == JobDone {
+				assert.Contains(t, stmts[0].query, "state = 'done'")
+			} else {
+				require.Len(t, args, 6)
+				assert.Equal(t, tt.state, args[3])
+				assert.WithinDuration(t, start.Add(tt.delay), args[4].(time.Time), time.Second)
+				assert.Equal(t, tt.lastErr, args[5])
+			}
+			for name, n := range tt.counters {
+				assert.Equal(t, n, counter(scope, name), name)
+			}
+		})
+	}
+}
+
+func TestJobQueueProcessInterrupted(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return &fakeResult{affected: 1}, nil
+	})
+	q, scope := newTestJobQueue(t, f, JobQueueConfig{HeartbeatInterval: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	q.process(ctx, testJob(3, 3), func(ctx context.Context, job *Job) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	stmts := f.statements("UPDATE " + JobsTable)
+	require.Len(t, stmts, 1)
+	assert.Contains(t, stmts[0].query, "state = 'pending', attempts = attempts - 1")
+	assert.Contains(t, stmts[0].query, jobClaimed)
+	assert.Equal(t, []interface{}{int64(7), "host:1:1", int64(3)}, stmts[0].args)
+	assert.Equal(t, int64(1), counter(scope, "jobs_interrupted"))
+	assert.Equal(t, int64(0), counter(scope, "jobs_dead"), "attempt is not spent")
+	assert.Equal(t, int64(0), counter(scope, "jobs_failed"))
+
+	// job which is finished on stop is done
+	ctx, cancel = context.WithCancel(context.Background())
+	q.process(ctx, testJob(1, 3), func(ctx context.Context, job *Job) error {
+		cancel()
+		return nil
+	})
+	assert.Equal(t, int64(1), counter(scope, "jobs_done"))
+}
+
+func TestJobQueueHeartbeatLost(t *testing.T) {
+	var heartbeats int32
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if strings.Contains(query, "SET heartbeat_at = now()") && atomic.AddInt32(&heartbeats, 1) < 3 {
+			return &fakeResult{affected: 1}, nil
+		}
+		// job is recovered and claimed by other worker
+		return &fakeResult{affected: 0}, nil
+	})
+	q, scope := newTestJobQueue(t, f, JobQueueConfig{HeartbeatInterval: time.Millisecond * 5})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.process(context.Background(), testJob(1, 3), func(ctx context.Context, job *Job) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second * 5):
+				return nil
+			}
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("job with lost claim is not cancelled")
+	}
+
+	beats := f.statements("SET heartbeat_at = now()")
+	require.Len(t, beats, 3)
+	for _, s := range beats {
+		assert.Equal(t, []interface{}{int64(7), "host:1:1", int64(1)}, s.args)
+	}
+	assert.Equal(t, int64(1), counter(scope, "jobs_lost"), "late state update is skipped")
+	assert.Equal(t, int64(0), counter(scope, "jobs_interrupted"), "queue is not stopping")
+}
+
+func TestJobQueueRecover(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return &fakeResult{affected: 2}, nil
+	})
+	q, scope := newTestJobQueue(t, f, JobQueueConfig{HeartbeatInterval: time.Millisecond * 5, StuckTimeout: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	q.wg.Add(1)
+	go q.recover(ctx)
+	require.Eventually(t, func() bool {
+		return counter(scope, "jobs_recovered") >= 2
+	}, time.Second, time.Millisecond)
+	cancel()
+	q.wg.Wait()
+
+	stmts := f.statements("heartbeat_at < $1")
+	require.NotEmpty(t, stmts)
+	assert.Contains(t, stmts[0].query, "CASE WHEN attempts >= max_attempts THEN 'dead' ELSE 'pending' END")
+	assert.WithinDuration(t, time.Now().Add(-time.Minute), stmts[0].args[0].(time.Time), time.Second)
+}
+
+func TestJobQueueAdmin(t *testing.T) {
+	tests := []struct {
+		name     string
+		affected int64
+		dbErr    error
+		call     func(q *JobQueue) error
+		err      error
+	}{
+		{name: "retry", affected: 1, call: func(q *JobQueue) error { return q.RetryJob(context.Background(), 7) }},
+		{name: "retry of unknown job", call: func(q *JobQueue) error { return q.RetryJob(context.Background(), 7) }, err: ErrJobNotFound},
+		{
+			name:  "retry of pgx unique key conflict",
+			dbErr: &pgconn.PgError{Code: "23505"},
+			call:  func(q *JobQueue) error { return q.RetryJob(context.Background(), 7) },
+			err:   ErrJobExists,
+		},
+		{
+			name:  "retry of pq unique key conflict",
+			dbErr: &pq.Error{Code: "23505"},
+			call:  func(q *JobQueue) error { return q.RetryJob(context.Background(), 7) },
+			err:   ErrJobExists,
+		},
+		{
+			name:  "retry with other error",
+			dbErr: sql.ErrConnDone,
+			call:  func(q *JobQueue) error { return q.RetryJob(context.Background(), 7) },
+			err:   sql.ErrConnDone,
+		},
+		{name: "cancel", affected: 1, call: func(q *JobQueue) error { return q.CancelJob(context.Background(), 7) }},
+		{name: "cancel of running job", call: func(q *JobQueue) error { return q.CancelJob(context.Background(), 7) }, err: ErrJobNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+				return &fakeResult{affected: tt.affected}, tt.dbErr
+			})
+			q, _ := newTestJobQueue(t, f, JobQueueConfig{})
+			err := tt.call(q)
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, tt.err), "unexpected error %v", err)
+			}
+			stmts := f.statements("WHERE id = $1")
+			require.Len(t, stmts, 1)
+			assert.Equal(t, []interface{}{int64(7)}, stmts[0].args)
+		})
+	}
+}
+
+func TestJobQueueEnqueue(t *testing.T) {
+	var id int64
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		res := &fakeResult{columns: []string{"id"}}
+		if args[1] == nil || args[1] == "new" {
+			id++
+			res.rows = [][]driver.Value{{id}}
+		}
+		return res, nil
+	})
+	q, _ := newTestJobQueue(t, f, JobQueueConfig{DefaultMaxAttempts: 4})
+	runAt := time.Now().Add(time.Hour)
+
+	got, err := q.Enqueue(context.Background(), "mail", map[string]string{"to": "a"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), got)
+	got, err = q.Enqueue(context.Background(), "mail", nil, &EnqueueOptions{UniqueKey: "new", Priority: 5, RunAt: runAt, MaxAttempts: 2})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), got)
+	_, err = q.Enqueue(context.Background(), "mail", nil, &EnqueueOptions{UniqueKey: "queued"})
+	assert.Equal(t, ErrJobExists, err)
+	_, err = q.Enqueue(context.Background(), "mail", func() {}, nil)
+	assert.Error(t, err, "payload is not json")
+
+	stmts := f.statements("INSERT INTO " + JobsTable)
+	require.Len(t, stmts, 3)
+	assert.Equal(t, "mail", stmts[0].args[0])
+	assert.Nil(t, stmts[0].args[1])
+	assert.Equal(t, `{"to":"a"}`, stmts[0].args[2])
+	assert.Equal(t, int64(4), stmts[0].args[4], "default max attempts")
+	assert.WithinDuration(t, time.Now(), stmts[0].args[5].(time.Time), time.Second)
+	assert.Equal(t, []interface{}{"mail", "new", "null", int64(5), int64(2), runAt}, stmts[1].args)
+}
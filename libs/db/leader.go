@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber-go/tally"
+	"go.uber.org/fx"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+// LeaderFunc is work of leader. Its context is canceled when leadership is lost or leader is stopped.
+type LeaderFunc func(ctx context.Context)
+
+// Leader run callback in one instance of service which holds advisory lock of name.
+// Other instances wait for lock and take leadership when it is released or connection of leader is lost.
+type Leader struct {
+	ctx    context.Context
+	logger log.Logger
+	locker *Locker
+	name   string
+	fn     LeaderFunc
+
+	// RetryInterval is delay before next election after callback returned or leadership was lost
+	RetryInterval time.Duration
+
+	leader int32
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewLeader(ctx context.Context, logger log.Logger, locker *Locker, name string, fn LeaderFunc, lc fx.Lifecycle) (*Leader, error) {
+	if locker == nil {
+		return nil, fmt.Errorf("no locker for leader %s", name)
+	}
+	l := &Leader{
+		ctx:           ctx,
+		logger:        log.ForkLogger(logger),
+		locker:        locker,
+		name:          name,
+		fn:            fn,
+		RetryInterval: time.Second,
+		done:          make(chan struct{}),
+	}
+	if lc != nil {
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				l.Start()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				return l.Stop(ctx)
+			},
+		})
+	}
+	return l, nil
+}
+
+// IsLeader report that this instance holds leadership now
+func (l *Leader) IsLeader() bool {
+	return atomic.LoadInt32(&l.leader) == 1
+}
+
+// Start run election loop in background
+func (l *Leader) Start() {
+	ctx, cancel := context.WithCancel(l.ctx)
+	l.cancel = cancel
+	go l.run(ctx)
+}
+
+// Stop cancel callback, release leadership and wait for election loop
+func (l *Leader) Stop(ctx context.Context) error {
+	if l.cancel == nil {
+		return nil
+	}
+	l.cancel()
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Leader) run(ctx context.Context) {
+	defer close(l.done)
+	for ctx.Err() == nil {
+		lease, err := l.locker.Lock(ctx, l.name)
+		if err != nil {
+			return // ctx is done
+		}
+		l.lead(ctx, lease)
+		select {
+		case <-ctx.Done():
+		case <-time.After(l.RetryInterval):
+		}
+	}
+}
+
+// lead run callback while lease is held
+func (l *Leader) lead(ctx context.Context, lease *Lease) {
+	l.setLeader(true)
+	l.logger.Infof("leadership %s is taken", l.name)
+	leadCtx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		l.fn(leadCtx)
+	}()
+	select {
+	case <-finished:
+	case <-lease.Done():
+		l.logger.Warnf("leadership %s is lost", l.name)
+	case <-ctx.Done():
+	}
+	cancel()
+	<-finished
+	l.setLeader(false)
+
+	releaseCtx, releaseCancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer releaseCancel()
+	err := lease.Release(releaseCtx)
+	if err != nil {
+		l.logger.Warnf("release leadership %s: %v", l.name, err)
+	}
+}
+
+func (l *Leader) setLeader(leader bool) {
+	var v int32
+	var gauge float64
+	if leader {
+		v, gauge = 1, 1
+	}
+	atomic.StoreInt32(&l.leader, v)
+	l.locker.selector.setLeadership(l.locker.cfg.Key, l.name, leader)
+	l.metrics().Gauge("leader").Update(gauge)
+}
+
+func (l *Leader) metrics() tally.Scope {
+	scope := l.locker.selector.metrics.Scope()
+	if scope == nil {
+		return tally.NoopScope
+	}
+	return scope.Tagged(map[string]string{"db": l.locker.cfg.Key, "leader": l.name})
+}
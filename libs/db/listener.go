@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"go.uber.org/fx"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/rx"
+	"git.pnhub.ru/core/libs/util"
+)
+
+type ListenerConfig struct {
+	// Key is db key in Selector(default DefaultDBKey)
+	Key      string   `json:"key" yaml:"key"`
+	Channels []string `json:"channels" yaml:"channels"`
+	// JSON decode payloads to Notification.Data
+	JSON bool `json:"json" yaml:"json"`
+	// Reconnect is backoff between reconnects after connection loss
+	Reconnect util.Backoff `json:"reconnect" yaml:"reconnect"`
+}
+
+// Notification is postgres notification pushed to rx.Notifier of its channel
+type Notification struct {
+	Channel string
+	PID     uint32
+	Payload string
+	// Data is decoded json payload if ListenerConfig.JSON is set
+	Data interface{}
+}
+
+// Listener deliver postgres LISTEN/NOTIFY notifications to rx.Notifier per channel.
+// It holds dedicated connection, reconnects and re-LISTEN channels after connection loss.
+type Listener struct {
+	ctx      context.Context
+	logger   log.Logger
+	selector *Selector
+	cfg      ListenerConfig
+
+	mx        sync.RWMutex
+	notifiers map[string]*rx.Notifier
+	wake      context.CancelFunc
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewListener(ctx context.Context, logger log.Logger, selector *Selector, cfg *ListenerConfig, lc fx.Lifecycle) (*Listener, error) {
+	if selector == nil {
+		return nil, fmt.Errorf("no db selector for listener")
+	}
+	c := ListenerConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.Key == "" {
+		c.Key = DefaultDBKey
+	}
+	l := &Listener{
+		ctx:       ctx,
+		logger:    log.ForkLogger(logger),
+		selector:  selector,
+		cfg:       c,
+		notifiers: make(map[string]*rx.Notifier),
+		done:      make(chan struct{}),
+	}
+	for _, channel := range c.Channels {
+		l.notifiers[channel] = rx.NewNotifier(ctx)
+	}
+	if lc != nil {
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				l.Start()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				return l.Stop(ctx)
+			},
+		})
+	}
+	return l, nil
+}
+
+// Notifier return notifier of channel. Channel which is not in config is listened after call.
+func (l *Listener) Notifier(channel string) *rx.Notifier {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	n, ok := l.notifiers[channel]
+	if !ok {
+		n = rx.NewNotifier(l.ctx)
+		l.notifiers[channel] = n
+		if l.wake != nil {
+			l.wake()
+		}
+	}
+	return n
+}
+
+// Start run listen loop in background
+func (l *Listener) Start() {
+	ctx, cancel := context.WithCancel(l.ctx)
+	l.cancel = cancel
+	go l.run(ctx)
+}
+
+// Stop stop listen loop and close connection
+func (l *Listener) Stop(ctx context.Context) error {
+	if l.cancel == nil {
+		return nil
+	}
+	l.cancel()
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Notify send notification to channel. Non string payload is encoded to json.
+// Inside RunInTx notification is sent in transaction and delivered on commit.
+func (l *Listener) Notify(ctx context.Context, channel string, payload interface{}) error {
+	return Notify(ctx, l.selector, l.cfg.Key, channel, payload)
+}
+
+// Notify send notification to channel of db key with pg_notify, transaction from ctx is used if it is opened by RunInTx
+func Notify(ctx context.Context, selector *Selector, key string, channel string, payload interface{}) error {
+	var text string
+	switch p := payload.(type) {
+	case string:
+		text = p
+	case []byte:
+		text = string(p)
+	default:
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	const query = "SELECT pg_notify($1, $2)"
+	if tx := TxFromContext(ctx, key); tx != nil {
+		return tx.exec(ctx, query, channel, text)
+	}
+	node, err := selector.Writer(ctx, key)
+	if err != nil {
+		return err
+	}
+	if node.PGX != nil {
+		_, err = node.PGX.Exec(ctx, query, channel, text)
+		return err
+	}
+	if node.DB == nil {
+		return ErrWrongDriver{Key: key, Driver: node.Cfg.Driver, Want: "postgres"}
+	}
+	_, err = node.DB.ExecContext(ctx, query, channel, text)
+	return err
+}
+
+func (l *Listener) run(ctx context.Context) {
+	defer close(l.done)
+	attempt := 0
+	for ctx.Err() == nil {
+		err := l.listen(ctx, func() { attempt = 0 })
+		if ctx.Err() != nil {
+			return
+		}
+		l.logger.Warnf("db listener connection lost: %v", err)
+		if l.cfg.Reconnect.Wait(ctx, attempt) != nil {
+			return
+		}
+		attempt++
+	}
+}
+
+// listen open dedicated connection, LISTEN channels and deliver notifications until error or ctx is done
+func (l *Listener) listen(ctx context.Context, connected func()) error {
+	cfg, err := l.selector.GetCfg(l.cfg.Key)
+	if err != nil {
+		return err
+	}
+	connCfg := *cfg
+	connCfg.MaxOpenConns = 1
+	connCfg.Replicas = nil
+	conn, err := NewPGXNative(ctx, l.logger, &connCfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c, err := conn.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	connected()
+	listened := make(map[string]bool)
+	for {
+		// wait is canceled when channel is added, pgconn keeps connection on cancel(it is read timeout)
+		waitCtx, wake := context.WithCancel(ctx)
+		l.mx.Lock()
+		l.wake = wake
+		l.mx.Unlock()
+		err = l.listenChannels(ctx, c.Conn(), listened)
+		if err != nil {
+			wake()
+			return err
+		}
+		n, err := c.Conn().WaitForNotification(waitCtx)
+		wake()
+		if err != nil {
+			if waitCtx.Err() != nil && ctx.Err() == nil {
+				continue // channel is added
+			}
+			return err
+		}
+		l.deliver(n)
+	}
+}
+
+// listenChannels LISTEN channels which are not listened on connection yet
+func (l *Listener) listenChannels(ctx context.Context, conn *pgx.Conn, listened map[string]bool) error {
+	l.mx.RLock()
+	var channels []string
+	for channel := range l.notifiers {
+		if !listened[channel] {
+			channels = append(channels, channel)
+		}
+	}
+	l.mx.RUnlock()
+	for _, channel := range channels {
+		_, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize())
+		if err != nil {
+			return err
+		}
+		listened[channel] = true
+	}
+	if len(channels) > 0 {
+		l.logger.Infof("db listener: listen %v", channels)
+	}
+	return nil
+}
+
+func (l *Listener) deliver(n *pgconn.Notification) {
+	l.mx.RLock()
+	notifier, ok := l.notifiers[n.Channel]
+	l.mx.RUnlock()
+	if !ok {
+		return
+	}
+	out := &Notification{Channel: n.Channel, PID: n.PID, Payload: n.Payload}
+	if l.cfg.JSON && n.Payload != "" {
+		err := json.Unmarshal([]byte(n.Payload), &out.Data)
+		if err != nil {
+			l.logger.Warnf("db listener: bad json payload on %s: %v", n.Channel, err)
+		}
+	}
+	notifier.Notify(out)
+}
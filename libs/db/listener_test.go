@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerDeliver(t *testing.T) {
+	d := newFakeDB(nil).selector()
+	l, err := NewListener(context.Background(), d.logger, d, &ListenerConfig{Channels: []string{"users"}, JSON: true}, nil)
+	require.NoError(t, err)
+	received := make(chan *Notification, 10)
+	o := l.Notifier("users").CreateObserver(func(ctx context.Context, i interface{}) {
+		received <- i.(*Notification)
+	}, 10)
+	defer o.Stop()
+
+	next := func() *Notification {
+		select {
+		case n := <-received:
+			return n
+		case <-time.After(time.Second):
+			t.Fatal("notification is not delivered")
+			return nil
+		}
+	}
+	l.deliver(&pgconn.Notification{Channel: "orders", PID: 7, Payload: `{"id":2}`})
+	l.deliver(&pgconn.Notification{Channel: "users", PID: 7, Payload: `{"id":1}`})
+	assert.Equal(t, &Notification{Channel: "users", PID: 7, Payload: `{"id":1}`, Data: map[string]interface{}{"id": float64(1)}}, next(),
+		"notification of channel without notifier is skipped")
+
+	l.deliver(&pgconn.Notification{Channel: "users", PID: 7, Payload: "deleted"})
+	assert.Equal(t, &Notification{Channel: "users", PID: 7, Payload: "deleted"}, next(), "bad json is delivered as payload")
+}
+
+func TestListenerNotifier(t *testing.T) {
+	d := newFakeDB(nil).selector()
+	l, err := NewListener(context.Background(), d.logger, d, &ListenerConfig{Channels: []string{"users"}}, nil)
+	require.NoError(t, err)
+	woken := 0
+	l.wake = func() {
+		woken++
+	}
+	users := l.Notifier("users")
+	assert.Equal(t, 0, woken, "configured channel is listened on connect")
+	orders := l.Notifier("orders")
+	assert.Same(t, orders, l.Notifier("orders"))
+	assert.NotSame(t, users, orders)
+	assert.Equal(t, 1, woken, "connection wait is interrupted once for new channel")
+}
+
+func TestNotify(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return nil, nil
+	})
+	d := f.selector()
+	ctx := context.Background()
+	require.NoError(t, Notify(ctx, d, DefaultDBKey, "users", "plain"))
+	require.NoError(t, Notify(ctx, d, DefaultDBKey, "users", []byte("bytes")))
+	require.NoError(t, Notify(ctx, d, DefaultDBKey, "users", map[string]int{"id": 1}))
+	var payloads []interface{}
+	for _, s := range f.statements("pg_notify") {
+		assert.Equal(t, "users", s.args[0])
+		payloads = append(payloads, s.args[1])
+	}
+	assert.Equal(t, []interface{}{"plain", "bytes", `{"id":1}`}, payloads)
+
+	err := RunInTx(ctx, d, "", nil, func(ctx context.Context) error {
+		return Notify(ctx, d, DefaultDBKey, "orders", "created")
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"BEGIN", "SELECT pg_notify($1, $2)", "COMMIT"}, queryLog(f)[3:], "notification is sent in transaction of context")
+
+	assert.IsType(t, ErrNotFound{}, Notify(ctx, d, "unknown", "users", "plain"))
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"go.uber.org/fx"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+type LockerConfig struct {
+	// Key is db key in Selector(default DefaultDBKey)
+	Key string `json:"key" yaml:"key"`
+	// RetryInterval is period of lock attempts of blocking Lock(default 1s)
+	RetryInterval time.Duration `json:"retry_interval" yaml:"retry_interval"`
+	// CheckInterval is period of connection ping while locks are held(default 1s)
+	CheckInterval time.Duration `json:"check_interval" yaml:"check_interval"`
+	// Timeout is timeout of statements on dedicated connection(default 5s)
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+	// PingTimeout is timeout of connection check, lock calls wait for it(default 250ms)
+	PingTimeout time.Duration `json:"ping_timeout" yaml:"ping_timeout"`
+}
+
+// LockID return advisory lock id of name
+func LockID(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// Locker take postgres session advisory locks on dedicated connection.
+// Locks are released by postgres when connection is lost, leases of lost connection are done.
+type Locker struct {
+	ctx      context.Context
+	logger   log.Logger
+	selector *Selector
+	cfg      LockerConfig
+
+	mx     sync.Mutex
+	conn   *pgx.Conn
+	leases map[int64]*Lease
+	cancel context.CancelFunc
+}
+
+// Lease is held advisory lock
+type Lease struct {
+	Name   string
+	ID     int64
+	locker *Locker
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Done is closed when lock is released or its connection is lost
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// Release unlock advisory lock
+func (l *Lease) Release(ctx context.Context) error {
+	return l.locker.release(ctx, l)
+}
+
+func (l *Lease) close() {
+	l.once.Do(func() {
+		close(l.done)
+	})
+}
+
+func NewLocker(ctx context.Context, logger log.Logger, selector *Selector, cfg *LockerConfig, lc fx.Lifecycle) (*Locker, error) {
+	if selector == nil {
+		return nil, fmt.Errorf("no db selector for locker")
+	}
+	c := LockerConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.Key == "" {
+		c.Key = DefaultDBKey
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = time.Second
+	}
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Second * 5
+	}
+	if c.PingTimeout <= 0 {
+		c.PingTimeout = time.Millisecond * 250
+	}
+	checkCtx, cancel := context.WithCancel(ctx)
+	l := &Locker{
+		ctx:      ctx,
+		logger:   log.ForkLogger(logger),
+		selector: selector,
+		cfg:      c,
+		leases:   make(map[int64]*Lease),
+		cancel:   cancel,
+	}
+	go l.check(checkCtx)
+	if lc != nil {
+		lc.Append(fx.Hook{
+			OnStop: func(ctx context.Context) error {
+				l.Close(ctx)
+				return nil
+			},
+		})
+	}
+	return l, nil
+}
+
+// TryLock take lock without waiting, return false if it is held by other session.
+// Statement is run with internal context, so cancel of ctx does not break connection with other leases.
+func (l *Locker) TryLock(ctx context.Context, name string) (*Lease, bool, error) {
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
+	id := LockID(name)
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if _, ok := l.leases[id]; ok {
+		return nil, false, nil // held by this locker
+	}
+	stmtCtx, cancel := l.statementCtx()
+	defer cancel()
+	conn, err := l.connLocked(stmtCtx)
+	if err != nil {
+		return nil, false, err
+	}
+	var ok bool
+	err = conn.QueryRow(stmtCtx, "SELECT pg_try_advisory_lock($1)", id).Scan(&ok)
+	if err != nil {
+		l.dropLocked(err)
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	lease := &Lease{Name: name, ID: id, locker: l, done: make(chan struct{})}
+	l.leases[id] = lease
+	return lease, true, nil
+}
+
+// Lock wait until lock is taken or ctx is done. Lock is polled with RetryInterval,
+// so connection is not blocked for other locks.
+func (l *Locker) Lock(ctx context.Context, name string) (*Lease, error) {
+	ticker := time.NewTicker(l.cfg.RetryInterval)
+	defer ticker.Stop()
+	for {
+		lease, ok, err := l.TryLock(ctx, name)
+		if err != nil {
+			l.logger.Warnf("lock %s: %v", name, err)
+		}
+		if ok {
+			return lease, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close release all locks and close connection
+func (l *Locker) Close(ctx context.Context) {
+	l.cancel()
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.conn == nil {
+		return
+	}
+	err := l.conn.Close(ctx)
+	if err != nil {
+		l.logger.Warnf("close locker connection: %v", err)
+	}
+	l.dropLocked(nil)
+}
+
+func (l *Locker) release(ctx context.Context, lease *Lease) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.leases[lease.ID] != lease {
+		return nil // already released or lost
+	}
+	delete(l.leases, lease.ID)
+	lease.close()
+	if l.conn == nil {
+		return nil
+	}
+	stmtCtx, cancel := l.statementCtx()
+	defer cancel()
+	_, err := l.conn.Exec(stmtCtx, "SELECT pg_advisory_unlock($1)", lease.ID)
+	if err != nil {
+		l.dropLocked(err)
+	}
+	return err
+}
+
+// statementCtx return context for statement on dedicated connection. Cancel of context closes connection,
+// so it is not derived from context of caller.
+func (l *Locker) statementCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(l.ctx, l.cfg.Timeout)
+}
+
+// connLocked return dedicated connection, connection is opened if it is not
+func (l *Locker) connLocked(ctx context.Context) (*pgx.Conn, error) {
+	if l.conn != nil {
+		return l.conn, nil
+	}
+	cfg, err := l.selector.GetCfg(l.cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	connCfg, err := pgx.ParseConfig(cfg.FormatDriver())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pgx.ConnectConfig(ctx, connCfg)
+	if err != nil {
+		return nil, err
+	}
+	l.conn = conn
+	return conn, nil
+}
+
+// dropLocked forget connection after error, all leases are lost with it
+func (l *Locker) dropLocked(cause error) {
+	if cause != nil && len(l.leases) > 0 {
+		l.logger.Error(fmt.Errorf("locker connection lost with %d locks: %v", len(l.leases), cause))
+	}
+	if l.conn != nil {
+		_ = l.conn.Close(context.Background())
+		l.conn = nil
+	}
+	for id, lease := range l.leases {
+		lease.close()
+		delete(l.leases, id)
+	}
+}
+
+// check ping connection while locks are held. Connection can not be used concurrently,
+// so ping holds mutex and it is limited by short PingTimeout.
+func (l *Locker) check(ctx context.Context) {
+	ticker := time.NewTicker(l.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		l.mx.Lock()
+		if l.conn != nil && len(l.leases) > 0 {
+			pingCtx, cancel := context.WithTimeout(ctx, l.cfg.PingTimeout)
+			err := l.conn.Ping(pingCtx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				l.dropLocked(err)
+			}
+		}
+		l.mx.Unlock()
+	}
+}
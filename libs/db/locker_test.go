@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+func TestLockID(t *testing.T) {
+	// fnv-1a 64 of name as signed bigint of pg_advisory_lock
+	assert.Equal(t, int64(-3750763034362895579), LockID(""))
+	assert.Equal(t, LockID("jobs"), LockID("jobs"))
+
+	seen := make(map[int64]string)
+	for _, name := range []string{"jobs", "jobs ", "Jobs", "outbox", "migrations", "a", "b"} {
+		id := LockID(name)
+		other, ok := seen[id]
+		assert.False(t, ok, "%q and %q have same id", name, other)
+		seen[id] = name
+	}
+}
+
+func newTestLocker(t *testing.T) *Locker {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	l, err := NewLocker(ctx, &log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()}, &Selector{}, nil, nil)
+	require.NoError(t, err)
+	return l
+}
+
+func testLease(l *Locker, name string) *Lease {
+	lease := &Lease{Name: name, ID: LockID(name), locker: l, done: make(chan struct{})}
+	l.leases[lease.ID] = lease
+	return lease
+}
+
+func isDone(lease *Lease) bool {
+	select {
+	case <-lease.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestLockerDefaults(t *testing.T) {
+	l := newTestLocker(t)
+	assert.Equal(t, LockerConfig{
+		Key:           DefaultDBKey,
+		RetryInterval: time.Second,
+		CheckInterval: time.Second,
+		Timeout:       time.Second * 5,
+		PingTimeout:   time.Millisecond * 250,
+	}, l.cfg)
+
+	_, err := NewLocker(context.Background(), nil, nil, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestLockerDropLocked(t *testing.T) {
+	l := newTestLocker(t)
+	a := testLease(l, "a")
+	b := testLease(l, "b")
+
+	l.mx.Lock()
+	l.dropLocked(errors.New("connection reset"))
+	l.mx.Unlock()
+
+	assert.True(t, isDone(a))
+	assert.True(t, isDone(b))
+	assert.Empty(t, l.leases)
+	assert.Nil(t, l.conn)
+
+	// lost lease is released without statement
+	assert.NoError(t, a.Release(context.Background()))
+	l.mx.Lock()
+	l.dropLocked(nil)
+	l.mx.Unlock()
+}
+
+func TestLockerRelease(t *testing.T) {
+	l := newTestLocker(t)
+	a := testLease(l, "a")
+	b := testLease(l, "b")
+
+	// conn is nil, lease is forgotten without statement
+	require.NoError(t, a.Release(context.Background()))
+	assert.True(t, isDone(a))
+	assert.False(t, isDone(b), "other lease is held")
+	assert.NotContains(t, l.leases, a.ID)
+	assert.NoError(t, a.Release(context.Background()), "second release is noop")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, b.Release(ctx))
+	assert.False(t, isDone(b), "lease is kept when release is cancelled")
+}
+
+func TestLockerTryLockHeld(t *testing.T) {
+	l := newTestLocker(t)
+	testLease(l, "a")
+
+	lease, ok, err := l.TryLock(context.Background(), "a")
+	assert.NoError(t, err)
+	assert.False(t, ok, "lock held by this locker")
+	assert.Nil(t, lease)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok, err = l.TryLock(ctx, "b")
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, ok)
+}
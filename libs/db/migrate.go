@@ -2,76 +2,398 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database"
-	"github.com/golang-migrate/migrate/v4/database/clickhouse"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
-	"github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source"
 
 	"git.pnhub.ru/core/libs/log"
 )
 
+// NilMigrationVersion is version of database without applied migrations
+const NilMigrationVersion = database.NilVersion
+
+// Migration directions
+const (
+	MigrationUp   = "up"
+	MigrationDown = "down"
+)
+
+// productionEnvironments are values of Config.Environment where down migrations are refused by default
+var productionEnvironments = map[string]bool{
+	"production": true,
+	"prod":       true,
+}
+
+// ErrDirtyMigration is returned when previous migration failed and database is marked dirty
+type ErrDirtyMigration struct {
+	Database string
+	Version  int
+}
+
+func (e ErrDirtyMigration) Error() string {
+	return fmt.Sprintf("database %s is dirty at migration version %d: previous migration failed in the middle. "+
+		"Fix schema manually, then mark it with Migrate.Force(%d) if migration %d is fully applied "+
+		"or with Migrate.Force(<previous version>) if it is not", e.Database, e.Version, e.Version, e.Version)
+}
+
+// ErrDownMigrationRefused is returned for down migration in production environment without Config.AllowDownMigrations
+type ErrDownMigrationRefused struct {
+	Database    string
+	Environment string
+}
+
+func (e ErrDownMigrationRefused) Error() string {
+	return fmt.Sprintf("down migration of database %s is refused in %s environment, set allow_down_migrations to run it",
+		e.Database, e.Environment)
+}
+
+// MigrationStatus is state of database migrations. Version is NilMigrationVersion when no migration is applied.
+type MigrationStatus struct {
+	Version int                `json:"version"`
+	Dirty   bool               `json:"dirty"`
+	Latest  int                `json:"latest"`
+	Pending []PlannedMigration `json:"pending,omitempty"`
+}
+
+// PlannedMigration is migration file which will be applied to reach target version
+type PlannedMigration struct {
+	Version   uint   `json:"version"`
+	Direction string `json:"direction"`
+	Name      string `json:"name"`
+}
+
+func (p PlannedMigration) String() string {
+	return fmt.Sprintf("%s %s", p.Direction, p.Name)
+}
+
 type Migrate struct {
 	cfg    *Config
 	logger log.Logger
+
+	source   *memorySource
+	driver   database.Driver
+	db       *sql.DB
+	instance *migrate.Migrate
 }
 
 func NewMigrate(logger log.Logger, cfg *Config) *Migrate {
 	return &Migrate{cfg: cfg, logger: log.ForkLogger(logger)}
 }
 
+// Act migrate database to Config.DesiredVersion. It does nothing if desired version or migrations source is not set.
+// Dirty database fails with ErrDirtyMigration, connection is closed after migration.
 func (m *Migrate) Act() error {
-	if m.cfg.DesiredVersion > 0 && m.cfg.SQLDir != "" {
-		driver, err := m.CreateMigrationDriver()
+	_, err := m.ActStatus()
+	return err
+}
+
+// ActStatus is Act which return resulting migration status(nil if migrations are not configured)
+func (m *Migrate) ActStatus() (*MigrationStatus, error) {
+	if m.cfg.DesiredVersion <= 0 || (m.cfg.SQLDir == "" && m.cfg.MigrationsSource == "") {
+		return nil, nil
+	}
+	defer m.closeLogged()
+
+	version, dirty, err := m.version()
+	if err != nil {
+		return nil, err
+	}
+	m.logger.Infof("current DB migration: %s - version:%d dirty:%t", m.cfg.Database, version, dirty)
+	if dirty {
+		return nil, ErrDirtyMigration{Database: m.cfg.Database, Version: version}
+	}
+	err = m.verifyOnStart()
+	if err != nil {
+		return nil, err
+	}
+	if m.cfg.DesiredVersion != version {
+		err = m.Goto(uint(m.cfg.DesiredVersion))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		sqlDir := fmt.Sprintf("file://%s", m.cfg.SQLDir)
-		fd, err := new(file.File).Open(sqlDir)
+	} else {
+		err = m.recordChecksums(version)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		version, dirty, err := driver.Version()
+	}
+	err = m.checkDriftOnStart()
+	if err != nil {
+		return nil, err
+	}
+	return m.Status()
+}
+
+// Up apply all pending migrations
+func (m *Migrate) Up() error {
+	return m.run(func(instance *migrate.Migrate) error {
+		return instance.Up()
+	})
+}
+
+// Down rollback n last migrations
+func (m *Migrate) Down(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	err := m.checkDown()
+	if err != nil {
+		return err
+	}
+	return m.run(func(instance *migrate.Migrate) error {
+		return instance.Steps(-n)
+	})
+}
+
+// Goto migrate up or down to version. Down direction is checked by environment.
+func (m *Migrate) Goto(version uint) error {
+	current, _, err := m.version()
+	if err != nil {
+		return err
+	}
+	if int(version) < current {
+		err = m.checkDown()
 		if err != nil {
 			return err
 		}
-		m.logger.Infof("current DB migration: %s - version:%d dirty:%t", m.cfg.Database, version, dirty)
-		if m.cfg.DesiredVersion != version {
-			instance, err := migrate.NewWithInstance("file", fd, m.cfg.Database, driver)
-			if err != nil {
-				return err
+	}
+	return m.run(func(instance *migrate.Migrate) error {
+		return instance.Migrate(version)
+	})
+}
+
+// Force set version and reset dirty flag without running migrations(NilMigrationVersion removes version)
+func (m *Migrate) Force(version int) error {
+	return m.run(func(instance *migrate.Migrate) error {
+		return instance.Force(version)
+	})
+}
+
+// Status return current version, latest available version and pending up migrations
+func (m *Migrate) Status() (*MigrationStatus, error) {
+	version, dirty, err := m.version()
+	if err != nil {
+		return nil, err
+	}
+	latest, err := m.latest()
+	if err != nil {
+		return nil, err
+	}
+	st := &MigrationStatus{Version: version, Dirty: dirty, Latest: latest}
+	if latest > version {
+		st.Pending, err = m.Plan(uint(latest))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// Plan list migration files which will be applied to move from current version to target version
+func (m *Migrate) Plan(target uint) ([]PlannedMigration, error) {
+	err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	current, _, err := m.version()
+	if err != nil {
+		return nil, err
+	}
+	var plan []PlannedMigration
+	if int(target) > current {
+		var v uint
+		if current == NilMigrationVersion {
+			v, err = m.source.First()
+		} else {
+			v, err = m.source.Next(uint(current))
+		}
+		for err == nil && v <= target {
+			name, readErr := m.fileName(v, MigrationUp)
+			if readErr != nil {
+				return nil, readErr
 			}
-			err = instance.Migrate(uint(m.cfg.DesiredVersion))
-			if err != nil {
-				return err
+			if name != "" {
+				plan = append(plan, PlannedMigration{Version: v, Direction: MigrationUp, Name: name})
+			}
+			v, err = m.source.Next(v)
+		}
+	} else if int(target) < current {
+		v := uint(current)
+		for err == nil && v > target {
+			name, readErr := m.fileName(v, MigrationDown)
+			if readErr != nil {
+				return nil, readErr
 			}
-			version, dirty, err := instance.Version()
-			if err != nil {
-				return err
+			if name != "" {
+				plan = append(plan, PlannedMigration{Version: v, Direction: MigrationDown, Name: name})
 			}
-			m.logger.Infof("migrated DB: %s - version:%d dirty:%t", m.cfg.Database, version, dirty)
+			v, err = m.source.Prev(v)
+		}
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// Close close source and database connection
+func (m *Migrate) Close() error {
+	if m.instance == nil {
+		return nil
+	}
+	srcErr, dbErr := m.instance.Close()
+	m.instance, m.source, m.driver, m.db = nil, nil, nil, nil
+	if srcErr != nil || dbErr != nil {
+		return fmt.Errorf("close migrations: source: %v, database: %v", srcErr, dbErr)
+	}
+	return nil
+}
+
+func (m *Migrate) closeLogged() {
+	err := m.Close()
+	if err != nil {
+		m.logger.Error(err)
+	}
+}
+
+func (m *Migrate) open() error {
+	if m.instance != nil {
+		return nil
+	}
+	src, err := newMigrationSource(m.cfg)
+	if err != nil {
+		return err
+	}
+	driver, sqlDB, err := m.createDriver()
+	if err != nil {
+		return err
+	}
+	driver = &goMigrationDriver{Driver: driver, db: sqlDB}
+	instance, err := migrate.NewWithInstance("memory", src, m.cfg.Database, driver)
+	if err != nil {
+		_ = driver.Close()
+		return err
+	}
+	m.source, m.driver, m.db, m.instance = src, driver, sqlDB, instance
+	return nil
+}
+
+// run call migration action and log resulting version
+func (m *Migrate) run(action func(instance *migrate.Migrate) error) error {
+	err := m.open()
+	if err != nil {
+		return err
+	}
+	err = action(m.instance)
+	if err == migrate.ErrNoChange {
+		err = nil
+	}
+	if dirtyErr, ok := err.(migrate.ErrDirty); ok {
+		err = ErrDirtyMigration{Database: m.cfg.Database, Version: dirtyErr.Version}
+	}
+	if err != nil {
+		return err
+	}
+	version, dirty, err := m.version()
+	if err != nil {
+		return err
+	}
+	m.logger.Infof("migrated DB: %s - version:%d dirty:%t", m.cfg.Database, version, dirty)
+	if dirty {
+		return nil
+	}
+	return m.recordChecksums(version)
+}
+
+func (m *Migrate) version() (int, bool, error) {
+	err := m.open()
+	if err != nil {
+		return 0, false, err
+	}
+	return m.driver.Version()
+}
+
+// latest return last version from source
+func (m *Migrate) latest() (int, error) {
+	err := m.open()
+	if err != nil {
+		return 0, err
+	}
+	v, err := m.source.First()
+	if errors.Is(err, os.ErrNotExist) {
+		return NilMigrationVersion, nil
+	}
+	for err == nil {
+		var next uint
+		next, err = m.source.Next(v)
+		if err == nil {
+			v = next
 		}
 	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	return int(v), nil
+}
+
+// fileName return migration file name or empty string if source has no migration in direction
+func (m *Migrate) fileName(v uint, direction string) (string, error) {
+	var migration *source.Migration
+	var ok bool
+	if direction == MigrationDown {
+		migration, ok = m.source.migrations.Down(v)
+	} else {
+		migration, ok = m.source.migrations.Up(v)
+	}
+	if !ok {
+		return "", nil
+	}
+	return migration.Raw, nil
+}
+
+// checkDown refuse down migration in production environment
+func (m *Migrate) checkDown() error {
+	env := strings.ToLower(m.cfg.Environment)
+	if productionEnvironments[env] && !m.cfg.AllowDownMigrations {
+		return ErrDownMigrationRefused{Database: m.cfg.Database, Environment: m.cfg.Environment}
+	}
 	return nil
 }
 
 func (m *Migrate) CreateMigrationDriver() (database.Driver, error) {
+	driver, _, err := m.createDriver()
+	return driver, err
+}
+
+func (m *Migrate) createDriver() (database.Driver, *sql.DB, error) {
+	var driverName string
 	switch m.cfg.Driver {
 	case "postgres", "pgx", "pgx-native":
-		db, err := sql.Open("pgx", m.cfg.FormatDriver())
-		if err != nil {
-			return nil, err
-		}
-		return postgres.WithInstance(db, &postgres.Config{})
+		driverName = "pgx"
 	case "clickhouse":
-		db, err := sql.Open(m.cfg.Driver, m.cfg.FormatDriver())
-		if err != nil {
-			return nil, err
-		}
-		return clickhouse.WithInstance(db, &clickhouse.Config{})
+		driverName = m.cfg.Driver
 	default:
-		return nil, fmt.Errorf("unknown driver for migrations tool")
+		return nil, nil, fmt.Errorf("unknown driver for migrations tool")
+	}
+	db, err := sql.Open(driverName, m.cfg.FormatDriver())
+	if err != nil {
+		return nil, nil, err
+	}
+	var driver database.Driver
+	if driverName == "clickhouse" {
+		driver, err = m.createClickHouseDriver(db)
+	} else {
+		driver, err = postgres.WithInstance(db, &postgres.Config{})
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, err
 	}
+	return driver, db, nil
 }
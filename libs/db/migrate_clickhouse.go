@@ -0,0 +1,80 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/clickhouse"
+)
+
+// clusterPlaceholder in ClickHouse migrations is replaced by Config.Cluster, e.g. CREATE TABLE t ON CLUSTER ${cluster}
+const clusterPlaceholder = "${cluster}"
+
+// createClickHouseDriver create migrations driver. With Config.Cluster migrations table is created
+// ON CLUSTER with ReplicatedMergeTree engine before driver init, so version is shared by all replicas.
+func (m *Migrate) createClickHouseDriver(db *sql.DB) (database.Driver, error) {
+	cfg := &clickhouse.Config{
+		DatabaseName:    m.cfg.Database,
+		MigrationsTable: clickhouse.DefaultMigrationsTable,
+	}
+	if m.cfg.Cluster == "" {
+		return clickhouse.WithInstance(db, cfg)
+	}
+	err := m.createReplicatedMigrationsTable(db, cfg.MigrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := clickhouse.WithInstance(db, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterDriver{Driver: driver, cluster: m.cfg.Cluster}, nil
+}
+
+func (m *Migrate) createReplicatedMigrationsTable(db *sql.DB, table string) error {
+	database := m.cfg.Database
+	if database == "" {
+		err := db.QueryRow("SELECT currentDatabase()").Scan(&database)
+		if err != nil {
+			return err
+		}
+	}
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.%s ON CLUSTER %s (
+			version    Int64,
+			dirty      UInt8,
+			sequence   UInt64
+		) ENGINE = ReplicatedMergeTree('/clickhouse/tables/%s/%s/%s', '{replica}') ORDER BY sequence`,
+		database, table, m.cfg.Cluster, m.cfg.Cluster, database, table)
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("create replicated migrations table: %v", err)
+	}
+	return nil
+}
+
+// onCluster return ON CLUSTER clause for ClickHouse cluster or empty string
+func (m *Migrate) onCluster() string {
+	if m.cfg.Driver != "clickhouse" || m.cfg.Cluster == "" {
+		return ""
+	}
+	return " ON CLUSTER " + m.cfg.Cluster
+}
+
+// clusterDriver replace cluster placeholder in migrations
+type clusterDriver struct {
+	database.Driver
+	cluster string
+}
+
+func (d *clusterDriver) Run(migration io.Reader) error {
+	body, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	body = bytes.ReplaceAll(body, []byte(clusterPlaceholder), []byte(d.cluster))
+	return d.Driver.Run(bytes.NewReader(body))
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/source"
+)
+
+// goMigrationMarker is body of placeholder migration which is replaced by Go function on run
+const goMigrationMarker = "-- go-migration:"
+
+// GoMigrationFunc is migration written in Go. It is run in transaction of migration connection.
+type GoMigrationFunc func(ctx context.Context, tx *Tx) error
+
+type goMigration struct {
+	name string
+	up   GoMigrationFunc
+	down GoMigrationFunc
+}
+
+var migrationsRegistry = struct {
+	mx    sync.RWMutex
+	files map[string]map[string][]byte
+	funcs map[string]map[uint]*goMigration
+}{
+	files: make(map[string]map[string][]byte),
+	funcs: make(map[string]map[uint]*goMigration),
+}
+
+// RegisterMigrations add migration files(name -> content) to in-binary source with name.
+// It is called from code generated by cmd/embed-migrations.
+func RegisterMigrations(sourceName string, files map[string][]byte) {
+	migrationsRegistry.mx.Lock()
+	defer migrationsRegistry.mx.Unlock()
+	m, ok := migrationsRegistry.files[sourceName]
+	if !ok {
+		m = make(map[string][]byte, len(files))
+		migrationsRegistry.files[sourceName] = m
+	}
+	for name, content := range files {
+		m[name] = content
+	}
+}
+
+// RegisterGoMigration add Go migration with version to source with name. Down function can be nil.
+// Go migrations are ordered by version together with sql files of source.
+func RegisterGoMigration(sourceName string, version uint, name string, up, down GoMigrationFunc) {
+	migrationsRegistry.mx.Lock()
+	defer migrationsRegistry.mx.Unlock()
+	m, ok := migrationsRegistry.funcs[sourceName]
+	if !ok {
+		m = make(map[uint]*goMigration)
+		migrationsRegistry.funcs[sourceName] = m
+	}
+	m[version] = &goMigration{name: name, up: up, down: down}
+}
+
+func registeredGoMigration(sourceName string, version uint) (*goMigration, bool) {
+	migrationsRegistry.mx.RLock()
+	defer migrationsRegistry.mx.RUnlock()
+	m, ok := migrationsRegistry.funcs[sourceName][version]
+	return m, ok
+}
+
+// memorySource is golang-migrate source over migrations loaded to memory
+type memorySource struct {
+	migrations *source.Migrations
+	content    map[string][]byte
+}
+
+// newMigrationSource load sql files from SQLDir(or embedded source if dir is not set) and Go migrations of MigrationsSource
+func newMigrationSource(cfg *Config) (*memorySource, error) {
+	var files map[string][]byte
+	var err error
+	switch {
+	case cfg.SQLDir != "":
+		files, err = readMigrationDir(cfg.SQLDir)
+		if err != nil {
+			return nil, err
+		}
+	case cfg.MigrationsSource != "":
+		migrationsRegistry.mx.RLock()
+		files = migrationsRegistry.files[cfg.MigrationsSource]
+		migrationsRegistry.mx.RUnlock()
+	default:
+		return nil, fmt.Errorf("no sql dir or migrations source for database %s", cfg.Database)
+	}
+
+	s := &memorySource{
+		migrations: source.NewMigrations(),
+		content:    make(map[string][]byte, len(files)),
+	}
+	for name, content := range files {
+		m, err := source.DefaultParse(name)
+		if err != nil {
+			continue // skip non migration files
+		}
+		if !s.migrations.Append(m) {
+			return nil, fmt.Errorf("duplicate migration file %s", name)
+		}
+		s.content[name] = content
+	}
+
+	if cfg.MigrationsSource == "" {
+		return s, nil
+	}
+	migrationsRegistry.mx.RLock()
+	defer migrationsRegistry.mx.RUnlock()
+	for version, gm := range migrationsRegistry.funcs[cfg.MigrationsSource] {
+		for _, direction := range []source.Direction{source.Up, source.Down} {
+			if direction == source.Down && gm.down == nil {
+				continue
+			}
+			raw := fmt.Sprintf("%d_%s.%s.go", version, gm.name, direction)
+			if !s.migrations.Append(&source.Migration{Version: version, Identifier: gm.name, Direction: direction, Raw: raw}) {
+				return nil, fmt.Errorf("go migration %s conflicts with sql migration of version %d", raw, version)
+			}
+			s.content[raw] = []byte(fmt.Sprintf("%s%s/%d/%s", goMigrationMarker, cfg.MigrationsSource, version, direction))
+		}
+	}
+	return s, nil
+}
+
+func readMigrationDir(dir string) (map[string][]byte, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[e.Name()] = content
+	}
+	return files, nil
+}
+
+func (s *memorySource) Open(url string) (source.Driver, error) {
+	return nil, fmt.Errorf("memory migration source is created from config")
+}
+
+func (s *memorySource) Close() error {
+	return nil
+}
+
+func (s *memorySource) First() (uint, error) {
+	v, ok := s.migrations.First()
+	if !ok {
+		return 0, &os.PathError{Op: "first", Path: "memory", Err: os.ErrNotExist}
+	}
+	return v, nil
+}
+
+func (s *memorySource) Prev(version uint) (uint, error) {
+	v, ok := s.migrations.Prev(version)
+	if !ok {
+		return 0, &os.PathError{Op: fmt.Sprintf("prev for version %d", version), Path: "memory", Err: os.ErrNotExist}
+	}
+	return v, nil
+}
+
+func (s *memorySource) Next(version uint) (uint, error) {
+	v, ok := s.migrations.Next(version)
+	if !ok {
+		return 0, &os.PathError{Op: fmt.Sprintf("next for version %d", version), Path: "memory", Err: os.ErrNotExist}
+	}
+	return v, nil
+}
+
+func (s *memorySource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	if m, ok := s.migrations.Up(version); ok {
+		return ioutil.NopCloser(bytes.NewReader(s.content[m.Raw])), m.Identifier, nil
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read up version %d", version), Path: "memory", Err: os.ErrNotExist}
+}
+
+func (s *memorySource) ReadDown(version uint) (io.ReadCloser, string, error) {
+	if m, ok := s.migrations.Down(version); ok {
+		return ioutil.NopCloser(bytes.NewReader(s.content[m.Raw])), m.Identifier, nil
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read down version %d", version), Path: "memory", Err: os.ErrNotExist}
+}
+
+// goMigrationDriver run Go migrations for placeholder bodies and pass sql migrations to wrapped driver
+type goMigrationDriver struct {
+	database.Driver
+	db *sql.DB
+}
+
+func (d *goMigrationDriver) Run(migration io.Reader) error {
+	body, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(body, []byte(goMigrationMarker)) {
+		return d.Driver.Run(bytes.NewReader(body))
+	}
+	sourceName, version, direction, err := parseGoMigrationMarker(string(body))
+	if err != nil {
+		return err
+	}
+	gm, ok := registeredGoMigration(sourceName, version)
+	if !ok {
+		return fmt.Errorf("go migration %d of source %s is not registered", version, sourceName)
+	}
+	fn := gm.up
+	if direction == string(source.Down) {
+		fn = gm.down
+	}
+	if fn == nil {
+		return fmt.Errorf("go migration %d_%s has no %s function", version, gm.name, direction)
+	}
+
+	ctx := context.Background()
+	sqlTx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(ctx, &Tx{SQL: sqlTx})
+	if err != nil {
+		_ = sqlTx.Rollback()
+		return database.Error{OrigErr: err, Err: "go migration failed", Query: []byte(fmt.Sprintf("%d_%s", version, gm.name))}
+	}
+	return sqlTx.Commit()
+}
+
+func parseGoMigrationMarker(body string) (sourceName string, version uint, direction string, err error) {
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(body, goMigrationMarker)), "/")
+	if len(parts) != 3 {
+		return "", 0, "", fmt.Errorf("bad go migration marker %q", body)
+	}
+	v, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("bad go migration version %q", parts[1])
+	}
+	return parts[0], uint(v), parts[2], nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/stub"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readMigration(t *testing.T, s *memorySource, version uint, direction source.Direction) string {
+	read := s.ReadUp
+	if direction == source.Down {
+		read = s.ReadDown
+	}
+	r, _, err := read(version)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestEmbeddedMigrationSource(t *testing.T) {
+	RegisterMigrations("test-embedded", map[string][]byte{
+		"1_init.up.sql":   []byte("CREATE TABLE users (id int);"),
+		"1_init.down.sql": []byte("DROP TABLE users;"),
+		"3_index.up.sql":  []byte("CREATE INDEX users_id ON users (id);"),
+		"schema.sql":      []byte("not a migration"),
+	})
+	noop := func(ctx context.Context, tx *Tx) error { return nil }
+	RegisterGoMigration("test-embedded", 2, "backfill", noop, nil)
+
+	s, err := newMigrationSource(&Config{MigrationsSource: "test-embedded"})
+	require.NoError(t, err)
+	var versions []uint
+	for v, err := s.First(); err == nil; v, err = s.Next(v) {
+		versions = append(versions, v)
+	}
+	assert.Equal(t, []uint{1, 2, 3}, versions, "go migration is ordered with sql files")
+	assert.Equal(t, "DROP TABLE users;", readMigration(t, s, 1, source.Down))
+	assert.Equal(t, goMigrationMarker+"test-embedded/2/up", readMigration(t, s, 2, source.Up))
+	_, _, err = s.ReadDown(2)
+	assert.Error(t, err, "go migration without down function")
+
+	RegisterGoMigration("test-embedded", 3, "index", noop, nil)
+	_, err = newMigrationSource(&Config{MigrationsSource: "test-embedded"})
+	assert.EqualError(t, err, "go migration 3_index.up.go conflicts with sql migration of version 3")
+
+	_, err = newMigrationSource(&Config{Database: "app"})
+	assert.EqualError(t, err, "no sql dir or migrations source for database app")
+}
+
+func TestGoMigrationDriver(t *testing.T) {
+	var failed error
+	RegisterGoMigration("test-driver", 5, "backfill", func(ctx context.Context, tx *Tx) error {
+		if failed != nil {
+			return failed
+		}
+		_, err := tx.SQL.ExecContext(ctx, "UPDATE users SET active = true")
+		return err
+	}, nil)
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return nil, nil
+	})
+	next, err := stub.WithInstance(nil, &stub.Config{})
+	require.NoError(t, err)
+	d := &goMigrationDriver{Driver: next, db: sql.OpenDB(f)}
+
+	require.NoError(t, d.Run(strings.NewReader("CREATE TABLE users (id int);")))
+	assert.Equal(t, "CREATE TABLE users (id int);", string(next.(*stub.Stub).LastRunMigration), "sql is run by wrapped driver")
+
+	require.NoError(t, d.Run(strings.NewReader(goMigrationMarker+"test-driver/5/up")))
+	assert.Equal(t, []string{"BEGIN", "UPDATE users SET active = true", "COMMIT"}, queryLog(f))
+
+	failed = errors.New("no users")
+	err = d.Run(strings.NewReader(goMigrationMarker + "test-driver/5/up"))
+	require.IsType(t, database.Error{}, err)
+	assert.Equal(t, failed, err.(database.Error).OrigErr)
+	assert.Len(t, f.statements("ROLLBACK"), 1)
+
+	assert.EqualError(t, d.Run(strings.NewReader(goMigrationMarker+"test-driver/5/down")), "go migration 5_backfill has no down function")
+	assert.EqualError(t, d.Run(strings.NewReader(goMigrationMarker+"test-driver/6/up")), "go migration 6 of source test-driver is not registered")
+	assert.EqualError(t, d.Run(strings.NewReader(goMigrationMarker+"test-driver/x/up")), `bad go migration version "x"`)
+	assert.Error(t, d.Run(strings.NewReader(goMigrationMarker+"test-driver/5")))
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/stub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+var testMigrations = map[string]string{
+	"1_init.up.sql":    "CREATE TABLE a (id int);",
+	"1_init.down.sql":  "DROP TABLE a;",
+	"2_users.up.sql":   "CREATE TABLE users (id int);",
+	"2_users.down.sql": "DROP TABLE users;",
+	"3_index.up.sql":   "CREATE INDEX users_id ON users (id);",
+	"README.md":        "not a migration",
+}
+
+// newStubMigrate return Migrate over migration files of temp dir and stub database at version
+func newStubMigrate(t *testing.T, cfg *Config, version int, dirty bool) (*Migrate, *stub.Stub) {
+	dir, err := ioutil.TempDir("", "migrations")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	for name, content := range testMigrations {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	cfg.Database = "test"
+	cfg.SQLDir = dir
+	cfg.ChecksumMode = VerifyOff
+
+	m := NewMigrate(&log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()}, cfg)
+	m.source, err = newMigrationSource(cfg)
+	require.NoError(t, err)
+	driver, err := stub.WithInstance(nil, &stub.Config{})
+	require.NoError(t, err)
+	db := driver.(*stub.Stub)
+	db.CurrentVersion, db.IsDirty = version, dirty
+	m.driver = driver
+	m.instance, err = migrate.NewWithInstance("memory", m.source, cfg.Database, driver)
+	require.NoError(t, err)
+	return m, db
+}
+
+func TestMigratePlan(t *testing.T) {
+	tests := []struct {
+		name    string
+		current int
+		target  uint
+		plan    []string
+	}{
+		{name: "from empty db", current: NilMigrationVersion, target: 3, plan: []string{"up 1_init.up.sql", "up 2_users.up.sql", "up 3_index.up.sql"}},
+		{name: "up to middle", current: 1, target: 2, plan: []string{"up 2_users.up.sql"}},
+		{name: "down skips migration without down file", current: 3, target: 1, plan: []string{"down 2_users.down.sql"}},
+		{name: "down to empty db", current: 2, target: 0, plan: []string{"down 2_users.down.sql", "down 1_init.down.sql"}},
+		{name: "current version", current: 2, target: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newStubMigrate(t, &Config{}, tt.current, false)
+			plan, err := m.Plan(tt.target)
+			require.NoError(t, err)
+			var got []string
+			for _, p := range plan {
+				got = append(got, p.String())
+			}
+			assert.Equal(t, tt.plan, got)
+		})
+	}
+}
+
+func TestMigrateStatus(t *testing.T) {
+	m, _ := newStubMigrate(t, &Config{}, 1, false)
+	st, err := m.Status()
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.Version)
+	assert.Equal(t, 3, st.Latest)
+	assert.False(t, st.Dirty)
+	assert.Equal(t, []PlannedMigration{
+		{Version: 2, Direction: MigrationUp, Name: "2_users.up.sql"},
+		{Version: 3, Direction: MigrationUp, Name: "3_index.up.sql"},
+	}, st.Pending)
+
+	m, _ = newStubMigrate(t, &Config{}, 3, false)
+	st, err = m.Status()
+	require.NoError(t, err)
+	assert.Empty(t, st.Pending)
+}
+
+func TestMigrateProductionGuard(t *testing.T) {
+	m, db := newStubMigrate(t, &Config{Environment: "Production"}, 3, false)
+	assert.Equal(t, ErrDownMigrationRefused{Database: "test", Environment: "Production"}, m.Goto(1))
+	assert.IsType(t, ErrDownMigrationRefused{}, m.Down(1))
+	assert.NoError(t, m.Down(0), "nothing to roll back")
+	assert.Empty(t, db.MigrationSequence)
+
+	m, db = newStubMigrate(t, &Config{Environment: "prod"}, 1, false)
+	require.NoError(t, m.Goto(3), "up migration is allowed in production")
+	assert.Equal(t, 3, db.CurrentVersion)
+
+	m, db = newStubMigrate(t, &Config{Environment: "prod", AllowDownMigrations: true}, 2, false)
+	require.NoError(t, m.Down(1))
+	assert.Equal(t, 1, db.CurrentVersion)
+	assert.Equal(t, []string{"DROP TABLE users;"}, db.MigrationSequence)
+
+	m, db = newStubMigrate(t, &Config{Environment: "staging"}, 2, false)
+	require.NoError(t, m.Goto(1))
+	assert.Equal(t, 1, db.CurrentVersion)
+}
+
+func TestMigrateDirty(t *testing.T) {
+	m, db := newStubMigrate(t, &Config{}, 2, true)
+	err := m.Up()
+	require.Equal(t, ErrDirtyMigration{Database: "test", Version: 2}, err)
+	assert.Contains(t, err.Error(), "Migrate.Force(2)")
+	assert.Empty(t, db.MigrationSequence)
+
+	st, err := m.ActStatus()
+	assert.NoError(t, err)
+	assert.Nil(t, st, "nothing is done without desired version")
+
+	require.NoError(t, m.Force(2))
+	assert.False(t, db.IsDirty)
+}
+
+func TestMigrateActStatus(t *testing.T) {
+	m, db := newStubMigrate(t, &Config{DesiredVersion: 2}, NilMigrationVersion, false)
+	st, err := m.ActStatus()
+	require.NoError(t, err)
+	assert.Equal(t, &MigrationStatus{
+		Version: 2,
+		Latest:  3,
+		Pending: []PlannedMigration{{Version: 3, Direction: MigrationUp, Name: "3_index.up.sql"}},
+	}, st)
+	assert.Equal(t, 2, db.CurrentVersion)
+	assert.Nil(t, m.instance, "connection is closed after migration")
+
+	m, _ = newStubMigrate(t, &Config{DesiredVersion: 2}, 2, true)
+	_, err = m.ActStatus()
+	assert.Equal(t, ErrDirtyMigration{Database: "test", Version: 2}, err)
+}
+
+func TestClusterMigrations(t *testing.T) {
+	m := &Migrate{cfg: &Config{Driver: "clickhouse", Cluster: "main"}}
+	assert.Equal(t, " ON CLUSTER main", m.onCluster())
+	assert.Empty(t, (&Migrate{cfg: &Config{Driver: "clickhouse"}}).onCluster())
+	assert.Empty(t, (&Migrate{cfg: &Config{Driver: "postgres", Cluster: "main"}}).onCluster(), "cluster is used only by clickhouse")
+
+	driver, err := stub.WithInstance(nil, &stub.Config{})
+	require.NoError(t, err)
+	d := &clusterDriver{Driver: driver, cluster: "main"}
+	require.NoError(t, d.Run(strings.NewReader("CREATE TABLE a ON CLUSTER "+clusterPlaceholder+" (id UInt64) ENGINE = ReplicatedMergeTree")))
+	assert.Equal(t, "CREATE TABLE a ON CLUSTER main (id UInt64) ENGINE = ReplicatedMergeTree", string(driver.(*stub.Stub).LastRunMigration))
+}
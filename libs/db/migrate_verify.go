@@ -0,0 +1,584 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4/source"
+)
+
+// ChecksumTable is side table with checksums of applied migrations
+const ChecksumTable = "schema_migrations_checksums"
+
+// Verification modes of ChecksumMode and SchemaDriftMode
+const (
+	VerifyWarn = "warn"
+	VerifyFail = "fail"
+	VerifyOff  = "off"
+)
+
+// ChecksumMismatch is applied migration which file was changed after applying
+type ChecksumMismatch struct {
+	Version  uint
+	Name     string
+	Current  string
+	Recorded string
+}
+
+func (c ChecksumMismatch) String() string {
+	return fmt.Sprintf("migration %s(version %d) was changed after applying: checksum %s, applied %s",
+		c.Name, c.Version, c.Current, c.Recorded)
+}
+
+// ErrChecksumMismatch is returned on start when ChecksumMode is fail
+type ErrChecksumMismatch struct {
+	Database   string
+	Mismatches []ChecksumMismatch
+}
+
+func (e ErrChecksumMismatch) Error() string {
+	lines := make([]string, 0, len(e.Mismatches))
+	for _, m := range e.Mismatches {
+		lines = append(lines, m.String())
+	}
+	return fmt.Sprintf("applied migrations of database %s were changed:\n%s", e.Database, strings.Join(lines, "\n"))
+}
+
+// VerifyChecksums compare checksums of applied migration files with recorded ones
+func (m *Migrate) VerifyChecksums() ([]ChecksumMismatch, error) {
+	err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	err = m.createChecksumTable()
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := m.recordedChecksums()
+	if err != nil {
+		return nil, err
+	}
+	var out []ChecksumMismatch
+	for version, r := range recorded {
+		migration, ok := m.source.migrations.Up(version)
+		if !ok {
+			continue
+		}
+		current := checksum(m.source.content[migration.Raw])
+		if current != r {
+			out = append(out, ChecksumMismatch{Version: version, Name: migration.Raw, Current: current, Recorded: r})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Version < out[j].Version
+	})
+	return out, nil
+}
+
+func (m *Migrate) verifyOnStart() error {
+	mode := strings.ToLower(m.cfg.ChecksumMode)
+	if mode == VerifyOff {
+		return nil
+	}
+	mismatches, err := m.VerifyChecksums()
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	if mode == VerifyFail {
+		return ErrChecksumMismatch{Database: m.cfg.Database, Mismatches: mismatches}
+	}
+	for _, mm := range mismatches {
+		m.logger.Warn(mm.String())
+	}
+	return nil
+}
+
+// recordChecksums save checksums of applied migrations which are not recorded yet and remove rolled back ones
+func (m *Migrate) recordChecksums(version int) error {
+	if strings.ToLower(m.cfg.ChecksumMode) == VerifyOff {
+		return nil
+	}
+	err := m.createChecksumTable()
+	if err != nil {
+		return err
+	}
+	recorded, err := m.recordedChecksums()
+	if err != nil {
+		return err
+	}
+
+	var insert []*source.Migration
+	var remove bool
+	for v := range recorded {
+		if int(v) > version {
+			remove = true
+		}
+	}
+	if version != NilMigrationVersion {
+		v, err := m.source.First()
+		for err == nil && int(v) <= version {
+			if _, ok := recorded[v]; !ok {
+				if migration, ok := m.source.migrations.Up(v); ok {
+					insert = append(insert, migration)
+				}
+			}
+			v, err = m.source.Next(v)
+		}
+	}
+	if !remove && len(insert) == 0 {
+		return nil
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if remove {
+		_, err = tx.Exec(m.checksumQuery(
+			"DELETE FROM "+ChecksumTable+" WHERE version > $1",
+			"ALTER TABLE "+ChecksumTable+" DELETE WHERE version > ?"), int64(version))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if len(insert) > 0 {
+		stmt, err := tx.Prepare(m.checksumQuery(
+			"INSERT INTO "+ChecksumTable+" (version, name, checksum) VALUES ($1, $2, $3)",
+			"INSERT INTO "+ChecksumTable+" (version, name, checksum) VALUES (?, ?, ?)"))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		for _, migration := range insert {
+			_, err = stmt.Exec(int64(migration.Version), migration.Raw, checksum(m.source.content[migration.Raw]))
+			if err != nil {
+				_ = stmt.Close()
+				_ = tx.Rollback()
+				return err
+			}
+		}
+		_ = stmt.Close()
+	}
+	return tx.Commit()
+}
+
+func (m *Migrate) createChecksumTable() error {
+	_, err := m.db.Exec(m.checksumQuery(
+		`CREATE TABLE IF NOT EXISTS `+ChecksumTable+` (
+			version bigint PRIMARY KEY,
+			name text NOT NULL,
+			checksum text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`,
+		`CREATE TABLE IF NOT EXISTS `+ChecksumTable+m.onCluster()+` (
+			version UInt64,
+			name String,
+			checksum String,
+			applied_at DateTime DEFAULT now()
+		) ENGINE = `+m.checksumEngine()+` ORDER BY version`))
+	return err
+}
+
+func (m *Migrate) recordedChecksums() (map[uint]string, error) {
+	rows, err := m.db.Query(m.checksumQuery(
+		"SELECT version, checksum FROM "+ChecksumTable,
+		"SELECT version, argMax(checksum, applied_at) FROM "+ChecksumTable+" GROUP BY version"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[uint]string)
+	for rows.Next() {
+		var version int64
+		var sum string
+		err = rows.Scan(&version, &sum)
+		if err != nil {
+			return nil, err
+		}
+		out[uint(version)] = sum
+	}
+	return out, rows.Err()
+}
+
+// checksumEngine is ClickHouse engine of checksums table, replicated on cluster
+func (m *Migrate) checksumEngine() string {
+	if m.cfg.Cluster == "" {
+		return "ReplacingMergeTree(applied_at)"
+	}
+	return fmt.Sprintf("ReplicatedReplacingMergeTree('/clickhouse/tables/%s/%s/%s', '{replica}', applied_at)",
+		m.cfg.Cluster, m.cfg.Database, ChecksumTable)
+}
+
+// checksumQuery choose query for postgres or clickhouse
+func (m *Migrate) checksumQuery(postgres, clickhouse string) string {
+	if m.cfg.Driver == "clickhouse" {
+		return clickhouse
+	}
+	return postgres
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// SchemaSnapshot is database schema used for drift detection
+type SchemaSnapshot struct {
+	Tables []TableSchema `json:"tables"`
+}
+
+type TableSchema struct {
+	Name    string         `json:"name"`
+	Columns []ColumnSchema `json:"columns"`
+	Indexes []IndexSchema  `json:"indexes,omitempty"`
+}
+
+type ColumnSchema struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable,omitempty"`
+	Default  string `json:"default,omitempty"`
+}
+
+type IndexSchema struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+// ErrSchemaDrift is returned on start when SchemaDriftMode is fail
+type ErrSchemaDrift struct {
+	Database string
+	Diff     []string
+}
+
+func (e ErrSchemaDrift) Error() string {
+	return fmt.Sprintf("schema of database %s differs from snapshot:\n%s", e.Database, strings.Join(e.Diff, "\n"))
+}
+
+// Snapshot read live schema(tables, columns, indexes) of database, migrations tables are skipped
+func (m *Migrate) Snapshot(ctx context.Context) (*SchemaSnapshot, error) {
+	err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	if m.cfg.Driver == "clickhouse" {
+		return readClickHouseSchema(ctx, m.db)
+	}
+	return readPostgresSchema(ctx, m.db)
+}
+
+// WriteSchemaSnapshot write live schema to file. It is called after migrating scratch database.
+func (m *Migrate) WriteSchemaSnapshot(ctx context.Context, filePath string) error {
+	snapshot, err := m.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, append(data, '\n'), 0644)
+}
+
+// SchemaDrift compare live schema with snapshot file and return readable diff(empty if schemas are equal).
+// Lines start with '+' for objects which exist only in database, '-' for missing ones and '~' for changed.
+func (m *Migrate) SchemaDrift(ctx context.Context, filePath string) ([]string, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	expected := new(SchemaSnapshot)
+	err = json.Unmarshal(data, expected)
+	if err != nil {
+		return nil, fmt.Errorf("bad schema snapshot %s: %v", filePath, err)
+	}
+	live, err := m.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return DiffSchema(expected, live), nil
+}
+
+func (m *Migrate) checkDriftOnStart() error {
+	if m.cfg.SchemaSnapshot == "" || strings.ToLower(m.cfg.SchemaDriftMode) == VerifyOff {
+		return nil
+	}
+	diff, err := m.SchemaDrift(context.Background(), m.cfg.SchemaSnapshot)
+	if err != nil {
+		return err
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	if strings.ToLower(m.cfg.SchemaDriftMode) == VerifyFail {
+		return ErrSchemaDrift{Database: m.cfg.Database, Diff: diff}
+	}
+	m.logger.Warnf("schema of database %s differs from snapshot %s:\n%s", m.cfg.Database, m.cfg.SchemaSnapshot, strings.Join(diff, "\n"))
+	return nil
+}
+
+// DiffSchema return readable difference between expected and actual schema
+func DiffSchema(expected, actual *SchemaSnapshot) []string {
+	var diff []string
+	exp := tablesByName(expected)
+	act := tablesByName(actual)
+	names := make(map[string]bool, len(exp)+len(act))
+	for k := range exp {
+		names[k] = true
+	}
+	for k := range act {
+		names[k] = true
+	}
+	for _, name := range sortedNames(names) {
+		e, inExp := exp[name]
+		a, inAct := act[name]
+		switch {
+		case !inAct:
+			diff = append(diff, "- table "+name)
+			continue
+		case !inExp:
+			diff = append(diff, "+ table "+name)
+			continue
+		}
+
+		cols := make(map[string]bool)
+		expCols := make(map[string]ColumnSchema, len(e.Columns))
+		for _, c := range e.Columns {
+			expCols[c.Name] = c
+			cols[c.Name] = true
+		}
+		actCols := make(map[string]ColumnSchema, len(a.Columns))
+		for _, c := range a.Columns {
+			actCols[c.Name] = c
+			cols[c.Name] = true
+		}
+		for _, col := range sortedNames(cols) {
+			ec, inExp := expCols[col]
+			ac, inAct := actCols[col]
+			switch {
+			case !inAct:
+				diff = append(diff, fmt.Sprintf("- column %s.%s %s", name, col, ec.describe()))
+			case !inExp:
+				diff = append(diff, fmt.Sprintf("+ column %s.%s %s", name, col, ac.describe()))
+			case ec != ac:
+				diff = append(diff, fmt.Sprintf("~ column %s.%s: %s -> %s", name, col, ec.describe(), ac.describe()))
+			}
+		}
+
+		indexes := make(map[string]bool)
+		expIdx := make(map[string]string, len(e.Indexes))
+		for _, i := range e.Indexes {
+			expIdx[i.Name] = i.Definition
+			indexes[i.Name] = true
+		}
+		actIdx := make(map[string]string, len(a.Indexes))
+		for _, i := range a.Indexes {
+			actIdx[i.Name] = i.Definition
+			indexes[i.Name] = true
+		}
+		for _, idx := range sortedNames(indexes) {
+			ed, inExp := expIdx[idx]
+			ad, inAct := actIdx[idx]
+			switch {
+			case !inAct:
+				diff = append(diff, fmt.Sprintf("- index %s.%s: %s", name, idx, ed))
+			case !inExp:
+				diff = append(diff, fmt.Sprintf("+ index %s.%s: %s", name, idx, ad))
+			case ed != ad:
+				diff = append(diff, fmt.Sprintf("~ index %s.%s: %s -> %s", name, idx, ed, ad))
+			}
+		}
+	}
+	return diff
+}
+
+func (c ColumnSchema) describe() string {
+	s := c.Type
+	if !c.Nullable {
+		s += " not null"
+	}
+	if c.Default != "" {
+		s += " default " + c.Default
+	}
+	return s
+}
+
+func tablesByName(s *SchemaSnapshot) map[string]TableSchema {
+	out := make(map[string]TableSchema, len(s.Tables))
+	for _, t := range s.Tables {
+		out[t.Name] = t
+	}
+	return out
+}
+
+// sortedNames return sorted union of names
+func sortedNames(sets ...map[string]bool) []string {
+	union := make(map[string]bool)
+	for _, set := range sets {
+		for k := range set {
+			union[k] = true
+		}
+	}
+	out := make([]string, 0, len(union))
+	for k := range union {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// skippedTables are tables of migration tools which are not part of schema snapshot
+var skippedTables = map[string]bool{
+	"schema_migrations": true,
+	ChecksumTable:       true,
+}
+
+func readPostgresSchema(ctx context.Context, db *sql.DB) (*SchemaSnapshot, error) {
+	tables := make(map[string]*TableSchema)
+	var order []string
+	table := func(name string) *TableSchema {
+		t, ok := tables[name]
+		if !ok {
+			t = &TableSchema{Name: name}
+			tables[name] = t
+			order = append(order, name)
+		}
+		return t
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT table_name, column_name, data_type, is_nullable = 'YES', COALESCE(column_default, '')
+		FROM information_schema.columns
+		WHERE table_schema = current_schema()
+		ORDER BY table_name, ordinal_position`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		var c ColumnSchema
+		err = rows.Scan(&name, &c.Name, &c.Type, &c.Nullable, &c.Default)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !skippedTables[name] {
+			t := table(name)
+			t.Columns = append(t.Columns, c)
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT tablename, indexname, indexdef
+		FROM pg_indexes
+		WHERE schemaname = current_schema()
+		ORDER BY tablename, indexname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var i IndexSchema
+		err = rows.Scan(&name, &i.Name, &i.Definition)
+		if err != nil {
+			return nil, err
+		}
+		if !skippedTables[name] {
+			t := table(name)
+			t.Indexes = append(t.Indexes, i)
+		}
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return collectTables(tables, order), nil
+}
+
+func readClickHouseSchema(ctx context.Context, db *sql.DB) (*SchemaSnapshot, error) {
+	tables := make(map[string]*TableSchema)
+	var order []string
+
+	rows, err := db.QueryContext(ctx, `SELECT table, name, type, default_expression
+		FROM system.columns
+		WHERE database = currentDatabase()
+		ORDER BY table, position`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		var c ColumnSchema
+		err = rows.Scan(&name, &c.Name, &c.Type, &c.Default)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if skippedTables[name] {
+			continue
+		}
+		c.Nullable = strings.HasPrefix(c.Type, "Nullable(")
+		t, ok := tables[name]
+		if !ok {
+			t = &TableSchema{Name: name}
+			tables[name] = t
+			order = append(order, name)
+		}
+		t.Columns = append(t.Columns, c)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// engine and sorting key play role of indexes in ClickHouse
+	rows, err = db.QueryContext(ctx, `SELECT name, engine, sorting_key, partition_key
+		FROM system.tables
+		WHERE database = currentDatabase()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, engine, sortingKey, partitionKey string
+		err = rows.Scan(&name, &engine, &sortingKey, &partitionKey)
+		if err != nil {
+			return nil, err
+		}
+		t, ok := tables[name]
+		if !ok {
+			continue
+		}
+		t.Indexes = append(t.Indexes,
+			IndexSchema{Name: "engine", Definition: engine},
+			IndexSchema{Name: "sorting_key", Definition: sortingKey},
+			IndexSchema{Name: "partition_key", Definition: partitionKey},
+		)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return collectTables(tables, order), nil
+}
+
+func collectTables(tables map[string]*TableSchema, order []string) *SchemaSnapshot {
+	sort.Strings(order)
+	out := &SchemaSnapshot{Tables: make([]TableSchema, 0, len(order))}
+	for _, name := range order {
+		out.Tables = append(out.Tables, *tables[name])
+	}
+	return out
+}
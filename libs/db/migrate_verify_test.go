@@ -0,0 +1,100 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffSchema(t *testing.T) {
+	expected := &SchemaSnapshot{Tables: []TableSchema{
+		{
+			Name: "users",
+			Columns: []ColumnSchema{
+				{Name: "id", Type: "bigint"},
+				{Name: "email", Type: "text"},
+				{Name: "name", Type: "text", Nullable: true},
+			},
+			Indexes: []IndexSchema{{Name: "users_pkey", Definition: "CREATE UNIQUE INDEX users_pkey ON users USING btree (id)"}},
+		},
+		{Name: "orders", Columns: []ColumnSchema{{Name: "id", Type: "bigint"}}},
+	}}
+	assert.Empty(t, DiffSchema(expected, expected))
+
+	actual := &SchemaSnapshot{Tables: []TableSchema{
+		{
+			Name: "users",
+			Columns: []ColumnSchema{
+				{Name: "id", Type: "bigint"},
+				{Name: "email", Type: "character varying"},
+				{Name: "active", Type: "boolean", Default: "true"},
+			},
+			Indexes: []IndexSchema{
+				{Name: "users_pkey", Definition: "CREATE UNIQUE INDEX users_pkey ON users USING btree (id)"},
+				{Name: "users_email", Definition: "CREATE INDEX users_email ON users USING btree (email)"},
+			},
+		},
+		{Name: "audit", Columns: []ColumnSchema{{Name: "id", Type: "bigint"}}},
+	}}
+	assert.Equal(t, []string{
+		"+ table audit",
+		"- table orders",
+		"+ column users.active boolean not null default true",
+		"~ column users.email: text not null -> character varying not null",
+		"- column users.name text",
+		"+ index users.users_email: CREATE INDEX users_email ON users USING btree (email)",
+	}, DiffSchema(expected, actual))
+}
+
+func TestMigrateChecksums(t *testing.T) {
+	recorded := map[int64]string{
+		1: checksum([]byte(testMigrations["1_init.up.sql"])),
+		2: "0000",
+	}
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if strings.HasPrefix(query, "SELECT version, checksum") {
+			res := &fakeResult{columns: []string{"version", "checksum"}}
+			for v, sum := range recorded {
+				res.rows = append(res.rows, []driver.Value{v, sum})
+			}
+			return res, nil
+		}
+		return nil, nil
+	})
+	m, _ := newStubMigrate(t, &Config{}, 2, false)
+	m.db = sql.OpenDB(f)
+
+	mismatches, err := m.VerifyChecksums()
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, uint(2), mismatches[0].Version)
+	assert.Equal(t, "2_users.up.sql", mismatches[0].Name)
+	assert.Equal(t, checksum([]byte(testMigrations["2_users.up.sql"])), mismatches[0].Current)
+
+	assert.NoError(t, m.verifyOnStart(), "checksums are not verified when mode is off")
+	m.cfg.ChecksumMode = "WARN"
+	assert.NoError(t, m.verifyOnStart())
+	m.cfg.ChecksumMode = VerifyFail
+	assert.Equal(t, ErrChecksumMismatch{Database: "test", Mismatches: mismatches}, m.verifyOnStart())
+
+	// version 3 is applied
+	delete(recorded, 2)
+	require.NoError(t, m.recordChecksums(3))
+	inserts := f.statements("INSERT INTO " + ChecksumTable)
+	require.Len(t, inserts, 2, "checksums of not recorded migrations are inserted")
+	assert.Equal(t, []interface{}{int64(2), "2_users.up.sql", checksum([]byte(testMigrations["2_users.up.sql"]))}, inserts[0].args)
+	assert.Equal(t, []interface{}{int64(3), "3_index.up.sql", checksum([]byte(testMigrations["3_index.up.sql"]))}, inserts[1].args)
+	assert.Empty(t, f.statements("DELETE"))
+
+	// rollback to version 1
+	recorded[2] = "0000"
+	require.NoError(t, m.recordChecksums(1))
+	deletes := f.statements("DELETE FROM " + ChecksumTable)
+	require.Len(t, deletes, 1)
+	assert.Equal(t, []interface{}{int64(1)}, deletes[0].args)
+	assert.Len(t, f.statements("COMMIT"), 2)
+}
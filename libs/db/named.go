@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// BindNamed replace :name parameters of query with placeholders of style and return their values from arg.
+// Arg is map[string]interface{} or struct(pointer to struct) with fields mapped like in struct scanning.
+// Quoted strings, dollar-quoted strings, identifiers, comments and :: casts are left as is.
+// Name of parameter starts with letter or underscore, so array slices like arr[1:2] are not parameters.
+func BindNamed(style PlaceholderStyle, query string, arg interface{}) (string, []interface{}, error) {
+	lookup, err := namedLookup(arg)
+	if err != nil {
+		return "", nil, err
+	}
+	return bindNamed(style, query, lookup)
+}
+
+func bindNamed(style PlaceholderStyle, query string, lookup func(name string) (interface{}, bool)) (string, []interface{}, error) {
+	var out strings.Builder
+	var args []interface{}
+	positions := make(map[string]int)
+	n := len(query)
+	for i := 0; i < n; {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := skipQuoted(query, i, c)
+			out.WriteString(query[i:end])
+			i = end
+		case c == '-' && i+1 < n && query[i+1] == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = n - i
+			}
+			out.WriteString(query[i : i+end])
+			i += end
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = n
+			} else {
+				end += i + 4
+			}
+			out.WriteString(query[i:end])
+			i = end
+		case c == '$' && (i == 0 || !isNameChar(query[i-1])) && dollarTag(query, i) != "":
+			end := skipDollarQuoted(query, i, dollarTag(query, i))
+			out.WriteString(query[i:end])
+			i = end
+		case c == ':' && i+1 < n && query[i+1] == ':':
+			out.WriteString("::")
+			i += 2
+		case c == ':' && i+1 < n && isNameStart(query[i+1]):
+			j := i + 1
+			for j < n && isNameChar(query[j]) {
+				j++
+			}
+			name := query[i+1 : j]
+			value, ok := lookup(name)
+			if !ok {
+				return "", nil, fmt.Errorf("no value for named parameter %s", name)
+			}
+			if style == Question {
+				args = append(args, value)
+				out.WriteByte('?')
+			} else {
+				pos, ok := positions[name]
+				if !ok {
+					args = append(args, value)
+					pos = len(args)
+					positions[name] = pos
+				}
+				out.WriteString("$" + strconv.Itoa(pos))
+			}
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String(), args, nil
+}
+
+// NamedExec run query with named parameters from arg, return count of affected rows
+func NamedExec(ctx context.Context, q Querier, query string, arg interface{}) (int64, error) {
+	query, args, err := BindNamed(q.Placeholder(), query, arg)
+	if err != nil {
+		return 0, err
+	}
+	return q.Exec(ctx, query, args...)
+}
+
+// NamedQueryOne is QueryOne with named parameters from arg
+func NamedQueryOne(ctx context.Context, q Querier, dest interface{}, query string, arg interface{}) error {
+	query, args, err := BindNamed(q.Placeholder(), query, arg)
+	if err != nil {
+		return err
+	}
+	return QueryOne(ctx, q, dest, query, args...)
+}
+
+// NamedQueryAll is QueryAll with named parameters from arg
+func NamedQueryAll(ctx context.Context, q Querier, dest interface{}, query string, arg interface{}) error {
+	query, args, err := BindNamed(q.Placeholder(), query, arg)
+	if err != nil {
+		return err
+	}
+	return QueryAll(ctx, q, dest, query, args...)
+}
+
+// NamedIterate is Iterate with named parameters from arg
+func NamedIterate(ctx context.Context, q Querier, query string, arg interface{}) (*Iterator, error) {
+	query, args, err := BindNamed(q.Placeholder(), query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return Iterate(ctx, q, query, args...)
+}
+
+func namedLookup(arg interface{}) (func(name string) (interface{}, bool), error) {
+	if m, ok := arg.(map[string]interface{}); ok {
+		return func(name string) (interface{}, bool) {
+			v, ok := m[name]
+			return v, ok
+		}, nil
+	}
+	v := reflect.ValueOf(arg)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, fmt.Errorf("nil named parameters")
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("named parameters must be map[string]interface{} or struct, got %T", arg)
+	}
+	fields := structFields(v.Type())
+	return func(name string) (interface{}, bool) {
+		f, ok := fields[name]
+		if !ok {
+			return nil, false
+		}
+		fv := v
+		for i, x := range f.index {
+			if i > 0 && fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					return nil, true
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(x)
+		}
+		return fv.Interface(), true
+	}, nil
+}
+
+// skipQuoted return index after quoted string or identifier started at i, doubled quote is escape
+func skipQuoted(query string, i int, quote byte) int {
+	for j := i + 1; j < len(query); j++ {
+		if query[j] != quote {
+			continue
+		}
+		if j+1 < len(query) && query[j+1] == quote {
+			j++
+			continue
+		}
+		return j + 1
+	}
+	return len(query)
+}
+
+// dollarTag return delimiter($$ or $tag$) of dollar-quoted string started at i or empty string
+func dollarTag(query string, i int) string {
+	j := i + 1
+	if j < len(query) && !isNameStart(query[j]) && query[j] != '$' {
+		return ""
+	}
+	for j < len(query) && isNameChar(query[j]) {
+		j++
+	}
+	if j >= len(query) || query[j] != '$' {
+		return ""
+	}
+	return query[i : j+1]
+}
+
+// skipDollarQuoted return index after dollar-quoted string started at i with delimiter tag
+func skipDollarQuoted(query string, i int, tag string) int {
+	end := strings.Index(query[i+len(tag):], tag)
+	if end < 0 {
+		return len(query)
+	}
+	return i + len(tag) + end + len(tag)
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
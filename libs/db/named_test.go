@@ -0,0 +1,136 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindNamed(t *testing.T) {
+	arg := map[string]interface{}{"id": 1, "name": "a", "tags": []string{"x"}}
+	tests := []struct {
+		name  string
+		style PlaceholderStyle
+		query string
+		out   string
+		args  []interface{}
+		err   bool
+	}{
+		{
+			name:  "dollar",
+			style: Dollar,
+			query: "SELECT * FROM users WHERE id = :id AND name = :name",
+			out:   "SELECT * FROM users WHERE id = $1 AND name = $2",
+			args:  []interface{}{1, "a"},
+		},
+		{
+			name:  "repeated parameter",
+			style: Dollar,
+			query: "UPDATE users SET name = :name WHERE id = :id OR parent = :id",
+			out:   "UPDATE users SET name = $1 WHERE id = $2 OR parent = $2",
+			args:  []interface{}{"a", 1},
+		},
+		{
+			name:  "question",
+			style: Question,
+			query: "SELECT * FROM users WHERE id = :id OR parent = :id",
+			out:   "SELECT * FROM users WHERE id = ? OR parent = ?",
+			args:  []interface{}{1, 1},
+		},
+		{
+			name:  "cast",
+			style: Dollar,
+			query: "SELECT :id::bigint, now()::date",
+			out:   "SELECT $1::bigint, now()::date",
+			args:  []interface{}{1},
+		},
+		{
+			name:  "quoted",
+			style: Dollar,
+			query: `SELECT ':no', "col:x", 'it''s :no' FROM t WHERE id = :id`,
+			out:   `SELECT ':no', "col:x", 'it''s :no' FROM t WHERE id = $1`,
+			args:  []interface{}{1},
+		},
+		{
+			name:  "comments",
+			style: Dollar,
+			query: "SELECT 1 -- :no\nFROM t /* :no */ WHERE id = :id",
+			out:   "SELECT 1 -- :no\nFROM t /* :no */ WHERE id = $1",
+			args:  []interface{}{1},
+		},
+		{
+			name:  "dollar quoted",
+			style: Dollar,
+			query: "SELECT $$ :no $$, $fn$ :no $$ $fn$, :id",
+			out:   "SELECT $$ :no $$, $fn$ :no $$ $fn$, $1",
+			args:  []interface{}{1},
+		},
+		{
+			name:  "positional placeholder is not dollar quote",
+			style: Dollar,
+			query: "SELECT $1, :id",
+			out:   "SELECT $1, $1",
+			args:  []interface{}{1},
+		},
+		{
+			name:  "array slice",
+			style: Dollar,
+			query: "SELECT arr[1:2] FROM t WHERE id = :id",
+			out:   "SELECT arr[1:2] FROM t WHERE id = $1",
+			args:  []interface{}{1},
+		},
+		{
+			name:  "missing parameter",
+			style: Dollar,
+			query: "SELECT * FROM users WHERE id = :other",
+			err:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, args, err := BindNamed(tt.style, tt.query, arg)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, out)
+			assert.Equal(t, tt.args, args)
+		})
+	}
+}
+
+func TestBindNamedStruct(t *testing.T) {
+	type Inner struct {
+		Email string `db:"email"`
+	}
+	type user struct {
+		ID   int64  `db:"id"`
+		Name string `db:"name"`
+		*Inner
+	}
+	tests := []struct {
+		name string
+		arg  interface{}
+		args []interface{}
+		err  bool
+	}{
+		{name: "struct", arg: user{ID: 1, Name: "a", Inner: &Inner{Email: "e"}}, args: []interface{}{int64(1), "a", "e"}},
+		{name: "pointer", arg: &user{ID: 2, Name: "b", Inner: &Inner{Email: "f"}}, args: []interface{}{int64(2), "b", "f"}},
+		{name: "nil embedded pointer", arg: user{ID: 3}, args: []interface{}{int64(3), "", nil}},
+		{name: "nil pointer", arg: (*user)(nil), err: true},
+		{name: "not struct", arg: 1, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, args, err := BindNamed(Dollar, "INSERT INTO users VALUES (:id, :name, :email)", tt.arg)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.args, args)
+		})
+	}
+}
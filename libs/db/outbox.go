@@ -0,0 +1,400 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+	"github.com/uber-go/tally"
+	"go.uber.org/fx"
+
+	"git.pnhub.ru/core/libs/kfk"
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/metrics"
+	"git.pnhub.ru/core/libs/trace"
+	"git.pnhub.ru/core/libs/util"
+)
+
+// OutboxTable is table of outbox messages, it is created by migration of RegisterOutboxMigration
+const OutboxTable = "outbox"
+
+const outboxMigrationUp = `create table if not exists outbox
+(
+    id              bigserial   not null
+        constraint outbox_pk
+            primary key,
+    topic           varchar     not null,
+    key             bytea,
+    payload         bytea       not null,
+    headers         jsonb       not null default '{}',
+    created_at      timestamptz not null default now(),
+    attempts        integer     not null default 0,
+    next_attempt_at timestamptz not null default now(),
+    last_error      text,
+    sent_at         timestamptz
+);
+
+create index if not exists outbox_pending_index
+    on outbox (next_attempt_at, id)
+    where sent_at is null;
+
+create index if not exists outbox_sent_at_index
+    on outbox (sent_at)
+    where sent_at is not null;
+`
+
+const outboxMigrationDown = `drop table if exists outbox;
+`
+
+// RegisterOutboxMigration add outbox table migration with version to in-binary migrations source
+func RegisterOutboxMigration(sourceName string, version uint) {
+	RegisterMigrations(sourceName, map[string][]byte{
+		fmt.Sprintf("%d_outbox.up.sql", version):   []byte(outboxMigrationUp),
+		fmt.Sprintf("%d_outbox.down.sql", version): []byte(outboxMigrationDown),
+	})
+}
+
+var ErrNoTx = fmt.Errorf("no transaction for outbox message")
+
+type OutboxConfig struct {
+	// Key is db key in Selector(default DefaultDBKey)
+	Key          string        `json:"key" yaml:"key"`
+	BatchSize    int           `json:"batch_size" yaml:"batch_size"`
+	PollInterval time.Duration `json:"poll_interval" yaml:"poll_interval"`
+	// Backoff is delay before next publish attempt of failed message
+	Backoff util.Backoff `json:"backoff" yaml:"backoff"`
+	// Retention is time sent messages are kept before prune(default 7 days), PruneInterval is period of prune
+	Retention     time.Duration `json:"retention" yaml:"retention"`
+	PruneInterval time.Duration `json:"prune_interval" yaml:"prune_interval"`
+}
+
+func (c *OutboxConfig) setDefaults() {
+	if c.Key == "" {
+		c.Key = DefaultDBKey
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = time.Second
+	}
+	if c.Retention <= 0 {
+		c.Retention = time.Hour * 24 * 7
+	}
+	if c.PruneInterval <= 0 {
+		c.PruneInterval = time.Hour
+	}
+}
+
+// Outbox store messages in db transaction and relay them to kafka after commit.
+// Relay claims rows with FOR UPDATE SKIP LOCKED, so it can run in several instances.
+type Outbox struct {
+	ctx      context.Context
+	logger   log.Logger
+	selector *Selector
+	client   *kfk.Client
+	cfg      OutboxConfig
+
+	mx      sync.Mutex
+	writers map[string]*kafka.Writer
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewOutbox(ctx context.Context, logger log.Logger, selector *Selector, client *kfk.Client, cfg *OutboxConfig, lc fx.Lifecycle) (*Outbox, error) {
+	if selector == nil {
+		return nil, fmt.Errorf("no db selector for outbox")
+	}
+	c := OutboxConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	c.setDefaults()
+	o := &Outbox{
+		ctx:      ctx,
+		logger:   log.ForkLogger(logger),
+		selector: selector,
+		client:   client,
+		cfg:      c,
+		writers:  make(map[string]*kafka.Writer),
+		done:     make(chan struct{}),
+	}
+	if lc != nil && client != nil {
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				o.Start()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				return o.Stop(ctx)
+			},
+		})
+	}
+	return o, nil
+}
+
+// Enqueue store message in transaction tx(or transaction of RunInTx in ctx if tx is nil).
+// Message is published by relay after commit. Trace context of ctx is added to headers.
+func (o *Outbox) Enqueue(ctx context.Context, tx *Tx, topic string, key, payload []byte, headers map[string]string) error {
+	if tx == nil {
+		tx = TxFromContext(ctx, o.cfg.Key)
+	}
+	if tx == nil {
+		return ErrNoTx
+	}
+	h := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		h[k] = v
+	}
+	trace.Inject(ctx, func(k, v string) {
+		h[k] = v
+	})
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return tx.exec(ctx, "INSERT INTO "+OutboxTable+" (topic, key, payload, headers) VALUES ($1, $2, $3, $4)",
+		topic, key, payload, string(data))
+}
+
+// Start run relay in background
+func (o *Outbox) Start() {
+	ctx, cancel := context.WithCancel(o.ctx)
+	o.cancel = cancel
+	go o.relay(ctx)
+}
+
+// Stop stop relay and close kafka writers
+func (o *Outbox) Stop(ctx context.Context) error {
+	if o.cancel == nil {
+		return nil
+	}
+	o.cancel()
+	select {
+	case <-o.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	for topic, w := range o.writers {
+		err := w.Close()
+		if err != nil {
+			o.logger.Warnf("close outbox writer of %s: %v", topic, err)
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) relay(ctx context.Context) {
+	defer close(o.done)
+	poll := time.NewTicker(o.cfg.PollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(o.cfg.PruneInterval)
+	defer prune.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+			for {
+				n, err := o.RelayBatch(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						o.logger.Error(fmt.Errorf("outbox relay: %v", err))
+					}
+					break
+				}
+				if n < o.cfg.BatchSize {
+					break
+				}
+			}
+			o.reportBacklog(ctx)
+		case <-prune.C:
+			n, err := o.Prune(ctx)
+			if err != nil {
+				o.logger.Error(fmt.Errorf("outbox prune: %v", err))
+			} else if n > 0 {
+				o.logger.Infof("outbox: pruned %d sent messages", n)
+			}
+		}
+	}
+}
+
+type outboxMessage struct {
+	id        int64
+	topic     string
+	key       []byte
+	payload   []byte
+	headers   string
+	createdAt time.Time
+	attempts  int
+}
+
+// RelayBatch claim batch of due messages, publish them to kafka and mark them sent.
+// Messages of topic which failed to publish are scheduled for retry with backoff. Return count of claimed messages.
+func (o *Outbox) RelayBatch(ctx context.Context) (int, error) {
+	if o.client == nil {
+		return 0, fmt.Errorf("no kafka client for outbox relay")
+	}
+	var claimed int
+	err := RunInTx(ctx, o.selector, o.cfg.Key, nil, func(ctx context.Context) error {
+		tx := TxFromContext(ctx, o.cfg.Key)
+		var messages []*outboxMessage
+		err := tx.queryEach(ctx, "SELECT id, topic, key, payload, headers, created_at, attempts FROM "+OutboxTable+
+			" WHERE sent_at IS NULL AND next_attempt_at <= now() ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED",
+			[]interface{}{o.cfg.BatchSize}, func(scan func(dest ...interface{}) error) error {
+				m := &outboxMessage{}
+				err := scan(&m.id, &m.topic, &m.key, &m.payload, &m.headers, &m.createdAt, &m.attempts)
+				if err != nil {
+					return err
+				}
+				messages = append(messages, m)
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+		claimed = len(messages)
+		if claimed == 0 {
+			return nil
+		}
+
+		byTopic := make(map[string][]*outboxMessage)
+		var topics []string
+		for _, m := range messages {
+			if _, ok := byTopic[m.topic]; !ok {
+				topics = append(topics, m.topic)
+			}
+			byTopic[m.topic] = append(byTopic[m.topic], m)
+		}
+		for _, topic := range topics {
+			err = o.publish(ctx, tx, topic, byTopic[topic])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return claimed, err
+}
+
+// publish write messages of topic and update their state in tx
+func (o *Outbox) publish(ctx context.Context, tx *Tx, topic string, messages []*outboxMessage) error {
+	scope := o.metrics().Tagged(map[string]string{"topic": topic})
+	msgs := make([]kafka.Message, 0, len(messages))
+	ids := make([]int64, 0, len(messages))
+	for _, m := range messages {
+		msg := kafka.Message{Key: m.key, Value: m.payload}
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(m.headers), &headers); err != nil {
+			o.logger.Warnf("outbox message %d has bad headers: %v", m.id, err)
+		}
+		for k, v := range headers {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+		}
+		msgs = append(msgs, msg)
+		ids = append(ids, m.id)
+	}
+
+	err := o.writer(topic).WriteMessages(ctx, msgs...)
+	if err != nil {
+		scope.Counter("outbox_failed").Inc(int64(len(messages)))
+		o.logger.Warnf("outbox publish of %d messages to %s failed: %v", len(messages), topic, err)
+		for _, m := range messages {
+			next := time.Now().Add(o.cfg.Backoff.Delay(m.attempts))
+			updErr := tx.exec(ctx, "UPDATE "+OutboxTable+" SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3 WHERE id = $1",
+				m.id, next, err.Error())
+			if updErr != nil {
+				return updErr
+			}
+		}
+		return nil
+	}
+
+	err = tx.exec(ctx, "UPDATE "+OutboxTable+" SET sent_at = now(), last_error = NULL WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	scope.Counter("outbox_sent").Inc(int64(len(messages)))
+	latency := scope.Histogram("outbox_relay_latency", metrics.DefaultBuckets())
+	for _, m := range messages {
+		latency.RecordDuration(time.Since(m.createdAt))
+	}
+	return nil
+}
+
+func (o *Outbox) writer(topic string) *kafka.Writer {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	w, ok := o.writers[topic]
+	if !ok {
+		cfg := o.client.DefaultWriteConfig()
+		cfg.Topic = topic
+		cfg.BatchTimeout = time.Millisecond * 10
+		w = o.client.CreateWriter(cfg)
+		o.writers[topic] = w
+	}
+	return w
+}
+
+// Prune delete messages sent before retention period, return count of deleted messages
+func (o *Outbox) Prune(ctx context.Context) (int64, error) {
+	node, err := o.selector.Writer(ctx, o.cfg.Key)
+	if err != nil {
+		return 0, err
+	}
+	const query = "DELETE FROM " + OutboxTable + " WHERE sent_at < $1"
+	before := time.Now().Add(-o.cfg.Retention)
+	if node.PGX != nil {
+		tag, err := node.PGX.Exec(ctx, query, before)
+		if err != nil {
+			return 0, err
+		}
+		return tag.RowsAffected(), nil
+	}
+	res, err := node.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Backlog return count of not sent messages
+func (o *Outbox) Backlog(ctx context.Context) (int64, error) {
+	node, err := o.selector.Writer(ctx, o.cfg.Key)
+	if err != nil {
+		return 0, err
+	}
+	const query = "SELECT count(*) FROM " + OutboxTable + " WHERE sent_at IS NULL"
+	var n int64
+	if node.PGX != nil {
+		err = node.PGX.QueryRow(ctx, query).Scan(&n)
+	} else {
+		err = node.DB.QueryRowContext(ctx, query).Scan(&n)
+	}
+	return n, err
+}
+
+func (o *Outbox) reportBacklog(ctx context.Context) {
+	n, err := o.Backlog(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			o.logger.Warnf("outbox backlog: %v", err)
+		}
+		return
+	}
+	o.metrics().Gauge("outbox_backlog").Update(float64(n))
+}
+
+func (o *Outbox) metrics() tally.Scope {
+	scope := o.selector.metrics.Scope()
+	if scope == nil {
+		return tally.NoopScope
+	}
+	return scope.Tagged(map[string]string{"db": o.cfg.Key})
+}
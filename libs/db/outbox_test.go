@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.pnhub.ru/core/libs/trace"
+)
+
+func TestOutboxEnqueue(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return nil, nil
+	})
+	d := f.selector()
+	o, err := NewOutbox(context.Background(), d.logger, d, nil, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 100, o.cfg.BatchSize)
+	assert.Equal(t, time.Hour*24*7, o.cfg.Retention)
+
+	ctx := context.Background()
+	assert.Equal(t, ErrNoTx, o.Enqueue(ctx, nil, "users", nil, []byte("{}"), nil))
+
+	remote := trace.SpanContext{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{1}, Flags: trace.FlagSampled}
+	ctx = trace.ContextWithRemoteSpanContext(ctx, remote)
+	err = RunInTx(ctx, d, "", nil, func(ctx context.Context) error {
+		return o.Enqueue(ctx, nil, "users", []byte("1"), []byte(`{"id":1}`), map[string]string{"source": "api"})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"BEGIN", "INSERT INTO outbox (topic, key, payload, headers) VALUES ($1, $2, $3, $4)", "COMMIT"}, queryLog(f))
+	args := f.statements("INSERT")[0].args
+	assert.Equal(t, []interface{}{"users", []byte("1"), []byte(`{"id":1}`)}, args[:3])
+	var headers map[string]string
+	require.NoError(t, json.Unmarshal([]byte(args[3].(string)), &headers))
+	assert.Equal(t, "api", headers["source"])
+	sc, err := trace.ParseTraceparent(headers[trace.TraceparentHeader])
+	require.NoError(t, err, "trace context is kept in headers")
+	assert.Equal(t, remote.TraceID, sc.TraceID)
+
+	_, err = o.RelayBatch(ctx)
+	assert.EqualError(t, err, "no kafka client for outbox relay")
+}
+
+func TestOutboxPrune(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if strings.HasPrefix(query, "SELECT count(*)") {
+			return &fakeResult{columns: []string{"count"}, rows: [][]driver.Value{{int64(5)}}}, nil
+		}
+		return &fakeResult{affected: 3}, nil
+	})
+	d := f.selector()
+	o, err := NewOutbox(context.Background(), d.logger, d, nil, &OutboxConfig{Retention: time.Hour}, nil)
+	require.NoError(t, err)
+
+	n, err := o.Prune(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	before := f.statements("DELETE FROM outbox WHERE sent_at < $1")[0].args[0].(time.Time)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), before, time.Minute)
+
+	n, err = o.Backlog(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+}
+
+func TestRegisterOutboxMigration(t *testing.T) {
+	RegisterOutboxMigration("test-outbox", 7)
+	s, err := newMigrationSource(&Config{MigrationsSource: "test-outbox"})
+	require.NoError(t, err)
+	v, err := s.First()
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), v)
+	assert.Contains(t, readMigration(t, s, 7, "up"), "create table if not exists outbox")
+	assert.Equal(t, "drop table if exists outbox;\n", readMigration(t, s, 7, "down"))
+}
@@ -2,27 +2,207 @@ package db
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/uber-go/tally"
 
 	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/tenant"
+	"git.pnhub.ru/core/libs/trace"
 )
 
+// pgxLogLevel is level passed to pgx. Query messages are logged by pgx on info level,
+// so pgx must emit them for tracing and metrics. PGXLogger filters output by own level.
+const pgxLogLevel = pgx.LogLevelInfo
+
+// queryMessages are pgx log messages which are emitted after query execution
+var queryMessages = map[string]bool{
+	"Query":    true,
+	"Exec":     true,
+	"CopyFrom": true,
+}
+
+type queryNameKey struct{}
+
+// WithQueryName return context with query name which is used as metrics tag and in slow query log
+func WithQueryName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, queryNameKey{}, name)
+}
+
+func QueryNameFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	name, _ := ctx.Value(queryNameKey{}).(string)
+	return name
+}
+
+// QueryMetrics is shared holder of scope for query metrics, scope can be set after pools are created
+type QueryMetrics struct {
+	scope atomic.Value
+}
+
+func (m *QueryMetrics) SetScope(scope tally.Scope) {
+	m.scope.Store(scope)
+}
+
+// Scope return scope or nil if it is not set
+func (m *QueryMetrics) Scope() tally.Scope {
+	if m == nil {
+		return nil
+	}
+	s, _ := m.scope.Load().(tally.Scope)
+	return s
+}
+
 type PGXLogger struct {
-	logger log.Logger
+	logger  log.Logger
+	level   pgx.LogLevel
+	db      string
+	key     string
+	slow    time.Duration
+	metrics *QueryMetrics
+}
+
+// NewPGXLogger create logger with level and slow query threshold from config(default level is error)
+func NewPGXLogger(logger log.Logger, cfg *Config) *PGXLogger {
+	l := &PGXLogger{
+		logger: log.ForkLogger(logger, cfg.Database),
+		level:  pgx.LogLevelError,
+		db:     cfg.Database,
+		key:    cfg.Database,
+		slow:   cfg.SlowQueryThreshold,
+	}
+	if cfg.LogLevel != "" {
+		level, err := pgx.LogLevelFromString(cfg.LogLevel)
+		if err != nil {
+			l.logger.Errorf("bad pgx log level %q, error level is used", cfg.LogLevel)
+		} else {
+			l.level = level
+		}
+	}
+	return l
+}
+
+// WithMetrics set db key tag and holder of scope for query metrics
+func (l *PGXLogger) WithMetrics(key string, metrics *QueryMetrics) *PGXLogger {
+	l.key = key
+	l.metrics = metrics
+	return l
 }
 
 func (l *PGXLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	if queryMessages[msg] {
+		l.traceQuery(ctx, level, msg, data)
+		l.recordQuery(ctx, level, msg, data)
+	}
+	if level > l.level {
+		return
+	}
+	logger := log.WithContext(ctx, l.logger).With(logFields(data)...)
 	switch level {
 	case pgx.LogLevelTrace:
-		l.logger.Debug(msg, data)
+		logger.Debug(msg)
 	case pgx.LogLevelDebug:
-		l.logger.Debug(msg, data)
+		logger.Debug(msg)
 	case pgx.LogLevelInfo:
-		l.logger.Info(msg, data)
+		logger.Info(msg)
 	case pgx.LogLevelWarn:
-		l.logger.Warn(msg, data)
+		logger.Warn(msg)
 	case pgx.LogLevelError:
-		l.logger.Error(msg, data)
+		logger.Error(msg)
+	}
+}
+
+// recordQuery write query timer and error counter and log slow query
+func (l *PGXLogger) recordQuery(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	d, _ := data["time"].(time.Duration)
+	name := QueryNameFromContext(ctx)
+	if name == "" {
+		name = strings.ToLower(msg)
+	}
+	if scope := l.metrics.Scope(); scope != nil {
+		tagged := scope.Tagged(tenant.Tags(ctx, map[string]string{"db": l.key, "query": name}))
+		if level <= pgx.LogLevelError {
+			tagged.Counter("query_errors").Inc(1)
+		} else {
+			tagged.Timer("query").Record(d)
+		}
+	}
+	if l.slow > 0 && d >= l.slow {
+		log.WithContext(ctx, l.logger).With(
+			"query", name,
+			"sql", data["sql"],
+			"args", redactArgs(data["args"]),
+			"time", d,
+		).Warn("slow query")
+	}
+}
+
+// redactArgs hide query arguments values, only count and types are logged
+func redactArgs(v interface{}) string {
+	args, ok := v.([]interface{})
+	if !ok {
+		return ""
+	}
+	types := make([]string, len(args))
+	for i, a := range args {
+		types[i] = fmt.Sprintf("$%d:%T", i+1, a)
+	}
+	return "[" + strings.Join(types, " ") + "]"
+}
+
+// logFields convert pgx data to sorted logger key-values, values of args are redacted
+func logFields(data map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]interface{}, 0, len(data)*2)
+	for _, k := range keys {
+		if k == "args" {
+			out = append(out, k, redactArgs(data[k]))
+			continue
+		}
+		out = append(out, k, data[k])
+	}
+	return out
+}
+
+// traceQuery create span for finished query. Span is created only inside existing trace.
+func (l *PGXLogger) traceQuery(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	end := time.Now()
+	start := end
+	if d, ok := data["time"].(time.Duration); ok {
+		start = end.Add(-d)
+	}
+	attributes := map[string]interface{}{
+		"db.system":    "postgresql",
+		"db.name":      l.db,
+		"db.statement": data["sql"],
+	}
+	if name := QueryNameFromContext(ctx); name != "" {
+		attributes["db.query"] = name
+	}
+	_, span := trace.Start(ctx, "db."+strings.ToLower(msg),
+		trace.WithKind(trace.SpanKindClient),
+		trace.WithStartTime(start),
+		trace.WithAttributes(attributes))
+	if level <= pgx.LogLevelError {
+		if err, ok := data["err"].(error); ok {
+			span.SetError(err)
+		} else {
+			span.SetError(fmt.Errorf("%s failed", msg))
+		}
 	}
+	span.EndAt(end)
 }
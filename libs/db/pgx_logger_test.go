@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+func newObservedPGXLogger(cfg *Config) (*PGXLogger, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	return NewPGXLogger(&log.LoggerWrapper{SugaredLogger: zap.New(core).Sugar()}, cfg), logs
+}
+
+func TestPGXLoggerLevel(t *testing.T) {
+	l, logs := newObservedPGXLogger(&Config{Database: "app", LogLevel: "warn"})
+	data := map[string]interface{}{
+		"sql":  "SELECT * FROM users WHERE email = $1",
+		"args": []interface{}{"user@example.com", 42},
+		"time": time.Millisecond,
+	}
+	l.Log(context.Background(), pgx.LogLevelInfo, "Query", data)
+	assert.Zero(t, logs.Len(), "info is below configured level")
+
+	l.Log(context.Background(), pgx.LogLevelError, "Query", data)
+	entries := logs.TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "[$1:string $2:int]", fields["args"], "values of args are not logged")
+	assert.Equal(t, "app", fields[log.LoggerComponentKey])
+
+	l, logs = newObservedPGXLogger(&Config{Database: "app", LogLevel: "verbose"})
+	assert.Equal(t, pgx.LogLevel(pgx.LogLevelError), l.level, "error level is used for bad level")
+	assert.Equal(t, 1, logs.Len())
+}
+
+func TestPGXLoggerSlowQuery(t *testing.T) {
+	l, logs := newObservedPGXLogger(&Config{Database: "app", SlowQueryThreshold: time.Millisecond * 10})
+	ctx := WithQueryName(context.Background(), "GetUser")
+	l.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{"sql": "SELECT 1", "time": time.Millisecond})
+	assert.Zero(t, logs.Len())
+
+	l.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{
+		"sql":  "SELECT * FROM users WHERE id = $1",
+		"args": []interface{}{int64(7)},
+		"time": time.Millisecond * 20,
+	})
+	entries := logs.FilterMessage("slow query").AllUntimed()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.WarnLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "GetUser", fields["query"])
+	assert.Equal(t, "[$1:int64]", fields["args"])
+	assert.Equal(t, time.Millisecond*20, fields["time"])
+}
+
+func TestPGXLoggerMetrics(t *testing.T) {
+	metrics := new(QueryMetrics)
+	l, _ := newObservedPGXLogger(&Config{Database: "app"})
+	l.WithMetrics("main", metrics)
+	// scope is not set yet
+	l.Log(context.Background(), pgx.LogLevelInfo, "Exec", map[string]interface{}{"time": time.Millisecond})
+
+	scope := tally.NewTestScope("", nil)
+	metrics.SetScope(scope)
+	l.Log(WithQueryName(context.Background(), "InsertUser"), pgx.LogLevelInfo, "Exec", map[string]interface{}{"time": time.Millisecond})
+	l.Log(context.Background(), pgx.LogLevelError, "Query", map[string]interface{}{"err": errors.New("timeout")})
+	l.Log(context.Background(), pgx.LogLevelInfo, "Prepare", map[string]interface{}{"time": time.Millisecond})
+
+	snapshot := scope.Snapshot()
+	require.Len(t, snapshot.Timers(), 1, "only finished queries are recorded")
+	for _, timer := range snapshot.Timers() {
+		assert.Equal(t, map[string]string{"db": "main", "query": "InsertUser"}, timer.Tags())
+		assert.Equal(t, []time.Duration{time.Millisecond}, timer.Values())
+	}
+	require.Len(t, snapshot.Counters(), 1)
+	for _, counter := range snapshot.Counters() {
+		assert.Equal(t, "query_errors", counter.Name())
+		assert.Equal(t, map[string]string{"db": "main", "query": "query"}, counter.Tags(), "message is name of query without name")
+	}
+}
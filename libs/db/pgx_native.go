@@ -3,7 +3,6 @@ package db
 import (
 	"context"
 
-	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 
 	"git.pnhub.ru/core/libs/log"
@@ -14,12 +13,16 @@ type PGXNative struct {
 }
 
 func NewPGXNative(ctx context.Context, logger log.Logger, cfg *Config) (*PGXNative, error) {
+	return NewPGXNativeWithLogger(ctx, NewPGXLogger(logger, cfg), cfg)
+}
+
+func NewPGXNativeWithLogger(ctx context.Context, pgxLogger *PGXLogger, cfg *Config) (*PGXNative, error) {
 	dbPoolCfg, err := pgxpool.ParseConfig(cfg.FormatDriver())
 	if err != nil {
 		return nil, err
 	}
-	dbPoolCfg.ConnConfig.Logger = &PGXLogger{logger: log.ForkLogger(logger, cfg.Database)}
-	dbPoolCfg.ConnConfig.LogLevel = pgx.LogLevelError
+	dbPoolCfg.ConnConfig.Logger = pgxLogger
+	dbPoolCfg.ConnConfig.LogLevel = pgxLogLevel
 
 	if cfg.MaxConnLifetime > 0 {
 		dbPoolCfg.MaxConnLifetime = cfg.MaxConnLifetime
@@ -27,6 +30,9 @@ func NewPGXNative(ctx context.Context, logger log.Logger, cfg *Config) (*PGXNati
 	if cfg.MaxOpenConns > 0 {
 		dbPoolCfg.MaxConns = int32(cfg.MaxOpenConns)
 	}
+	if len(cfg.Tenants) > 0 {
+		dbPoolCfg.BeforeAcquire = newSearchPaths(cfg, dbPoolCfg.MaxConns).beforeAcquire
+	}
 
 	pool, err := pgxpool.ConnectConfig(ctx, dbPoolCfg)
 	if err != nil {
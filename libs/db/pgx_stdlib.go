@@ -10,13 +10,17 @@ import (
 )
 
 func NewPGXStdlib(logger log.Logger, cfg *Config) (*sql.DB, error) {
+	return NewPGXStdlibWithLogger(NewPGXLogger(logger, cfg), cfg)
+}
+
+func NewPGXStdlibWithLogger(pgxLogger *PGXLogger, cfg *Config) (*sql.DB, error) {
 	pgxStdlibCfg, err := pgx.ParseConfig(cfg.FormatDriver())
 	if err != nil {
 		return nil, err
 	}
 
-	pgxStdlibCfg.Logger = &PGXLogger{logger: log.ForkLogger(logger, cfg.Database)}
-	pgxStdlibCfg.LogLevel = pgx.LogLevelError
+	pgxStdlibCfg.Logger = pgxLogger
+	pgxStdlibCfg.LogLevel = pgxLogLevel
 	pgxStdlibCfg.PreferSimpleProtocol = cfg.PreferSimpleProtocol
 
 	db := stdlib.OpenDB(*pgxStdlibCfg)
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// PlaceholderStyle is style of positional query parameters of driver
+type PlaceholderStyle int
+
+const (
+	// Dollar is $1, $2 style of postgres
+	Dollar PlaceholderStyle = iota
+	// Question is ? style of clickhouse
+	Question
+)
+
+// PlaceholderStyleOf return placeholder style of driver
+func PlaceholderStyleOf(driver string) PlaceholderStyle {
+	if driver == "clickhouse" {
+		return Question
+	}
+	return Dollar
+}
+
+// Rows is result of Querier.Query
+type Rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Columns() ([]string, error)
+	Err() error
+	Close() error
+}
+
+// Querier is common interface of *sql.DB, *PGXNative and Tx for query helpers
+type Querier interface {
+	Query(ctx context.Context, query string, args ...interface{}) (Rows, error)
+	Exec(ctx context.Context, query string, args ...interface{}) (int64, error)
+	Placeholder() PlaceholderStyle
+}
+
+// NewSQLQuerier create Querier over database/sql db of driver
+func NewSQLQuerier(db *sql.DB, driver string) Querier {
+	return &sqlQuerier{db: db, style: PlaceholderStyleOf(driver)}
+}
+
+// NewPGXQuerier create Querier over pgx pool
+func NewPGXQuerier(p *PGXNative) Querier {
+	return &pgxQuerier{q: p}
+}
+
+// Querier return Querier of node. Queries of sql.DB with tenants are run with search_path of tenant from context.
+func (n *Node) Querier() Querier {
+	if n.PGX != nil {
+		return NewPGXQuerier(n.PGX)
+	}
+	if len(n.Cfg.Tenants) > 0 && n.Cfg.Driver != "clickhouse" {
+		return &tenantSQLQuerier{db: n.DB, cfg: n.Cfg, style: PlaceholderStyleOf(n.Cfg.Driver)}
+	}
+	return NewSQLQuerier(n.DB, n.Cfg.Driver)
+}
+
+// Querier return Querier which runs queries in transaction
+func (t *Tx) Querier() Querier {
+	if t.PGX != nil {
+		return &pgxQuerier{q: t.PGX}
+	}
+	return &sqlQuerier{db: t.SQL, style: PlaceholderStyleOf(t.driver)}
+}
+
+// Querier return transaction of RunInTx in ctx or primary of db
+func (d *Selector) Querier(ctx context.Context, keys ...string) (Querier, error) {
+	if tx := TxFromContext(ctx, keys...); tx != nil {
+		return tx.Querier(), nil
+	}
+	node, err := d.Writer(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return node.Querier(), nil
+}
+
+// ReadQuerier return transaction of RunInTx in ctx or reader of db(replica if it is available)
+func (d *Selector) ReadQuerier(ctx context.Context, keys ...string) (Querier, error) {
+	if tx := TxFromContext(ctx, keys...); tx != nil {
+		return tx.Querier(), nil
+	}
+	node, err := d.Reader(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return node.Querier(), nil
+}
+
+// sqlConn is common part of *sql.DB and *sql.Tx
+type sqlConn interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type sqlQuerier struct {
+	db    sqlConn
+	style PlaceholderStyle
+}
+
+func (q *sqlQuerier) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	return q.db.QueryContext(ctx, query, args...)
+}
+
+func (q *sqlQuerier) Exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	res, err := q.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, nil // driver does not report affected rows
+	}
+	return n, nil
+}
+
+func (q *sqlQuerier) Placeholder() PlaceholderStyle {
+	return q.style
+}
+
+// pgxConn is common part of pgx pool and transaction
+type pgxConn interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+type pgxQuerier struct {
+	q pgxConn
+}
+
+func (q *pgxQuerier) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := q.q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &pgxRows{Rows: rows}, nil
+}
+
+func (q *pgxQuerier) Exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	tag, err := q.q.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (q *pgxQuerier) Placeholder() PlaceholderStyle {
+	return Dollar
+}
+
+// pgxRows adapt pgx.Rows to Rows
+type pgxRows struct {
+	pgx.Rows
+}
+
+func (r *pgxRows) Columns() ([]string, error) {
+	fields := r.FieldDescriptions()
+	out := make([]string, len(fields))
+	for i, f := range fields {
+		out[i] = string(f.Name)
+	}
+	return out, nil
+}
+
+func (r *pgxRows) Close() error {
+	r.Rows.Close()
+	return nil
+}
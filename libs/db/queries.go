@@ -0,0 +1,377 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.pnhub.ru/core/libs/tenant"
+	"git.pnhub.ru/core/libs/util"
+)
+
+// queryNameHeader start query in sql file(example: -- name: GetUser).
+// Types of parameters can follow name(example: -- name: GetUser(bigint, text)), they are used only by ValidateQueries.
+const queryNameHeader = "-- name:"
+
+// NamedQuery is query loaded from sql file
+type NamedQuery struct {
+	Name string
+	SQL  string
+	File string
+	// Named is set for query with :name parameters, it is run with one map or struct argument(like NamedExec)
+	Named bool
+	// ParamTypes are types of $n parameters from header, in order of numbers(named parameters are numbered by first use)
+	ParamTypes []string
+}
+
+var queriesRegistry = struct {
+	mx    sync.RWMutex
+	files map[string]map[string][]byte
+}{
+	files: make(map[string]map[string][]byte),
+}
+
+// RegisterQueries add query files(name -> content) to in-binary source with name.
+// It is called from code generated by cmd/embed-migrations with -queries flag.
+func RegisterQueries(sourceName string, files map[string][]byte) {
+	queriesRegistry.mx.Lock()
+	defer queriesRegistry.mx.Unlock()
+	m, ok := queriesRegistry.files[sourceName]
+	if !ok {
+		m = make(map[string][]byte, len(files))
+		queriesRegistry.files[sourceName] = m
+	}
+	for name, content := range files {
+		m[name] = content
+	}
+}
+
+// ParseQueries split sql file to queries by `-- name: Name` headers, text before first header is ignored
+func ParseQueries(file string, content []byte) ([]*NamedQuery, error) {
+	var out []*NamedQuery
+	var current *NamedQuery
+	var body strings.Builder
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		current.SQL = strings.TrimRight(strings.TrimSpace(body.String()), ";")
+		if current.SQL == "" {
+			return fmt.Errorf("query %s in %s is empty", current.Name, file)
+		}
+		_, args, err := bindNamed(Dollar, current.SQL, func(string) (interface{}, bool) { return nil, true })
+		if err != nil {
+			return err
+		}
+		current.Named = len(args) > 0
+		out = append(out, current)
+		body.Reset()
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), len(content)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, queryNameHeader) {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			name, types, err := parseQueryHeader(strings.TrimSpace(strings.TrimPrefix(trimmed, queryNameHeader)))
+			if err != nil {
+				return nil, fmt.Errorf("%v in %s", err, file)
+			}
+			current = &NamedQuery{Name: name, File: file, ParamTypes: types}
+			continue
+		}
+		if current != nil {
+			body.WriteString(line)
+			body.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// parseQueryHeader return name and parameter types of header text(example: GetUser(bigint, text))
+func parseQueryHeader(header string) (string, []string, error) {
+	name := header
+	var types []string
+	if i := strings.IndexByte(header, '('); i >= 0 {
+		if !strings.HasSuffix(header, ")") {
+			return "", nil, fmt.Errorf("bad parameter types of query header %q", header)
+		}
+		name = strings.TrimSpace(header[:i])
+		if list := strings.TrimSpace(header[i+1 : len(header)-1]); list != "" {
+			// commas of type modifiers(numeric(10, 2)) are skipped
+			depth, start := 0, 0
+			for j := 0; j <= len(list); j++ {
+				switch {
+				case j < len(list) && list[j] == '(':
+					depth++
+				case j < len(list) && list[j] == ')':
+					depth--
+				case j == len(list) || list[j] == ',' && depth == 0:
+					t := strings.TrimSpace(list[start:j])
+					if t == "" {
+						return "", nil, fmt.Errorf("empty parameter type in query header %q", header)
+					}
+					types = append(types, t)
+					start = j + 1
+				}
+			}
+		}
+	}
+	if name == "" || strings.IndexFunc(name, func(r rune) bool { return r > 127 || !isNameChar(byte(r)) }) >= 0 {
+		return "", nil, fmt.Errorf("bad query name %q", name)
+	}
+	return name, types, nil
+}
+
+// LoadQueries load queries of *.sql files from QueriesDir(or in-binary QueriesSource if dir is not set) by name.
+// Nil is returned if queries are not configured.
+func LoadQueries(cfg *Config) (map[string]*NamedQuery, error) {
+	var files map[string][]byte
+	switch {
+	case cfg.QueriesDir != "":
+		entries, err := ioutil.ReadDir(cfg.QueriesDir)
+		if err != nil {
+			return nil, err
+		}
+		files = make(map[string][]byte, len(entries))
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(cfg.QueriesDir, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			files[e.Name()] = content
+		}
+	case cfg.QueriesSource != "":
+		queriesRegistry.mx.RLock()
+		files = queriesRegistry.files[cfg.QueriesSource]
+		queriesRegistry.mx.RUnlock()
+		if files == nil {
+			return nil, fmt.Errorf("no registered queries source %s", cfg.QueriesSource)
+		}
+	default:
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make(map[string]*NamedQuery)
+	for _, file := range names {
+		queries, err := ParseQueries(file, files[file])
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range queries {
+			if prev, ok := out[q.Name]; ok {
+				return nil, fmt.Errorf("query %s is defined in %s and %s", q.Name, prev.File, q.File)
+			}
+			out[q.Name] = q
+		}
+	}
+	return out, nil
+}
+
+// Bind return sql and arguments for placeholder style, named query takes one map or struct argument
+func (q *NamedQuery) Bind(style PlaceholderStyle, args ...interface{}) (string, []interface{}, error) {
+	if !q.Named {
+		return q.SQL, args, nil
+	}
+	if len(args) != 1 {
+		return "", nil, fmt.Errorf("query %s has named parameters and requires one map or struct argument", q.Name)
+	}
+	return BindNamed(style, q.SQL, args[0])
+}
+
+// ValidateQueries PREPARE each query on one connection of postgres node, errors of invalid queries are collected
+// by query name to util.MultiError. Queries must be SELECT, INSERT, UPDATE, DELETE or VALUES. Schema of first tenant
+// is used for db with tenants. ClickHouse queries are not validated.
+// Postgres infers types of parameters from context, parameter without context(example: SELECT :x) fails with
+// "could not determine data type of parameter $1", types of such query must be set in header(-- name: Get(int)).
+func ValidateQueries(ctx context.Context, node *Node, queries map[string]*NamedQuery) error {
+	if len(queries) == 0 || node.Cfg.Driver == "clickhouse" {
+		return nil
+	}
+	var exec func(query string, args ...interface{}) error
+	switch {
+	case node.PGX != nil:
+		if len(node.Cfg.Tenants) > 0 {
+			ctx = tenant.WithTenant(ctx, node.Cfg.Tenants[0]) // search_path is set on acquire
+		}
+		c, err := node.PGX.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Release()
+		exec = func(query string, args ...interface{}) error {
+			_, err := c.Exec(ctx, query, args...)
+			return err
+		}
+	case node.DB != nil:
+		conn, err := node.DB.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		exec = func(query string, args ...interface{}) error {
+			_, err := conn.ExecContext(ctx, query, args...)
+			return err
+		}
+		if len(node.Cfg.Tenants) > 0 {
+			err = exec("SELECT set_config('search_path', $1, false)", node.Cfg.tenantPath(node.Cfg.Tenants[0]))
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = exec("RESET search_path")
+			}()
+		}
+	default:
+		return fmt.Errorf("no connection to validate queries")
+	}
+
+	names := make([]string, 0, len(queries))
+	for name := range queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := util.NewMultiError()
+	for i, name := range names {
+		q := queries[name]
+		query := q.SQL
+		if q.Named {
+			query, _, _ = bindNamed(Dollar, q.SQL, func(string) (interface{}, bool) { return nil, true })
+		}
+		stmt := "validate_query_" + strconv.Itoa(i)
+		prepare := "PREPARE " + stmt
+		if len(q.ParamTypes) > 0 {
+			prepare += "(" + strings.Join(q.ParamTypes, ", ") + ")"
+		}
+		err := exec(prepare + " AS " + query)
+		if err != nil {
+			errs.Add(fmt.Errorf("%s: %v", q.File, err), name)
+			continue
+		}
+		err = exec("DEALLOCATE " + stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return errs.Check()
+}
+
+// NamedQuery return query with name loaded for db
+func (d *Selector) NamedQuery(key, name string) (*NamedQuery, error) {
+	if key == "" {
+		key = DefaultDBKey
+	}
+	d.mx.RLock()
+	q, ok := d.queries[key][name]
+	d.mx.RUnlock()
+	if !ok {
+		return nil, ErrNoQuery{Key: key, Name: name}
+	}
+	return q, nil
+}
+
+// Exec run query with name on transaction of RunInTx in ctx or primary of db, return count of affected rows.
+// Query name is used as metrics tag and trace attribute.
+func (d *Selector) Exec(ctx context.Context, key, name string, args ...interface{}) (int64, error) {
+	ctx, q, query, args, err := d.bindQuery(ctx, key, name, args)
+	if err != nil {
+		return 0, err
+	}
+	return q.Exec(ctx, query, args...)
+}
+
+// QueryOne is QueryOne of query with name
+func (d *Selector) QueryOne(ctx context.Context, key, name string, dest interface{}, args ...interface{}) error {
+	ctx, q, query, args, err := d.bindQuery(ctx, key, name, args)
+	if err != nil {
+		return err
+	}
+	return QueryOne(ctx, q, dest, query, args...)
+}
+
+// QueryAll is QueryAll of query with name
+func (d *Selector) QueryAll(ctx context.Context, key, name string, dest interface{}, args ...interface{}) error {
+	ctx, q, query, args, err := d.bindQuery(ctx, key, name, args)
+	if err != nil {
+		return err
+	}
+	return QueryAll(ctx, q, dest, query, args...)
+}
+
+// Iterate is Iterate of query with name
+func (d *Selector) Iterate(ctx context.Context, key, name string, args ...interface{}) (*Iterator, error) {
+	ctx, q, query, args, err := d.bindQuery(ctx, key, name, args)
+	if err != nil {
+		return nil, err
+	}
+	return Iterate(ctx, q, query, args...)
+}
+
+// bindQuery return context with query name, querier of db and bound query
+func (d *Selector) bindQuery(ctx context.Context, key, name string, args []interface{}) (context.Context, Querier, string, []interface{}, error) {
+	nq, err := d.NamedQuery(key, name)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	if key == "" {
+		key = DefaultDBKey
+	}
+	q, err := d.Querier(ctx, key)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	query, args, err := nq.Bind(q.Placeholder(), args...)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	return WithQueryName(ctx, name), q, query, args, nil
+}
+
+// loadQueries load queries of db and validate them on its primary
+func (d *Selector) loadQueries(ctx context.Context, key string, cfg *Config) error {
+	queries, err := LoadQueries(cfg)
+	if err != nil || queries == nil {
+		return err
+	}
+	node, err := d.primary(key)
+	if err != nil {
+		return err
+	}
+	err = ValidateQueries(ctx, node, queries)
+	if err != nil {
+		return fmt.Errorf("invalid queries of db %s: %v", key, err)
+	}
+	d.mx.Lock()
+	d.queries[key] = queries
+	d.mx.Unlock()
+	d.logger.Infof("loaded %d queries of db %s", len(queries), key)
+	return nil
+}
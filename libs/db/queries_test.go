@@ -0,0 +1,107 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueries(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		queries []*NamedQuery
+		err     bool
+	}{
+		{
+			name: "queries",
+			content: "-- file comment\n" +
+				"-- name: GetUser\nSELECT * FROM users WHERE id = $1;\n\n" +
+				"  -- name: UpdateUser  \nUPDATE users\nSET name = :name\nWHERE id = :id;\n",
+			queries: []*NamedQuery{
+				{Name: "GetUser", SQL: "SELECT * FROM users WHERE id = $1", File: "users.sql"},
+				{Name: "UpdateUser", SQL: "UPDATE users\nSET name = :name\nWHERE id = :id", File: "users.sql", Named: true},
+			},
+		},
+		{
+			name:    "cast and dollar quote are not named",
+			content: "-- name: Cast\nSELECT $1::int, $$:x$$, arr[1:2] FROM t\n",
+			queries: []*NamedQuery{
+				{Name: "Cast", SQL: "SELECT $1::int, $$:x$$, arr[1:2] FROM t", File: "users.sql"},
+			},
+		},
+		{
+			name:    "parameter types",
+			content: "-- name: Echo(int, numeric(10, 2), text[])\nSELECT :x, :y, :z\n-- name: Now()\nSELECT now()\n",
+			queries: []*NamedQuery{
+				{Name: "Echo", SQL: "SELECT :x, :y, :z", File: "users.sql", Named: true, ParamTypes: []string{"int", "numeric(10, 2)", "text[]"}},
+				{Name: "Now", SQL: "SELECT now()", File: "users.sql"},
+			},
+		},
+		{name: "no queries", content: "SELECT 1;\n"},
+		{name: "empty query", content: "-- name: Empty\n\n-- name: Next\nSELECT 1\n", err: true},
+		{name: "bad name", content: "-- name: Get User\nSELECT 1\n", err: true},
+		{name: "no name", content: "-- name:\nSELECT 1\n", err: true},
+		{name: "unclosed types", content: "-- name: Get(int\nSELECT $1\n", err: true},
+		{name: "empty type", content: "-- name: Get(int, )\nSELECT $1, $2\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries, err := ParseQueries("users.sql", []byte(tt.content))
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.queries, queries)
+		})
+	}
+}
+
+func TestLoadQueries(t *testing.T) {
+	RegisterQueries("test_queries", map[string][]byte{
+		"users.sql": []byte("-- name: GetUser\nSELECT * FROM users WHERE id = $1\n-- name: InsertUser\nINSERT INTO users (name) VALUES (:name)\n"),
+	})
+	queries, err := LoadQueries(&Config{QueriesSource: "test_queries"})
+	require.NoError(t, err)
+	require.Contains(t, queries, "GetUser")
+	assert.False(t, queries["GetUser"].Named)
+	assert.True(t, queries["InsertUser"].Named)
+
+	queries, err = LoadQueries(&Config{})
+	require.NoError(t, err)
+	assert.Nil(t, queries)
+
+	RegisterQueries("test_duplicates", map[string][]byte{
+		"a.sql": []byte("-- name: Get\nSELECT 1\n"),
+		"b.sql": []byte("-- name: Get\nSELECT 2\n"),
+	})
+	_, err = LoadQueries(&Config{QueriesSource: "test_duplicates"})
+	assert.Error(t, err)
+
+	_, err = LoadQueries(&Config{QueriesSource: "unknown"})
+	assert.Error(t, err)
+
+	queries, err = LoadQueries(&Config{QueriesDir: "../../res/queries/pg_dbname"})
+	require.NoError(t, err, "example queries of res tree are parsed")
+	assert.False(t, queries["GetTableA"].Named)
+	assert.True(t, queries["InsertTableA"].Named)
+}
+
+func TestNamedQueryBind(t *testing.T) {
+	q := &NamedQuery{Name: "Update", SQL: "UPDATE users SET name = :name WHERE id = :id", Named: true}
+	query, args, err := q.Bind(Question, map[string]interface{}{"id": 1, "name": "a"})
+	require.NoError(t, err)
+	assert.Equal(t, "UPDATE users SET name = ? WHERE id = ?", query)
+	assert.Equal(t, []interface{}{"a", 1}, args)
+
+	_, _, err = q.Bind(Dollar, 1, 2)
+	assert.Error(t, err)
+
+	plain := &NamedQuery{Name: "Get", SQL: "SELECT * FROM users WHERE id = $1"}
+	query, args, err = plain.Bind(Dollar, 1)
+	require.NoError(t, err)
+	assert.Equal(t, plain.SQL, query)
+	assert.Equal(t, []interface{}{1}, args)
+}
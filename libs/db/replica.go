@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicationLagQuery return replay lag of standby in seconds, lag is zero when all received WAL is replayed
+const replicationLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+// Node is single db instance. Only one of DB and PGX is set depending on driver(PGX for pgx-native).
+type Node struct {
+	Cfg *Config
+	DB  *sql.DB
+	PGX *PGXNative
+}
+
+func (n *Node) Ping(ctx context.Context) error {
+	if n.PGX != nil {
+		return n.PGX.Ping(ctx)
+	}
+	return n.DB.PingContext(ctx)
+}
+
+// ReplicationLag return replay lag of postgres standby
+func (n *Node) ReplicationLag(ctx context.Context) (time.Duration, error) {
+	var seconds float64
+	var err error
+	if n.PGX != nil {
+		err = n.PGX.QueryRow(ctx, replicationLagQuery).Scan(&seconds)
+	} else {
+		err = n.DB.QueryRowContext(ctx, replicationLagQuery).Scan(&seconds)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func (n *Node) Close() {
+	if n.PGX != nil {
+		n.PGX.Close()
+		return
+	}
+	_ = n.DB.Close()
+}
+
+type replica struct {
+	cfg       *Config
+	mx        sync.RWMutex
+	node      *Node
+	healthy   bool
+	checked   bool
+	lastErr   error
+	lastCheck time.Time
+}
+
+func (r *replica) get() (*Node, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.node, r.healthy
+}
+
+// replicaSet balance reads between healthy replicas with round robin
+type replicaSet struct {
+	replicas []*replica
+	next     uint64
+}
+
+func (s *replicaSet) pick() *Node {
+	n := len(s.replicas)
+	start := atomic.AddUint64(&s.next, 1)
+	for i := 0; i < n; i++ {
+		node, healthy := s.replicas[(start+uint64(i))%uint64(n)].get()
+		if healthy {
+			return node
+		}
+	}
+	return nil
+}
+
+type readYourWritesKey struct{}
+
+// writeTracker remember keys of db which were written in context
+type writeTracker struct {
+	mx      sync.Mutex
+	all     bool
+	written map[string]bool
+}
+
+// WithReadYourWrites return context where Reader return primary for db key after Writer was requested for it.
+// Usually it is called once per request(http middleware, grpc interceptor).
+func WithReadYourWrites(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(readYourWritesKey{}).(*writeTracker); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, readYourWritesKey{}, &writeTracker{written: make(map[string]bool)})
+}
+
+// WithPrimaryReads return context where Reader always return primary
+func WithPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readYourWritesKey{}, &writeTracker{all: true})
+}
+
+func markWritten(ctx context.Context, key string) {
+	t, ok := ctx.Value(readYourWritesKey{}).(*writeTracker)
+	if !ok || t.all {
+		return
+	}
+	t.mx.Lock()
+	t.written[key] = true
+	t.mx.Unlock()
+}
+
+func readsFromPrimary(ctx context.Context, key string) bool {
+	t, ok := ctx.Value(readYourWritesKey{}).(*writeTracker)
+	if !ok {
+		return false
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.all || t.written[key]
+}
+
+func (d *Selector) setupReplicas(key string, cfg *Config) {
+	if len(cfg.Replicas) == 0 {
+		return
+	}
+	set := &replicaSet{replicas: make([]*replica, 0, len(cfg.Replicas))}
+	for _, rc := range cfg.Replicas {
+		r := &replica{cfg: cfg.ReplicaConfig(rc)}
+		d.checkReplica(d.ctx, key, r)
+		set.replicas = append(set.replicas, r)
+	}
+	d.mx.Lock()
+	d.replicaMap[key] = set
+	d.mx.Unlock()
+}
+
+// checkReplica connect replica if it is not connected yet and update its health
+func (d *Selector) checkReplica(ctx context.Context, key string, r *replica) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.replicaCheckInterval())
+	defer cancel()
+
+	node, wasHealthy := r.get()
+	err := func() error {
+		if node == nil {
+			n, err := d.openNode(key, r.cfg)
+			if err != nil {
+				return err
+			}
+			r.mx.Lock()
+			r.node = n
+			r.mx.Unlock()
+			node = n
+		}
+		err := node.Ping(ctx)
+		if err != nil {
+			return err
+		}
+		if r.cfg.MaxReplicationLag <= 0 || r.cfg.Driver == "clickhouse" {
+			return nil
+		}
+		lag, err := node.ReplicationLag(ctx)
+		if err != nil {
+			return err
+		}
+		if lag > r.cfg.MaxReplicationLag {
+			return fmt.Errorf("replication lag %s exceeds %s", lag, r.cfg.MaxReplicationLag)
+		}
+		return nil
+	}()
+
+	r.mx.Lock()
+	checked := r.checked
+	r.healthy = err == nil
+	r.checked = true
+	r.lastErr = err
+	r.lastCheck = time.Now()
+	r.mx.Unlock()
+	logger := d.logger.With("db", key, "replica", r.cfg.Host)
+	switch {
+	case err != nil && (wasHealthy || !checked):
+		logger.Warnf("replica is out of rotation: %v", err)
+	case err == nil && !wasHealthy:
+		logger.Info("replica is in rotation")
+	}
+}
+
+func (d *Selector) closeReplicas() {
+	for k, set := range d.replicaMap {
+		for _, r := range set.replicas {
+			node, _ := r.get()
+			if node != nil {
+				d.logger.Debugf("closing replica %s of %s", r.cfg.Host, k)
+				node.Close()
+			}
+		}
+	}
+}
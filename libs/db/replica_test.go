@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testReplica(host string, healthy bool) *replica {
+	cfg := &Config{Host: host}
+	return &replica{cfg: cfg, node: &Node{Cfg: cfg}, healthy: healthy, checked: true}
+}
+
+func pickHosts(s *replicaSet, n int) []string {
+	var out []string
+	for i := 0; i < n; i++ {
+		node := s.pick()
+		if node == nil {
+			out = append(out, "")
+			continue
+		}
+		out = append(out, node.Cfg.Host)
+	}
+	return out
+}
+
+func TestReplicaSetPick(t *testing.T) {
+	s := &replicaSet{replicas: []*replica{testReplica("r1", true), testReplica("r2", true), testReplica("r3", true)}}
+	assert.Equal(t, []string{"r2", "r3", "r1", "r2"}, pickHosts(s, 4), "round robin")
+
+	s.replicas[1].healthy = false
+	assert.Equal(t, []string{"r3", "r1", "r3", "r3"}, pickHosts(s, 4), "unhealthy replica is skipped")
+
+	s.replicas[0].healthy = false
+	s.replicas[2].healthy = false
+	assert.Equal(t, []string{"", ""}, pickHosts(s, 2))
+	assert.Nil(t, (&replicaSet{}).pick())
+}
+
+func TestSelectorReadYourWrites(t *testing.T) {
+	primary := &Config{Host: "primary"}
+	d := &Selector{
+		cfgMap: SelectorConfig{DefaultDBKey: primary, "other": {Host: "other"}},
+		replicaMap: map[string]*replicaSet{
+			DefaultDBKey: {replicas: []*replica{testReplica("replica", true)}},
+		},
+	}
+	reader := func(ctx context.Context, keys ...string) string {
+		node, err := d.Reader(ctx, keys...)
+		require.NoError(t, err)
+		return node.Cfg.Host
+	}
+
+	assert.Equal(t, "replica", reader(context.Background()))
+	assert.Equal(t, "other", reader(context.Background(), "other"), "db without replicas is read from primary")
+
+	ctx := WithReadYourWrites(context.Background())
+	assert.Equal(t, "replica", reader(ctx))
+	_, err := d.Writer(ctx, "other")
+	require.NoError(t, err)
+	assert.Equal(t, "replica", reader(ctx), "write of other db does not affect reads")
+	_, err = d.Writer(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "primary", reader(ctx), "db is read from primary after write in context")
+	assert.Equal(t, ctx, WithReadYourWrites(ctx), "tracker is created once")
+
+	// writes without tracker are not remembered
+	_, err = d.Writer(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "replica", reader(context.Background()))
+
+	assert.Equal(t, "primary", reader(WithPrimaryReads(context.Background())))
+
+	d.replicaMap[DefaultDBKey].replicas[0].healthy = false
+	assert.Equal(t, "primary", reader(context.Background()), "primary is used without healthy replicas")
+
+	_, err = d.Reader(context.Background(), "unknown")
+	assert.IsType(t, ErrNotFound{}, err)
+}
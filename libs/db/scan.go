@@ -0,0 +1,228 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// structField is path to field of struct by column name
+type structField struct {
+	index []int
+}
+
+var structFieldsCache sync.Map // reflect.Type -> map[string]structField
+
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// structFields return fields of struct by column name. Column is `db:"col"` tag or lower case field name,
+// fields with tag "-" are skipped. Fields of embedded structs are included if embedded struct has no tag.
+func structFields(t reflect.Type) map[string]structField {
+	if v, ok := structFieldsCache.Load(t); ok {
+		return v.(map[string]structField)
+	}
+	out := make(map[string]structField)
+	collectFields(t, nil, out)
+	structFieldsCache.Store(t, out)
+	return out
+}
+
+func collectFields(t reflect.Type, parent []int, out map[string]structField) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("db")
+		if tag == "-" || (f.PkgPath != "" && (!f.Anonymous || f.Type.Kind() == reflect.Ptr)) {
+			continue
+		}
+		index := make([]int, len(parent)+1)
+		copy(index, parent)
+		index[len(parent)] = i
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct && !isScalar(ft) {
+			collectFields(ft, index, out)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := tag
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if _, ok := out[name]; ok && len(index) > len(out[name].index) {
+			continue // field of outer struct wins
+		}
+		out[name] = structField{index: index}
+	}
+}
+
+// isScalar report type scanned as one column, not as struct
+func isScalar(t reflect.Type) bool {
+	if t == timeType || reflect.PtrTo(t).Implements(scannerType) {
+		return true
+	}
+	return t.Kind() != reflect.Struct
+}
+
+// fieldByIndex return field of struct value, nil embedded pointers are allocated
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// scanTargets return pointers to fields of struct value v for columns, unknown columns are discarded
+func scanTargets(v reflect.Value, columns []string) []interface{} {
+	fields := structFields(v.Type())
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		f, ok := fields[column]
+		if !ok {
+			targets[i] = new(interface{})
+			continue
+		}
+		targets[i] = fieldByIndex(v, f.index).Addr().Interface()
+	}
+	return targets
+}
+
+// scanRow scan current row to dest which is pointer to struct or pointer to scalar
+func scanRow(rows Rows, columns []string, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("scan destination must be non nil pointer, got %T", dest)
+	}
+	elem := v.Elem()
+	if isScalar(elem.Type()) {
+		if len(columns) != 1 {
+			return fmt.Errorf("scan of %d columns to %T", len(columns), dest)
+		}
+		return rows.Scan(dest)
+	}
+	return rows.Scan(scanTargets(elem, columns)...)
+}
+
+// QueryOne scan first row of query to dest(pointer to struct or scalar). Return sql.ErrNoRows if query has no rows.
+func QueryOne(ctx context.Context, q Querier, dest interface{}, query string, args ...interface{}) error {
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	err = scanRow(rows, columns, dest)
+	if err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+// QueryAll scan all rows of query to dest which is pointer to slice of structs, pointers to structs or scalars
+func QueryAll(ctx context.Context, q Querier, dest interface{}, query string, args ...interface{}) error {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("QueryAll destination must be pointer to slice, got %T", dest)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+
+	it, err := Iterate(ctx, q, query, args...)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	out := slice.Slice(0, 0)
+	for it.Next() {
+		item := reflect.New(elemType)
+		err = it.Scan(item.Interface())
+		if err != nil {
+			return err
+		}
+		if isPtr {
+			out = reflect.Append(out, item)
+		} else {
+			out = reflect.Append(out, item.Elem())
+		}
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+	slice.Set(out)
+	return nil
+}
+
+// Iterator stream rows of query, it must be closed
+type Iterator struct {
+	rows    Rows
+	columns []string
+	err     error
+}
+
+// Iterate run query and return iterator over its rows
+func Iterate(ctx context.Context, q Querier, query string, args ...interface{}) (*Iterator, error) {
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{rows: rows}, nil
+}
+
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	return it.rows.Next()
+}
+
+// Scan scan current row to dest(pointer to struct or scalar)
+func (it *Iterator) Scan(dest interface{}) error {
+	if it.columns == nil {
+		it.columns, it.err = it.rows.Columns()
+		if it.err != nil {
+			return it.err
+		}
+	}
+	return scanRow(it.rows, it.columns, dest)
+}
+
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+func (it *Iterator) Close() error {
+	return it.rows.Close()
+}
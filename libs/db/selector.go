@@ -10,6 +10,7 @@ import (
 	_ "github.com/jackc/pgx/v4/stdlib"      // add pgx driver
 	_ "github.com/lib/pq"                   // add pq driver
 
+	"github.com/uber-go/tally"
 	"go.uber.org/fx"
 
 	"git.pnhub.ru/core/libs/log"
@@ -24,9 +25,21 @@ type Selector struct {
 	mx       sync.RWMutex
 	pgxMap   map[string]*PGXNative
 	sqlDBMap map[string]*sql.DB
+
+	replicaMap map[string]*replicaSet
+	healthMap  map[string]*health
+	stopHealth context.CancelFunc
+	metrics    *QueryMetrics
+	shards     map[string]*shardGroup
+	queries    map[string]map[string]*NamedQuery
 }
 
 func NewSelector(ctx context.Context, logger log.Logger, cfg SelectorConfig, lc fx.Lifecycle) (*Selector, error) {
+	return NewSelectorWithShards(ctx, logger, cfg, nil, lc)
+}
+
+// NewSelectorWithShards create selector with shard groups, keys of groups must be db keys of cfg
+func NewSelectorWithShards(ctx context.Context, logger log.Logger, cfg SelectorConfig, shards ShardsConfig, lc fx.Lifecycle) (*Selector, error) {
 	if cfg == nil || len(cfg) == 0 {
 		return nil, fmt.Errorf("no cfg for db selecor")
 	}
@@ -36,10 +49,24 @@ func NewSelector(ctx context.Context, logger log.Logger, cfg SelectorConfig, lc
 		cfgMap:   cfg,
 		pgxMap:   make(map[string]*PGXNative, len(cfg)),
 		sqlDBMap: make(map[string]*sql.DB, len(cfg)),
+
+		replicaMap: make(map[string]*replicaSet),
+		healthMap:  make(map[string]*health, len(cfg)),
+		metrics:    new(QueryMetrics),
+		queries:    make(map[string]map[string]*NamedQuery),
+	}
+	var err error
+	dbs.shards, err = newShardGroups(cfg, shards)
+	if err != nil {
+		return nil, err
 	}
 
 	for key, dbConfig := range cfg {
-		err := NewMigrate(logger, dbConfig).Act()
+		migration, err := NewMigrate(logger, dbConfig).ActStatus()
+		if err != nil {
+			return nil, err
+		}
+		tenantMigrations, err := MigrateTenants(logger, dbConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -47,11 +74,21 @@ func NewSelector(ctx context.Context, logger log.Logger, cfg SelectorConfig, lc
 		if err != nil {
 			return nil, err
 		}
+		dbs.healthMap[key].migration = migration
+		dbs.healthMap[key].tenantMigrations = tenantMigrations
+		err = dbs.loadQueries(ctx, key, dbConfig)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if lc != nil {
 		lc.Append(fx.Hook{
 			OnStart: func(ctx context.Context) error {
+				var healthCtx context.Context
+				healthCtx, dbs.stopHealth = context.WithCancel(dbs.ctx)
+				go dbs.checkHealth(healthCtx)
+				go dbs.reportPoolStats(healthCtx)
 				return nil
 			},
 			OnStop: func(ctx context.Context) error {
@@ -65,86 +102,182 @@ func NewSelector(ctx context.Context, logger log.Logger, cfg SelectorConfig, lc
 	return dbs, nil
 }
 
+// SetupDB connect primary db and its replicas. Replica which is not available is connected later by health check.
 func (d *Selector) SetupDB(key string, cfg *Config) error {
-	var db interface{}
+	node, err := d.openNode(key, cfg)
+	if err != nil {
+		return err
+	}
+	d.setNode(key, node)
+	d.setupReplicas(key, cfg)
+	return nil
+}
+
+func (d *Selector) openNode(key string, cfg *Config) (*Node, error) {
+	node := &Node{Cfg: cfg}
 	var err error
 	switch cfg.Driver {
 	case "pgx":
-		db, err = NewPGXStdlib(d.logger, cfg)
-		if err != nil {
-			return err
-		}
+		node.DB, err = NewPGXStdlibWithLogger(NewPGXLogger(d.logger, cfg).WithMetrics(key, d.metrics), cfg)
 	case "pgx-native":
-		db, err = NewPGXNative(d.ctx, d.logger, cfg)
-		if err != nil {
-			return err
-		}
+		node.PGX, err = NewPGXNativeWithLogger(d.ctx, NewPGXLogger(d.logger, cfg).WithMetrics(key, d.metrics), cfg)
 	default:
-		db, err = NewSQLDB(cfg)
-		if err != nil {
-			return err
-		}
+		node.DB, err = NewSQLDB(cfg)
 	}
-	d.setDB(key, cfg, db)
-	return nil
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
 }
 
-func (d *Selector) setDB(key string, cfg *Config, i interface{}) {
+// setNode set primary of key and return previous one
+func (d *Selector) setNode(key string, node *Node) *Node {
 	d.mx.Lock()
 	defer d.mx.Unlock()
-	switch db := i.(type) {
-	case *PGXNative:
-		d.pgxMap[key] = db
-		d.cfgMap[key] = cfg
-	case *sql.DB:
-		d.sqlDBMap[key] = db
-		d.cfgMap[key] = cfg
+	var old *Node
+	if db, ok := d.sqlDBMap[key]; ok {
+		old = &Node{Cfg: d.cfgMap[key], DB: db}
+	}
+	if pgx, ok := d.pgxMap[key]; ok {
+		old = &Node{Cfg: d.cfgMap[key], PGX: pgx}
+	}
+	delete(d.sqlDBMap, key)
+	delete(d.pgxMap, key)
+	if node.PGX != nil {
+		d.pgxMap[key] = node.PGX
+	} else {
+		d.sqlDBMap[key] = node.DB
+	}
+	d.cfgMap[key] = node.Cfg
+	if _, ok := d.healthMap[key]; !ok {
+		d.healthMap[key] = new(health)
 	}
+	return old
 }
 
-func (d *Selector) Cfg(keys ...string) *Config {
-	d.mx.RLock()
-	defer d.mx.RUnlock()
+// SetScope enable query metrics(pgx drivers) and pool stats of all db
+func (d *Selector) SetScope(scope tally.Scope) {
+	d.metrics.SetScope(scope.SubScope("db"))
+}
+
+func selectorKey(keys []string) string {
 	if len(keys) == 0 {
-		return d.cfgMap[DefaultDBKey]
+		return DefaultDBKey
 	}
-	key := keys[0]
+	return keys[0]
+}
+
+// GetCfg return config of db or ErrNotFound
+func (d *Selector) GetCfg(keys ...string) (*Config, error) {
+	key := selectorKey(keys)
+	d.mx.RLock()
+	defer d.mx.RUnlock()
 	cfg, ok := d.cfgMap[key]
 	if !ok {
-		d.logger.Fatal("no db with key %s", key)
+		return nil, ErrNotFound{Key: key}
 	}
-	return cfg
+	return cfg, nil
 }
 
-func (d *Selector) DB(keys ...string) *sql.DB {
+// GetDB return *sql.DB of primary. ErrWrongDriver is returned for pgx-native db.
+func (d *Selector) GetDB(keys ...string) (*sql.DB, error) {
+	key := selectorKey(keys)
 	d.mx.RLock()
 	defer d.mx.RUnlock()
-	if len(keys) == 0 {
-		return d.sqlDBMap[DefaultDBKey]
+	if db, ok := d.sqlDBMap[key]; ok {
+		return db, nil
 	}
-	key := keys[0]
-	db, ok := d.sqlDBMap[key]
-	if !ok {
-		d.logger.Fatal("no db with key %s", key)
+	if cfg, ok := d.cfgMap[key]; ok {
+		return nil, ErrWrongDriver{Key: key, Driver: cfg.Driver, Want: "*sql.DB"}
+	}
+	return nil, ErrNotFound{Key: key}
+}
+
+// GetPGXNative return pgx pool of primary. ErrWrongDriver is returned for db with other driver.
+func (d *Selector) GetPGXNative(keys ...string) (*PGXNative, error) {
+	key := selectorKey(keys)
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	if db, ok := d.pgxMap[key]; ok {
+		return db, nil
+	}
+	if cfg, ok := d.cfgMap[key]; ok {
+		return nil, ErrWrongDriver{Key: key, Driver: cfg.Driver, Want: "*PGXNative"}
+	}
+	return nil, ErrNotFound{Key: key}
+}
+
+// Cfg return config of db, nil is returned for unknown key.
+// Deprecated: use GetCfg.
+func (d *Selector) Cfg(keys ...string) *Config {
+	cfg, err := d.GetCfg(keys...)
+	if err != nil {
+		d.logger.Error(err)
+	}
+	return cfg
+}
+
+// DB return *sql.DB of primary, nil is returned for unknown key or pgx-native db.
+// Deprecated: use GetDB.
+func (d *Selector) DB(keys ...string) *sql.DB {
+	db, err := d.GetDB(keys...)
+	if err != nil {
+		d.logger.Error(err)
 	}
 	return db
 }
 
+// PGXNative return pgx pool of primary, nil is returned for unknown key or db with other driver.
+// Deprecated: use GetPGXNative.
 func (d *Selector) PGXNative(keys ...string) *PGXNative {
+	db, err := d.GetPGXNative(keys...)
+	if err != nil {
+		d.logger.Error(err)
+	}
+	return db
+}
+
+// Writer return primary of db. Reader return primary for the same key and ctx after it if ctx is created by WithReadYourWrites.
+func (d *Selector) Writer(ctx context.Context, keys ...string) (*Node, error) {
+	key := selectorKey(keys)
+	node, err := d.primary(key)
+	if err != nil {
+		return nil, err
+	}
+	markWritten(ctx, key)
+	return node, nil
+}
+
+// Reader return healthy replica of db(round robin) or primary if db has no healthy replicas
+func (d *Selector) Reader(ctx context.Context, keys ...string) (*Node, error) {
+	key := selectorKey(keys)
+	if !readsFromPrimary(ctx, key) {
+		d.mx.RLock()
+		set, ok := d.replicaMap[key]
+		d.mx.RUnlock()
+		if ok {
+			if node := set.pick(); node != nil {
+				return node, nil
+			}
+		}
+	}
+	return d.primary(key)
+}
+
+func (d *Selector) primary(key string) (*Node, error) {
 	d.mx.RLock()
 	defer d.mx.RUnlock()
-	if len(keys) == 0 {
-		return d.pgxMap[DefaultDBKey]
-	}
-	key := keys[0]
-	db, ok := d.pgxMap[key]
+	cfg, ok := d.cfgMap[key]
 	if !ok {
-		d.logger.Fatal("no db with key %s", key)
+		return nil, ErrNotFound{Key: key}
 	}
-	return db
+	return &Node{Cfg: cfg, DB: d.sqlDBMap[key], PGX: d.pgxMap[key]}, nil
 }
 
 func (d *Selector) Close() {
+	if d.stopHealth != nil {
+		d.stopHealth()
+	}
 	d.mx.Lock()
 	defer d.mx.Unlock()
 
@@ -159,4 +292,5 @@ func (d *Selector) Close() {
 		d.logger.Infof("closing pgx %s", k)
 		pgx.Close()
 	}
+	d.closeReplicas()
 }
@@ -0,0 +1,269 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	"git.pnhub.ru/core/libs/util"
+)
+
+// shardVirtualNodes is count of points of each shard on hash ring
+const shardVirtualNodes = 128
+
+// ShardsConfig declare shard groups by name
+type ShardsConfig map[string]*ShardGroupConfig
+
+// ShardGroupConfig is list of db keys(of SelectorConfig) which are shards of one data set.
+// Shard keys are routed by Ranges if they are set, otherwise by consistent hashing.
+type ShardGroupConfig struct {
+	Keys   []string     `json:"keys" yaml:"keys"`
+	Ranges []ShardRange `json:"ranges" yaml:"ranges"`
+}
+
+// ShardRange is range [From, To) of integer shard keys which are routed to db with Key
+type ShardRange struct {
+	Key  string `json:"key" yaml:"key"`
+	From int64  `json:"from" yaml:"from"`
+	To   int64  `json:"to" yaml:"to"`
+}
+
+// shardGroup route shard keys to db keys of group by ranges or hash ring
+type shardGroup struct {
+	name   string
+	keys   []string
+	ring   []shardPoint
+	ranges []ShardRange
+}
+
+type shardPoint struct {
+	hash uint64
+	key  string
+}
+
+// newShardGroups build shard groups of config, keys of groups must be db keys of selector config
+func newShardGroups(cfg SelectorConfig, shards ShardsConfig) (map[string]*shardGroup, error) {
+	groups := make(map[string]*shardGroup, len(shards))
+	for name, c := range shards {
+		if c == nil || len(c.Keys) == 0 {
+			return nil, fmt.Errorf("shard group %s has no keys", name)
+		}
+		g := &shardGroup{name: name, keys: make([]string, 0, len(c.Keys))}
+		seen := make(map[string]bool, len(c.Keys))
+		for _, key := range c.Keys {
+			if _, ok := cfg[key]; !ok {
+				return nil, fmt.Errorf("shard group %s: %v", name, ErrNotFound{Key: key})
+			}
+			if seen[key] {
+				return nil, fmt.Errorf("shard group %s has key %s twice", name, key)
+			}
+			seen[key] = true
+			g.keys = append(g.keys, key)
+		}
+		if len(c.Ranges) == 0 {
+			g.buildRing()
+		} else {
+			err := g.buildRanges(c.Ranges, seen)
+			if err != nil {
+				return nil, err
+			}
+		}
+		groups[name] = g
+	}
+	return groups, nil
+}
+
+func (g *shardGroup) buildRing() {
+	g.ring = make([]shardPoint, 0, len(g.keys)*shardVirtualNodes)
+	for _, key := range g.keys {
+		for i := 0; i < shardVirtualNodes; i++ {
+			g.ring = append(g.ring, shardPoint{hash: shardHash([]byte(key + "#" + strconv.Itoa(i))), key: key})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool {
+		if g.ring[i].hash == g.ring[j].hash {
+			return g.ring[i].key < g.ring[j].key
+		}
+		return g.ring[i].hash < g.ring[j].hash
+	})
+}
+
+func (g *shardGroup) buildRanges(ranges []ShardRange, keys map[string]bool) error {
+	withRanges := make(map[string]bool, len(keys))
+	for _, r := range ranges {
+		if !keys[r.Key] {
+			return fmt.Errorf("range [%d, %d) of shard group %s has key %s which is not in group", r.From, r.To, g.name, r.Key)
+		}
+		if r.From >= r.To {
+			return fmt.Errorf("empty range [%d, %d) of shard %s", r.From, r.To, r.Key)
+		}
+		withRanges[r.Key] = true
+		g.ranges = append(g.ranges, r)
+	}
+	for _, key := range g.keys {
+		if !withRanges[key] {
+			return fmt.Errorf("shard %s of group %s has no ranges", key, g.name)
+		}
+	}
+	sort.Slice(g.ranges, func(i, j int) bool {
+		return g.ranges[i].From < g.ranges[j].From
+	})
+	for i := 1; i < len(g.ranges); i++ {
+		prev, r := g.ranges[i-1], g.ranges[i]
+		if r.From < prev.To {
+			return fmt.Errorf("range [%d, %d) of shard %s overlaps range [%d, %d) of shard %s",
+				r.From, r.To, r.Key, prev.From, prev.To, prev.Key)
+		}
+	}
+	return nil
+}
+
+// route return db key for shard key
+func (g *shardGroup) route(shardKey interface{}) (string, error) {
+	if g.ranges != nil {
+		n, ok := shardInt(shardKey)
+		if !ok {
+			return "", fmt.Errorf("shard group %s is routed by ranges, shard key must be integer, got %T", g.name, shardKey)
+		}
+		i := sort.Search(len(g.ranges), func(i int) bool {
+			return g.ranges[i].To > n
+		})
+		if i == len(g.ranges) || g.ranges[i].From > n {
+			return "", ErrNoShard{Group: g.name, ShardKey: shardKey}
+		}
+		return g.ranges[i].Key, nil
+	}
+	h := shardHash(shardKeyBytes(shardKey))
+	i := sort.Search(len(g.ring), func(i int) bool {
+		return g.ring[i].hash >= h
+	})
+	if i == len(g.ring) {
+		i = 0
+	}
+	return g.ring[i].key, nil
+}
+
+// shardHash is fnv-1a with final mix for even spread of similar keys on ring
+func shardHash(data []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func shardKeyBytes(shardKey interface{}) []byte {
+	switch k := shardKey.(type) {
+	case string:
+		return []byte(k)
+	case []byte:
+		return k
+	}
+	if n, ok := shardInt(shardKey); ok {
+		return []byte(strconv.FormatInt(n, 10))
+	}
+	return []byte(fmt.Sprint(shardKey))
+}
+
+func shardInt(shardKey interface{}) (int64, bool) {
+	v := reflect.ValueOf(shardKey)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v.Uint()), true
+	}
+	return 0, false
+}
+
+// Shard return db key of shard of group for shard key. Integer keys are routed by ranges if group has them,
+// other groups use consistent hashing, so adding shard moves only part of keys.
+func (d *Selector) Shard(group string, shardKey interface{}) (string, error) {
+	g, ok := d.shards[group]
+	if !ok {
+		return "", ErrNoShard{Group: group}
+	}
+	return g.route(shardKey)
+}
+
+// ShardKeys return db keys of all shards of group in configured order
+func (d *Selector) ShardKeys(group string) ([]string, error) {
+	g, ok := d.shards[group]
+	if !ok {
+		return nil, ErrNoShard{Group: group}
+	}
+	out := make([]string, len(g.keys))
+	copy(out, g.keys)
+	return out, nil
+}
+
+// ScatterGather run fn concurrently for each shard of group and wait for all of them.
+// Errors are collected by db key to util.MultiError.
+func (d *Selector) ScatterGather(ctx context.Context, group string, fn func(ctx context.Context, key string) error) error {
+	keys, err := d.ShardKeys(group)
+	if err != nil {
+		return err
+	}
+	errs := util.NewMultiError()
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			errs.Add(fn(ctx, key), key)
+		}(key)
+	}
+	wg.Wait()
+	return errs.Check()
+}
+
+// ScatterQueryAll run query on reader of each shard of group and append rows of all shards to dest like QueryAll.
+// Rows are merged in configured order of shard keys, rows of successful shards are kept if some shards failed.
+func (d *Selector) ScatterQueryAll(ctx context.Context, group string, dest interface{}, query string, args ...interface{}) error {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("ScatterQueryAll destination must be pointer to slice, got %T", dest)
+	}
+	slice = slice.Elem()
+	keys, err := d.ShardKeys(group)
+	if err != nil {
+		return err
+	}
+	results := make(map[string]reflect.Value, len(keys))
+	var mx sync.Mutex
+	err = d.ScatterGather(ctx, group, func(ctx context.Context, key string) error {
+		q, err := d.ReadQuerier(ctx, key)
+		if err != nil {
+			return err
+		}
+		part := reflect.New(slice.Type())
+		err = QueryAll(ctx, q, part.Interface(), query, args...)
+		if err != nil {
+			return err
+		}
+		mx.Lock()
+		results[key] = part.Elem()
+		mx.Unlock()
+		return nil
+	})
+	out := slice.Slice(0, 0)
+	for _, key := range keys {
+		if part, ok := results[key]; ok {
+			out = reflect.AppendSlice(out, part)
+		}
+	}
+	slice.Set(out)
+	return err
+}
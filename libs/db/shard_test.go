@@ -0,0 +1,176 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardRanges(t *testing.T) {
+	shards := ShardsConfig{"users": {
+		Keys: []string{"s1", "s2"},
+		Ranges: []ShardRange{
+			{Key: "s1", From: 0, To: 100},
+			{Key: "s2", From: 100, To: 200},
+			{Key: "s1", From: 200, To: 300},
+		},
+	}}
+	groups, err := newShardGroups(SelectorConfig{"s1": {}, "s2": {}}, shards)
+	require.NoError(t, err)
+	g := groups["users"]
+	require.NotNil(t, g)
+
+	tests := []struct {
+		key   interface{}
+		shard string
+		err   bool
+	}{
+		{key: 0, shard: "s1"},
+		{key: int64(99), shard: "s1"},
+		{key: uint8(100), shard: "s2"},
+		{key: int32(199), shard: "s2"},
+		{key: uint64(250), shard: "s1"},
+		{key: 300, err: true},
+		{key: -1, err: true},
+		{key: uint64(1 << 63), err: true},
+		{key: "100", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%T(%v)", tt.key, tt.key), func(t *testing.T) {
+			shard, err := g.route(tt.key)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.shard, shard)
+		})
+	}
+}
+
+func TestShardGroupsErrors(t *testing.T) {
+	cfg := SelectorConfig{"s1": {}, "s2": {}}
+	tests := []struct {
+		name   string
+		shards ShardsConfig
+	}{
+		{
+			name:   "no keys",
+			shards: ShardsConfig{"g": {}},
+		},
+		{
+			name:   "unknown key",
+			shards: ShardsConfig{"g": {Keys: []string{"s1", "s3"}}},
+		},
+		{
+			name:   "duplicate key",
+			shards: ShardsConfig{"g": {Keys: []string{"s1", "s1"}}},
+		},
+		{
+			name: "range of key out of group",
+			shards: ShardsConfig{"g": {
+				Keys:   []string{"s1"},
+				Ranges: []ShardRange{{Key: "s1", From: 0, To: 100}, {Key: "s2", From: 100, To: 200}},
+			}},
+		},
+		{
+			name: "overlap",
+			shards: ShardsConfig{"g": {
+				Keys:   []string{"s1", "s2"},
+				Ranges: []ShardRange{{Key: "s1", From: 0, To: 100}, {Key: "s2", From: 99, To: 200}},
+			}},
+		},
+		{
+			name: "overlap of the same shard",
+			shards: ShardsConfig{"g": {
+				Keys:   []string{"s1"},
+				Ranges: []ShardRange{{Key: "s1", From: 0, To: 100}, {Key: "s1", From: 50, To: 60}},
+			}},
+		},
+		{
+			name: "empty range",
+			shards: ShardsConfig{"g": {
+				Keys:   []string{"s1"},
+				Ranges: []ShardRange{{Key: "s1", From: 10, To: 10}},
+			}},
+		},
+		{
+			name: "key without ranges",
+			shards: ShardsConfig{"g": {
+				Keys:   []string{"s1", "s2"},
+				Ranges: []ShardRange{{Key: "s1", From: 0, To: 100}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newShardGroups(cfg, tt.shards)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestShardRing(t *testing.T) {
+	cfg := SelectorConfig{"s1": {}, "s2": {}, "s3": {}, "s4": {}, "other": {}}
+	shards := ShardsConfig{"events": {Keys: []string{"s3", "s1", "s2"}}}
+	groups, err := newShardGroups(cfg, shards)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	g := groups["events"]
+	assert.Equal(t, []string{"s3", "s1", "s2"}, g.keys, "declared order is kept")
+	assert.Len(t, g.ring, 3*shardVirtualNodes)
+
+	const keys = 30000
+	before := make(map[int]string, keys)
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		shard, err := g.route(i)
+		require.NoError(t, err)
+		before[i] = shard
+		counts[shard]++
+	}
+	for key, n := range counts {
+		assert.InDelta(t, keys/3, n, keys/3*0.25, "keys of shard %s", key)
+	}
+
+	// routing is stable for the same key and type of integer
+	shard, err := g.route(int64(42))
+	require.NoError(t, err)
+	assert.Equal(t, before[42], shard)
+	shard, err = g.route("42")
+	require.NoError(t, err)
+	assert.Equal(t, before[42], shard)
+
+	// adding shard moves keys only to new shard
+	shards["events"].Keys = append(shards["events"].Keys, "s4")
+	groups, err = newShardGroups(cfg, shards)
+	require.NoError(t, err)
+	g = groups["events"]
+	moved := 0
+	for i := 0; i < keys; i++ {
+		shard, err := g.route(i)
+		require.NoError(t, err)
+		if shard != before[i] {
+			assert.Equal(t, "s4", shard)
+			moved++
+		}
+	}
+	assert.InDelta(t, keys/4, moved, keys/4*0.25)
+}
+
+func TestSelectorShard(t *testing.T) {
+	groups, err := newShardGroups(SelectorConfig{"s1": {}}, ShardsConfig{"g": {Keys: []string{"s1"}}})
+	require.NoError(t, err)
+	d := &Selector{shards: groups}
+
+	shard, err := d.Shard("g", "any")
+	require.NoError(t, err)
+	assert.Equal(t, "s1", shard)
+
+	_, err = d.Shard("unknown", 1)
+	assert.IsType(t, ErrNoShard{}, err)
+	_, err = d.ShardKeys("unknown")
+	assert.IsType(t, ErrNoShard{}, err)
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v4"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/tenant"
+)
+
+// TenantSchema return schema of tenant
+func (c *Config) TenantSchema(t string) string {
+	return c.TenantSchemaPrefix + t
+}
+
+// IsTenant check that tenant is in Tenants
+func (c *Config) IsTenant(t string) bool {
+	for _, known := range c.Tenants {
+		if known == t {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantConfig return config with search_path of tenant schema, it is used for tenant migrations
+func (c *Config) TenantConfig(t string) *Config {
+	out := *c
+	out.SearchPath = c.tenantPath(t)
+	out.Tenants = nil
+	out.Replicas = nil
+	return &out
+}
+
+// tenantSearchPath return search_path for tenant of ctx, empty string is returned if db has no tenants or ctx has no tenant
+func (c *Config) tenantSearchPath(ctx context.Context) string {
+	if len(c.Tenants) == 0 {
+		return ""
+	}
+	t := tenant.FromContext(ctx)
+	if t == "" {
+		return ""
+	}
+	return c.tenantPath(t)
+}
+
+// tenantPath is tenant schema followed by shared SearchPath. Shared schemas are not added for unknown tenant,
+// so its queries fail instead of reading shared tables.
+func (c *Config) tenantPath(t string) string {
+	path := pgx.Identifier{c.TenantSchema(t)}.Sanitize()
+	if c.SearchPath != "" && c.IsTenant(t) {
+		path += ", " + c.SearchPath
+	}
+	return path
+}
+
+// searchPaths set search_path of tenant on acquire of pgx-native pool connection.
+// It remembers path of each connection, so path is set only when tenant of connection changes.
+type searchPaths struct {
+	cfg *Config
+	max int
+
+	mx    sync.Mutex
+	conns map[*pgx.Conn]string
+}
+
+func newSearchPaths(cfg *Config, maxConns int32) *searchPaths {
+	return &searchPaths{cfg: cfg, max: int(maxConns) * 2, conns: make(map[*pgx.Conn]string)}
+}
+
+func (s *searchPaths) beforeAcquire(ctx context.Context, conn *pgx.Conn) bool {
+	want := s.cfg.tenantSearchPath(ctx)
+	s.mx.Lock()
+	current := s.conns[conn]
+	s.mx.Unlock()
+	if current == want {
+		return true
+	}
+	ctx = WithQueryName(ctx, "set_search_path")
+	var err error
+	if want == "" {
+		_, err = conn.Exec(ctx, "RESET search_path")
+	} else {
+		_, err = conn.Exec(ctx, "SELECT set_config('search_path', $1, false)", want)
+	}
+	if err != nil {
+		return false // connection is destroyed by pool
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.conns[conn] = want
+	if len(s.conns) > s.max {
+		for c := range s.conns {
+			if c.IsClosed() {
+				delete(s.conns, c)
+			}
+		}
+	}
+	return true
+}
+
+// tenantSQLQuerier is Querier of sql.DB with tenants. Query of ctx with tenant is run in own transaction with
+// search_path of tenant set locally, so path is reset by end of transaction and is not left on pool connection.
+type tenantSQLQuerier struct {
+	db    *sql.DB
+	cfg   *Config
+	style PlaceholderStyle
+}
+
+func (q *tenantSQLQuerier) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	path := q.cfg.tenantSearchPath(ctx)
+	if path == "" {
+		return q.db.QueryContext(ctx, query, args...)
+	}
+	tx, err := q.begin(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return &tenantRows{Rows: rows, tx: tx}, nil
+}
+
+func (q *tenantSQLQuerier) Exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	path := q.cfg.tenantSearchPath(ctx)
+	if path == "" {
+		return (&sqlQuerier{db: q.db, style: q.style}).Exec(ctx, query, args...)
+	}
+	tx, err := q.begin(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := (&sqlQuerier{db: tx, style: q.style}).Exec(ctx, query, args...)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (q *tenantSQLQuerier) Placeholder() PlaceholderStyle {
+	return q.style
+}
+
+func (q *tenantSQLQuerier) begin(ctx context.Context, path string) (*sql.Tx, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "SELECT set_config('search_path', $1, true)", path)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// tenantRows commit transaction of query when rows are closed, transaction is rolled back after rows error
+type tenantRows struct {
+	*sql.Rows
+	tx *sql.Tx
+}
+
+func (r *tenantRows) Close() error {
+	err := r.Rows.Close()
+	if err != nil || r.Rows.Err() != nil {
+		_ = r.tx.Rollback()
+		return err
+	}
+	return r.tx.Commit()
+}
+
+// setTxSearchPath set search_path of tenant from ctx for sql.DB transaction
+func setTxSearchPath(ctx context.Context, cfg *Config, tx *sql.Tx) error {
+	path := cfg.tenantSearchPath(ctx)
+	if path == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "SELECT set_config('search_path', $1, true)", path)
+	return err
+}
+
+// MigrateTenants create schema of each tenant and migrate it to DesiredVersion.
+// Nil is returned if db has no tenants or migrations are not configured.
+func MigrateTenants(logger log.Logger, cfg *Config) (map[string]*MigrationStatus, error) {
+	if len(cfg.Tenants) == 0 || cfg.DesiredVersion <= 0 || (cfg.SQLDir == "" && cfg.MigrationsSource == "") {
+		return nil, nil
+	}
+	db, err := sql.Open("pgx", cfg.FormatDriver())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	out := make(map[string]*MigrationStatus, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		_, err = db.Exec("CREATE SCHEMA IF NOT EXISTS " + pgx.Identifier{cfg.TenantSchema(t)}.Sanitize())
+		if err != nil {
+			return nil, fmt.Errorf("create schema of tenant %s: %v", t, err)
+		}
+		status, err := NewMigrate(logger, cfg.TenantConfig(t)).ActStatus()
+		if err != nil {
+			return nil, fmt.Errorf("migrate tenant %s: %v", t, err)
+		}
+		out[t] = status
+	}
+	return out, nil
+}
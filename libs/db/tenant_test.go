@@ -0,0 +1,41 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.pnhub.ru/core/libs/tenant"
+)
+
+func TestTenantSearchPath(t *testing.T) {
+	cfg := &Config{Tenants: []string{"acme"}, TenantSchemaPrefix: "t_", SearchPath: "shared, public"}
+	tests := []struct {
+		name   string
+		cfg    *Config
+		tenant string
+		path   string
+	}{
+		{name: "known tenant", cfg: cfg, tenant: "acme", path: `"t_acme", shared, public`},
+		{name: "unknown tenant", cfg: cfg, tenant: "beta", path: `"t_beta"`},
+		{name: "quoted schema", cfg: cfg, tenant: `a"b`, path: `"t_a""b"`},
+		{name: "no tenant", cfg: cfg, tenant: "", path: ""},
+		{name: "db without tenants", cfg: &Config{SearchPath: "public"}, tenant: "acme", path: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.tenant != "" {
+				ctx = tenant.WithTenant(ctx, tt.tenant)
+			}
+			assert.Equal(t, tt.path, tt.cfg.tenantSearchPath(ctx))
+		})
+	}
+}
+
+func TestNodeQuerierTenants(t *testing.T) {
+	assert.IsType(t, &tenantSQLQuerier{}, (&Node{Cfg: &Config{Driver: "postgres", Tenants: []string{"acme"}}}).Querier())
+	assert.IsType(t, &sqlQuerier{}, (&Node{Cfg: &Config{Driver: "postgres"}}).Querier())
+	assert.IsType(t, &sqlQuerier{}, (&Node{Cfg: &Config{Driver: "clickhouse", Tenants: []string{"acme"}}}).Querier())
+}
@@ -0,0 +1,303 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/lib/pq"
+
+	"git.pnhub.ru/core/libs/util"
+)
+
+// DefaultTxAttempts is number of attempts of transaction which fails with serialization failure or deadlock
+const DefaultTxAttempts = 3
+
+// SQLSTATE codes of errors after which transaction can be retried
+const (
+	SQLStateSerializationFailure = "40001"
+	SQLStateDeadlockDetected     = "40P01"
+)
+
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxAttempts limit attempts of retryable transaction(default DefaultTxAttempts, 1 disables retries)
+	MaxAttempts int
+	Backoff     util.Backoff
+}
+
+// Tx is transaction opened by RunInTx. Only one of SQL and PGX is set depending on db driver.
+type Tx struct {
+	Key string
+	SQL *sql.Tx
+	PGX pgx.Tx
+
+	driver    string
+	mx        sync.Mutex
+	savepoint int
+}
+
+// txScope is transaction level(transaction or savepoint) with its after commit hooks
+type txScope struct {
+	tx     *Tx
+	parent *txScope
+	mx     sync.Mutex
+	hooks  []func(ctx context.Context)
+}
+
+type txKey struct {
+	key string
+}
+
+// TxFromContext return transaction of db key opened by RunInTx in ctx or nil
+func TxFromContext(ctx context.Context, keys ...string) *Tx {
+	if s := scopeFromContext(ctx, selectorKey(keys)); s != nil {
+		return s.tx
+	}
+	return nil
+}
+
+func scopeFromContext(ctx context.Context, key string) *txScope {
+	s, _ := ctx.Value(txKey{key: key}).(*txScope)
+	return s
+}
+
+// AfterCommit register hook which is called after commit of outer transaction of db key in ctx.
+// Hooks of rolled back transaction or savepoint are dropped. Hook is called immediately if ctx has no transaction.
+func AfterCommit(ctx context.Context, hook func(ctx context.Context), keys ...string) {
+	s := scopeFromContext(ctx, selectorKey(keys))
+	if s == nil {
+		hook(ctx)
+		return
+	}
+	s.mx.Lock()
+	s.hooks = append(s.hooks, hook)
+	s.mx.Unlock()
+}
+
+// IsRetryableTxError check that error is serialization failure or deadlock
+func IsRetryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == SQLStateSerializationFailure || pgErr.Code == SQLStateDeadlockDetected
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == SQLStateSerializationFailure || pqErr.Code == SQLStateDeadlockDetected
+	}
+	return false
+}
+
+// RunInTx run fn in transaction of primary db with key. Transaction is passed to fn in context(TxFromContext).
+// Nested call with the same key use savepoint of outer transaction, options of nested call are ignored.
+// Outer transaction is retried with backoff on serialization failure and deadlock, so fn must be safe for re-run.
+// Hooks registered by AfterCommit are called after successful commit.
+func RunInTx(ctx context.Context, selector *Selector, key string, opts *TxOptions, fn func(ctx context.Context) error) error {
+	if key == "" {
+		key = DefaultDBKey
+	}
+	if parent := scopeFromContext(ctx, key); parent != nil {
+		return runInSavepoint(ctx, parent, fn)
+	}
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+	attempts := opts.MaxAttempts
+	if attempts <= 0 {
+		attempts = DefaultTxAttempts
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			selector.logger.Debugf("retry transaction of db %s(attempt %d): %v", key, attempt+1, err)
+			if waitErr := opts.Backoff.Wait(ctx, attempt-1); waitErr != nil {
+				return err
+			}
+		}
+		var scope *txScope
+		scope, err = runTxOnce(ctx, selector, key, opts, fn)
+		if err == nil {
+			for _, hook := range scope.hooks {
+				hook(ctx)
+			}
+			return nil
+		}
+		if !IsRetryableTxError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func runTxOnce(ctx context.Context, selector *Selector, key string, opts *TxOptions, fn func(ctx context.Context) error) (scope *txScope, err error) {
+	node, err := selector.Writer(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := beginTx(ctx, node, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	scope = &txScope{tx: tx}
+	defer func() {
+		if r := recover(); r != nil {
+			_ = tx.rollback(ctx)
+			panic(r)
+		}
+	}()
+
+	err = fn(context.WithValue(ctx, txKey{key: key}, scope))
+	if err != nil {
+		rbErr := tx.rollback(ctx)
+		if rbErr != nil {
+			selector.logger.Error(fmt.Errorf("rollback of db %s transaction failed: %v", key, rbErr))
+		}
+		return nil, err
+	}
+	err = tx.commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scope, nil
+}
+
+func runInSavepoint(ctx context.Context, parent *txScope, fn func(ctx context.Context) error) (err error) {
+	tx := parent.tx
+	tx.mx.Lock()
+	tx.savepoint++
+	name := fmt.Sprintf("sp_%d", tx.savepoint)
+	tx.mx.Unlock()
+
+	err = tx.exec(ctx, "SAVEPOINT "+name)
+	if err != nil {
+		return err
+	}
+	scope := &txScope{tx: tx, parent: parent}
+	defer func() {
+		if r := recover(); r != nil {
+			_ = tx.exec(ctx, "ROLLBACK TO SAVEPOINT "+name)
+			panic(r)
+		}
+	}()
+
+	err = fn(context.WithValue(ctx, txKey{key: tx.Key}, scope))
+	if err != nil {
+		rbErr := tx.exec(ctx, "ROLLBACK TO SAVEPOINT "+name)
+		if rbErr != nil {
+			return fmt.Errorf("%v(rollback to savepoint failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	err = tx.exec(ctx, "RELEASE SAVEPOINT "+name)
+	if err != nil {
+		return err
+	}
+	parent.mx.Lock()
+	parent.hooks = append(parent.hooks, scope.hooks...)
+	parent.mx.Unlock()
+	return nil
+}
+
+func beginTx(ctx context.Context, node *Node, key string, opts *TxOptions) (*Tx, error) {
+	if node.PGX != nil {
+		tx, err := node.PGX.BeginTx(ctx, pgx.TxOptions{
+			IsoLevel:   pgxIsoLevel(opts.Isolation),
+			AccessMode: pgxAccessMode(opts.ReadOnly),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &Tx{Key: key, PGX: tx, driver: node.Cfg.Driver}, nil
+	}
+	tx, err := node.DB.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	err = setTxSearchPath(ctx, node.Cfg, tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return &Tx{Key: key, SQL: tx, driver: node.Cfg.Driver}, nil
+}
+
+func (t *Tx) exec(ctx context.Context, query string, args ...interface{}) error {
+	if t.PGX != nil {
+		_, err := t.PGX.Exec(ctx, query, args...)
+		return err
+	}
+	_, err := t.SQL.ExecContext(ctx, query, args...)
+	return err
+}
+
+// queryEach run query in transaction and call fn for each row with scan function of the row
+func (t *Tx) queryEach(ctx context.Context, query string, args []interface{}, fn func(scan func(dest ...interface{}) error) error) error {
+	if t.PGX != nil {
+		rows, err := t.PGX.Query(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			err = fn(rows.Scan)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+	rows, err := t.SQL.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = fn(rows.Scan)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (t *Tx) commit(ctx context.Context) error {
+	if t.PGX != nil {
+		return t.PGX.Commit(ctx)
+	}
+	return t.SQL.Commit()
+}
+
+func (t *Tx) rollback(ctx context.Context) error {
+	if t.PGX != nil {
+		return t.PGX.Rollback(ctx)
+	}
+	return t.SQL.Rollback()
+}
+
+func pgxIsoLevel(level sql.IsolationLevel) pgx.TxIsoLevel {
+	switch level {
+	case sql.LevelSerializable:
+		return pgx.Serializable
+	case sql.LevelRepeatableRead, sql.LevelSnapshot:
+		return pgx.RepeatableRead
+	case sql.LevelReadCommitted:
+		return pgx.ReadCommitted
+	case sql.LevelReadUncommitted:
+		return pgx.ReadUncommitted
+	default:
+		return ""
+	}
+}
+
+func pgxAccessMode(readOnly bool) pgx.TxAccessMode {
+	if readOnly {
+		return pgx.ReadOnly
+	}
+	return pgx.ReadWrite
+}
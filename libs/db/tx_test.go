@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.pnhub.ru/core/libs/util"
+)
+
+func TestIsRetryableTxError(t *testing.T) {
+	assert.True(t, IsRetryableTxError(&pgconn.PgError{Code: SQLStateSerializationFailure}))
+	assert.True(t, IsRetryableTxError(&pgconn.PgError{Code: SQLStateDeadlockDetected}))
+	assert.True(t, IsRetryableTxError(&pq.Error{Code: SQLStateSerializationFailure}))
+	assert.True(t, IsRetryableTxError(&pq.Error{Code: SQLStateDeadlockDetected}))
+	assert.True(t, IsRetryableTxError(fmt.Errorf("commit: %w", &pgconn.PgError{Code: SQLStateDeadlockDetected})), "wrapped error")
+
+	assert.False(t, IsRetryableTxError(&pgconn.PgError{Code: "23505"}))
+	assert.False(t, IsRetryableTxError(&pq.Error{Code: "57014"}))
+	assert.False(t, IsRetryableTxError(errors.New(SQLStateSerializationFailure)))
+	assert.False(t, IsRetryableTxError(nil))
+}
+
+// queryLog return all statements of fake in order
+func queryLog(f *fakeDB) []string {
+	var out []string
+	for _, s := range f.statements("") {
+		out = append(out, s.query)
+	}
+	return out
+}
+
+var fastTx = &TxOptions{Backoff: util.Backoff{Min: time.Millisecond, Max: time.Millisecond}}
+
+func TestRunInTxRetry(t *testing.T) {
+	commits := 0
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if query == "COMMIT" {
+			commits++
+			if commits < 3 {
+				return nil, &pq.Error{Code: SQLStateSerializationFailure}
+			}
+		}
+		return nil, nil
+	})
+	runs, hooks := 0, 0
+	err := RunInTx(context.Background(), f.selector(), "", fastTx, func(ctx context.Context) error {
+		runs++
+		require.NotNil(t, TxFromContext(ctx))
+		assert.NotNil(t, TxFromContext(ctx).SQL)
+		AfterCommit(ctx, func(context.Context) { hooks++ })
+		_, err := TxFromContext(ctx).SQL.ExecContext(ctx, "UPDATE accounts SET balance = 0")
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, runs, "transaction is re-run after serialization failure")
+	assert.Equal(t, 1, hooks, "hooks of failed attempts are dropped")
+}
+
+func TestRunInTxAttempts(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		if query == "COMMIT" {
+			return nil, &pgconn.PgError{Code: SQLStateDeadlockDetected}
+		}
+		return nil, nil
+	})
+	runs := 0
+	opts := *fastTx
+	opts.MaxAttempts = 1
+	err := RunInTx(context.Background(), f.selector(), "", &opts, func(ctx context.Context) error {
+		runs++
+		return nil
+	})
+	assert.True(t, IsRetryableTxError(err))
+	assert.Equal(t, 1, runs, "one attempt disables retries")
+
+	runs = 0
+	err = RunInTx(context.Background(), f.selector(), "", fastTx, func(ctx context.Context) error {
+		runs++
+		return nil
+	})
+	assert.True(t, IsRetryableTxError(err))
+	assert.Equal(t, DefaultTxAttempts, runs)
+}
+
+func TestRunInTxRollback(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return nil, nil
+	})
+	called := false
+	failure := errors.New("insufficient funds")
+	err := RunInTx(context.Background(), f.selector(), "", fastTx, func(ctx context.Context) error {
+		AfterCommit(ctx, func(context.Context) { called = true })
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.False(t, called)
+	assert.Equal(t, []string{"BEGIN", "ROLLBACK"}, queryLog(f), "not retryable error is not retried")
+
+	assert.Panics(t, func() {
+		_ = RunInTx(context.Background(), f.selector(), "", fastTx, func(ctx context.Context) error {
+			panic("bug")
+		})
+	})
+	assert.Equal(t, []string{"BEGIN", "ROLLBACK", "BEGIN", "ROLLBACK"}, queryLog(f), "transaction is rolled back on panic")
+
+	assert.IsType(t, ErrNotFound{}, RunInTx(context.Background(), f.selector(), "unknown", nil, func(ctx context.Context) error {
+		return nil
+	}))
+}
+
+func TestRunInTxSavepoint(t *testing.T) {
+	f := newFakeDB(func(query string, args []interface{}) (*fakeResult, error) {
+		return nil, nil
+	})
+	selector := f.selector()
+	var order []string
+	err := RunInTx(context.Background(), selector, "", fastTx, func(ctx context.Context) error {
+		AfterCommit(ctx, func(context.Context) { order = append(order, "outer") })
+
+		err := RunInTx(ctx, selector, "", nil, func(ctx context.Context) error {
+			AfterCommit(ctx, func(context.Context) { order = append(order, "released") })
+			return nil
+		})
+		require.NoError(t, err)
+
+		failure := errors.New("duplicate")
+		err = RunInTx(ctx, selector, "", nil, func(ctx context.Context) error {
+			AfterCommit(ctx, func(context.Context) { order = append(order, "rolled back") })
+			return failure
+		})
+		assert.Equal(t, failure, err)
+		assert.Empty(t, order, "hooks wait for commit of outer transaction")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"outer", "released"}, order)
+	assert.Equal(t, []string{
+		"BEGIN",
+		"SAVEPOINT sp_1",
+		"RELEASE SAVEPOINT sp_1",
+		"SAVEPOINT sp_2",
+		"ROLLBACK TO SAVEPOINT sp_2",
+		"COMMIT",
+	}, queryLog(f))
+
+	called := false
+	AfterCommit(context.Background(), func(context.Context) { called = true })
+	assert.True(t, called, "hook without transaction is called immediately")
+}
@@ -39,7 +39,7 @@ func NewInfluxDBClient(config *Config) (*Client, error) {
 	}
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+			InsecureSkipVerify: config.InsecureSkipVerify, // #nosec
 		},
 		DisableCompression:    false,
 		MaxConnsPerHost:       1000,
@@ -53,7 +53,21 @@ func NewInfluxDBClient(config *Config) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewInfluxDBClientWithHTTPClient(config, &http.Client{
+		Timeout:   config.Timeout,
+		Transport: tr,
+	})
+}
 
+// NewInfluxDBClientWithHTTPClient returns a new Client which sends requests through provided http client
+// (example: client from base.HTTPClientFactory). Transport settings from config are ignored.
+func NewInfluxDBClientWithHTTPClient(config *Config, httpClient *http.Client) (*Client, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config for influx client == nil")
+	}
+	if httpClient == nil {
+		return nil, fmt.Errorf("http client for influx client == nil")
+	}
 	u, err := url.Parse(config.URL)
 	if err != nil {
 		return nil, err
@@ -77,16 +91,12 @@ func NewInfluxDBClient(config *Config) (*Client, error) {
 		return nil, err
 	}
 	ic := &Client{
-		baseURL:  *u,
-		queryURL: queryURL,
-		writeURL: writeURL,
-		Cfg:      config,
-		httpClient: &http.Client{
-			Timeout:   config.Timeout,
-			Transport: tr,
-		},
-		transport: tr,
-		headers:   make(map[string]string),
+		baseURL:    *u,
+		queryURL:   queryURL,
+		writeURL:   writeURL,
+		Cfg:        config,
+		httpClient: httpClient,
+		headers:    make(map[string]string),
 	}
 
 	ic.headers["User-Agent"] = ic.Cfg.UserAgent
@@ -104,7 +114,6 @@ type Client struct {
 	queryURL   string
 	Cfg        *Config
 	httpClient *http.Client
-	transport  *http.Transport
 	headers    map[string]string
 }
 
@@ -352,7 +361,7 @@ func (ic *Client) WritePoints(points []Point) error {
 
 // Close releases the Client's resources.
 func (ic *Client) Close() error {
-	ic.transport.CloseIdleConnections()
+	ic.httpClient.CloseIdleConnections()
 	return nil
 }
 
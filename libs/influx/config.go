@@ -20,4 +20,8 @@ type Config struct {
 	Timeout               time.Duration `json:"timeout" yaml:"timeout"`
 	ResponseHeaderTimeout time.Duration `json:"response_header_timeout" yaml:"response_header_timeout"`
 	IdleConnTimeout       time.Duration `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+	// InsecureSkipVerify disable verification of server certificate(only for test setups)
+	InsecureSkipVerify bool `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+	// HTTPClient is name of base.HTTPClientFactory client. Transport settings above are ignored if it is set.
+	HTTPClient string `json:"http_client" yaml:"http_client"`
 }
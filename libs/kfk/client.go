@@ -85,6 +85,16 @@ func (k *Client) CreateReader(cfg *kafka.ReaderConfig) *kafka.Reader {
 	return kafka.NewReader(*cfg)
 }
 
+// CreateTracedWriter create writer which propagates trace context in message headers
+func (k *Client) CreateTracedWriter(cfg *kafka.WriterConfig) *Writer {
+	return &Writer{Writer: k.CreateWriter(cfg), topic: cfg.Topic, logger: k.logger.With(log.LoggerComponentKey, cfg.Topic)}
+}
+
+// CreateTracedReader create reader which continues trace from message headers
+func (k *Client) CreateTracedReader(cfg *kafka.ReaderConfig) *Reader {
+	return &Reader{Reader: k.CreateReader(cfg), topic: cfg.Topic, logger: k.logger.With(log.LoggerComponentKey, cfg.Topic)}
+}
+
 func (k *Client) ControllerConn() (*kafka.Conn, error) {
 	var controllerConn *kafka.Conn
 	var err error
@@ -0,0 +1,102 @@
+package kfk
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+
+	"git.pnhub.ru/core/libs/log"
+	"git.pnhub.ru/core/libs/trace"
+)
+
+// InjectTraceHeaders write W3C trace context from ctx to message headers
+func InjectTraceHeaders(ctx context.Context, msg *kafka.Message) {
+	trace.Inject(ctx, func(key, value string) {
+		for i := range msg.Headers {
+			if msg.Headers[i].Key == key {
+				msg.Headers[i].Value = []byte(value)
+				return
+			}
+		}
+		msg.Headers = append(msg.Headers, kafka.Header{Key: key, Value: []byte(value)})
+	})
+}
+
+// ExtractTraceHeaders return context with remote span context from message headers
+func ExtractTraceHeaders(ctx context.Context, msg kafka.Message) context.Context {
+	return trace.Extract(ctx, func(key string) string {
+		for _, h := range msg.Headers {
+			if h.Key == key {
+				return string(h.Value)
+			}
+		}
+		return ""
+	})
+}
+
+// Writer create producer span for every WriteMessages call and inject its context in message headers
+type Writer struct {
+	*kafka.Writer
+	topic  string
+	logger log.Logger
+}
+
+func (w *Writer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	ctx, span := trace.Start(ctx, "kafka.produce "+w.topic,
+		trace.WithKind(trace.SpanKindProducer),
+		trace.WithAttributes(map[string]interface{}{
+			"messaging.system":      "kafka",
+			"messaging.destination": w.topic,
+			"messaging.batch_size":  len(msgs),
+		}))
+	defer span.End()
+	for i := range msgs {
+		InjectTraceHeaders(ctx, &msgs[i])
+	}
+	err := w.Writer.WriteMessages(ctx, msgs...)
+	if err != nil {
+		log.FromContext(ctx, w.logger).Warnf("kafka write to %s: %v", w.topic, err)
+	}
+	span.SetError(err)
+	return err
+}
+
+// Reader return messages with context which continues producer trace
+type Reader struct {
+	*kafka.Reader
+	topic  string
+	logger log.Logger
+}
+
+// ReadTracedMessage read message like kafka.Reader.ReadMessage and return context with consumer span.
+// Span is finished, returned context is used as parent for message processing spans,
+// it also carries reader logger which is taken with trace and span ids by log.FromContext.
+func (r *Reader) ReadTracedMessage(ctx context.Context) (context.Context, kafka.Message, error) {
+	msg, err := r.Reader.ReadMessage(ctx)
+	if err != nil {
+		return ctx, msg, err
+	}
+	return r.consumerContext(ctx, msg), msg, nil
+}
+
+// FetchTracedMessage fetch message like kafka.Reader.FetchMessage and return context with consumer span
+func (r *Reader) FetchTracedMessage(ctx context.Context) (context.Context, kafka.Message, error) {
+	msg, err := r.Reader.FetchMessage(ctx)
+	if err != nil {
+		return ctx, msg, err
+	}
+	return r.consumerContext(ctx, msg), msg, nil
+}
+
+func (r *Reader) consumerContext(ctx context.Context, msg kafka.Message) context.Context {
+	ctx, span := trace.Start(ExtractTraceHeaders(ctx, msg), "kafka.consume "+r.topic,
+		trace.WithKind(trace.SpanKindConsumer),
+		trace.WithAttributes(map[string]interface{}{
+			"messaging.system":      "kafka",
+			"messaging.destination": msg.Topic,
+			"messaging.partition":   msg.Partition,
+			"messaging.offset":      msg.Offset,
+		}))
+	span.End()
+	return log.ToContext(ctx, r.logger)
+}
@@ -0,0 +1,57 @@
+package log
+
+import (
+	"context"
+	"sync"
+)
+
+// ContextFieldsFunc extract log fields(key-value pairs) from context
+type ContextFieldsFunc func(ctx context.Context) []interface{}
+
+var (
+	contextFieldsMx sync.RWMutex
+	contextFields   []ContextFieldsFunc
+)
+
+// RegisterContextFields add extractor which is used by WithContext(example: trace and span ids)
+func RegisterContextFields(f ContextFieldsFunc) {
+	contextFieldsMx.Lock()
+	contextFields = append(contextFields, f)
+	contextFieldsMx.Unlock()
+}
+
+// WithContext return logger with fields extracted from context by registered extractors
+func WithContext(ctx context.Context, logger Logger) Logger {
+	if ctx == nil {
+		return logger
+	}
+	contextFieldsMx.RLock()
+	defer contextFieldsMx.RUnlock()
+	var fields []interface{}
+	for _, f := range contextFields {
+		fields = append(fields, f(ctx)...)
+	}
+	if len(fields) == 0 {
+		return logger
+	}
+	return logger.With(fields...)
+}
+
+type loggerKey struct{}
+
+// ToContext store logger in context, it is returned by FromContext with fields of context
+func ToContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext return logger stored by ToContext(or fallback if there is no one) with fields of context.
+// Fields are extracted on every call, so ids of spans started after ToContext are logged too.
+func FromContext(ctx context.Context, fallback Logger) Logger {
+	if ctx == nil {
+		return fallback
+	}
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return WithContext(ctx, logger)
+	}
+	return WithContext(ctx, fallback)
+}
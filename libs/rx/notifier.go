@@ -44,7 +44,13 @@ func (n *Notifier) Notify(object interface{}) {
 }
 
 func (n *Notifier) CreateObserver(cb Callback, bufferSize int) *Observer {
-	o := NewObserver(n.ctx, cb, bufferSize)
+	return n.CreateObserverWithPolicy(cb, bufferSize, Block)
+}
+
+// CreateObserverWithPolicy create observer which handle buffer overflow according to policy.
+// Observer is removed from Notifier when it stops.
+func (n *Notifier) CreateObserverWithPolicy(cb Callback, bufferSize int, policy SlowConsumerPolicy) *Observer {
+	o := NewObserverWithPolicy(n.ctx, cb, bufferSize, policy)
 	n.lock.Lock()
 	n.observerMap[o.id] = o
 	n.lock.Unlock()
@@ -3,18 +3,37 @@ package rx
 import (
 	"context"
 	"math/rand"
+	"sync/atomic"
+)
+
+// SlowConsumerPolicy define Observer behavior when its buffer is full
+type SlowConsumerPolicy int
+
+const (
+	// Block wait until observer handle previous events. Slow observer blocks Notifier.
+	Block SlowConsumerPolicy = iota
+	// DropNewest skip events which do not fit in buffer
+	DropNewest
+	// Disconnect stop observer on buffer overflow
+	Disconnect
 )
 
 // Observer type represent structure witch can react on events
 type Observer struct {
-	id     uint64
-	ctx    context.Context
-	cancel context.CancelFunc
-	cb     Callback
-	events chan interface{}
+	id      uint64
+	ctx     context.Context
+	cancel  context.CancelFunc
+	cb      Callback
+	events  chan interface{}
+	policy  SlowConsumerPolicy
+	dropped uint64
 }
 
 func NewObserver(ctx context.Context, cb Callback, bufferSize int) *Observer {
+	return NewObserverWithPolicy(ctx, cb, bufferSize, Block)
+}
+
+func NewObserverWithPolicy(ctx context.Context, cb Callback, bufferSize int, policy SlowConsumerPolicy) *Observer {
 	oCtx, cancel := context.WithCancel(ctx)
 	o := &Observer{
 		ctx:    oCtx,
@@ -22,6 +41,7 @@ func NewObserver(ctx context.Context, cb Callback, bufferSize int) *Observer {
 		cb:     cb,
 		events: make(chan interface{}, bufferSize),
 		id:     rand.Uint64(),
+		policy: policy,
 	}
 	go o.observe()
 	return o
@@ -36,18 +56,49 @@ func (o *Observer) observe() {
 			if !ok {
 				return
 			}
-			if o.cb != nil {
+			// event can be received together with stop
+			if o.cb != nil && o.ctx.Err() == nil {
 				o.cb(o.ctx, obj)
 			}
 		}
 	}
 }
 
+// Notify push event in observer buffer. Behavior on full buffer depends on observer SlowConsumerPolicy.
 func (o *Observer) Notify(obj interface{}) {
-	o.events <- obj
+	switch o.policy {
+	case DropNewest:
+		select {
+		case o.events <- obj:
+		default:
+			atomic.AddUint64(&o.dropped, 1)
+		}
+	case Disconnect:
+		select {
+		case o.events <- obj:
+		default:
+			atomic.AddUint64(&o.dropped, 1)
+			o.Stop()
+		}
+	default:
+		select {
+		case o.events <- obj:
+		case <-o.ctx.Done():
+		}
+	}
+}
+
+// Dropped return number of events which were not delivered because of full buffer
+func (o *Observer) Dropped() uint64 {
+	return atomic.LoadUint64(&o.dropped)
+}
+
+// Done return channel which is closed when observer is stopped
+func (o *Observer) Done() <-chan struct{} {
+	return o.ctx.Done()
 }
 
+// Stop observer. Events are not passed to callback after Stop. Stop can be called from Notify of Disconnect policy.
 func (o *Observer) Stop() {
-	o.cb = nil
 	o.cancel()
 }
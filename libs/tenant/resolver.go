@@ -0,0 +1,232 @@
+package tenant
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tenant sources of Resolver
+const (
+	SourceHeader    = "header"
+	SourceSubdomain = "subdomain"
+	SourceJWT       = "jwt"
+)
+
+const DefaultHeader = "X-Tenant-ID"
+
+var (
+	// ErrNoTenant is returned when request has no tenant in any source
+	ErrNoTenant = errors.New("no tenant in request")
+	// ErrUnknownTenant is returned for tenant which is not in Config.Tenants or has bad name
+	ErrUnknownTenant = errors.New("unknown tenant")
+)
+
+type Config struct {
+	// Sources are tried in order: header, subdomain, jwt(default header)
+	Sources []string `json:"sources" yaml:"sources"`
+	// Header is request header with tenant(default X-Tenant-ID)
+	Header string `json:"header" yaml:"header"`
+	// Domain is base domain for subdomain source, tenant is label before it(acme.example.com -> acme)
+	Domain string `json:"domain" yaml:"domain"`
+	// JWTClaim is claim of bearer token with tenant. Token is verified with JWTSecret(HS256)
+	// or by Resolver.Claims if it is set.
+	JWTClaim  string `json:"jwt_claim" yaml:"jwt_claim"`
+	JWTSecret string `json:"jwt_secret" yaml:"jwt_secret"`
+	// Tenants are known tenants, other tenants are rejected. Any tenant with safe name is accepted if list is empty.
+	Tenants []string `json:"tenants" yaml:"tenants"`
+	// Required reject requests without tenant, Default is used for them otherwise
+	Required bool   `json:"required" yaml:"required"`
+	Default  string `json:"default" yaml:"default"`
+}
+
+// ClaimsFunc verify bearer token and return its claims
+type ClaimsFunc func(token string) (map[string]interface{}, error)
+
+// Resolver find tenant of HTTP request
+type Resolver struct {
+	cfg   Config
+	known map[string]bool
+	// Claims verify tokens of jwt source instead of HS256 with Config.JWTSecret
+	Claims ClaimsFunc
+}
+
+func NewResolver(cfg *Config) (*Resolver, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("no tenant resolver config")
+	}
+	c := *cfg
+	if len(c.Sources) == 0 {
+		c.Sources = []string{SourceHeader}
+	}
+	if c.Header == "" {
+		c.Header = DefaultHeader
+	}
+	for _, source := range c.Sources {
+		switch source {
+		case SourceHeader:
+		case SourceSubdomain:
+			if c.Domain == "" {
+				return nil, fmt.Errorf("subdomain tenant source requires domain")
+			}
+		case SourceJWT:
+			if c.JWTClaim == "" {
+				return nil, fmt.Errorf("jwt tenant source requires claim")
+			}
+		default:
+			return nil, fmt.Errorf("unknown tenant source %s", source)
+		}
+	}
+	r := &Resolver{cfg: c}
+	if len(c.Tenants) > 0 {
+		r.known = make(map[string]bool, len(c.Tenants))
+		for _, t := range c.Tenants {
+			r.known[t] = true
+		}
+	}
+	return r, nil
+}
+
+// Resolve return tenant of request from first source which has it. Default(possibly empty) is returned
+// for request without tenant if tenant is not required.
+func (r *Resolver) Resolve(req *http.Request) (string, error) {
+	for _, source := range r.cfg.Sources {
+		var tenant string
+		var err error
+		switch source {
+		case SourceHeader:
+			tenant = strings.TrimSpace(req.Header.Get(r.cfg.Header))
+		case SourceSubdomain:
+			tenant = r.subdomain(req.Host)
+		case SourceJWT:
+			tenant, err = r.jwtTenant(req)
+		}
+		if err != nil {
+			return "", err
+		}
+		if tenant != "" {
+			return tenant, r.check(tenant)
+		}
+	}
+	if r.cfg.Required {
+		return "", ErrNoTenant
+	}
+	return r.cfg.Default, nil
+}
+
+// check accept known tenant or any tenant with safe name if list of tenants is empty
+func (r *Resolver) check(tenant string) error {
+	if r.known != nil {
+		if !r.known[tenant] {
+			return ErrUnknownTenant
+		}
+		return nil
+	}
+	for _, c := range tenant {
+		if !(c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return ErrUnknownTenant
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) subdomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	suffix := "." + strings.ToLower(strings.TrimPrefix(r.cfg.Domain, "."))
+	if !strings.HasSuffix(host, suffix) {
+		return ""
+	}
+	labels := strings.Split(strings.TrimSuffix(host, suffix), ".")
+	return labels[len(labels)-1]
+}
+
+func (r *Resolver) jwtTenant(req *http.Request) (string, error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", nil
+	}
+	token := strings.TrimSpace(auth[7:])
+	var claims map[string]interface{}
+	var err error
+	switch {
+	case r.Claims != nil:
+		claims, err = r.Claims(token)
+	case r.cfg.JWTSecret != "":
+		claims, err = verifyHS256(token, []byte(r.cfg.JWTSecret))
+	default:
+		err = fmt.Errorf("no jwt verification for tenant claim")
+	}
+	if err != nil {
+		return "", err
+	}
+	switch v := claims[r.cfg.JWTClaim].(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// verifyHS256 check signature and expiration of HS256 token and return its claims
+func verifyHS256(token string, secret []byte) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported jwt algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt signature: %v", err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("bad jwt signature")
+	}
+	var claims map[string]interface{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, fmt.Errorf("jwt is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, fmt.Errorf("jwt is not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return fmt.Errorf("malformed jwt: %v", err)
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("malformed jwt: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package tenant
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "secret"
+
+func signHS256(t *testing.T, header, claims map[string]interface{}, secret string) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(header) + "." + encode(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyHS256(t *testing.T) {
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	now := time.Now().Unix()
+	valid := signHS256(t, hs256, map[string]interface{}{"tenant": "acme"}, testSecret)
+	tests := []struct {
+		name   string
+		token  string
+		tenant string
+		err    bool
+	}{
+		{name: "valid", token: valid, tenant: "acme"},
+		{
+			name:   "not expired",
+			token:  signHS256(t, hs256, map[string]interface{}{"tenant": "acme", "exp": now + 60, "nbf": now - 60}, testSecret),
+			tenant: "acme",
+		},
+		{name: "expired", token: signHS256(t, hs256, map[string]interface{}{"tenant": "acme", "exp": now - 1}, testSecret), err: true},
+		{name: "not valid yet", token: signHS256(t, hs256, map[string]interface{}{"tenant": "acme", "nbf": now + 60}, testSecret), err: true},
+		{name: "other secret", token: signHS256(t, hs256, map[string]interface{}{"tenant": "acme"}, "other"), err: true},
+		{name: "none algorithm", token: signHS256(t, map[string]interface{}{"alg": "none"}, map[string]interface{}{"tenant": "acme"}, testSecret), err: true},
+		{name: "tampered claims", token: valid[:len(valid)-1] + "A", err: true},
+		{name: "two parts", token: "a.b", err: true},
+		{name: "bad base64", token: "!.!.!", err: true},
+		{name: "empty", token: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyHS256(tt.token, []byte(testSecret))
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.tenant, claims["tenant"])
+		})
+	}
+}
+
+func TestResolverSubdomain(t *testing.T) {
+	r, err := NewResolver(&Config{Sources: []string{SourceSubdomain}, Domain: "example.com"})
+	require.NoError(t, err)
+	tests := []struct {
+		host   string
+		tenant string
+	}{
+		{host: "acme.example.com", tenant: "acme"},
+		{host: "acme.example.com:8080", tenant: "acme"},
+		{host: "ACME.Example.COM", tenant: "acme"},
+		{host: "api.acme.example.com", tenant: "acme"},
+		{host: "example.com", tenant: ""},
+		{host: "acmeexample.com", tenant: ""},
+		{host: "acme.example.org", tenant: ""},
+		{host: "localhost:8080", tenant: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			assert.Equal(t, tt.tenant, r.subdomain(tt.host))
+		})
+	}
+}
+
+func TestResolverResolve(t *testing.T) {
+	token := signHS256(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"org": "acme"}, testSecret)
+	tests := []struct {
+		name    string
+		cfg     Config
+		host    string
+		headers map[string]string
+		tenant  string
+		err     error
+	}{
+		{
+			name:    "header",
+			cfg:     Config{},
+			headers: map[string]string{DefaultHeader: "acme"},
+			tenant:  "acme",
+		},
+		{
+			name:    "first source with tenant",
+			cfg:     Config{Sources: []string{SourceHeader, SourceSubdomain}, Domain: "example.com"},
+			host:    "beta.example.com",
+			headers: map[string]string{DefaultHeader: "acme"},
+			tenant:  "acme",
+		},
+		{
+			name:   "subdomain after empty header",
+			cfg:    Config{Sources: []string{SourceHeader, SourceSubdomain}, Domain: "example.com"},
+			host:   "beta.example.com",
+			tenant: "beta",
+		},
+		{
+			name:    "jwt",
+			cfg:     Config{Sources: []string{SourceJWT}, JWTClaim: "org", JWTSecret: testSecret},
+			headers: map[string]string{"Authorization": "Bearer " + token},
+			tenant:  "acme",
+		},
+		{
+			name:    "unknown tenant",
+			cfg:     Config{Tenants: []string{"acme"}},
+			headers: map[string]string{DefaultHeader: "beta"},
+			err:     ErrUnknownTenant,
+		},
+		{
+			name:    "unsafe tenant name",
+			cfg:     Config{},
+			headers: map[string]string{DefaultHeader: "acme;drop"},
+			err:     ErrUnknownTenant,
+		},
+		{
+			name: "required",
+			cfg:  Config{Required: true},
+			err:  ErrNoTenant,
+		},
+		{
+			name:   "default",
+			cfg:    Config{Default: "public"},
+			tenant: "public",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewResolver(&tt.cfg)
+			require.NoError(t, err)
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			tenant, err := r.Resolve(req)
+			if tt.err != nil {
+				assert.Equal(t, tt.err, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.tenant, tenant)
+		})
+	}
+}
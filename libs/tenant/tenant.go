@@ -0,0 +1,64 @@
+// Package tenant contain tenant of request in context and its resolution from HTTP request
+package tenant
+
+import (
+	"context"
+
+	"github.com/uber-go/tally"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+// Tag is name of log field and metrics tag with tenant
+const Tag = "tenant"
+
+func init() {
+	log.RegisterContextFields(logFields)
+}
+
+type tenantKey struct{}
+
+// WithTenant return context with tenant
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// FromContext return tenant of context or empty string
+func FromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+// Tags add tenant of context to tags, tags are returned as is for context without tenant
+func Tags(ctx context.Context, tags map[string]string) map[string]string {
+	t := FromContext(ctx)
+	if t == "" {
+		return tags
+	}
+	out := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		out[k] = v
+	}
+	out[Tag] = t
+	return out
+}
+
+// Scope return scope tagged with tenant of context
+func Scope(ctx context.Context, scope tally.Scope) tally.Scope {
+	t := FromContext(ctx)
+	if t == "" {
+		return scope
+	}
+	return scope.Tagged(map[string]string{Tag: t})
+}
+
+func logFields(ctx context.Context) []interface{} {
+	t := FromContext(ctx)
+	if t == "" {
+		return nil
+	}
+	return []interface{}{Tag, t}
+}
@@ -0,0 +1,52 @@
+package trace
+
+import (
+	"time"
+)
+
+const (
+	ExporterNone   = ""
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+type Config struct {
+	ServiceName string `json:"service_name" yaml:"service_name"`
+	// Exporter is one of: otlp, stdout, file. Spans are not exported if it is empty, but trace context is still propagated.
+	Exporter string `json:"exporter" yaml:"exporter"`
+	// Endpoint is OTLP/HTTP traces endpoint
+	Endpoint string            `json:"endpoint" yaml:"endpoint"`
+	Headers  map[string]string `json:"headers" yaml:"headers"`
+	FilePath string            `json:"file_path" yaml:"file_path"`
+	// SampleRatio is part of root traces which are recorded(0..1, default 1). Child spans follow parent decision.
+	SampleRatio   *float64      `json:"sample_ratio" yaml:"sample_ratio"`
+	QueueSize     int           `json:"queue_size" yaml:"queue_size"`
+	BatchSize     int           `json:"batch_size" yaml:"batch_size"`
+	FlushInterval time.Duration `json:"flush_interval" yaml:"flush_interval"`
+	Timeout       time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+func (c *Config) setDefaults() {
+	if c.Endpoint == "" {
+		c.Endpoint = DefaultOTLPEndpoint
+	}
+	if c.SampleRatio == nil {
+		ratio := 1.0
+		c.SampleRatio = &ratio
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 2048
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 512
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second * 5
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Second * 10
+	}
+}
@@ -0,0 +1,95 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Exporter send finished spans to storage
+type Exporter interface {
+	Export(ctx context.Context, spans []*SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+// NewExporter create exporter defined in config. nil exporter is returned for empty Config.Exporter.
+func NewExporter(cfg *Config) (Exporter, error) {
+	switch cfg.Exporter {
+	case ExporterNone:
+		return nil, nil
+	case ExporterOTLP:
+		return NewOTLPExporter(cfg), nil
+	case ExporterStdout:
+		return NewWriterExporter(os.Stdout), nil
+	case ExporterFile:
+		f, err := os.OpenFile(cfg.FilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return NewWriterExporter(f), nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %s", cfg.Exporter)
+	}
+}
+
+// WriterExporter write spans as JSON lines, it is useful for local development
+type WriterExporter struct {
+	mx sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+type jsonSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       SpanKind               `json:"kind"`
+	Start      string                 `json:"start"`
+	Duration   string                 `json:"duration"`
+	Status     StatusCode             `json:"status,omitempty"`
+	Message    string                 `json:"message,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func (e *WriterExporter) Export(ctx context.Context, spans []*SpanData) error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceID:    s.SpanContext.TraceID.String(),
+			SpanID:     s.SpanContext.SpanID.String(),
+			Name:       s.Name,
+			Kind:       s.Kind,
+			Start:      s.Start.Format("2006-01-02T15:04:05.000000Z07:00"),
+			Duration:   s.End.Sub(s.Start).String(),
+			Status:     s.StatusCode,
+			Message:    s.StatusMessage,
+			Attributes: s.Attributes,
+		}
+		if s.Parent.IsValid() {
+			js.ParentID = s.Parent.String()
+		}
+		err := enc.Encode(js)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *WriterExporter) Shutdown(ctx context.Context) error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if f, ok := e.w.(*os.File); ok && f != os.Stdout && f != os.Stderr {
+		return f.Close()
+	}
+	return nil
+}
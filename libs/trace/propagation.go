@@ -0,0 +1,85 @@
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// W3C trace context headers
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// ParseTraceparent parse W3C traceparent header value(version-traceid-spanid-flags)
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("bad traceparent %q", s)
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff {
+		return sc, fmt.Errorf("bad traceparent version %q", parts[0])
+	}
+	if version[0] == 0 && len(parts) != 4 {
+		return sc, fmt.Errorf("bad traceparent %q", s)
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, fmt.Errorf("bad trace id %q", parts[1])
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, fmt.Errorf("bad span id %q", parts[2])
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, fmt.Errorf("bad trace flags %q", parts[3])
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("zero ids in traceparent %q", s)
+	}
+	return sc, nil
+}
+
+// FormatTraceparent format span context as W3C traceparent header value
+func FormatTraceparent(sc SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// Inject pass span context from ctx to carrier through set function
+func Inject(ctx context.Context, set func(key, value string)) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	set(TraceparentHeader, FormatTraceparent(sc))
+	if sc.TraceState != "" {
+		set(TracestateHeader, sc.TraceState)
+	}
+}
+
+// Extract read remote span context from carrier through get function. Context is returned as is if carrier has no valid traceparent.
+func Extract(ctx context.Context, get func(key string) string) context.Context {
+	sc, err := ParseTraceparent(get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	sc.TraceState = get(TracestateHeader)
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+func InjectHTTP(ctx context.Context, h http.Header) {
+	Inject(ctx, h.Set)
+}
+
+func ExtractHTTP(ctx context.Context, h http.Header) context.Context {
+	return Extract(ctx, h.Get)
+}
@@ -0,0 +1,74 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		sampled bool
+		err     bool
+	}{
+		{name: "sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sampled: true},
+		{name: "not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{name: "future version with extra fields", value: "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", sampled: true},
+		{name: "version 00 with extra fields", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", err: true},
+		{name: "forbidden version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", err: true},
+		{name: "short trace id", value: "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", err: true},
+		{name: "zero trace id", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", err: true},
+		{name: "zero span id", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", err: true},
+		{name: "bad flags", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-x1", err: true},
+		{name: "empty", value: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceparent(tt.value)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+			assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+			assert.Equal(t, tt.sampled, sc.IsSampled())
+		})
+	}
+}
+
+func TestPropagationHTTP(t *testing.T) {
+	in := http.Header{}
+	in.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	in.Set(TracestateHeader, "vendor=1")
+	ctx := ExtractHTTP(context.Background(), in)
+	remote := SpanContextFromContext(ctx)
+	require.True(t, remote.IsValid())
+	assert.True(t, remote.Remote)
+	assert.Equal(t, "vendor=1", remote.TraceState)
+
+	ctx, span := NoopTracer().Start(ctx, "handler")
+	defer span.End()
+	assert.False(t, span.IsRecording(), "noop tracer does not record spans")
+
+	out := http.Header{}
+	InjectHTTP(ctx, out)
+	sc, err := ParseTraceparent(out.Get(TraceparentHeader))
+	require.NoError(t, err)
+	assert.Equal(t, remote.TraceID, sc.TraceID, "trace id is propagated")
+	assert.NotEqual(t, remote.SpanID, sc.SpanID, "child span id is sent")
+	assert.True(t, sc.IsSampled(), "sampling decision of parent is kept")
+	assert.Equal(t, "vendor=1", out.Get(TracestateHeader))
+
+	bad := http.Header{}
+	bad.Set(TraceparentHeader, "garbage")
+	assert.Equal(t, context.Background(), ExtractHTTP(context.Background(), bad))
+	empty := http.Header{}
+	InjectHTTP(context.Background(), empty)
+	assert.Empty(t, empty, "nothing is injected without span")
+}
@@ -0,0 +1,218 @@
+// Package trace contains minimal distributed tracing: W3C trace context propagation, spans and exporters
+// (OTLP/HTTP and JSON lines to stdout or file). Trace and span ids are added to log fields of loggers
+// created with log.WithContext or log.FromContext. HTTPServer, grpc server and kfk traced readers store logger in
+// context, so handlers get ids by log.FromContext(ctx, logger).
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+const FlagSampled byte = 0x01
+
+// SpanContext is part of span which is propagated between processes
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+	Remote     bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&FlagSampled == FlagSampled
+}
+
+type SpanKind int
+
+// Values are equal to OTLP span kinds
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+	SpanKindProducer
+	SpanKindConsumer
+)
+
+type StatusCode int
+
+// Values are equal to OTLP status codes
+const (
+	StatusUnset StatusCode = iota
+	StatusOK
+	StatusError
+)
+
+// Span is single operation in trace. Only sampled spans are recorded and exported.
+type Span struct {
+	tracer    *Tracer
+	recording bool
+	mx        sync.Mutex
+	data      SpanData
+	ended     bool
+}
+
+// SpanData is snapshot of finished span passed to Exporter
+type SpanData struct {
+	Name          string
+	SpanContext   SpanContext
+	Parent        SpanID
+	Kind          SpanKind
+	Start         time.Time
+	End           time.Time
+	Attributes    map[string]interface{}
+	StatusCode    StatusCode
+	StatusMessage string
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+func (s *Span) IsRecording() bool {
+	return s != nil && s.recording
+}
+
+func (s *Span) SetName(name string) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mx.Lock()
+	s.data.Name = name
+	s.mx.Unlock()
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mx.Lock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+	s.mx.Unlock()
+}
+
+// SetError mark span as failed. nil error is ignored.
+func (s *Span) SetError(err error) {
+	if err == nil || !s.IsRecording() {
+		return
+	}
+	s.mx.Lock()
+	s.data.StatusCode = StatusError
+	s.data.StatusMessage = err.Error()
+	s.mx.Unlock()
+}
+
+func (s *Span) SetStatus(code StatusCode, msg string) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mx.Lock()
+	s.data.StatusCode = code
+	s.data.StatusMessage = msg
+	s.mx.Unlock()
+}
+
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt finish span and pass it to exporter. Second call is ignored.
+func (s *Span) EndAt(t time.Time) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mx.Lock()
+	if s.ended {
+		s.mx.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = t
+	data := s.data
+	s.mx.Unlock()
+	s.tracer.enqueue(&data)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan return context which holds span
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext return current span or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+type remoteKey struct{}
+
+// ContextWithRemoteSpanContext store span context received from other process, it is used as parent of next span
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanContextFromContext return span context of current span or remote span context
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	mustRandom(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	mustRandom(id[:])
+	return id
+}
+
+func mustRandom(b []byte) {
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(fmt.Errorf("cannot generate trace id: %v", err))
+	}
+}
@@ -0,0 +1,224 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	mathRand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/fx"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+var defaultTracer atomic.Value
+
+func init() {
+	defaultTracer.Store(NoopTracer())
+	log.RegisterContextFields(logFields)
+}
+
+// Default return tracer which is used by package level Start. It is noop tracer until NewTracer is called.
+func Default() *Tracer {
+	return defaultTracer.Load().(*Tracer)
+}
+
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+// Start create span with default tracer
+func Start(ctx context.Context, name string, opts ...StartOption) (context.Context, *Span) {
+	return Default().Start(ctx, name, opts...)
+}
+
+// Tracer create spans and pass finished sampled spans to exporter in batches
+type Tracer struct {
+	cfg      Config
+	logger   log.Logger
+	exporter Exporter
+	queue    chan *SpanData
+	stop     chan struct{}
+	done     chan struct{}
+	dropped  uint64
+	stopOnce sync.Once
+}
+
+// NoopTracer propagate trace context but does not record spans
+func NoopTracer() *Tracer {
+	return &Tracer{}
+}
+
+// NewTracer create tracer with exporter from config and set it as default tracer.
+// Queued spans are flushed on fx stop.
+func NewTracer(ctx context.Context, logger log.Logger, cfg *Config, lc fx.Lifecycle) (*Tracer, error) {
+	if cfg == nil {
+		t := NoopTracer()
+		SetDefault(t)
+		return t, nil
+	}
+	c := *cfg
+	c.setDefaults()
+	exporter, err := NewExporter(&c)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracer{
+		cfg:      c,
+		logger:   log.ForkLogger(logger),
+		exporter: exporter,
+	}
+	if exporter != nil {
+		t.queue = make(chan *SpanData, c.QueueSize)
+		t.stop = make(chan struct{})
+		t.done = make(chan struct{})
+		go t.process()
+	}
+	SetDefault(t)
+
+	if lc != nil {
+		lc.Append(fx.Hook{
+			OnStop: func(ctx context.Context) error {
+				return t.Shutdown(ctx)
+			},
+		})
+	}
+	return t, nil
+}
+
+type StartOption func(d *SpanData)
+
+func WithKind(kind SpanKind) StartOption {
+	return func(d *SpanData) {
+		d.Kind = kind
+	}
+}
+
+func WithStartTime(t time.Time) StartOption {
+	return func(d *SpanData) {
+		d.Start = t
+	}
+}
+
+func WithAttributes(attrs map[string]interface{}) StartOption {
+	return func(d *SpanData) {
+		if d.Attributes == nil {
+			d.Attributes = make(map[string]interface{}, len(attrs))
+		}
+		for k, v := range attrs {
+			d.Attributes[k] = v
+		}
+	}
+}
+
+// Start create child span of span(local or remote) from context and return context with new span
+func (t *Tracer) Start(ctx context.Context, name string, opts ...StartOption) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+	s := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:  name,
+			Kind:  SpanKindInternal,
+			Start: time.Now(),
+		},
+	}
+	if parent.IsValid() {
+		s.data.SpanContext = SpanContext{
+			TraceID:    parent.TraceID,
+			Flags:      parent.Flags,
+			TraceState: parent.TraceState,
+		}
+		s.data.Parent = parent.SpanID
+	} else {
+		s.data.SpanContext = SpanContext{TraceID: newTraceID()}
+		if t.exporter != nil && mathRand.Float64() < *t.cfg.SampleRatio {
+			s.data.SpanContext.Flags |= FlagSampled
+		}
+	}
+	s.data.SpanContext.SpanID = newSpanID()
+	s.recording = t.exporter != nil && s.data.SpanContext.IsSampled()
+	for _, opt := range opts {
+		opt(&s.data)
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+// Shutdown export queued spans and close exporter
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+func (t *Tracer) enqueue(d *SpanData) {
+	if t.queue == nil {
+		return
+	}
+	select {
+	case t.queue <- d:
+	default:
+		if atomic.AddUint64(&t.dropped, 1)%1000 == 1 {
+			t.logger.Warnf("trace queue is full, dropped spans: %d", atomic.LoadUint64(&t.dropped))
+		}
+	}
+}
+
+func (t *Tracer) process() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.cfg.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*SpanData, 0, t.cfg.BatchSize)
+	for {
+		select {
+		case d := <-t.queue:
+			batch = append(batch, d)
+			if len(batch) >= t.cfg.BatchSize {
+				batch = t.export(batch)
+			}
+		case <-ticker.C:
+			batch = t.export(batch)
+		case <-t.stop:
+			for {
+				select {
+				case d := <-t.queue:
+					batch = append(batch, d)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) export(batch []*SpanData) []*SpanData {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.Timeout)
+	defer cancel()
+	err := t.exporter.Export(ctx, batch)
+	if err != nil {
+		t.logger.Error(fmt.Errorf("cannot export %d spans: %v", len(batch), err))
+	}
+	return batch[:0]
+}
+
+func logFields(ctx context.Context) []interface{} {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []interface{}{"trace_id", sc.TraceID.String(), "span_id", sc.SpanID.String()}
+}
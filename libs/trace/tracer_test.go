@@ -0,0 +1,102 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"git.pnhub.ru/core/libs/log"
+)
+
+func readSpans(t *testing.T, path string) []jsonSpan {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var out []jsonSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s jsonSpan
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &s))
+		out = append(out, s)
+	}
+	return out
+}
+
+func TestTracerFileExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer SetDefault(NoopTracer())
+
+	path := filepath.Join(dir, "spans.jsonl")
+	tracer, err := NewTracer(context.Background(), &log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()},
+		&Config{Exporter: ExporterFile, FilePath: path}, nil)
+	require.NoError(t, err)
+	assert.Same(t, tracer, Default())
+
+	ctx, root := Start(context.Background(), "request", WithKind(SpanKindServer))
+	assert.True(t, root.IsRecording(), "root spans are sampled by default")
+	_, child := Start(ctx, "query", WithAttributes(map[string]interface{}{"db.system": "postgresql"}))
+	child.SetStatus(StatusError, "timeout")
+	child.End()
+	child.End()
+	root.End()
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	spans := readSpans(t, path)
+	require.Len(t, spans, 2, "second End is ignored")
+	assert.Equal(t, "query", spans[0].Name)
+	assert.Equal(t, "request", spans[1].Name)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentID)
+	assert.Empty(t, spans[1].ParentID)
+	assert.Equal(t, SpanKindServer, spans[1].Kind)
+	assert.Equal(t, "timeout", spans[0].Message)
+	assert.Equal(t, "postgresql", spans[0].Attributes["db.system"])
+}
+
+func TestTracerSampleRatio(t *testing.T) {
+	defer SetDefault(NoopTracer())
+	never := 0.0
+	tracer, err := NewTracer(context.Background(), &log.LoggerWrapper{SugaredLogger: zap.NewNop().Sugar()},
+		&Config{Exporter: ExporterStdout, SampleRatio: &never}, nil)
+	require.NoError(t, err)
+	defer tracer.Shutdown(context.Background())
+
+	ctx, root := tracer.Start(context.Background(), "request")
+	assert.False(t, root.IsRecording())
+	assert.True(t, root.SpanContext().IsValid(), "not sampled span has ids for propagation")
+
+	sampled := ContextWithRemoteSpanContext(context.Background(), SpanContext{TraceID: TraceID{1}, SpanID: SpanID{1}, Flags: FlagSampled})
+	_, child := tracer.Start(sampled, "handler")
+	assert.True(t, child.IsRecording(), "child follows sampled parent")
+	_, child = tracer.Start(ctx, "query")
+	assert.False(t, child.IsRecording(), "child follows not sampled parent")
+}
+
+func TestLogFields(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := &log.LoggerWrapper{SugaredLogger: zap.New(core).Sugar()}
+
+	log.FromContext(context.Background(), logger).Info("no span")
+	ctx := log.ToContext(context.Background(), logger)
+	ctx, span := NoopTracer().Start(ctx, "request")
+	log.FromContext(ctx, nil).Info("in span")
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 2)
+	assert.Empty(t, entries[0].ContextMap())
+	assert.Equal(t, map[string]interface{}{
+		"trace_id": span.SpanContext().TraceID.String(),
+		"span_id":  span.SpanContext().SpanID.String(),
+	}, entries[1].ContextMap(), "ids of span started after ToContext are logged")
+}
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"context"
+	"math"
+	mathRand "math/rand"
+	"time"
+)
+
+var DefaultBackoff = Backoff{
+	Min:    time.Millisecond * 100,
+	Max:    time.Second * 10,
+	Factor: 2,
+	Jitter: true,
+}
+
+// Backoff calculate exponential delays between attempts
+type Backoff struct {
+	Min    time.Duration `json:"min" yaml:"min"`
+	Max    time.Duration `json:"max" yaml:"max"`
+	Factor float64       `json:"factor" yaml:"factor"`
+	// Jitter randomize delay in [delay/2, delay) range
+	Jitter bool `json:"jitter" yaml:"jitter"`
+}
+
+// Delay return delay before attempt with defined number(starts from 0)
+func (b Backoff) Delay(attempt int) time.Duration {
+	if b.Min <= 0 {
+		b.Min = DefaultBackoff.Min
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoff.Max
+	}
+	if b.Factor < 1 {
+		b.Factor = DefaultBackoff.Factor
+	}
+	d := float64(b.Min) * math.Pow(b.Factor, float64(attempt))
+	if d > float64(b.Max) || math.IsInf(d, 0) {
+		d = float64(b.Max)
+	}
+	if b.Jitter {
+		d = d/2 + mathRand.Float64()*d/2
+	}
+	return time.Duration(d)
+}
+
+// Wait sleep delay for attempt. Return ctx error if context was done before.
+func (b Backoff) Wait(ctx context.Context, attempt int) error {
+	return SleepContext(ctx, b.Delay(attempt))
+}
+
+// SleepContext sleep defined duration or until context done
+func SleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
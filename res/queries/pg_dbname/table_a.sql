@@ -0,0 +1,16 @@
+-- name: GetTableA
+SELECT id, text_uniq, number, not_null_number
+FROM table_a
+WHERE id = $1;
+
+-- name: ListTableAByNumber
+SELECT id, text_uniq, number, not_null_number
+FROM table_a
+WHERE number >= :min_number
+ORDER BY id
+LIMIT :limit;
+
+-- name: InsertTableA
+INSERT INTO table_a (text_uniq, number, not_null_number)
+VALUES (:text_uniq, :number, :not_null_number)
+RETURNING id;